@@ -8,6 +8,8 @@ import (
 
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"golang.org/x/sync/errgroup"
 
 	agent1 "github.com/juju/1.25-upgrade/juju1/agent"
 	agent2 "github.com/juju/1.25-upgrade/juju2/agent"
@@ -23,7 +25,13 @@ It removes any imported model on the target controller as long as the
 model hasn't yet been activated. It also rolls back the agent upgrade
 on machines in the environment: removing Juju 2 tools, setting
 symlinks back to the previous tools and reverting changes to agent
-configurations.
+configurations. It can be run while the state servers' mongo replica
+set is unhealthy.
+
+If --restore-lxc-snapshots is specified, each LXC container that has a
+snapshot on its host, taken by backup-lxc --backup-target=host, is
+also restored from it, in place of any LXD container it was migrated
+to.
 
 `
 
@@ -31,11 +39,13 @@ func newAbortCommand() cmd.Command {
 	command := &abortCommand{}
 	command.remoteCommand = "abort-impl"
 	command.needsController = true
+	command.allowDegraded = true
 	return wrap(command)
 }
 
 type abortCommand struct {
 	baseClientCommand
+	restoreLXCSnapshots bool
 }
 
 func (c *abortCommand) Info() *cmd.Info {
@@ -47,6 +57,11 @@ func (c *abortCommand) Info() *cmd.Info {
 	}
 }
 
+func (c *abortCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	f.BoolVar(&c.restoreLXCSnapshots, "restore-lxc-snapshots", false, "restore LXC containers from their host-local snapshots")
+}
+
 func (c *abortCommand) Init(args []string) error {
 	args, err := c.baseClientCommand.init(args)
 	if err != nil {
@@ -55,6 +70,13 @@ func (c *abortCommand) Init(args []string) error {
 	return cmd.CheckEmpty(args)
 }
 
+func (c *abortCommand) Run(ctx *cmd.Context) error {
+	if c.restoreLXCSnapshots {
+		c.extraOptions = append(c.extraOptions, "--restore-lxc-snapshots")
+	}
+	return c.baseClientCommand.Run(ctx)
+}
+
 var abortImplDoc = `
 
 abort-impl must be executed on an API server machine of a 1.25
@@ -73,6 +95,12 @@ func newAbortImplCommand() cmd.Command {
 
 type abortImplCommand struct {
 	baseRemoteCommand
+	restoreLXCSnapshots bool
+}
+
+func (c *abortImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseRemoteCommand.SetFlags(f)
+	f.BoolVar(&c.restoreLXCSnapshots, "restore-lxc-snapshots", false, "restore LXC containers from their host-local snapshots")
 }
 
 func (c *abortImplCommand) Init(args []string) error {
@@ -106,6 +134,14 @@ func (c *abortImplCommand) Run(ctx *cmd.Context) error {
 		logger.Errorf("rolling back agent upgrades failed: %s", rollbackErr.Error())
 	}
 
+	var lxcErr error
+	if c.restoreLXCSnapshots {
+		lxcErr = c.restoreLXCContainers(ctx)
+		if lxcErr != nil {
+			logger.Errorf("restoring LXC containers failed: %s", lxcErr.Error())
+		}
+	}
+
 	// This is a bit funny - if the agent upgrade failed we might not
 	// be able to open a state to talk to the environ
 	// provider. Although if the rollback failed because it was
@@ -115,7 +151,7 @@ func (c *abortImplCommand) Run(ctx *cmd.Context) error {
 		logger.Errorf("downgrading tags failed: %s", tagErr.Error())
 	}
 
-	if modelErr != nil || rollbackErr != nil || tagErr != nil {
+	if modelErr != nil || rollbackErr != nil || lxcErr != nil || tagErr != nil {
 		return errors.Errorf("at least one error occurred aborting the upgrade")
 	}
 	return nil
@@ -147,15 +183,40 @@ func (c *abortImplCommand) rollbackAgents(ctx *cmd.Context) error {
 	if err != nil {
 		return errors.Annotate(err, "unable to get addresses for machines")
 	}
-	targets := flatMachineExecTargets(machines...)
-	results, err := parallelExec(targets, "python3 ~/1.25-agent-upgrade/agent-upgrade.py rollback")
+	return errors.Trace(rollbackAgentUpgrades(ctx, machines))
+}
+
+// restoreLXCContainers restores each LXC container that has a
+// snapshot on its host from that snapshot.
+func (c *abortImplCommand) restoreLXCContainers(ctx *cmd.Context) error {
+	st, err := getState()
 	if err != nil {
-		return errors.Trace(err)
+		return errors.Annotate(err, "getting state")
 	}
-	if err := reportResults(ctx, "rollback", machines, results); err != nil {
+	defer st.Close()
+
+	lxcByHost, err := getLXCContainersFromState(st)
+	if err != nil {
 		return errors.Trace(err)
 	}
-	return nil
+	var group errgroup.Group
+	for host, containers := range lxcByHost {
+		host, containers := host, containers // copy for closure
+		group.Go(func() error {
+			for _, container := range containers {
+				err := restoreLXCContainerFromSnapshot(st, container, host)
+				if errors.IsNotFound(err) {
+					ctx.Infof("container %q has no snapshot, not restoring", container.Id())
+					continue
+				} else if err != nil {
+					return errors.Annotatef(err, "restoring container %q", container.Id())
+				}
+				ctx.Infof("container %q restored", container.Id())
+			}
+			return nil
+		})
+	}
+	return errors.Trace(group.Wait())
 }
 
 func (c *abortImplCommand) downgradeTags(ctx *cmd.Context) error {
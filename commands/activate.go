@@ -5,6 +5,7 @@ package commands
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
@@ -99,6 +100,13 @@ func (c *activateImplCommand) Run(ctx *cmd.Context) error {
 		return errors.Annotate(err, "getting model UUID")
 	}
 
+	// finalize refuses to run unless the model has been verified since
+	// it was activated, so the activation time is recorded first: if
+	// it can't be, the model is left inactive. verify-target-model
+	// might report hook failures from the moment before activation.
+	if err := recordPhaseTime(activatedAtFile, time.Now()); err != nil {
+		return errors.Annotate(err, "recording activation time")
+	}
 	err = targetAPI.Activate(modelUUID)
 	if err != nil {
 		return errors.Annotate(err, "activating new model")
@@ -32,3 +32,10 @@ func getConfig(tag names.MachineTag) (agent.ConfigSetterWriter, error) {
 	path := agent.ConfigPath("/var/lib/juju", tag)
 	return agent.ReadConfig(path)
 }
+
+// getSavedConfig returns the 1.25 agent config that the agent upgrade
+// script saved for rollback before rewriting the config for 2.x.
+func getSavedConfig(tag names.MachineTag) (agent.ConfigSetterWriter, error) {
+	path := filepath.Join("/var/lib/juju/1.25-upgrade-rollback", tag.String()+"_agent.conf")
+	return agent.ReadConfig(path)
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/utils"
+	"github.com/juju/utils/arch"
+	"github.com/juju/utils/series"
+	"github.com/juju/version"
+
+	"github.com/juju/1.25-upgrade/juju2/environs/simplestreams"
+	envtools "github.com/juju/1.25-upgrade/juju2/environs/tools"
+)
+
+const (
+	// agentBinariesManifest is the name of the file, alongside the
+	// agent binaries copied to the API server machine, that records
+	// the expected size and SHA256 of each of them.
+	agentBinariesManifest = "agent-binaries.json"
+
+	// agentBinariesChecksums is the name of the file in a plain
+	// directory of agent binaries that holds their SHA256 sums, in
+	// the format written by sha256sum.
+	agentBinariesChecksums = "SHA256SUMS"
+)
+
+// agentBinariesDirName is the directory in the tools directory on
+// the API server machine that agent binaries supplied with
+// --agent-binaries are copied to.
+const agentBinariesDirName = "agent-binaries"
+
+// agentBinary describes an agent binary tarball supplied by the user.
+type agentBinary struct {
+	// Version is the binary version of the agent, e.g.
+	// 2.2.4-trusty-amd64.
+	Version string
+
+	// File is the base name of the tarball.
+	File string
+
+	Size   int64
+	SHA256 string
+
+	// path is the location of the tarball on the client.
+	path string
+}
+
+// readAgentBinaries returns the agent binaries in dir, which is either
+// a simplestreams mirror of agent binaries, or a plain directory of
+// tarballs with a SHA256SUMS file.
+func readAgentBinaries(dir string) ([]agentBinary, error) {
+	for _, base := range []string{dir, filepath.Join(dir, "tools")} {
+		if _, err := os.Stat(filepath.Join(base, "streams", "v1")); err == nil {
+			return readSimplestreamsAgentBinaries(base)
+		}
+	}
+	return readPlainAgentBinaries(dir)
+}
+
+func readSimplestreamsAgentBinaries(dir string) ([]agentBinary, error) {
+	source := simplestreams.NewURLDataSource(
+		"agent binaries mirror",
+		utils.MakeFileURL(dir),
+		utils.VerifySSLHostnames,
+		simplestreams.CUSTOM_CLOUD_DATA,
+		false,
+	)
+	seen := make(map[string]bool)
+	var binaries []agentBinary
+	for _, stream := range envtools.AllMetadataStreams {
+		cons := envtools.NewGeneralToolsConstraint(2, -1, simplestreams.LookupParams{
+			Series: series.SupportedSeries(),
+			Arches: arch.AllSupportedArches,
+			Stream: stream,
+		})
+		metadata, _, err := envtools.Fetch([]simplestreams.DataSource{source}, cons)
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Annotatef(err, "reading %q stream metadata", stream)
+		}
+		for _, md := range metadata {
+			binary := md.Version + "-" + md.Release + "-" + md.Arch
+			if seen[binary] {
+				continue
+			}
+			seen[binary] = true
+			fileURL, err := url.Parse(md.FullPath)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			binaries = append(binaries, agentBinary{
+				Version: binary,
+				File:    path.Base(md.Path),
+				Size:    md.Size,
+				SHA256:  md.SHA256,
+				path:    fileURL.Path,
+			})
+		}
+	}
+	if len(binaries) == 0 {
+		return nil, errors.Errorf("no agent binaries found in simplestreams mirror %s", dir)
+	}
+	return binaries, nil
+}
+
+func readPlainAgentBinaries(dir string) ([]agentBinary, error) {
+	checksums, err := readChecksums(filepath.Join(dir, agentBinariesChecksums))
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading checksums for %s", dir)
+	}
+	tarballs, err := filepath.Glob(filepath.Join(dir, "*.tgz"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var binaries []agentBinary
+	for _, tarball := range tarballs {
+		file := filepath.Base(tarball)
+		binary := strings.TrimPrefix(strings.TrimSuffix(file, ".tgz"), "juju-")
+		if _, err := version.ParseBinary(binary); err != nil {
+			logger.Debugf("ignoring %s: %v", tarball, err)
+			continue
+		}
+		sum, ok := checksums[file]
+		if !ok {
+			return nil, errors.Errorf("no SHA256 sum for %s in %s", file, agentBinariesChecksums)
+		}
+		info, err := os.Stat(tarball)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		binaries = append(binaries, agentBinary{
+			Version: binary,
+			File:    file,
+			Size:    info.Size(),
+			SHA256:  sum,
+			path:    tarball,
+		})
+	}
+	if len(binaries) == 0 {
+		return nil, errors.Errorf("no agent binaries found in %s", dir)
+	}
+	return binaries, nil
+}
+
+// readChecksums parses a file in the format written by sha256sum, and
+// returns the sums keyed by file name.
+func readChecksums(checksumsFile string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(checksumsFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// sha256sum marks files read in binary mode with "*".
+		sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return sums, errors.Trace(scanner.Err())
+}
+
+// pushAgentBinaries copies the agent binaries found in dir, along with
+// a manifest of their checksums, to the API server machine. It returns
+// the directory on the API server machine they were copied to.
+func pushAgentBinaries(ctx *cmd.Context, c *baseClientCommand, dir string) (string, error) {
+	binaries, err := readAgentBinaries(dir)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	tempDir, err := ioutil.TempDir("", "agent-binaries")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer removeAll(tempDir)
+	manifest, err := json.MarshalIndent(binaries, "", "  ")
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	manifestPath := filepath.Join(tempDir, agentBinariesManifest)
+	if err := ioutil.WriteFile(manifestPath, manifest, 0644); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	remoteDir := remoteToolsPath(agentBinariesDirName)
+	rc, err := runViaSSH(
+		c.address,
+		"mkdir -p "+remoteDir+"; chown -R "+c.sshUser+" "+remoteDir,
+		c.sshOptions()...,
+	)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if rc != 0 {
+		return "", errors.Errorf("creating %s exited %d", remoteDir, rc)
+	}
+
+	files := []string{manifestPath}
+	for _, binary := range binaries {
+		ctx.Infof("copying agent binary %s to the API server machine", binary.Version)
+		files = append(files, binary.path)
+	}
+	if err := copyViaSSH(c.address, files, remoteDir+"/", c.sshOptions()...); err != nil {
+		return "", errors.Annotate(err, "copying agent binaries")
+	}
+	return remoteDir, nil
+}
+
+// loadAgentBinaries reads the manifest of agent binaries copied to
+// dir by pushAgentBinaries, and returns them keyed by version.
+func loadAgentBinaries(dir string) (map[string]agentBinary, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, agentBinariesManifest))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var binaries []agentBinary
+	if err := json.Unmarshal(data, &binaries); err != nil {
+		return nil, errors.Annotatef(err, "parsing %s", agentBinariesManifest)
+	}
+	result := make(map[string]agentBinary)
+	for _, binary := range binaries {
+		binary.path = filepath.Join(dir, binary.File)
+		result[binary.Version] = binary
+	}
+	return result, nil
+}
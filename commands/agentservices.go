@@ -0,0 +1,350 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils/series"
+	"github.com/juju/utils/shell"
+	names2 "gopkg.in/juju/names.v2"
+
+	agent2 "github.com/juju/1.25-upgrade/juju2/agent"
+	tools2 "github.com/juju/1.25-upgrade/juju2/agent/tools"
+	"github.com/juju/1.25-upgrade/juju2/juju/paths"
+	service2 "github.com/juju/1.25-upgrade/juju2/service"
+	"github.com/juju/1.25-upgrade/juju2/service/common"
+	"github.com/juju/1.25-upgrade/juju2/service/upstart"
+)
+
+// These match the rollback information kept by agent-upgrade.py,
+// relative to the data directory.
+const (
+	agentRollbackDir  = "1.25-upgrade-rollback"
+	legacyDir         = agentRollbackDir + "/legacy"
+	legacyChangesFile = agentRollbackDir + "/legacy-changes.json"
+)
+
+// The states that agent-services-impl --check reports for each
+// service definition and link.
+const (
+	definitionMatches = "matches 2.x"
+	definitionDiffers = "differs from 2.x"
+	definitionMissing = "missing"
+)
+
+var agentServicesImplDoc = `
+
+agent-services-impl must be executed as root on a machine of a 1.25
+environment, after the agent upgrade script has switched its agents to
+the 2.x tools.
+
+The command renders each agent's init service definition with the 2.x
+service package for the machine's series - an upstart job on trusty,
+and a systemd unit elsewhere - and installs it in place of the 1.25
+one. It also links juju-run, juju-dumplogs and juju-introspect to the
+machine agent's jujud, as 2.x does. Whatever is replaced is kept with
+the agent upgrade's rollback information, and is restored if the
+upgrade is rolled back.
+
+With --check, nothing is changed: the command reports whether each
+definition and link matches what 2.x would install.
+
+`
+
+func newAgentServicesImplCommand() cmd.Command {
+	return &agentServicesImplCommand{}
+}
+
+type agentServicesImplCommand struct {
+	cmd.CommandBase
+	dataDir string
+	check   bool
+}
+
+func (c *agentServicesImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "agent-services-impl",
+		Purpose: "machine aspect of upgrade-agents and agent-status",
+		Doc:     agentServicesImplDoc,
+	}
+}
+
+func (c *agentServicesImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.dataDir, "data-dir", dataDir, "Juju data directory")
+	f.BoolVar(&c.check, "check", false, "only report whether the definitions match 2.x")
+}
+
+func (c *agentServicesImplCommand) Init(args []string) error {
+	return cmd.CheckEmpty(args)
+}
+
+func (c *agentServicesImplCommand) Run(ctx *cmd.Context) error {
+	hostSeries, err := series.HostSeries()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	services, err := agentServices(c.dataDir, hostSeries)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	links, err := helperLinks(c.dataDir, hostSeries)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if c.check {
+		for _, svc := range services {
+			state, err := serviceDefinitionState(svc)
+			if err != nil {
+				return errors.Annotatef(err, "checking %s", svc.Name())
+			}
+			fmt.Fprintf(ctx.Stdout, "%s: %s\n", svc.Name(), state)
+		}
+		for _, link := range links {
+			fmt.Fprintf(ctx.Stdout, "%s: %s\n", link.path, link.state())
+		}
+		return nil
+	}
+
+	initSystem, err := service2.VersionInitSystem(hostSeries)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	changes, err := readLegacyChanges(c.dataDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, svc := range services {
+		// Exists fails if there's no definition it can read, in
+		// which case there's nothing to compare.
+		same, err := svc.Exists()
+		if err != nil {
+			logger.Debugf("reading %s definition: %v", svc.Name(), err)
+		}
+		if same {
+			fmt.Fprintf(ctx.Stdout, "%s: definition unchanged\n", svc.Name())
+			continue
+		}
+		// Keep the 1.25 definition before installing the new one,
+		// as Install removes a differing definition.
+		definition := serviceDefinitionPath(c.dataDir, initSystem, svc.Name())
+		if _, err := os.Lstat(definition); err == nil {
+			backup := filepath.Join(c.dataDir, legacyDir, strconv.Itoa(len(changes)))
+			if err := exec.Command("cp", "-a", definition, backup).Run(); err != nil {
+				return errors.Annotatef(err, "backing up %s", definition)
+			}
+			changes = append(changes, legacyChange{
+				Action:  "replaced-service",
+				Init:    initSystem,
+				Service: svc.Name(),
+				Path:    definition,
+				Backup:  backup,
+			})
+			if err := writeLegacyChanges(c.dataDir, changes); err != nil {
+				return errors.Trace(err)
+			}
+		} else if !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		if err := svc.Install(); err != nil {
+			return errors.Annotatef(err, "installing %s", svc.Name())
+		}
+		fmt.Fprintf(ctx.Stdout, "%s: installed 2.x definition\n", svc.Name())
+	}
+
+	for _, link := range links {
+		if link.state() == definitionMatches {
+			continue
+		}
+		if link.current != "" {
+			backup := filepath.Join(c.dataDir, legacyDir, strconv.Itoa(len(changes)))
+			if err := os.Rename(link.path, backup); err != nil {
+				return errors.Trace(err)
+			}
+			changes = append(changes, legacyChange{Action: "moved", Path: link.path, Backup: backup})
+		} else {
+			changes = append(changes, legacyChange{Action: "created", Path: link.path})
+		}
+		// Record the change first, so that rollback removes the
+		// link even if creating it fails part-way.
+		if err := writeLegacyChanges(c.dataDir, changes); err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.Symlink(link.target, link.path); err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Fprintf(ctx.Stdout, "%s: linked to %s\n", link.path, link.target)
+	}
+	return nil
+}
+
+// agentServices returns the init services that 2.x would install for
+// the agents on the machine. Unit agents are given the container type
+// of the machine, as the 2.x deployer does.
+func agentServices(dataDir, hostSeries string) ([]service2.Service, error) {
+	machineTag, err := getCurrentMachineTag(dataDir)
+	if err != nil {
+		return nil, errors.Annotate(err, "finding machine tag")
+	}
+	machineConfig, err := agent2.ReadConfig(agent2.ConfigPath(dataDir, names2.NewMachineTag(machineTag.Id())))
+	if err != nil {
+		return nil, errors.Annotate(err, "reading machine agent config")
+	}
+	containerType := machineConfig.Value(agent2.ContainerType)
+	logDir := machineConfig.LogDir()
+
+	renderer, err := shell.NewRenderer("bash")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	entries, err := ioutil.ReadDir(agent2.BaseDir(dataDir))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var result []service2.Service
+	for _, entry := range entries {
+		tag, err := names2.ParseTag(entry.Name())
+		if err != nil {
+			return nil, errors.Annotatef(err, "unexpected agent %q", entry.Name())
+		}
+		var conf common.Conf
+		switch tag.Kind() {
+		case names2.MachineTagKind:
+			info := service2.NewMachineAgentInfo(tag.Id(), dataDir, logDir)
+			conf = service2.AgentConf(info, renderer)
+		case names2.UnitTagKind:
+			info := service2.NewUnitAgentInfo(tag.Id(), dataDir, logDir)
+			conf = service2.ContainerAgentConf(info, renderer, containerType)
+		default:
+			return nil, errors.Errorf("unexpected agent %q", entry.Name())
+		}
+		svc, err := service2.NewService("jujud-"+tag.String(), conf, hostSeries)
+		if err != nil {
+			return nil, errors.Annotatef(err, "making service for %s", tag)
+		}
+		result = append(result, svc)
+	}
+	return result, nil
+}
+
+// serviceDefinitionPath returns the file or directory holding the
+// definition of the named service for the init system.
+func serviceDefinitionPath(dataDir, initSystem, name string) string {
+	if initSystem == service2.InitSystemUpstart {
+		return filepath.Join(upstart.InitDir, name+".conf")
+	}
+	return filepath.Join(dataDir, "init", name)
+}
+
+func serviceDefinitionState(svc service2.Service) (string, error) {
+	installed, err := svc.Installed()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if !installed {
+		return definitionMissing, nil
+	}
+	same, err := svc.Exists()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if same {
+		return definitionMatches, nil
+	}
+	return definitionDiffers, nil
+}
+
+// helperLink is one of the commands that 2.x links to the machine
+// agent's jujud.
+type helperLink struct {
+	path    string
+	target  string
+	current string
+}
+
+func (l helperLink) state() string {
+	switch l.current {
+	case l.target:
+		return definitionMatches
+	case "":
+		return definitionMissing
+	}
+	return definitionDiffers
+}
+
+func helperLinks(dataDir, hostSeries string) ([]helperLink, error) {
+	machineTag, err := getCurrentMachineTag(dataDir)
+	if err != nil {
+		return nil, errors.Annotate(err, "finding machine tag")
+	}
+	target := filepath.Join(tools2.ToolsDir(dataDir, machineTag.String()), "jujud")
+	var result []helperLink
+	for _, linkPath := range []func(string) (string, error){
+		paths.JujuRun,
+		paths.JujuDumpLogs,
+		paths.JujuIntrospect,
+	} {
+		p, err := linkPath(hostSeries)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		link := helperLink{path: p, target: target}
+		if info, err := os.Lstat(p); err == nil {
+			link.current = p
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link.current, err = os.Readlink(p); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Trace(err)
+		}
+		result = append(result, link)
+	}
+	return result, nil
+}
+
+// legacyChange is an entry in the record of changes that the agent
+// upgrade script undoes on rollback.
+type legacyChange struct {
+	Action  string `json:"action"`
+	Init    string `json:"init,omitempty"`
+	Service string `json:"service,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Backup  string `json:"backup,omitempty"`
+}
+
+func readLegacyChanges(dataDir string) ([]legacyChange, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataDir, legacyChangesFile))
+	if os.IsNotExist(err) {
+		// The upgrade script only writes the record if it retired
+		// something.
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var changes []legacyChange
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, errors.Annotate(err, "reading legacy changes")
+	}
+	return changes, nil
+}
+
+func writeLegacyChanges(dataDir string, changes []legacyChange) error {
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(filepath.Join(dataDir, legacyChangesFile), data, 0644))
+}
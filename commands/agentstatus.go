@@ -21,6 +21,11 @@ agents of a 1.25 environment. The agents may be running the 1.25 binary, or a
 2.x binary. The command will return the status of the agent, and what tools
 they are currently set to use.
 
+Once upgrade-agents has reached a machine, the command also reports whether
+each agent's init service definition matches what 2.x would install. The
+machine agent's entry also covers the juju-run, juju-dumplogs and
+juju-introspect links.
+
 `
 
 func newAgentStatusCommand() cmd.Command {
@@ -83,9 +88,14 @@ func (c *agentStatusImplCommand) Run(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 
+	definitions, err := agentDefinitions(machines)
+	if err != nil {
+		return errors.Annotate(err, "checking service definitions")
+	}
+
 	// The information is then gathered and parsed and formatted here before
 	// the data is passed back to the caller.
-	return printServiceStatus(ctx, machines)
+	return printServiceStatus(ctx, machines, definitions)
 }
 
 func loadMachines() ([]FlatMachine, error) {
@@ -109,10 +119,39 @@ func loadMachines() ([]FlatMachine, error) {
 		}
 	} else if err != nil {
 		return nil, errors.Annotate(err, "loading saved machines")
+	} else {
+		refreshStateServers(machines)
+	}
+	// Record the machines' SSH host keys on first contact, so
+	// that every later connection is checked against them.
+	if _, err := ensureHostKeys(machines); err != nil {
+		return nil, errors.Annotate(err, "recording SSH host keys")
 	}
 	return machines, nil
 }
 
+// refreshStateServers updates which of the saved machines are state
+// servers from the 1.25 environment, as the state servers may have
+// changed since the machines were saved. The saved information is
+// kept if the environment can't be read, as happens once the local
+// machine's agent config has been rewritten.
+func refreshStateServers(machines []FlatMachine) {
+	st, err := getState()
+	if err != nil {
+		logger.Debugf("not refreshing state servers: %v", err)
+		return
+	}
+	defer st.Close()
+	for i := range machines {
+		m, err := st.Machine(machines[i].ID)
+		if err != nil {
+			logger.Debugf("not refreshing machine %s: %v", machines[i].ID, err)
+			continue
+		}
+		machines[i].StateServer = isStateServer(m.Jobs())
+	}
+}
+
 func loadSavedMachines() ([]FlatMachine, error) {
 	data, err := ioutil.ReadFile(path.Join(toolsDir, "saved-machines.json"))
 	if err != nil {
@@ -149,10 +188,11 @@ func makeFlatMachine(st *state.State, m *state.Machine) (FlatMachine, error) {
 		return FlatMachine{}, errors.Annotatef(err, "address for machine %q", m.Id())
 	}
 	fm := FlatMachine{
-		Model:   st.EnvironUUID(),
-		Series:  m.Series(),
-		ID:      m.Id(),
-		Address: address,
+		Model:       st.EnvironUUID(),
+		Series:      m.Series(),
+		ID:          m.Id(),
+		Address:     address,
+		StateServer: isStateServer(m.Jobs()),
 	}
 	if instanceId, err := m.InstanceId(); err == nil {
 		fm.InstanceID = string(instanceId)
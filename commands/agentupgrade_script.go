@@ -9,14 +9,18 @@ const agentUpgradeScript = `# Copyright 2017 Canonical Ltd.
 # Licensed under the AGPLv3, see LICENCE file for details.
 """
 Upgrades the local agents to use the new tools binary in a directory
-beside this script. Keeps all changed files in
-/var/lib/juju/1.25-upgrade-rollback so that they can be restored if
-needed.
+beside this script, and retires the 1.25 rsyslog forwarding and juju-db
+service. Keeps all changed files in /var/lib/juju/1.25-upgrade-rollback
+so that they can be restored if needed. Rollback also restores the uniter
+state that the plugin's check-uniter-state-impl converted, and the agent
+service definitions and links that its agent-services-impl replaced.
 """
+import glob
 import json
 import os
 from os import path
 import shutil
+import subprocess
 import sys
 import tarfile
 import yaml
@@ -27,16 +31,48 @@ FILE_FORMAT = '2.0'
 CA_CERT = """{{.ControllerInfo.CACert}}"""
 CONTROLLER_TAG = '{{.ControllerTag}}'
 VERSION = '{{.Version}}'
-API_ADDRESSES = """{{range .ControllerInfo.Addrs}}{{.}}
+API_ADDRESSES = """{{range .APIAddresses}}{{.}}
 {{end}}""".splitlines()
 
-BASE_DIR = '/var/lib/juju'
+# The root of the machine's filesystem, which is only changed by the
+# plugin's tests.
+ROOT = '/'
+
+BASE_DIR = path.join(ROOT, 'var/lib/juju')
 ROLLBACK_DIR = path.join(BASE_DIR, '1.25-upgrade-rollback')
 TOOLS_DIR = path.join(BASE_DIR, 'tools')
 AGENTS_DIR = path.join(BASE_DIR, 'agents')
 
 UPGRADE_DIR, SCRIPT = path.split(__file__)
 
+# Where the plugin keeps the uniter state files it converts.
+UNITER_STATE_BACKUP_DIR = path.join(BASE_DIR, '1.25-upgrade-uniter-state')
+
+# 1.25-only files moved aside on upgrade, and the record of what was
+# changed so that rollback can undo it.
+LEGACY_DIR = path.join(ROLLBACK_DIR, 'legacy')
+LEGACY_CHANGES = path.join(ROLLBACK_DIR, 'legacy-changes.json')
+
+# The rsyslog config that forwards logs to the 1.25 state servers, and
+# the directories holding the certificates and the logrotate config and
+# helper that it uses. Juju 2.x sends logs over the API instead.
+RSYSLOG_DIR = path.join(ROOT, 'etc/rsyslog.d')
+LEGACY_FILES = [path.join(ROOT, pattern) for pattern in """\
+etc/rsyslog.d/25-juju*.conf
+var/lib/juju/rsyslog
+var/lib/juju/rsyslog-*
+""".splitlines()]
+
+# The juju-db service definitions of a former state server. The
+# service is only disabled here - the 1.25 database is still needed
+# until the migration is finalized. Juju links its systemd units from
+# files under /var/lib/juju/init.
+JUJU_DB_UPSTART = path.join(ROOT, 'etc/init/juju-db*.conf')
+JUJU_DB_SYSTEMD = [path.join(ROOT, pattern) for pattern in """\
+etc/systemd/system/juju-db*.service
+lib/systemd/system/juju-db*.service
+""".splitlines()]
+
 HOOK_TOOLS = """\
 action-fail
 action-get
@@ -152,7 +188,7 @@ def config_path(agent):
 
 def read_agent_config(agent):
     with open(config_path(agent)) as f:
-        data = yaml.load(f)
+        data = yaml.safe_load(f)
     return data
 
 def write_agent_config(agent, data):
@@ -186,14 +222,126 @@ def update_unit_config(agent, data):
 
     return data
 
+def record_legacy_change(changes, **change):
+    changes.append(change)
+    # Write the record after every change, so that rollback can undo
+    # the changes made before a failure.
+    with open(LEGACY_CHANGES, 'w') as f:
+        json.dump(changes, f, indent=2)
+
+def retire_legacy_artefacts():
+    changes = []
+    os.mkdir(LEGACY_DIR)
+    for pattern in LEGACY_FILES:
+        for legacy_path in sorted(glob.glob(pattern)):
+            backup_path = path.join(LEGACY_DIR, str(len(changes)))
+            shutil.move(legacy_path, backup_path)
+            record_legacy_change(changes, action='moved', path=legacy_path, backup=backup_path)
+
+    for job in sorted(glob.glob(JUJU_DB_UPSTART)):
+        override = job[:-len('.conf')] + '.override'
+        if path.exists(override):
+            continue
+        with open(override, 'w') as f:
+            f.write('manual\n')
+        record_legacy_change(changes, action='created', path=override)
+    for pattern in JUJU_DB_SYSTEMD:
+        for unit in sorted(glob.glob(pattern)):
+            service = path.basename(unit)
+            unit_file = path.realpath(unit)
+            subprocess.check_call(['systemctl', 'disable', service])
+            if unit_file == unit:
+                record_legacy_change(changes, action='disabled', service=service)
+                continue
+            # Disabling a linked unit removes the link too, so it's
+            # linked again to keep the service startable, and the
+            # file is recorded to enable it by path on rollback.
+            subprocess.check_call(['systemctl', 'link', unit_file])
+            record_legacy_change(changes, action='disabled', service=service, path=unit_file)
+
+    if any(c['action'] == 'moved' and c['path'].startswith(RSYSLOG_DIR + '/') for c in changes):
+        subprocess.check_call(['service', 'rsyslog', 'restart'])
+
+def restore_legacy_artefacts():
+    if not path.exists(LEGACY_CHANGES):
+        return
+    with open(LEGACY_CHANGES) as f:
+        changes = json.load(f)
+    # Every change is attempted even if undoing another one fails, and
+    # the failures are reported at the end. Undoing the changes that
+    # succeeded again is harmless, so the rollback can be rerun.
+    failures = []
+    for change in reversed(changes):
+        try:
+            restore_legacy_change(change)
+        except Exception as e:
+            print('cannot undo {}: {}'.format(change, e), file=sys.stderr)
+            failures.append(change.get('path') or change.get('service'))
+    if any(c['action'] == 'moved' and c['path'].startswith(RSYSLOG_DIR + '/') for c in changes):
+        try:
+            subprocess.check_call(['service', 'rsyslog', 'restart'])
+        except Exception as e:
+            print('cannot restart rsyslog: {}'.format(e), file=sys.stderr)
+            failures.append('rsyslog restart')
+    assert not failures, 'failed to restore: {}'.format(', '.join(failures))
+
+def restore_legacy_change(change):
+    action = change['action']
+    if action == 'moved':
+        if path.lexists(change['backup']):
+            os.makedirs(path.dirname(change['path']), exist_ok=True)
+            shutil.move(change['backup'], change['path'])
+    elif action == 'created':
+        if path.lexists(change['path']):
+            os.unlink(change['path'])
+    elif action == 'disabled':
+        # Units linked from elsewhere have to be enabled by path.
+        subprocess.check_call(['systemctl', 'enable', change.get('path', change['service'])])
+    elif action == 'replaced-service':
+        restore_service_definition(change)
+
+def restore_service_definition(change):
+    # The plugin's agent-services-impl replaces the 1.25 agent service
+    # definitions with those rendered by 2.x, keeping copies of them.
+    if not path.lexists(change['backup']):
+        return
+    if change['init'] == 'upstart':
+        os.replace(change['backup'], change['path'])
+        return
+    unit = change['service'] + '.service'
+    subprocess.call(['systemctl', 'disable', unit])
+    if path.exists(change['path']):
+        shutil.rmtree(change['path'])
+    shutil.move(change['backup'], change['path'])
+    subprocess.check_call(['systemctl', 'daemon-reload'])
+    subprocess.check_call(['systemctl', 'enable', path.join(change['path'], unit)])
+
+def restore_uniter_state():
+    if not path.exists(UNITER_STATE_BACKUP_DIR):
+        return
+    # The backup holds each converted file at its path relative to
+    # the unit's agent directory.
+    for dirpath, _, filenames in os.walk(UNITER_STATE_BACKUP_DIR):
+        for name in filenames:
+            backup_path = path.join(dirpath, name)
+            rel_path = path.relpath(backup_path, UNITER_STATE_BACKUP_DIR)
+            shutil.copy2(backup_path, path.join(AGENTS_DIR, rel_path))
+    shutil.rmtree(UNITER_STATE_BACKUP_DIR)
+
 def main():
     assert not path.exists(ROLLBACK_DIR), 'saved rollback information found - aborting'
     save_rollback_info()
     install_tools()
     update_configs()
+    retire_legacy_artefacts()
 
 def rollback():
-    assert path.exists(ROLLBACK_DIR), 'no rollback information found'
+    # The uniter state is converted before the rest of the upgrade, so
+    # it may need restoring even if the upgrade didn't start.
+    restore_uniter_state()
+    if not path.exists(ROLLBACK_DIR):
+        print('no rollback information found; the agents were not upgraded')
+        return
     for agent in all_agents():
         link_path = path.join(ROLLBACK_DIR, agent)
         target = os.readlink(link_path)
@@ -206,6 +354,8 @@ def rollback():
         backup_path = path.join(ROLLBACK_DIR, agent + '_agent.conf')
         shutil.copy(backup_path, agent_conf)
 
+    restore_legacy_artefacts()
+
     tools_base, _ = path.splitext(path.basename(find_new_tools()))
     added_tools = path.join(TOOLS_DIR, tools_base)
     shutil.rmtree(added_tools)
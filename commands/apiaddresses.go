@@ -0,0 +1,168 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils"
+	"github.com/juju/utils/set"
+
+	"github.com/juju/1.25-upgrade/juju2/network"
+)
+
+// agentAddressFlags holds the options controlling which of the
+// controller's addresses are written into the upgraded agents' config.
+type agentAddressFlags struct {
+	addresses string
+	scope     string
+	space     string
+}
+
+func (f *agentAddressFlags) setFlags(fs *gnuflag.FlagSet) {
+	fs.StringVar(&f.addresses, "agent-api-addresses", "", "comma-separated host:port controller addresses for the agents to use, instead of selecting them from the controller's")
+	fs.StringVar(&f.scope, "agent-address-scope", "", "select the controller addresses in this network scope (public, local-cloud, local-machine or link-local) for the agents")
+	fs.StringVar(&f.space, "agent-address-space", "", "select the controller addresses in this network space for the agents")
+}
+
+// options returns the flags for passing the options on to the remote
+// command.
+func (f *agentAddressFlags) options() []string {
+	var options []string
+	if f.addresses != "" {
+		options = append(options, utils.ShQuote("--agent-api-addresses="+f.addresses))
+	}
+	if f.scope != "" {
+		options = append(options, utils.ShQuote("--agent-address-scope="+f.scope))
+	}
+	if f.space != "" {
+		options = append(options, utils.ShQuote("--agent-address-space="+f.space))
+	}
+	return options
+}
+
+func (f *agentAddressFlags) validate() error {
+	if f.addresses != "" && (f.scope != "" || f.space != "") {
+		return errors.New("--agent-api-addresses cannot be combined with --agent-address-scope or --agent-address-space")
+	}
+	switch network.Scope(f.scope) {
+	case network.ScopeUnknown, network.ScopePublic, network.ScopeCloudLocal,
+		network.ScopeMachineLocal, network.ScopeLinkLocal:
+	default:
+		return errors.Errorf("unknown address scope %q", f.scope)
+	}
+	return nil
+}
+
+// selectAddresses returns the controller addresses that the agents
+// should be configured with. Unless they are given explicitly, they
+// are selected from each controller's host ports: those in the
+// requested scope and space, or by default the addresses that 2.x
+// would hand out to agents, preferring cloud-local ones.
+func (f *agentAddressFlags) selectAddresses(apiHostPorts [][]network.HostPort) ([]string, error) {
+	if f.addresses != "" {
+		var result []string
+		for _, addr := range strings.Split(f.addresses, ",") {
+			addr = strings.TrimSpace(addr)
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, errors.Annotatef(err, "parsing --agent-api-addresses")
+			}
+			result = append(result, addr)
+		}
+		return result, nil
+	}
+
+	seen := set.NewStrings()
+	var result []string
+	for _, server := range apiHostPorts {
+		var selected []string
+		if f.scope == "" && f.space == "" {
+			selected = network.SelectInternalHostPorts(server, false)
+		} else {
+			for _, hp := range server {
+				if f.scope != "" && hp.Scope != network.Scope(f.scope) {
+					continue
+				}
+				if f.space != "" && hp.SpaceName != network.SpaceName(f.space) {
+					continue
+				}
+				selected = append(selected, hp.NetAddr())
+			}
+		}
+		for _, addr := range selected {
+			if !seen.Contains(addr) {
+				seen.Add(addr)
+				result = append(result, addr)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil, errors.Errorf("no controller addresses match (controller addresses: %s)", formatAPIHostPorts(apiHostPorts))
+	}
+	return result, nil
+}
+
+func formatAPIHostPorts(apiHostPorts [][]network.HostPort) string {
+	var all []string
+	for _, server := range apiHostPorts {
+		for _, hp := range server {
+			desc := hp.NetAddr()
+			if hp.Scope != network.ScopeUnknown {
+				desc += " " + string(hp.Scope)
+			}
+			if hp.SpaceName != "" {
+				desc += " space " + string(hp.SpaceName)
+			}
+			all = append(all, desc)
+		}
+	}
+	return strings.Join(all, ", ")
+}
+
+// checkControllerReachable checks that every machine can connect to at
+// least one of the controller addresses.
+func checkControllerReachable(ctx *cmd.Context, machines []FlatMachine, addresses []string) error {
+	script, err := controllerReachabilityScript(addresses)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	results, err := parallelExec(flatMachineExecTargets(machines...), script)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(reportResults(ctx, "controller reachability check", machines, results))
+}
+
+// controllerReachabilityScript returns a script that tries to open a
+// TCP connection to each of the addresses, and fails if none of them
+// can be reached.
+func controllerReachabilityScript(addresses []string) (string, error) {
+	targets := make([]string, len(addresses))
+	for i, addr := range addresses {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		targets[i] = utils.ShQuote(host + " " + port)
+	}
+	return fmt.Sprintf(`
+set -u
+reachable=0
+for target in %s; do
+    set -- $target
+    if timeout 10 bash -c "exec 3<>/dev/tcp/$1/$2" 2>/dev/null; then
+        echo "controller address $1:$2 reachable"
+        reachable=1
+    else
+        echo "controller address $1:$2 unreachable"
+    fi
+done
+[ $reachable -eq 1 ]
+`, strings.Join(targets, " ")), nil
+}
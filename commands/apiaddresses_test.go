@@ -0,0 +1,70 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/1.25-upgrade/juju2/network"
+)
+
+type agentAddressSuite struct{}
+
+var _ = gc.Suite(&agentAddressSuite{})
+
+func hostPort(value string, scope network.Scope, space network.SpaceName) network.HostPort {
+	addr := network.NewScopedAddress(value, scope)
+	addr.SpaceName = space
+	return network.HostPort{Address: addr, Port: 17070}
+}
+
+var testAPIHostPorts = [][]network.HostPort{{
+	hostPort("54.0.0.1", network.ScopePublic, ""),
+	hostPort("10.0.0.1", network.ScopeCloudLocal, "internal"),
+	hostPort("127.0.0.1", network.ScopeMachineLocal, ""),
+}, {
+	hostPort("54.0.0.2", network.ScopePublic, ""),
+	hostPort("10.0.0.2", network.ScopeCloudLocal, "internal"),
+	hostPort("192.168.0.2", network.ScopeCloudLocal, "storage"),
+}}
+
+func (*agentAddressSuite) TestSelectAddresses(c *gc.C) {
+	for i, test := range []struct {
+		flags    agentAddressFlags
+		expected []string
+	}{{
+		expected: []string{"10.0.0.1:17070", "10.0.0.2:17070", "192.168.0.2:17070"},
+	}, {
+		flags:    agentAddressFlags{scope: "public"},
+		expected: []string{"54.0.0.1:17070", "54.0.0.2:17070"},
+	}, {
+		flags:    agentAddressFlags{space: "internal"},
+		expected: []string{"10.0.0.1:17070", "10.0.0.2:17070"},
+	}, {
+		flags:    agentAddressFlags{scope: "local-cloud", space: "storage"},
+		expected: []string{"192.168.0.2:17070"},
+	}, {
+		flags:    agentAddressFlags{addresses: "172.16.0.1:17070, 172.16.0.2:17070"},
+		expected: []string{"172.16.0.1:17070", "172.16.0.2:17070"},
+	}} {
+		c.Logf("test %d: %+v", i, test.flags)
+		addresses, err := test.flags.selectAddresses(testAPIHostPorts)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(addresses, jc.DeepEquals, test.expected)
+	}
+}
+
+func (*agentAddressSuite) TestSelectAddressesNoneMatch(c *gc.C) {
+	flags := agentAddressFlags{space: "dmz"}
+	_, err := flags.selectAddresses(testAPIHostPorts[:1])
+	c.Assert(err, gc.ErrorMatches, `no controller addresses match \(controller addresses: 54.0.0.1:17070 public, 10.0.0.1:17070 local-cloud space internal, 127.0.0.1:17070 local-machine\)`)
+}
+
+func (*agentAddressSuite) TestValidate(c *gc.C) {
+	flags := agentAddressFlags{addresses: "10.0.0.1:17070", scope: "public"}
+	c.Check(flags.validate(), gc.ErrorMatches, `--agent-api-addresses cannot be combined with .*`)
+	flags = agentAddressFlags{scope: "galactic"}
+	c.Check(flags.validate(), gc.ErrorMatches, `unknown address scope "galactic"`)
+}
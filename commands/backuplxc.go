@@ -5,10 +5,14 @@ package commands
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"time"
 
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
@@ -29,6 +33,25 @@ be backed up.
 
 If --dry-run is specified, then no backups will be created, nor
 will the containers be stopped.
+
+Backups are compressed with xz by default; --compress may be used to
+choose gzip, zstd or none instead. The chosen compressor must be
+installed on the container hosts.
+
+A manifest recording the environment, and the container, host, size,
+SHA256 and creation time of each backup, is written to the backup
+directory as each backup completes. If backup-lxc is run again with
+the same backup directory, containers whose backups are recorded in
+the manifest and still match it are skipped. The backups can be
+checked at any time with verify-lxc-backup.
+
+If --backup-target=host is specified, no backup dir is needed: instead
+of copying the backups to the client, each container is snapshotted
+on its own host, in /var/lib/lxc-backups. The snapshot is only taken if
+the host has enough free disk space for the uncompressed container.
+Containers with intact snapshots are skipped. The snapshots can be
+restored with restore-lxc --backup-target=host, or abort
+--restore-lxc-snapshots, and removed with cleanup-lxc-snapshots.
 `
 
 func newBackupLXCCommand() cmd.Command {
@@ -39,15 +62,17 @@ func newBackupLXCCommand() cmd.Command {
 
 type backupLXCCommand struct {
 	baseClientCommand
-	backupDir string
-	dryRun    bool
-	match     string
+	backupDir    string
+	backupTarget string
+	dryRun       bool
+	match        string
+	compress     string
 }
 
 func (c *backupLXCCommand) Info() *cmd.Info {
 	return &cmd.Info{
 		Name:    "backup-lxc",
-		Args:    "<environment name> <backup dir>",
+		Args:    "<environment name> [<backup dir>]",
 		Purpose: "create a backup of LXC containers for the specified environment",
 		Doc:     backupLXCDoc,
 	}
@@ -58,10 +83,18 @@ func (c *backupLXCCommand) Init(args []string) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if len(args) == 0 {
-		return errors.New("no backup directory specified")
+	if err := checkBackupTarget(c.backupTarget); err != nil {
+		return errors.Annotate(err, "parsing --backup-target")
+	}
+	if c.backupTarget == backupTargetClient {
+		if len(args) == 0 {
+			return errors.New("no backup directory specified")
+		}
+		c.backupDir, args = args[0], args[1:]
+	}
+	if _, err := lookupLXCBackupCompressor(c.compress); err != nil {
+		return errors.Annotate(err, "parsing --compress")
 	}
-	c.backupDir, args = args[0], args[1:]
 	return cmd.CheckEmpty(args)
 }
 
@@ -69,11 +102,15 @@ func (c *backupLXCCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.baseClientCommand.SetFlags(f)
 	f.BoolVar(&c.dryRun, "dry-run", false, "perform a dry run, without making any changes")
 	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs to back up")
+	f.StringVar(&c.compress, "compress", "xz", "backup compressor: xz, gzip, zstd or none")
+	f.StringVar(&c.backupTarget, "backup-target", backupTargetClient, "where to keep the backups: client or host")
 }
 
 func (c *backupLXCCommand) Run(ctx *cmd.Context) error {
-	if _, err := os.Stat(c.backupDir); err != nil {
-		return errors.Annotate(err, "checking backup dir")
+	if c.backupTarget == backupTargetClient {
+		if _, err := os.Stat(c.backupDir); err != nil {
+			return errors.Annotate(err, "checking backup dir")
+		}
 	}
 
 	match := func(string) bool { return true }
@@ -90,21 +127,45 @@ func (c *backupLXCCommand) Run(ctx *cmd.Context) error {
 	}
 
 	// Get a listing of all of the LXC containers in the environment.
-	lxcContainers, err := getLXCContainerList(&c.baseClientCommand)
+	list, err := getLXCContainerList(&c.baseClientCommand)
 	if err != nil {
 		return errors.Annotate(err, "getting LXC container list")
 	}
+	if c.backupTarget == backupTargetHost {
+		return c.snapshotContainers(ctx, list.Containers, match)
+	}
 
-	doBackup := func(containerName, outpath string) error {
+	// Resume from any existing manifest, which must be for
+	// the same environment.
+	manifest, err := readLXCBackupManifest(c.backupDir)
+	if errors.IsNotFound(err) {
+		manifest = &lxcBackupManifest{EnvironUUID: list.EnvironUUID}
+	} else if err != nil {
+		return errors.Trace(err)
+	} else if manifest.EnvironUUID != list.EnvironUUID {
+		return errors.Errorf(
+			"backup dir %s holds backups of environment %s, not %s",
+			c.backupDir, manifest.EnvironUUID, list.EnvironUUID,
+		)
+	}
+	writer := &lxcBackupWriter{backupDir: c.backupDir, manifest: manifest}
+	compressor, err := lookupLXCBackupCompressor(c.compress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	doBackup := func(container lxcContainer, file string) error {
+		outpath := filepath.Join(c.backupDir, file)
 		temp := outpath + ".tmp"
 		f, err := os.Create(temp)
 		if err != nil {
 			return errors.Annotate(err, "creating output file")
 		}
+		hash := sha256.New()
 		rc, err := runViaSSH(
 			c.address,
-			c.getRemoteCommand(c.remoteCommand, containerName),
-			withStdout(f),
+			c.getRemoteCommand(c.remoteCommand, "--compress="+c.compress, container.Id),
+			c.sshOptions(withStdout(io.MultiWriter(f, hash)))...,
 		)
 		f.Close()
 		if err != nil {
@@ -113,41 +174,113 @@ func (c *backupLXCCommand) Run(ctx *cmd.Context) error {
 		if rc != 0 {
 			return errors.Errorf("creating LXC backup exited %d", rc)
 		}
-		return utils.ReplaceFile(temp, outpath)
+		info, err := os.Stat(temp)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := utils.ReplaceFile(temp, outpath); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Annotate(writer.add(lxcBackup{
+			ContainerId: container.Id,
+			InstanceId:  container.InstanceId,
+			HostId:      container.HostId,
+			File:        file,
+			Compression: c.compress,
+			Size:        info.Size(),
+			SHA256:      hex.EncodeToString(hash.Sum(nil)),
+			Created:     time.Now().UTC(),
+		}), "updating backup manifest")
+	}
+
+	// Create a backup of each container matching --match, or all
+	// machines if --match isn't specified, unless it has already
+	// been backed up. The manifest is checked before any backups
+	// start, as it is updated as they complete.
+	type pendingBackup struct {
+		container lxcContainer
+		file      string
+	}
+	var pending []pendingBackup
+	for _, container := range list.Containers {
+		if !match(container.Id) {
+			ctx.Infof("Skipping non-matching container %q", container.Id)
+			continue
+		}
+		if existing := manifest.backup(container.Id); existing != nil && existing.InstanceId == container.InstanceId {
+			err := existing.verify(c.backupDir)
+			if err == nil {
+				ctx.Infof("Skipping container %q, already backed up to %s", container.Id, existing.File)
+				continue
+			}
+			ctx.Infof("Backing up container %q again: %v", container.Id, err)
+		}
+		file := container.InstanceId + compressor.extension
+		ctx.Infof("Backing up container %q to %s", container.Id, filepath.Join(c.backupDir, file))
+		pending = append(pending, pendingBackup{container, file})
+	}
+	if c.dryRun {
+		return nil
 	}
 
-	// Create a backup of each container matching --match,
-	// or all machines if --match isn't specified.
 	var group errgroup.Group
-	for _, container := range lxcContainers {
+	for _, p := range pending {
+		p := p // copy for closure
+		group.Go(func() error {
+			return errors.Annotatef(
+				doBackup(p.container, p.file),
+				"backing up %q to %s",
+				p.container.Id, p.file,
+			)
+		})
+	}
+	return group.Wait()
+}
+
+// snapshotContainers snapshots each of the matching containers on
+// its host.
+func (c *backupLXCCommand) snapshotContainers(ctx *cmd.Context, containers []lxcContainer, match func(string) bool) error {
+	var group errgroup.Group
+	for _, container := range containers {
 		containerName := container.Id
 		if !match(containerName) {
 			ctx.Infof("Skipping non-matching container %q", containerName)
 			continue
 		}
-		outpath := filepath.Join(c.backupDir, container.InstanceId+".tar.xz")
-		ctx.Infof("Backing up container %q to %s", containerName, outpath)
+		ctx.Infof("Snapshotting container %q on host %q", containerName, container.HostId)
 		if c.dryRun {
 			continue
 		}
 		group.Go(func() error {
-			return errors.Annotatef(
-				doBackup(containerName, outpath),
-				"backing up %q to %s",
-				containerName, outpath,
+			rc, err := runViaSSH(
+				c.address,
+				c.getRemoteCommand(
+					c.remoteCommand,
+					"--backup-target=host",
+					"--compress="+c.compress,
+					containerName,
+				),
+				c.sshOptions()...,
 			)
+			if err != nil {
+				return errors.Annotatef(err, "running %s via SSH", c.remoteCommand)
+			}
+			if rc != 0 {
+				return errors.Errorf("snapshotting container %q exited %d", containerName, rc)
+			}
+			return nil
 		})
 	}
 	return group.Wait()
 }
 
-func getLXCContainerList(c *baseClientCommand) ([]lxcContainer, error) {
+func getLXCContainerList(c *baseClientCommand) (*lxcContainerList, error) {
 	// Get a listing of all of the LXC containers in the environment.
 	var buf bytes.Buffer
 	rc, err := runViaSSH(
 		c.address,
 		c.getRemoteCommand(c.remoteCommand),
-		withStdout(&buf),
+		c.sshOptions(withStdout(&buf))...,
 	)
 	if err != nil {
 		return nil, errors.Annotatef(err, "running %s via SSH", c.remoteCommand)
@@ -159,16 +292,18 @@ func getLXCContainerList(c *baseClientCommand) ([]lxcContainer, error) {
 	if err := json.Unmarshal(buf.Bytes(), &lxcContainers); err != nil {
 		return nil, errors.Trace(err)
 	}
-	return lxcContainers.Containers, nil
+	return &lxcContainers, nil
 }
 
 type lxcContainerList struct {
-	Containers []lxcContainer `json:"containers"`
+	EnvironUUID string         `json:"environ-uuid"`
+	Containers  []lxcContainer `json:"containers"`
 }
 
 type lxcContainer struct {
 	Id         string
 	InstanceId string
+	HostId     string
 }
 
 var backupLXCImplDoc = `
@@ -179,7 +314,10 @@ environment.
 The command will get a list of all the LXC containers when run without
 arguments. When run with the name of a container, the command will
 SSH to the container's host, stop the container, send an archive
-of the container over stdout, and then start the container again.
+of the container over stdout, compressed with the compressor given
+by --compress, and then start the container again. With
+--backup-target=host, the archive is kept on the container's host
+instead, unless there is already an intact one.
 
 `
 
@@ -190,6 +328,8 @@ func newBackupLXCImplCommand() cmd.Command {
 type backupLXCImplCommand struct {
 	baseRemoteCommand
 	containerName string
+	compress      string
+	backupTarget  string
 }
 
 func (c *backupLXCImplCommand) Info() *cmd.Info {
@@ -201,6 +341,11 @@ func (c *backupLXCImplCommand) Info() *cmd.Info {
 	}
 }
 
+func (c *backupLXCImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.compress, "compress", "xz", "backup compressor")
+	f.StringVar(&c.backupTarget, "backup-target", backupTargetClient, "where to keep the backup")
+}
+
 func (c *backupLXCImplCommand) Init(args []string) error {
 	if len(args) > 0 {
 		c.containerName, args = args[0], args[1:]
@@ -230,12 +375,21 @@ func (c *backupLXCImplCommand) Run(ctx *cmd.Context) error {
 		return errors.Annotate(err, "getting host machine")
 	}
 
+	if c.backupTarget == backupTargetHost {
+		return c.snapshot(ctx, st, containerMachine, hostMachine)
+	}
+
+	compressor, err := lookupLXCBackupCompressor(c.compress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
 	logger.Debugf("stopping LXC container %q", c.containerName)
 	if err := StopLXCContainer(containerMachine, hostMachine); err != nil {
 		return errors.Annotate(err, "stopping LXC container")
 	}
 	logger.Debugf("creating backup of LXC container %q", c.containerName)
-	if err := BackupLXCContainer(containerMachine, hostMachine, ctx.GetStdout()); err != nil {
+	if err := BackupLXCContainer(containerMachine, hostMachine, compressor, ctx.GetStdout()); err != nil {
 		return errors.Annotate(err, "backing up LXC container")
 	}
 	logger.Debugf("restarting LXC container %q", c.containerName)
@@ -245,9 +399,41 @@ func (c *backupLXCImplCommand) Run(ctx *cmd.Context) error {
 	return nil
 }
 
+// snapshot creates a snapshot of the container on its host, unless
+// it already has an intact one. The container is restarted even if
+// the snapshot fails.
+func (c *backupLXCImplCommand) snapshot(ctx *cmd.Context, st *state.State, container, host *state.Machine) error {
+	existing, err := LXCSnapshot(container, host, st.EnvironUUID())
+	if err == nil {
+		ctx.Infof("Container %q already has a snapshot, %s", container.Id(), existing.File)
+		return nil
+	} else if !errors.IsNotFound(err) {
+		ctx.Infof("Replacing snapshot of container %q: %v", container.Id(), err)
+	}
+
+	logger.Debugf("stopping LXC container %q", c.containerName)
+	if err := StopLXCContainer(container, host); err != nil {
+		return errors.Annotate(err, "stopping LXC container")
+	}
+	logger.Debugf("creating snapshot of LXC container %q", c.containerName)
+	snapshot, snapshotErr := SnapshotLXCContainer(container, host, st.EnvironUUID(), c.compress)
+	logger.Debugf("restarting LXC container %q", c.containerName)
+	if err := StartLXCContainer(container, host); err != nil {
+		return errors.Annotate(err, "starting LXC container")
+	}
+	if snapshotErr != nil {
+		return errors.Annotate(snapshotErr, "snapshotting LXC container")
+	}
+	ctx.Infof(
+		"Snapshotted container %q to %s on host %q (%d bytes)",
+		container.Id(), snapshot.File, host.Id(), snapshot.Size,
+	)
+	return nil
+}
+
 func listLXCContainers(ctx *cmd.Context, st *state.State) error {
 	// Output a listing of LXC containers.
-	var lxcContainers lxcContainerList
+	lxcContainers := lxcContainerList{EnvironUUID: st.EnvironUUID()}
 	machines, err := st.AllMachines()
 	if err != nil {
 		return errors.Annotate(err, "getting machines")
@@ -260,9 +446,11 @@ func listLXCContainers(ctx *cmd.Context, st *state.State) error {
 		if err != nil {
 			return errors.Annotate(err, "getting container instance ID")
 		}
+		hostId, _ := m.ParentId()
 		lxcContainers.Containers = append(lxcContainers.Containers, lxcContainer{
 			Id:         m.Id(),
 			InstanceId: string(instanceId),
+			HostId:     hostId,
 		})
 	}
 	return json.NewEncoder(ctx.GetStdout()).Encode(&lxcContainers)
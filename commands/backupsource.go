@@ -0,0 +1,218 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils"
+
+	"github.com/juju/1.25-upgrade/juju1/state/backups"
+)
+
+var backupSourceDoc = `
+
+The backup-source command makes a full backup of the 1.25 environment's
+state server, the same as juju backups create would, and copies the
+archive to the client.
+
+The backup is recorded in the migration journal on the state server.
+The commands that change the source environment - update-maas-agentname,
+migrate-lxc and import - refuse to run until a backup has been made,
+unless they are given --skip-backup-check.
+
+`
+
+func newBackupSourceCommand() cmd.Command {
+	command := &backupSourceCommand{}
+	command.remoteCommand = "backup-source-impl"
+	return wrap(command)
+}
+
+type backupSourceCommand struct {
+	baseClientCommand
+
+	outputDir string
+}
+
+func (c *backupSourceCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "backup-source",
+		Args:    "<environment name>",
+		Purpose: "back up the source environment's state server",
+		Doc:     backupSourceDoc,
+	}
+}
+
+func (c *backupSourceCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	f.StringVar(&c.outputDir, "output-dir", ".", "directory to copy the backup archive to")
+}
+
+func (c *backupSourceCommand) Init(args []string) error {
+	args, err := c.baseClientCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+func (c *backupSourceCommand) Run(ctx *cmd.Context) error {
+	if err := c.prepareRemote(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.runRemote(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotate(c.fetchBackup(ctx), "copying backup")
+}
+
+// fetchBackup copies the latest backup recorded in the migration
+// journal from the state server, and checks it against the checksum
+// recorded for it.
+func (c *backupSourceCommand) fetchBackup(ctx *cmd.Context) error {
+	var journal, stderr bytes.Buffer
+	rc, err := runViaSSH(c.address, "cat "+utils.ShQuote(remoteToolsPath(migrationJournalFile)), c.sshOptions(withStdout(&journal), withStderr(&stderr))...)
+	if err != nil {
+		return errors.Annotate(err, "reading migration journal")
+	}
+	if rc != 0 {
+		return errors.Errorf("reading migration journal: %s", strings.TrimSpace(stderr.String()))
+	}
+	entries, err := parseJournal(journal.Bytes())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	backup := latestBackup(entries)
+	if backup == nil {
+		return errors.New("no backup recorded in the migration journal")
+	}
+
+	localPath := filepath.Join(c.outputDir, path.Base(backup.Archive))
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	hasher := sha1.New()
+	stderr.Reset()
+	rc, err = runViaSSH(c.address, "cat "+utils.ShQuote(backup.Archive), c.sshOptions(withStdout(io.MultiWriter(f, hasher)), withStderr(&stderr))...)
+	if err == nil && rc != 0 {
+		err = errors.New(strings.TrimSpace(stderr.String()))
+	}
+	if err == nil {
+		// The backup checksum is a base64-encoded SHA-1 of the
+		// compressed archive.
+		if checksum := base64.StdEncoding.EncodeToString(hasher.Sum(nil)); checksum != backup.Checksum {
+			err = errors.Errorf("checksum %s doesn't match backup checksum %s", checksum, backup.Checksum)
+		}
+	}
+	if err != nil {
+		os.Remove(localPath)
+		return errors.Annotatef(err, "copying %s", backup.Archive)
+	}
+	ctx.Infof("backup %s copied to %s", backup.BackupID, localPath)
+	return nil
+}
+
+var backupSourceImplDoc = `
+
+backup-source-impl must be executed on an API server machine of a 1.25
+environment.
+
+The command creates a backup of the state server with the 1.25 backups
+code, keeps a copy of the archive in the upgrade tools directory, and
+records the backup's ID and checksum in the migration journal.
+
+`
+
+func newBackupSourceImplCommand() cmd.Command {
+	return &backupSourceImplCommand{}
+}
+
+type backupSourceImplCommand struct {
+	baseRemoteCommand
+}
+
+func (c *backupSourceImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "backup-source-impl",
+		Purpose: "controller aspect of backup-source",
+		Doc:     backupSourceImplDoc,
+	}
+}
+
+func (c *backupSourceImplCommand) Run(ctx *cmd.Context) error {
+	st, err := getState()
+	if err != nil {
+		return errors.Annotate(err, "getting state")
+	}
+	defer st.Close()
+
+	tag, err := getCurrentMachineTag(dataDir)
+	if err != nil {
+		return errors.Annotate(err, "finding machine tag")
+	}
+	session := st.MongoSession().Copy()
+	defer session.Close()
+	dbInfo, err := backups.NewDBInfo(st.MongoConnectionInfo(), session)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	meta, err := backups.NewMetadataState(st, tag.Id())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	meta.Notes = "1.25-upgrade backup-source"
+	paths := backups.Paths{DataDir: dataDir, LogsDir: "/var/log/juju"}
+
+	stor := backups.NewStorage(st)
+	defer stor.Close()
+	b := backups.NewBackups(stor)
+	ctx.Infof("creating backup")
+	if err := b.Create(meta, &paths, dbInfo); err != nil {
+		return errors.Annotate(err, "creating backup")
+	}
+
+	_, archive, err := b.Get(meta.ID())
+	if err != nil {
+		return errors.Annotate(err, "getting backup archive")
+	}
+	defer archive.Close()
+	// The archive includes the agents' credentials, so it's only
+	// readable by root.
+	backupDir := path.Join(toolsDir, "backups")
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return errors.Trace(err)
+	}
+	archivePath := path.Join(backupDir, meta.Started.Format(backups.FilenameTemplate))
+	if err := writeFile(archivePath, 0600, archive); err != nil {
+		return errors.Annotate(err, "saving backup archive")
+	}
+
+	err = appendJournal(journalEntry{
+		Phase:    backupSourcePhase,
+		Time:     time.Now().UTC(),
+		BackupID: meta.ID(),
+		Checksum: meta.Checksum(),
+		Size:     meta.Size(),
+		Archive:  archivePath,
+	})
+	if err != nil {
+		return errors.Annotate(err, "recording backup in migration journal")
+	}
+	ctx.Infof("created backup %s (%d bytes)", meta.ID(), meta.Size())
+	return nil
+}
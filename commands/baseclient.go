@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net"
 	"path/filepath"
 	"strings"
 
@@ -14,6 +15,9 @@ import (
 
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils/set"
+	"github.com/juju/utils/ssh"
 	"github.com/kardianos/osext"
 
 	"github.com/juju/1.25-upgrade/juju1/environs/configstore"
@@ -30,11 +34,31 @@ type baseClientCommand struct {
 
 	needsController bool
 
+	// allowDegraded lets the command run while the environment's
+	// mongo replica set is unhealthy, for undoing the migration.
+	allowDegraded bool
+
 	info configstore.EnvironInfo
 
-	name    string
-	address string
-	plugin  string
+	name   string
+	plugin string
+
+	// addresses holds the hosts of all of the API servers recorded
+	// for the environment. address is the one of those that we
+	// SSH to, chosen by prepareRemote.
+	addresses []string
+	address   string
+
+	// stateServer is the address of a state server given in place
+	// of the environment's .jenv file, from which the rest of the
+	// environment's details are discovered.
+	stateServer string
+	writeJenv   bool
+
+	sshUser     string
+	sshIdentity string
+	sshProxy    string
+	jumpHost    string
 
 	remoteCommand string
 	remoteArgs    string
@@ -42,9 +66,26 @@ type baseClientCommand struct {
 	extraOptions []string
 }
 
+func (c *baseClientCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.ControllerCommandBase.SetFlags(f)
+	f.StringVar(&c.sshUser, "ssh-user", defaultSSHUser, "user to SSH to the environment's API server machines as")
+	f.StringVar(&c.sshIdentity, "ssh-identity", "", "private key file for SSH connections to the environment's API server machines")
+	f.StringVar(&c.jumpHost, "jump-host", "", "[user@]host[:port] of a bastion through which to SSH to the environment's API server machines")
+	f.StringVar(&c.sshProxy, "ssh-proxy", "", "SSH ProxyCommand through which to reach the environment's API server machines")
+	f.StringVar(&c.stateServer, "state-server", "", "address of a state server machine to discover the environment from, instead of its .jenv file")
+	f.BoolVar(&c.writeJenv, "write-jenv", false, "with --state-server, write a .jenv file for the environment with the discovered details")
+}
+
 // Init will grab the first arg as the environment name.
 // Validation of the name is also done here.
 func (c *baseClientCommand) init(args []string) ([]string, error) {
+	if c.jumpHost != "" && c.sshProxy != "" {
+		return args, errors.New("only one of --jump-host and --ssh-proxy may be specified")
+	}
+	if c.writeJenv && c.stateServer == "" {
+		return args, errors.New("--write-jenv requires --state-server")
+	}
+
 	// Make sure we can work out our own location.
 	if plugin, err := osext.Executable(); err != nil {
 		return args, errors.Annotate(err, "finding plugin location")
@@ -67,7 +108,11 @@ func (c *baseClientCommand) init(args []string) ([]string, error) {
 		args = args[1:]
 	}
 
-	if err := c.loadInfo(); err != nil {
+	if c.stateServer != "" {
+		// The environment's details are checked against the state
+		// server's agent config in prepareRemote.
+		c.addresses = []string{c.stateServer}
+	} else if err := c.loadInfo(); err != nil {
 		return args, err
 	}
 
@@ -151,14 +196,101 @@ func (c *baseClientCommand) loadInfo() error {
 
 	c.info = info
 
-	// Grab the first address
-	addresses := info.APIEndpoint().Addresses
-	address := addresses[0]
-	c.address = address[:strings.LastIndex(address, ":")]
+	// Collect the hosts of all the API addresses, so that we can
+	// fail over to another API server if the first is unreachable.
+	seen := set.NewStrings()
+	for _, address := range info.APIEndpoint().Addresses {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return errors.Annotatef(err, "parsing API address %q", address)
+		}
+		if seen.Contains(host) {
+			continue
+		}
+		seen.Add(host)
+		c.addresses = append(c.addresses, host)
+	}
+	if len(c.addresses) == 0 {
+		return errors.Errorf("environment %q has no API addresses", c.name)
+	}
 
 	return nil
 }
 
+// sshOptions returns the options for SSH connections from the client
+// to the environment's API server machines, followed by opts.
+func (c *baseClientCommand) sshOptions(opts ...execOption) []execOption {
+	result := []execOption{withUser(c.sshUser), withClientHostKey()}
+	if c.sshIdentity != "" {
+		result = append(result, withIdentity(c.sshIdentity))
+	}
+	if proxy := c.proxyCommand(); len(proxy) > 0 {
+		result = append(result, withProxyCommand(proxy...))
+	}
+	return append(result, opts...)
+}
+
+// proxyCommand returns the SSH proxy command specified by either
+// --ssh-proxy or --jump-host, or nil if neither was specified.
+func (c *baseClientCommand) proxyCommand() []string {
+	switch {
+	case c.sshProxy != "":
+		return strings.Fields(c.sshProxy)
+	case c.jumpHost != "":
+		return jumpHostProxyCommand(c.jumpHost, c.sshIdentity)
+	}
+	return nil
+}
+
+// jumpHostProxyCommand returns an SSH proxy command that forwards
+// the connection through the bastion host specified as
+// [user@]host[:port], authenticating with the identity file if one
+// is given.
+func jumpHostProxyCommand(jumpHost, identity string) []string {
+	command := []string{"ssh", "-q", "-W", "%h:%p"}
+	if identity != "" {
+		command = append(command, "-i", identity)
+	}
+	userHost := jumpHost
+	// The jump host's key is pinned on the client, in the same way as
+	// the API server machines' keys. known_hosts names hosts on other
+	// ports as [host]:port.
+	knownHost := jumpHost[strings.LastIndex(jumpHost, "@")+1:]
+	if host, port, err := net.SplitHostPort(jumpHost); err == nil {
+		userHost = host
+		command = append(command, "-p", port)
+		knownHost = host[strings.LastIndex(host, "@")+1:]
+		if port != "22" {
+			knownHost = "[" + knownHost + "]:" + port
+		}
+	}
+	knownHosts, strict := clientHostKeyOptions(knownHost)
+	strictValue := "no"
+	if strict == ssh.StrictHostChecksYes {
+		strictValue = "yes"
+	}
+	command = append(command,
+		"-o", "UserKnownHostsFile "+knownHosts,
+		"-o", "StrictHostKeyChecking "+strictValue,
+	)
+	return append(command, userHost)
+}
+
+// selectAddress chooses the API server address to SSH to, trying each
+// of the environment's API addresses in turn.
+func (c *baseClientCommand) selectAddress(ctx *cmd.Context) error {
+	if c.address != "" {
+		return nil
+	}
+	address, err := selectSSHAddress(c.addresses, len(c.proxyCommand()) > 0, c.sshOptions()...)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ctx.Verbosef("using API server address %s", address)
+	c.address = address
+	return nil
+}
+
 func (c *baseClientCommand) getRemoteCommand(cmd string, args ...string) string {
 	pluginBase := filepath.Base(c.plugin)
 	debug := ""
@@ -181,19 +313,40 @@ func (c *baseClientCommand) prepareRemote(ctx *cmd.Context) error {
 			return errors.Trace(err)
 		}
 	}
-	if err := checkUpdatePlugin(ctx, c.plugin, c.address); err != nil {
+	pinned, err := c.selectExecutionHost(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.address = pinned
+	if err := c.selectAddress(ctx); err != nil {
+		return errors.Annotate(err, "selecting API server address")
+	}
+	if err := checkUpdatePlugin(ctx, c.plugin, c.address, c.sshOptions()...); err != nil {
 		return errors.Annotate(err, "checking remote plugin")
 	}
-	return nil
+	if c.stateServer != "" {
+		if err := c.discoverEnvironment(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	// With several state servers, run the migration on the one with
+	// the mongo primary, and only if the replica set is healthy.
+	return errors.Trace(c.selectPrimary(ctx, pinned != ""))
 }
 
 func (c *baseClientCommand) Run(ctx *cmd.Context) error {
 	if err := c.prepareRemote(ctx); err != nil {
 		return errors.Trace(err)
 	}
+	return c.runRemote(ctx)
+}
+
+// runRemote runs the remote command on the API server machine. The
+// remote must already have been prepared with prepareRemote.
+func (c *baseClientCommand) runRemote(ctx *cmd.Context) error {
 	remoteCommand := c.getRemoteCommand(c.remoteCommand, c.remoteArgs)
 	logger.Debugf("running remote command: %q", remoteCommand)
-	rc, err := runViaSSH(c.address, remoteCommand)
+	rc, err := runViaSSH(c.address, remoteCommand, c.sshOptions()...)
 	if err != nil {
 		return errors.Annotatef(err, "running %s via SSH", c.remoteCommand)
 	}
@@ -6,6 +6,8 @@ package commands
 import (
 	"encoding/base64"
 	"encoding/json"
+	"os/exec"
+	"strings"
 
 	"gopkg.in/macaroon.v1"
 
@@ -75,6 +77,36 @@ func (c *baseRemoteCommand) getControllerConnection() (api.Connection, error) {
 	return api.Open(c.controllerInfo, api.DefaultDialOpts())
 }
 
+// startJujuDBScript starts juju-db if it isn't already running. Its
+// autostart is disabled when the agents are upgraded, but the 1.25
+// database is still needed until the migration is finalized. Earlier
+// versions of the upgrade disabled the systemd unit without linking
+// it again, so it's linked from /var/lib/juju/init if need be.
+const startJujuDBScript = `
+set -eu
+for conf in /etc/init/juju-db*.conf; do
+    [ -e "$conf" ] || continue
+    service=$(basename "$conf" .conf)
+    status "$service" | grep -q start/running || start "$service"
+done
+for unit in /var/lib/juju/init/juju-db*/juju-db*.service; do
+    [ -e "$unit" ] || continue
+    [ -e /etc/systemd/system/"$(basename "$unit")" ] || systemctl link "$unit"
+done
+for unit in /etc/systemd/system/juju-db*.service /lib/systemd/system/juju-db*.service; do
+    [ -e "$unit" ] || continue
+    systemctl start "$(basename "$unit")"
+done
+`
+
+func ensureJujuDBRunning() error {
+	output, err := exec.Command("bash", "-c", startJujuDBScript).CombinedOutput()
+	if err != nil {
+		return errors.Annotatef(err, "output: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
 func getState() (*state.State, error) {
 	tag, err := getCurrentMachineTag(dataDir)
 	if err != nil {
@@ -84,8 +116,25 @@ func getState() (*state.State, error) {
 	logger.Infof("current machine tag: %s", tag)
 
 	config, err := getConfig(tag)
+	if err == nil {
+		if _, available := config.MongoInfo(); !available {
+			err = errors.New("mongo info not available")
+		}
+	}
 	if err != nil {
-		return nil, errors.Annotate(err, "loading agent config")
+		// Once upgrade-agents has rewritten the agent config for
+		// 2.x it can't be used to connect to state, but the 1.25
+		// config it saved for rollback can.
+		logger.Infof("cannot use agent config (%v), trying saved 1.25 config", err)
+		config, err = getSavedConfig(tag)
+		if err != nil {
+			return nil, errors.Annotate(err, "loading agent config")
+		}
+		// The upgrade also stopped juju-db being started on boot,
+		// so it may need starting.
+		if err := ensureJujuDBRunning(); err != nil {
+			return nil, errors.Annotate(err, "starting juju-db")
+		}
 	}
 
 	mongoInfo, available := config.MongoInfo()
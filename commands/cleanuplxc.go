@@ -0,0 +1,177 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"regexp"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/juju/1.25-upgrade/juju1/state"
+)
+
+var cleanupLXCDoc = `
+The purpose of the cleanup-lxc command is to remove the LXC containers
+retained by migrate-lxc --copy-rootfs, once the migration to LXD has
+been confirmed.
+
+Only LXC containers that have a corresponding LXD container are
+removed.
+
+If --match is specified, it is treated as a regular expression for
+matching container names. Only containers whose names match will
+be removed.
+
+If --dry-run is specified, then no containers will be removed.
+`
+
+func newCleanupLXCCommand() cmd.Command {
+	command := &cleanupLXCCommand{}
+	command.remoteCommand = "cleanup-lxc-impl"
+	return wrap(command)
+}
+
+type cleanupLXCCommand struct {
+	baseClientCommand
+	dryRun bool
+	match  string
+}
+
+func (c *cleanupLXCCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "cleanup-lxc",
+		Args:    "<environment name>",
+		Purpose: "remove the LXC containers retained after migrating to LXD",
+		Doc:     cleanupLXCDoc,
+	}
+}
+
+func (c *cleanupLXCCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	f.BoolVar(&c.dryRun, "dry-run", false, "perform a dry run, without making any changes")
+	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs to remove")
+}
+
+func (c *cleanupLXCCommand) Init(args []string) error {
+	args, err := c.baseClientCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+func (c *cleanupLXCCommand) Run(ctx *cmd.Context) error {
+	if c.match != "" {
+		c.extraOptions = append(c.extraOptions, utils.ShQuote("--match="+c.match))
+	}
+	if c.dryRun {
+		c.extraOptions = append(c.extraOptions, "--dry-run")
+	}
+	return c.baseClientCommand.Run(ctx)
+}
+
+var cleanupLXCImplDoc = `
+
+cleanup-lxc-impl must be executed on an API server machine of a 1.25
+environment.
+
+The command will remove the LXC containers in the environment that
+have been migrated to LXD.
+
+`
+
+func newCleanupLXCImplCommand() cmd.Command {
+	return &cleanupLXCImplCommand{}
+}
+
+type cleanupLXCImplCommand struct {
+	baseRemoteCommand
+	dryRun bool
+	match  string
+}
+
+func (c *cleanupLXCImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "cleanup-lxc-impl",
+		Purpose: "controller aspect of cleanup-lxc",
+		Doc:     cleanupLXCImplDoc,
+	}
+}
+
+func (c *cleanupLXCImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseRemoteCommand.SetFlags(f)
+	f.BoolVar(&c.dryRun, "dry-run", false, "perform a dry run, without making any changes")
+	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs to remove")
+}
+
+func (c *cleanupLXCImplCommand) Run(ctx *cmd.Context) error {
+	match := func(string) bool { return true }
+	if c.match != "" {
+		matchRE, err := regexp.Compile(c.match)
+		if err != nil {
+			return errors.Annotate(err, "parsing --match")
+		}
+		match = matchRE.MatchString
+	}
+
+	st, err := getState()
+	if err != nil {
+		return errors.Annotate(err, "getting state")
+	}
+	defer st.Close()
+
+	lxcByHost, err := getLXCContainersFromState(st)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	containerNames, err := getContainerNames(lxcByHost, st.EnvironUUID())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	hosts := make([]*state.Machine, 0, len(lxcByHost))
+	for host := range lxcByHost {
+		hosts = append(hosts, host)
+	}
+	lxdByHost, err := getLXDContainersFromMachines(hosts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var group errgroup.Group
+	for host, containers := range lxcByHost {
+		lxdContainers := lxdByHost[host]
+		for _, container := range containers {
+			if !match(container.Id()) {
+				ctx.Infof("Skipping non-matching container %q", container.Id())
+				continue
+			}
+			names := containerNames[container]
+			if lxdContainers[names.newName] == nil {
+				// Only remove LXC containers once the LXD
+				// container has been migrated and renamed.
+				ctx.Infof(
+					"Skipping container %q, not migrated to LXD (%q)",
+					container.Id(), names.newName,
+				)
+				continue
+			}
+			ctx.Infof("Removing LXC container %q (%q)", container.Id(), names.oldName)
+			if c.dryRun {
+				continue
+			}
+			host := host // copy for closure
+			group.Go(func() error {
+				return errors.Annotatef(
+					DestroyLXCContainer(names.oldName, host),
+					"removing LXC container %q", names.oldName,
+				)
+			})
+		}
+	}
+	return group.Wait()
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"regexp"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/juju/1.25-upgrade/juju1/state"
+)
+
+var cleanupLXCSnapshotsDoc = `
+The purpose of the cleanup-lxc-snapshots command is to remove the
+host-local snapshots taken by backup-lxc --backup-target=host, once
+the migration to LXD has been accepted.
+
+Only the snapshots of LXC containers that have a corresponding LXD
+container are removed.
+
+If --match is specified, it is treated as a regular expression for
+matching container names. Only snapshots of containers whose names
+match will be removed.
+
+If --dry-run is specified, then no snapshots will be removed.
+`
+
+func newCleanupLXCSnapshotsCommand() cmd.Command {
+	command := &cleanupLXCSnapshotsCommand{}
+	command.remoteCommand = "cleanup-lxc-snapshots-impl"
+	return wrap(command)
+}
+
+type cleanupLXCSnapshotsCommand struct {
+	baseClientCommand
+	dryRun bool
+	match  string
+}
+
+func (c *cleanupLXCSnapshotsCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "cleanup-lxc-snapshots",
+		Args:    "<environment name>",
+		Purpose: "remove the host-local LXC snapshots after migrating to LXD",
+		Doc:     cleanupLXCSnapshotsDoc,
+	}
+}
+
+func (c *cleanupLXCSnapshotsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	f.BoolVar(&c.dryRun, "dry-run", false, "perform a dry run, without making any changes")
+	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs whose snapshots to remove")
+}
+
+func (c *cleanupLXCSnapshotsCommand) Init(args []string) error {
+	args, err := c.baseClientCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+func (c *cleanupLXCSnapshotsCommand) Run(ctx *cmd.Context) error {
+	if c.match != "" {
+		c.extraOptions = append(c.extraOptions, utils.ShQuote("--match="+c.match))
+	}
+	if c.dryRun {
+		c.extraOptions = append(c.extraOptions, "--dry-run")
+	}
+	return c.baseClientCommand.Run(ctx)
+}
+
+var cleanupLXCSnapshotsImplDoc = `
+
+cleanup-lxc-snapshots-impl must be executed on an API server machine
+of a 1.25 environment.
+
+The command will remove the host-local snapshots of the LXC containers
+in the environment that have been migrated to LXD.
+
+`
+
+func newCleanupLXCSnapshotsImplCommand() cmd.Command {
+	return &cleanupLXCSnapshotsImplCommand{}
+}
+
+type cleanupLXCSnapshotsImplCommand struct {
+	baseRemoteCommand
+	dryRun bool
+	match  string
+}
+
+func (c *cleanupLXCSnapshotsImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "cleanup-lxc-snapshots-impl",
+		Purpose: "controller aspect of cleanup-lxc-snapshots",
+		Doc:     cleanupLXCSnapshotsImplDoc,
+	}
+}
+
+func (c *cleanupLXCSnapshotsImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseRemoteCommand.SetFlags(f)
+	f.BoolVar(&c.dryRun, "dry-run", false, "perform a dry run, without making any changes")
+	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs whose snapshots to remove")
+}
+
+func (c *cleanupLXCSnapshotsImplCommand) Run(ctx *cmd.Context) error {
+	match := func(string) bool { return true }
+	if c.match != "" {
+		matchRE, err := regexp.Compile(c.match)
+		if err != nil {
+			return errors.Annotate(err, "parsing --match")
+		}
+		match = matchRE.MatchString
+	}
+
+	st, err := getState()
+	if err != nil {
+		return errors.Annotate(err, "getting state")
+	}
+	defer st.Close()
+
+	lxcByHost, err := getLXCContainersFromState(st)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	containerNames, err := getContainerNames(lxcByHost, st.EnvironUUID())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	hosts := make([]*state.Machine, 0, len(lxcByHost))
+	for host := range lxcByHost {
+		hosts = append(hosts, host)
+	}
+	lxdByHost, err := getLXDContainersFromMachines(hosts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var group errgroup.Group
+	for host, containers := range lxcByHost {
+		lxdContainers := lxdByHost[host]
+		for _, container := range containers {
+			if !match(container.Id()) {
+				ctx.Infof("Skipping non-matching container %q", container.Id())
+				continue
+			}
+			names := containerNames[container]
+			if lxdContainers[names.newName] == nil {
+				ctx.Infof(
+					"Skipping container %q, not migrated to LXD (%q)",
+					container.Id(), names.newName,
+				)
+				continue
+			}
+			ctx.Infof("Removing snapshot of container %q from host %q", container.Id(), host.Id())
+			if c.dryRun {
+				continue
+			}
+			host, container := host, container // copy for closure
+			group.Go(func() error {
+				return errors.Annotatef(
+					RemoveLXCSnapshot(container, host),
+					"removing snapshot of container %q", container.Id(),
+				)
+			})
+		}
+	}
+	return group.Wait()
+}
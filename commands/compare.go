@@ -0,0 +1,683 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	names2 "gopkg.in/juju/names.v2"
+
+	constraints1 "github.com/juju/1.25-upgrade/juju1/constraints"
+	"github.com/juju/1.25-upgrade/juju1/state"
+	"github.com/juju/1.25-upgrade/juju2/api"
+	"github.com/juju/1.25-upgrade/juju2/api/annotations"
+	"github.com/juju/1.25-upgrade/juju2/api/application"
+	"github.com/juju/1.25-upgrade/juju2/api/storage"
+	"github.com/juju/1.25-upgrade/juju2/apiserver/params"
+	"github.com/juju/1.25-upgrade/juju2/constraints"
+	"github.com/juju/1.25-upgrade/juju2/instance"
+)
+
+var compareDoc = `
+
+The compare command checks that the model in the target controller
+matches the 1.25 environment it was imported from. It reads the
+environment's machines, services, units, relations, config,
+constraints, annotations, storage, opened ports, and machine, unit
+agent and workload status from the 1.25 database, and the same
+details of the model over the 2.x API, and prints the differences
+grouped by category. Statuses can change while the agents are being
+upgraded, so they're best compared once the migration has settled.
+
+Differences that the migration is expected to introduce (such as LXC
+containers being renamed for LXD, or services becoming applications)
+are reported as accepted. The command fails if there are any others.
+
+`
+
+func newCompareCommand() cmd.Command {
+	command := &compareCommand{}
+	command.remoteCommand = "compare-impl"
+	command.needsController = true
+	return wrap(command)
+}
+
+type compareCommand struct {
+	baseClientCommand
+}
+
+func (c *compareCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "compare",
+		Args:    "<environment name> <controller name>",
+		Purpose: "compare the environment with the model imported from it",
+		Doc:     compareDoc,
+	}
+}
+
+func (c *compareCommand) Init(args []string) error {
+	args, err := c.baseClientCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+var compareImplDoc = `
+
+compare-impl must be executed on an API server machine of a 1.25
+environment.
+
+The command will compare the environment with the model imported from
+it into the target controller.
+
+`
+
+func newCompareImplCommand() cmd.Command {
+	return &compareImplCommand{
+		baseRemoteCommand{needsController: true},
+	}
+}
+
+type compareImplCommand struct {
+	baseRemoteCommand
+}
+
+func (c *compareImplCommand) Init(args []string) error {
+	args, err := c.baseRemoteCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+func (c *compareImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "compare-impl",
+		Purpose: "controller aspect of compare",
+		Doc:     compareImplDoc,
+	}
+}
+
+func (c *compareImplCommand) Run(ctx *cmd.Context) error {
+	st, err := getState()
+	if err != nil {
+		return errors.Annotate(err, "getting state")
+	}
+	defer st.Close()
+
+	source, err := sourceModelView(st)
+	if err != nil {
+		return errors.Annotate(err, "reading environment")
+	}
+
+	modelUUID := st.EnvironUUID()
+	info := *c.controllerInfo
+	info.ModelTag = names2.NewModelTag(modelUUID)
+	conn, err := api.Open(&info, api.DefaultDialOpts())
+	if err != nil {
+		return errors.Annotate(err, "connecting to target model")
+	}
+	defer conn.Close()
+	target, err := targetModelView(conn)
+	if err != nil {
+		return errors.Annotate(err, "reading target model")
+	}
+
+	accepted, err := acceptedDifferences(modelUUID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Fprintf(ctx.Stdout, "Comparing environment with model %s\n", modelUUID)
+	unexpected := reportDifferences(ctx.Stdout, diffModelViews(source, target), accepted)
+	if unexpected > 0 {
+		plural := "s"
+		if unexpected == 1 {
+			plural = ""
+		}
+		return errors.Errorf("%d unexpected difference%s", unexpected, plural)
+	}
+	fmt.Fprintln(ctx.Stdout, "no unexpected differences")
+	return nil
+}
+
+// Categories of compared attributes, in the order they're reported.
+const (
+	categoryMachines     = "machines"
+	categoryApplications = "applications"
+	categoryConfig       = "config"
+	categoryConstraints  = "constraints"
+	categoryUnits        = "units"
+	categoryStatus       = "status"
+	categoryPorts        = "opened ports"
+	categoryRelations    = "relations"
+	categoryAnnotations  = "annotations"
+	categoryStorage      = "storage"
+)
+
+var compareCategories = []string{
+	categoryMachines,
+	categoryApplications,
+	categoryConfig,
+	categoryConstraints,
+	categoryUnits,
+	categoryStatus,
+	categoryPorts,
+	categoryRelations,
+	categoryAnnotations,
+	categoryStorage,
+}
+
+// modelView is a flattened view of a model, holding a textual value
+// for each compared attribute, keyed by category and then by entity
+// and attribute (for example "machine 0 series").
+type modelView struct {
+	values map[string]map[string]string
+
+	// defaults holds the keys of application config values that
+	// are the charm's defaults. The 1.25 environment only records
+	// config that has been set, so these needn't be in the source.
+	defaults map[string]bool
+}
+
+func newModelView() *modelView {
+	return &modelView{
+		values:   make(map[string]map[string]string),
+		defaults: make(map[string]bool),
+	}
+}
+
+func (v *modelView) set(category, key, value string) {
+	values, ok := v.values[category]
+	if !ok {
+		values = make(map[string]string)
+		v.values[category] = values
+	}
+	values[key] = value
+}
+
+func (v *modelView) setAnnotations(entity string, annotations map[string]string) {
+	for name, value := range annotations {
+		v.set(categoryAnnotations, entity+" "+name, value)
+	}
+}
+
+// sourceModelView reads the view of the 1.25 environment from its
+// database. It's read directly, rather than from the exported model,
+// so that anything the exporter drops or changes shows up as a
+// difference.
+func sourceModelView(st *state.State) (*modelView, error) {
+	view := newModelView()
+	env, err := st.Environment()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cons, err := st.EnvironConstraints()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting environment constraints")
+	}
+	setSourceConstraints(view, "model", cons)
+	if err := setSourceAnnotations(view, st, "model", env); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	machines, err := st.AllMachines()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting machines")
+	}
+	for _, m := range machines {
+		entity := "machine " + m.Id()
+		view.set(categoryMachines, entity+" series", m.Series())
+		instId, err := m.InstanceId()
+		if err == nil {
+			view.set(categoryMachines, entity+" instance-id", string(instId))
+		} else if !errors.IsNotProvisioned(err) {
+			return nil, errors.Annotatef(err, "getting %s instance", entity)
+		}
+		status, err := m.Status()
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting %s status", entity)
+		}
+		view.set(categoryStatus, entity+" agent", string(status.Status))
+		cons, err := m.Constraints()
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, errors.Annotatef(err, "getting %s constraints", entity)
+		}
+		setSourceConstraints(view, entity, cons)
+		if err := setSourceAnnotations(view, st, entity, m); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	services, err := st.AllServices()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting services")
+	}
+	for _, svc := range services {
+		entity := "application " + svc.Name()
+		curl, _ := svc.CharmURL()
+		view.set(categoryApplications, entity+" charm", curl.String())
+		// A 1.25 service's series is always that of its charm.
+		view.set(categoryApplications, entity+" series", curl.Series)
+		view.set(categoryApplications, entity+" exposed", strconv.FormatBool(svc.IsExposed()))
+		settings, err := svc.ConfigSettings()
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting %s config", entity)
+		}
+		for name, value := range settings {
+			if value != nil {
+				view.set(categoryConfig, entity+" "+name, configValueString(value))
+			}
+		}
+		cons, err := svc.Constraints()
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting %s constraints", entity)
+		}
+		setSourceConstraints(view, entity, cons)
+		if err := setSourceAnnotations(view, st, entity, svc); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		units, err := svc.AllUnits()
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting %s units", entity)
+		}
+		for _, unit := range units {
+			if err := setSourceUnit(view, st, unit); err != nil {
+				return nil, errors.Annotatef(err, "reading unit %s", unit.Name())
+			}
+		}
+	}
+
+	relations, err := st.AllRelations()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting relations")
+	}
+	for _, rel := range relations {
+		var endpoints []string
+		for _, ep := range rel.Endpoints() {
+			endpoints = append(endpoints, fmt.Sprintf("%s:%s %s", ep.ServiceName, ep.Name, ep.Role))
+		}
+		sort.Strings(endpoints)
+		view.set(categoryRelations, "relation "+rel.String(), strings.Join(endpoints, ", "))
+	}
+
+	storageInstances, err := st.AllStorageInstances()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting storage")
+	}
+	for _, si := range storageInstances {
+		entity := "storage " + si.StorageTag().Id()
+		view.set(categoryStorage, entity+" kind", si.Kind().String())
+		if owner := si.Owner(); owner != nil {
+			view.set(categoryStorage, entity+" owner", owner.String())
+		}
+		storageAttachments, err := st.StorageAttachments(si.StorageTag())
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting %s attachments", entity)
+		}
+		var attachments []string
+		for _, sa := range storageAttachments {
+			attachments = append(attachments, sa.Unit().String())
+		}
+		sort.Strings(attachments)
+		view.set(categoryStorage, entity+" attachments", strings.Join(attachments, " "))
+	}
+	return view, nil
+}
+
+func setSourceUnit(view *modelView, st *state.State, unit *state.Unit) error {
+	entity := "unit " + unit.Name()
+	if principal, isSubordinate := unit.PrincipalName(); isSubordinate {
+		view.set(categoryUnits, entity+" principal", principal)
+	} else {
+		machineId, err := unit.AssignedMachineId()
+		if err != nil && !errors.IsNotAssigned(err) {
+			return errors.Trace(err)
+		}
+		view.set(categoryUnits, entity+" machine", machineId)
+	}
+	workload, err := unit.Status()
+	if err != nil {
+		return errors.Annotate(err, "getting workload status")
+	}
+	view.set(categoryStatus, entity+" workload", string(workload.Status))
+	agent, err := unit.AgentStatus()
+	if err != nil {
+		return errors.Annotate(err, "getting agent status")
+	}
+	view.set(categoryStatus, entity+" agent", string(agent.Status))
+
+	var ports []string
+	opened, err := unit.OpenedPorts()
+	if err != nil && !errors.IsNotAssigned(errors.Cause(err)) {
+		return errors.Annotate(err, "getting opened ports")
+	}
+	for _, pr := range opened {
+		ports = append(ports, portRangeString(pr.FromPort, pr.ToPort, pr.Protocol))
+	}
+	sort.Strings(ports)
+	view.set(categoryPorts, entity, strings.Join(ports, " "))
+	return errors.Trace(setSourceAnnotations(view, st, entity, unit))
+}
+
+func setSourceAnnotations(view *modelView, st *state.State, entity string, e state.GlobalEntity) error {
+	annotations, err := st.Annotations(e)
+	if err != nil {
+		return errors.Annotatef(err, "getting %s annotations", entity)
+	}
+	view.setAnnotations(entity, annotations)
+	return nil
+}
+
+// setSourceConstraints records the 1.25 constraints as 2.x would
+// format them. Networks constraints aren't supported by 2.x, so
+// they're recorded separately to show up as a difference.
+func setSourceConstraints(view *modelView, entity string, cons constraints1.Value) {
+	var result constraints.Value
+	result.Arch = cons.Arch
+	if cons.Container != nil {
+		container := instance.ContainerType(*cons.Container)
+		result.Container = &container
+	}
+	result.CpuCores = cons.CpuCores
+	result.CpuPower = cons.CpuPower
+	result.Mem = cons.Mem
+	result.RootDisk = cons.RootDisk
+	result.Tags = cons.Tags
+	result.InstanceType = cons.InstanceType
+	result.Spaces = cons.Spaces
+	view.set(categoryConstraints, entity, result.String())
+	if cons.Networks != nil {
+		view.set(categoryConstraints, entity+" networks", strings.Join(*cons.Networks, ","))
+	}
+}
+
+// targetModelView reads the view of the model from the target
+// controller's API.
+func targetModelView(conn api.Connection) (*modelView, error) {
+	modelTag, ok := conn.ModelTag()
+	if !ok {
+		return nil, errors.New("API connection is not to a model")
+	}
+	view := newModelView()
+	client := conn.Client()
+	status, err := client.Status(nil)
+	if err != nil {
+		return nil, errors.Annotate(err, "getting status")
+	}
+	modelCons, err := client.GetModelConstraints()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting model constraints")
+	}
+	view.set(categoryConstraints, "model", modelCons.String())
+
+	// Entities whose annotations are to be read, keyed by tag.
+	annotated := map[string]string{
+		modelTag.String(): "model",
+	}
+
+	var addMachine func(m params.MachineStatus)
+	addMachine = func(m params.MachineStatus) {
+		entity := "machine " + m.Id
+		view.set(categoryMachines, entity+" series", m.Series)
+		if m.InstanceId != "" {
+			view.set(categoryMachines, entity+" instance-id", string(m.InstanceId))
+		}
+		view.set(categoryStatus, entity+" agent", m.AgentStatus.Status)
+		view.set(categoryConstraints, entity, m.Constraints)
+		annotated[names2.NewMachineTag(m.Id).String()] = entity
+		for _, container := range m.Containers {
+			addMachine(container)
+		}
+	}
+	for _, m := range status.Machines {
+		addMachine(m)
+	}
+
+	appClient := application.NewClient(conn)
+	var addUnit func(name, principal string, unit params.UnitStatus)
+	addUnit = func(name, principal string, unit params.UnitStatus) {
+		entity := "unit " + name
+		if principal != "" {
+			view.set(categoryUnits, entity+" principal", principal)
+		} else {
+			view.set(categoryUnits, entity+" machine", unit.Machine)
+		}
+		view.set(categoryStatus, entity+" workload", unit.WorkloadStatus.Status)
+		view.set(categoryStatus, entity+" agent", unit.AgentStatus.Status)
+		ports := append([]string(nil), unit.OpenedPorts...)
+		sort.Strings(ports)
+		view.set(categoryPorts, entity, strings.Join(ports, " "))
+		annotated[names2.NewUnitTag(name).String()] = entity
+		for subName, sub := range unit.Subordinates {
+			addUnit(subName, name, sub)
+		}
+	}
+	for name, app := range status.Applications {
+		entity := "application " + name
+		view.set(categoryApplications, entity+" charm", app.Charm)
+		view.set(categoryApplications, entity+" series", app.Series)
+		view.set(categoryApplications, entity+" exposed", strconv.FormatBool(app.Exposed))
+		annotated[names2.NewApplicationTag(name).String()] = entity
+
+		details, err := appClient.Get(name)
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting application %q", name)
+		}
+		for option, info := range details.Config {
+			info, ok := info.(map[string]interface{})
+			if !ok || info["value"] == nil {
+				continue
+			}
+			key := entity + " " + option
+			view.set(categoryConfig, key, configValueString(info["value"]))
+			if isDefault, _ := info["default"].(bool); isDefault {
+				view.defaults[key] = true
+			}
+		}
+		view.set(categoryConstraints, entity, details.Constraints.String())
+
+		for unitName, unit := range app.Units {
+			addUnit(unitName, "", unit)
+		}
+	}
+
+	for _, rel := range status.Relations {
+		var endpoints []string
+		for _, ep := range rel.Endpoints {
+			endpoints = append(endpoints, fmt.Sprintf("%s:%s %s", ep.ApplicationName, ep.Name, ep.Role))
+		}
+		sort.Strings(endpoints)
+		view.set(categoryRelations, "relation "+rel.Key, strings.Join(endpoints, ", "))
+	}
+
+	tags := make([]string, 0, len(annotated))
+	for tag := range annotated {
+		tags = append(tags, tag)
+	}
+	results, err := annotations.NewClient(conn).Get(tags)
+	if err != nil {
+		return nil, errors.Annotate(err, "getting annotations")
+	}
+	for _, result := range results {
+		if result.Error.Error != nil {
+			return nil, errors.Annotatef(result.Error.Error, "getting annotations for %s", result.EntityTag)
+		}
+		view.setAnnotations(annotated[result.EntityTag], result.Annotations)
+	}
+
+	storageDetails, err := storage.NewClient(conn).ListStorageDetails()
+	if err != nil {
+		return nil, errors.Annotate(err, "listing storage")
+	}
+	for _, details := range storageDetails {
+		tag, err := names2.ParseStorageTag(details.StorageTag)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		entity := "storage " + tag.Id()
+		view.set(categoryStorage, entity+" kind", details.Kind.String())
+		if details.OwnerTag != "" {
+			view.set(categoryStorage, entity+" owner", details.OwnerTag)
+		}
+		var attachments []string
+		for unitTag := range details.Attachments {
+			attachments = append(attachments, unitTag)
+		}
+		sort.Strings(attachments)
+		view.set(categoryStorage, entity+" attachments", strings.Join(attachments, " "))
+	}
+	return view, nil
+}
+
+// portRangeString formats a port range as the 2.x status does.
+func portRangeString(from, to int, protocol string) string {
+	if from == to {
+		return fmt.Sprintf("%d/%s", from, protocol)
+	}
+	return fmt.Sprintf("%d-%d/%s", from, to, protocol)
+}
+
+// configValueString formats a config value so that numbers read from
+// the database and decoded from API responses compare equal.
+func configValueString(value interface{}) string {
+	if f, ok := value.(float64); ok && f == math.Trunc(f) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return fmt.Sprint(value)
+}
+
+// modelDifference is an attribute that differs between the source
+// environment and the target model. An empty source or target means
+// that the attribute only exists on the other side.
+type modelDifference struct {
+	category string
+	key      string
+	source   string
+	target   string
+	inSource bool
+	inTarget bool
+}
+
+// diffModelViews returns the differences between the views, ordered
+// by category and key.
+func diffModelViews(source, target *modelView) []modelDifference {
+	var diffs []modelDifference
+	for _, category := range compareCategories {
+		sourceValues, targetValues := source.values[category], target.values[category]
+		keys := make(map[string]bool)
+		for key := range sourceValues {
+			keys[key] = true
+		}
+		for key := range targetValues {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+
+		for _, key := range sorted {
+			sourceValue, inSource := sourceValues[key]
+			targetValue, inTarget := targetValues[key]
+			if inSource && inTarget && sourceValue == targetValue {
+				continue
+			}
+			if !inSource && target.defaults[key] {
+				continue
+			}
+			diffs = append(diffs, modelDifference{
+				category: category,
+				key:      key,
+				source:   sourceValue,
+				target:   targetValue,
+				inSource: inSource,
+				inTarget: inTarget,
+			})
+		}
+	}
+	return diffs
+}
+
+// acceptedDifference describes a difference that the migration is
+// expected to introduce.
+type acceptedDifference struct {
+	reason  string
+	accepts func(modelDifference) bool
+}
+
+// acceptedDifferences returns the differences expected when migrating
+// the environment with the given UUID.
+func acceptedDifferences(modelUUID string) ([]acceptedDifference, error) {
+	namespace, err := instance.NewNamespace(modelUUID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return []acceptedDifference{{
+		reason: "LXC containers are renamed when migrated to LXD",
+		accepts: func(d modelDifference) bool {
+			if d.category != categoryMachines || !d.inSource || !d.inTarget {
+				return false
+			}
+			id := strings.TrimPrefix(d.key, "machine ")
+			if !strings.HasSuffix(id, " instance-id") {
+				return false
+			}
+			id = strings.TrimSuffix(id, " instance-id")
+			hostname, err := namespace.Hostname(id)
+			return err == nil && strings.Contains(id, "/lxc/") && d.target == hostname
+		},
+	}, {
+		reason: "services are applications in 2.x",
+		accepts: func(d modelDifference) bool {
+			return d.inSource && d.inTarget &&
+				strings.Replace(d.source, "service-", "application-", -1) == d.target
+		},
+	}}, nil
+}
+
+// reportDifferences writes the differences, grouped by category, and
+// returns the number of them that aren't accepted.
+func reportDifferences(w io.Writer, diffs []modelDifference, accepted []acceptedDifference) int {
+	unexpected := 0
+	category := ""
+	for _, d := range diffs {
+		if d.category != category {
+			category = d.category
+			fmt.Fprintf(w, "%s:\n", category)
+		}
+		var text string
+		switch {
+		case !d.inTarget:
+			text = fmt.Sprintf("only in source: %s: %q", d.key, d.source)
+		case !d.inSource:
+			text = fmt.Sprintf("only in target: %s: %q", d.key, d.target)
+		default:
+			text = fmt.Sprintf("%s: %q in source, %q in target", d.key, d.source, d.target)
+		}
+		reason := ""
+		for _, a := range accepted {
+			if a.accepts(d) {
+				reason = a.reason
+				break
+			}
+		}
+		if reason != "" {
+			fmt.Fprintf(w, "  accepted %s (%s)\n", text, reason)
+			continue
+		}
+		fmt.Fprintf(w, "  UNEXPECTED %s\n", text)
+		unexpected++
+	}
+	return unexpected
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type compareSuite struct{}
+
+var _ = gc.Suite(&compareSuite{})
+
+const compareModelUUID = "deadbeef-0bad-400d-8000-4b1d0d06f00d"
+
+func (*compareSuite) TestDiffModelViews(c *gc.C) {
+	source := newModelView()
+	source.set(categoryMachines, "machine 0 series", "trusty")
+	source.set(categoryMachines, "machine 1 series", "trusty")
+	source.set(categoryConfig, "application mysql dataset-size", "80%")
+	source.set(categoryUnits, "unit mysql/1 machine", "1")
+
+	target := newModelView()
+	target.set(categoryMachines, "machine 0 series", "trusty")
+	target.set(categoryMachines, "machine 1 series", "xenial")
+	target.set(categoryConfig, "application mysql dataset-size", "80%")
+	target.set(categoryConfig, "application mysql max-connections", "-1")
+	target.defaults["application mysql max-connections"] = true
+	target.set(categoryStatus, "unit mysql/2 workload", "active")
+
+	c.Assert(diffModelViews(source, target), jc.DeepEquals, []modelDifference{{
+		category: categoryMachines,
+		key:      "machine 1 series",
+		source:   "trusty",
+		target:   "xenial",
+		inSource: true,
+		inTarget: true,
+	}, {
+		category: categoryUnits,
+		key:      "unit mysql/1 machine",
+		source:   "1",
+		inSource: true,
+	}, {
+		category: categoryStatus,
+		key:      "unit mysql/2 workload",
+		target:   "active",
+		inTarget: true,
+	}})
+}
+
+func (*compareSuite) TestReportDifferences(c *gc.C) {
+	accepted, err := acceptedDifferences(compareModelUUID)
+	c.Assert(err, jc.ErrorIsNil)
+	diffs := []modelDifference{{
+		category: categoryMachines,
+		key:      "machine 0/lxc/0 instance-id",
+		source:   "juju-machine-0-lxc-0",
+		target:   "juju-06f00d-0-lxc-0",
+		inSource: true,
+		inTarget: true,
+	}, {
+		category: categoryStorage,
+		key:      "storage data/0 owner",
+		source:   "service-mysql",
+		target:   "application-mysql",
+		inSource: true,
+		inTarget: true,
+	}, {
+		category: categoryStorage,
+		key:      "storage data/1 owner",
+		source:   "unit-mysql-0",
+		inSource: true,
+	}}
+	var buf bytes.Buffer
+	unexpected := reportDifferences(&buf, diffs, accepted)
+	c.Check(unexpected, gc.Equals, 1)
+	c.Check(buf.String(), gc.Equals, `machines:
+  accepted machine 0/lxc/0 instance-id: "juju-machine-0-lxc-0" in source, "juju-06f00d-0-lxc-0" in target (LXC containers are renamed when migrated to LXD)
+storage:
+  accepted storage data/0 owner: "service-mysql" in source, "application-mysql" in target (services are applications in 2.x)
+  UNEXPECTED only in source: storage data/1 owner: "unit-mysql-0"
+`)
+}
+
+func (*compareSuite) TestConfigValueString(c *gc.C) {
+	c.Check(configValueString(int64(1000000)), gc.Equals, "1000000")
+	c.Check(configValueString(float64(1000000)), gc.Equals, "1000000")
+	c.Check(configValueString(0.5), gc.Equals, "0.5")
+	c.Check(configValueString(true), gc.Equals, "true")
+	c.Check(configValueString("80%"), gc.Equals, "80%")
+}
@@ -0,0 +1,172 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	lxdshared "github.com/lxc/lxd/shared"
+)
+
+// containerInterface describes the static addressing of one of a
+// container's network interfaces. LXC configures these addresses
+// itself, but LXD leaves them to the container.
+type containerInterface struct {
+	Name        string   `json:"name"`
+	IPv4        []string `json:"ipv4,omitempty"`
+	IPv4Gateway string   `json:"ipv4-gateway,omitempty"`
+	IPv6        []string `json:"ipv6,omitempty"`
+	IPv6Gateway string   `json:"ipv6-gateway,omitempty"`
+}
+
+// staticInterfacesKey is the LXD container config key recording the
+// interfaces that LXC configured with static addresses, as JSON, so
+// that they can be added to the model as statically configured.
+const staticInterfacesKey = "user.juju-lxc-static-interfaces"
+
+// containerStaticInterfaces returns the static interfaces recorded in
+// the LXD container config, keyed by name.
+func containerStaticInterfaces(config map[string]string) (map[string]containerInterface, error) {
+	value := config[staticInterfacesKey]
+	if value == "" {
+		return nil, nil
+	}
+	var interfaces []containerInterface
+	if err := json.Unmarshal([]byte(value), &interfaces); err != nil {
+		return nil, errors.Annotatef(err, "parsing %s", staticInterfacesKey)
+	}
+	result := make(map[string]containerInterface)
+	for _, iface := range interfaces {
+		result[iface.Name] = iface
+	}
+	return result, nil
+}
+
+// containerInterfacesFile is the path, relative to the container's
+// root filesystem, of the ifupdown config written for interfaces that
+// LXC used to configure.
+const containerInterfacesFile = "etc/network/interfaces.d/60-lxc-to-lxd.cfg"
+
+// ifupdownStanzas returns ifupdown configuration for the interfaces.
+// The first address of each family is the interface's address; any
+// others are added once the interface is up.
+func ifupdownStanzas(interfaces []containerInterface) string {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "# Static addresses configured by LXC before the")
+	fmt.Fprintln(&buf, "# container was migrated to LXD.")
+	for _, iface := range interfaces {
+		fmt.Fprintf(&buf, "\nauto %s\n", iface.Name)
+		writeIfupdownFamily(&buf, iface.Name, "inet", iface.IPv4, iface.IPv4Gateway)
+		writeIfupdownFamily(&buf, iface.Name, "inet6", iface.IPv6, iface.IPv6Gateway)
+	}
+	return buf.String()
+}
+
+func writeIfupdownFamily(buf *bytes.Buffer, name, family string, addresses []string, gateway string) {
+	if len(addresses) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "iface %s %s static\n", name, family)
+	fmt.Fprintf(buf, "    address %s\n", addresses[0])
+	if gateway != "" {
+		fmt.Fprintf(buf, "    gateway %s\n", gateway)
+	}
+	ipCmd := "ip"
+	if family == "inet6" {
+		ipCmd = "ip -6"
+	}
+	for _, address := range addresses[1:] {
+		fmt.Fprintf(buf, "    post-up %s addr add %s dev %s\n", ipCmd, address, name)
+		fmt.Fprintf(buf, "    pre-down %s addr del %s dev %s\n", ipCmd, address, name)
+	}
+}
+
+// configuredInterfaces returns the names of the interfaces that have
+// an iface stanza in the given ifupdown config.
+func configuredInterfaces(config string) []string {
+	var names []string
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "iface" {
+			names = append(names, fields[1])
+		}
+	}
+	return names
+}
+
+// writeContainerInterfaces writes ifupdown configuration for those of
+// the interfaces that the container's own configuration doesn't
+// already configure, into the root filesystem at rootfs.
+func writeContainerInterfaces(rootfs string, interfaces []containerInterface) error {
+	mainFile := filepath.Join(rootfs, "etc/network/interfaces")
+	main, err := ioutil.ReadFile(mainFile)
+	if os.IsNotExist(err) {
+		logger.Warningf("container has no /etc/network/interfaces, not configuring static addresses")
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	existing := configuredInterfaces(string(main))
+	includes, err := filepath.Glob(filepath.Join(rootfs, "etc/network/interfaces.d/*.cfg"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, include := range includes {
+		data, err := ioutil.ReadFile(include)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		existing = append(existing, configuredInterfaces(string(data))...)
+	}
+
+	var unconfigured []containerInterface
+	for _, iface := range interfaces {
+		if lxdshared.StringInSlice(iface.Name, existing) {
+			logger.Infof("interface %s is already configured in the container", iface.Name)
+			continue
+		}
+		unconfigured = append(unconfigured, iface)
+	}
+	if len(unconfigured) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(rootfs, containerInterfacesFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(ifupdownStanzas(unconfigured)), 0644); err != nil {
+		return errors.Trace(err)
+	}
+	if !hasInterfacesSource(string(main)) {
+		main = append(main, "\nsource /etc/network/interfaces.d/*.cfg\n"...)
+		if err := ioutil.WriteFile(mainFile, main, 0644); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// hasInterfacesSource reports whether the ifupdown config sources the
+// .cfg files in /etc/network/interfaces.d.
+func hasInterfacesSource(config string) bool {
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "source" &&
+			(fields[1] == "/etc/network/interfaces.d/*.cfg" || fields[1] == "interfaces.d/*.cfg") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/utils/set"
+
+	"github.com/juju/1.25-upgrade/juju1/environs/configstore"
+)
+
+var environmentInfoImplDoc = `
+
+environment-info-impl must be executed on a state server machine of a
+1.25 environment.
+
+The command connects to the environment's database with the credentials
+in the machine agent's config, and prints the environment's name, UUID,
+CA certificate and API addresses as JSON. It lets the other commands be
+used without the environment's .jenv file.
+
+`
+
+func newEnvironmentInfoImplCommand() cmd.Command {
+	return &environmentInfoImplCommand{}
+}
+
+type environmentInfoImplCommand struct {
+	baseRemoteCommand
+}
+
+func (c *environmentInfoImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "environment-info-impl",
+		Purpose: "describe the environment from a state server's agent config",
+		Doc:     environmentInfoImplDoc,
+	}
+}
+
+// environmentInfo is what environment-info-impl discovers about the
+// environment.
+type environmentInfo struct {
+	Name         string   `json:"name"`
+	UUID         string   `json:"uuid"`
+	CACert       string   `json:"ca-cert"`
+	APIAddresses []string `json:"api-addresses"`
+}
+
+func (c *environmentInfoImplCommand) Run(ctx *cmd.Context) error {
+	// Opening state checks the mongo credentials in the agent config,
+	// and gives the addresses of all the state servers.
+	st, err := getState()
+	if err != nil {
+		return errors.Annotate(err, "getting state")
+	}
+	defer st.Close()
+
+	tag, err := getCurrentMachineTag(dataDir)
+	if err != nil {
+		return errors.Annotate(err, "finding machine tag")
+	}
+	config, err := getConfig(tag)
+	if err != nil {
+		// The agent config is rewritten by upgrade-agents.
+		config, err = getSavedConfig(tag)
+		if err != nil {
+			return errors.Annotate(err, "loading agent config")
+		}
+	}
+	envConfig, err := st.EnvironConfig()
+	if err != nil {
+		return errors.Annotate(err, "getting environment config")
+	}
+	hostPorts, err := st.APIHostPorts()
+	if err != nil {
+		return errors.Annotate(err, "getting API addresses")
+	}
+
+	info := environmentInfo{
+		Name:   envConfig.Name(),
+		UUID:   st.EnvironUUID(),
+		CACert: config.CACert(),
+	}
+	for _, server := range hostPorts {
+		for _, hp := range server {
+			info.APIAddresses = append(info.APIAddresses, hp.NetAddr())
+		}
+	}
+	return errors.Trace(json.NewEncoder(ctx.Stdout).Encode(info))
+}
+
+// discoverEnvironment finds out about the environment from the state
+// server given with --state-server, checking that it's the environment
+// named on the command line. The addresses of all of the state servers
+// are then tried for the remote command, and if --write-jenv was given
+// the information is saved for later commands.
+func (c *baseClientCommand) discoverEnvironment(ctx *cmd.Context) error {
+	var stdout, stderr bytes.Buffer
+	command := fmt.Sprintf("./%s environment-info-impl", filepath.Base(c.plugin))
+	rc, err := runViaSSH(c.address, command, c.sshOptions(withStdout(&stdout), withStderr(&stderr))...)
+	if err != nil {
+		return errors.Annotate(err, "getting environment information")
+	}
+	if rc != 0 {
+		return errors.Errorf("getting environment information: %s", strings.TrimSpace(stderr.String()))
+	}
+	var info environmentInfo
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		return errors.Annotate(err, "reading environment information")
+	}
+	if info.Name != c.name {
+		return errors.Errorf("%s is a state server of environment %q, not %q", c.address, info.Name, c.name)
+	}
+	ctx.Infof("environment %q (%s) found on %s", info.Name, info.UUID, c.address)
+
+	hosts := set.NewStrings(c.addresses...)
+	for _, addr := range info.APIAddresses {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return errors.Annotatef(err, "parsing API address %q", addr)
+		}
+		if !hosts.Contains(host) {
+			hosts.Add(host)
+			c.addresses = append(c.addresses, host)
+		}
+	}
+
+	if c.writeJenv {
+		if err := writeEnvironInfo(info); err != nil {
+			return errors.Annotate(err, "writing environment information")
+		}
+		ctx.Infof("wrote environment information for %q", info.Name)
+	}
+	return nil
+}
+
+// writeEnvironInfo writes a configstore entry for the environment
+// holding just its API endpoint, which is all that the other commands
+// need. It's not enough for the juju 1.25 client to connect with.
+func writeEnvironInfo(info environmentInfo) error {
+	store, err := configstore.Default()
+	if err != nil {
+		return errors.Annotate(err, "cannot get default config store")
+	}
+	if existing, err := store.ReadInfo(info.Name); err == nil && existing.Initialized() {
+		return errors.Errorf("environment %q already has information in %s", info.Name, existing.Location())
+	} else if err != nil && !errors.IsNotFound(err) {
+		return errors.Trace(err)
+	}
+	envInfo := store.CreateInfo(info.Name)
+	envInfo.SetAPIEndpoint(configstore.APIEndpoint{
+		Addresses:   info.APIAddresses,
+		CACert:      info.CACert,
+		EnvironUUID: info.UUID,
+	})
+	return errors.Trace(envInfo.Write())
+}
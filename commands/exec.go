@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
@@ -15,13 +18,28 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-const systemIdentity = "/var/lib/juju/system-identity"
+const (
+	systemIdentity = "/var/lib/juju/system-identity"
+
+	// defaultSSHUser is the user that Juju 1.25 provisions machines
+	// with, and the one used to SSH to them unless told otherwise.
+	defaultSSHUser = "ubuntu"
+)
 
 type execOptions struct {
 	ssh.Options
+	user   string
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
+
+	// proxyHost, if non-empty, is the address of the host machine
+	// that connections are proxied through.
+	proxyHost string
+
+	// pinClientHostKey is set for connections from the client, whose
+	// host keys are checked against the client's known_hosts file.
+	pinClientHostKey bool
 }
 
 type execOption func(*execOptions)
@@ -30,6 +48,12 @@ func withSystemIdentity() execOption {
 	return withIdentity(systemIdentity)
 }
 
+func withUser(user string) execOption {
+	return func(opts *execOptions) {
+		opts.user = user
+	}
+}
+
 func withIdentity(identity string) execOption {
 	return func(opts *execOptions) {
 		opts.SetIdentities(identity)
@@ -57,14 +81,33 @@ func withStderr(w io.Writer) execOption {
 // withProxyCommandForHost returns an option decorator for setting
 // an SSH proxy command to proxy through the given host.
 func withProxyCommandForHost(hostAddr string) execOption {
-	return withProxyCommand(
-		"ssh", "-q",
-		"-i", systemIdentity,
+	hostKeyOptions := []string{
 		"-o", "StrictHostKeyChecking no",
 		"-o UserKnownHostsFile /dev/null",
-		"ubuntu@"+hostAddr,
-		"nc %h %p",
-	)
+	}
+	if knownHosts := pinnedKnownHosts(hostAddr); knownHosts != "" {
+		hostKeyOptions = []string{
+			"-o", "StrictHostKeyChecking yes",
+			"-o UserKnownHostsFile " + knownHosts,
+		}
+	}
+	command := []string{"ssh", "-q", "-i", systemIdentity}
+	command = append(command, hostKeyOptions...)
+	command = append(command, defaultSSHUser+"@"+hostAddr, "nc %h %p")
+	proxy := withProxyCommand(command...)
+	return func(opts *execOptions) {
+		proxy(opts)
+		opts.proxyHost = hostAddr
+	}
+}
+
+// withClientHostKey returns an option decorator that checks the
+// host key of a machine that the client connects to against the one
+// recorded on the client.
+func withClientHostKey() execOption {
+	return func(opts *execOptions) {
+		opts.pinClientHostKey = true
+	}
 }
 
 func withProxyCommand(cmd ...string) execOption {
@@ -76,23 +119,64 @@ func withProxyCommand(cmd ...string) execOption {
 func defaultSSHOptions() ssh.Options {
 	var options ssh.Options
 	// Strict host key checking must be disabled because Juju 1.25 did not
-	// populate SSH host keys.
+	// populate SSH host keys. Once we've recorded a machine's host keys,
+	// newExecOptions enables checking against them.
 	options.SetStrictHostKeyChecking(ssh.StrictHostChecksNo)
 	options.SetKnownHostsFile(os.DevNull)
 	return options
 }
 
-// runViaSSH runs script in the remote machine with address addr.
-func runViaSSH(addr, script string, opts ...execOption) (int, error) {
-	// This is taken from cmd/juju/ssh.go there is no other clear way to set user
-	userAddr := "ubuntu@" + addr
-
-	options := execOptions{Options: defaultSSHOptions()}
-	options.stdout = os.Stdout
-	options.stderr = os.Stderr
+// newExecOptions returns the options for SSH connections to the
+// machine with address addr. If host keys have been recorded for
+// the machine, the connection will only be made if the machine
+// presents one of them.
+func newExecOptions(addr string, opts ...execOption) execOptions {
+	options := execOptions{
+		Options: defaultSSHOptions(),
+		user:    defaultSSHUser,
+		stdout:  os.Stdout,
+		stderr:  os.Stderr,
+	}
+	if knownHosts := pinnedKnownHosts(addr); knownHosts != "" {
+		options.SetKnownHostsFile(knownHosts)
+		options.SetStrictHostKeyChecking(ssh.StrictHostChecksYes)
+	}
 	for _, opt := range opts {
 		opt(&options)
 	}
+	if options.pinClientHostKey {
+		knownHosts, strict := clientHostKeyOptions(addr)
+		options.SetKnownHostsFile(knownHosts)
+		options.SetStrictHostKeyChecking(strict)
+	}
+	return options
+}
+
+// remoteExecutor runs scripts on, and copies files to, the machines
+// of an environment.
+type remoteExecutor interface {
+	// Run runs script as root on the machine with address addr, and
+	// returns its exit code. An error is only returned if the script
+	// couldn't be run at all.
+	Run(addr, script string, options execOptions) (int, error)
+
+	// Copy copies files to the directory dest on the machine with
+	// address addr. The args may include scp flags as well as file
+	// names.
+	Copy(addr string, args []string, dest string, options execOptions) error
+}
+
+// remoteExec is the executor used by runViaSSH and copyViaSSH. Tests
+// replace it with a simulated fleet of machines.
+var remoteExec remoteExecutor = sshExecutor{}
+
+// sshExecutor is a remoteExecutor that uses ssh and scp.
+type sshExecutor struct{}
+
+// Run is part of the remoteExecutor interface.
+func (sshExecutor) Run(addr, script string, options execOptions) (int, error) {
+	// This is taken from cmd/juju/ssh.go there is no other clear way to set user
+	userAddr := options.user + "@" + addr
 
 	userCmd := ssh.Command(
 		userAddr,
@@ -114,6 +198,59 @@ func runViaSSH(addr, script string, opts ...execOption) (int, error) {
 	return 0, nil
 }
 
+// Copy is part of the remoteExecutor interface.
+func (sshExecutor) Copy(addr string, args []string, dest string, options execOptions) error {
+	allArgs := make([]string, len(args), len(args)+1)
+	copy(allArgs, args)
+	allArgs = append(allArgs, fmt.Sprintf("%s@%s:%s", options.user, addr, dest))
+	return errors.Trace(ssh.Copy(allArgs, &options.Options))
+}
+
+// runViaSSH runs script in the remote machine with address addr.
+func runViaSSH(addr, script string, opts ...execOption) (int, error) {
+	return remoteExec.Run(addr, script, newExecOptions(addr, opts...))
+}
+
+// copyViaSSH copies files to the directory dest on the remote machine
+// with address addr. The args are passed to scp ahead of the
+// destination, so they may include scp flags as well as file names.
+func copyViaSSH(addr string, args []string, dest string, opts ...execOption) error {
+	return remoteExec.Copy(addr, args, dest, newExecOptions(addr, opts...))
+}
+
+// sshProbeTimeout is how long we wait for a TCP connection to an
+// SSH server before deciding that the address is unreachable.
+const sshProbeTimeout = 10 * time.Second
+
+// selectSSHAddress returns the first of the given addresses that
+// accepts an SSH session. When there is no proxy command, addresses
+// whose SSH port can't be reached directly are skipped without
+// invoking ssh, so that unroutable addresses fail fast.
+func selectSSHAddress(addrs []string, proxied bool, opts ...execOption) (string, error) {
+	opts = append(opts, withStdout(ioutil.Discard), withStderr(ioutil.Discard))
+	for _, addr := range addrs {
+		if !proxied {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, "22"), sshProbeTimeout)
+			if err != nil {
+				logger.Debugf("cannot reach %s: %v", addr, err)
+				continue
+			}
+			conn.Close()
+		}
+		rc, err := runViaSSH(addr, "true", opts...)
+		if err != nil {
+			logger.Debugf("cannot SSH to %s: %v", addr, err)
+			continue
+		}
+		if rc != 0 {
+			logger.Debugf("cannot SSH to %s: exited with %d", addr, rc)
+			continue
+		}
+		return addr, nil
+	}
+	return "", errors.Errorf("none of the addresses %q are reachable via SSH", addrs)
+}
+
 type FlatMachine struct {
 	Model      string
 	Series     string
@@ -126,6 +263,10 @@ type FlatMachine struct {
 	// host machine that contains this machine. If this
 	// is set, it implies the machine is a container.
 	HostAddress string
+
+	// StateServer is true if the machine manages the 1.25
+	// environment.
+	StateServer bool
 }
 
 func flatMachineExecTargets(machines ...FlatMachine) []execTarget {
@@ -4,21 +4,79 @@
 package commands
 
 import (
+	"bytes"
 	"net"
+	"sort"
+	"strconv"
+	"time"
 
+	"github.com/juju/cmd"
 	"github.com/juju/description"
 	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/lxc/lxd/shared/api"
 
 	"github.com/juju/1.25-upgrade/juju1/state"
 	"github.com/juju/1.25-upgrade/juju2/apiserver/common/networkingcommon"
+	"github.com/juju/1.25-upgrade/juju2/apiserver/params"
 	"github.com/juju/1.25-upgrade/juju2/cloud"
 	"github.com/juju/1.25-upgrade/juju2/environs"
 	"github.com/juju/1.25-upgrade/juju2/environs/config"
 	"github.com/juju/1.25-upgrade/juju2/instance"
+	"github.com/juju/1.25-upgrade/juju2/network"
 )
 
-func exportModel(st *state.State, targetCloud string) (description.Model, error) {
-	model, err := st.Export(targetCloud)
+// exportFlags holds the options limiting how much of the environment's
+// status history is exported, which can otherwise make the model too
+// big to import.
+type exportFlags struct {
+	skipStatusHistory bool
+	maxStatusHistory  int
+	statusHistoryAge  time.Duration
+}
+
+func (f *exportFlags) setFlags(fs *gnuflag.FlagSet) {
+	fs.BoolVar(&f.skipStatusHistory, "skip-status-history", false, "don't export any status history")
+	fs.IntVar(&f.maxStatusHistory, "max-status-history", 0, "export at most this many of the latest status history entries for each entity (0 for no limit)")
+	fs.DurationVar(&f.statusHistoryAge, "max-status-history-age", 0, "don't export status history older than this, for example 720h (0 for no limit)")
+}
+
+// options returns the flags for passing the options on to the remote
+// command.
+func (f *exportFlags) options() []string {
+	var options []string
+	if f.skipStatusHistory {
+		options = append(options, "--skip-status-history")
+	}
+	if f.maxStatusHistory != 0 {
+		options = append(options, "--max-status-history="+strconv.Itoa(f.maxStatusHistory))
+	}
+	if f.statusHistoryAge != 0 {
+		options = append(options, "--max-status-history-age="+f.statusHistoryAge.String())
+	}
+	return options
+}
+
+func (f *exportFlags) validate() error {
+	if f.maxStatusHistory < 0 {
+		return errors.New("--max-status-history must not be negative")
+	}
+	if f.statusHistoryAge < 0 {
+		return errors.New("--max-status-history-age must not be negative")
+	}
+	return nil
+}
+
+func (f *exportFlags) config() state.ExportConfig {
+	return state.ExportConfig{
+		SkipStatusHistory:   f.skipStatusHistory,
+		MaxStatusHistory:    f.maxStatusHistory,
+		MaxStatusHistoryAge: f.statusHistoryAge,
+	}
+}
+
+func exportModel(st *state.State, targetCloud string, cfg state.ExportConfig) (description.Model, error) {
+	model, err := st.ExportPartial(targetCloud, cfg)
 	if err != nil {
 		return nil, errors.Annotate(err, "exporting model representation")
 	}
@@ -34,6 +92,23 @@ func exportModel(st *state.State, targetCloud string) (description.Model, error)
 			return nil, errors.Annotate(err, "adding MAAS network entities")
 		}
 	}
+
+	// Juju 1.25 doesn't know about the network devices of LXC
+	// containers, and migrating them to LXD may have changed
+	// them anyway. Add those of any migrated LXD containers.
+	if err := addContainerNetworkEntities(model, st); err != nil {
+		return nil, errors.Annotate(err, "adding container network entities")
+	}
+
+	// Juju 1.25 doesn't record SSH host keys, so we add the ones
+	// collected from the machines themselves.
+	machines, err := getMachines(st)
+	if err != nil {
+		return nil, errors.Annotate(err, "getting machines")
+	}
+	if err := addSSHHostKeys(model, machines); err != nil {
+		return nil, errors.Annotate(err, "adding SSH host keys")
+	}
 	return model, nil
 }
 
@@ -84,38 +159,308 @@ func addMAASNetworkEntities(model description.Model, st *state.State) error {
 		}
 
 		networkConfig := networkingcommon.NetworkConfigFromInterfaceInfo(interfaces)
-		devicesArgs, devicesAddrs := networkingcommon.NetworkConfigsToStateArgs(networkConfig)
-		for _, d := range devicesArgs {
-			model.AddLinkLayerDevice(description.LinkLayerDeviceArgs{
-				Name:        d.Name,
-				MTU:         d.MTU,
-				ProviderID:  string(d.ProviderID),
-				MachineID:   machine.Id(),
-				Type:        string(d.Type),
-				MACAddress:  d.MACAddress,
-				IsAutoStart: d.IsAutoStart,
-				IsUp:        d.IsUp,
-				ParentName:  d.ParentName,
-			})
-		}
-		for _, d := range devicesAddrs {
-			ip, ipNet, err := net.ParseCIDR(d.CIDRAddress)
+		if err := addNetworkConfig(model, machine.Id(), networkConfig); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// addNetworkConfig adds the link-layer devices and IP addresses
+// described by the network config to the model description, for the
+// machine with the given ID.
+func addNetworkConfig(model description.Model, machineId string, networkConfig []params.NetworkConfig) error {
+	devicesArgs, devicesAddrs := networkingcommon.NetworkConfigsToStateArgs(networkConfig)
+	for _, d := range devicesArgs {
+		model.AddLinkLayerDevice(description.LinkLayerDeviceArgs{
+			Name:        d.Name,
+			MTU:         d.MTU,
+			ProviderID:  string(d.ProviderID),
+			MachineID:   machineId,
+			Type:        string(d.Type),
+			MACAddress:  d.MACAddress,
+			IsAutoStart: d.IsAutoStart,
+			IsUp:        d.IsUp,
+			ParentName:  d.ParentName,
+		})
+	}
+	for _, d := range devicesAddrs {
+		ip, ipNet, err := net.ParseCIDR(d.CIDRAddress)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		model.AddIPAddress(description.IPAddressArgs{
+			ProviderID:       string(d.ProviderID),
+			DeviceName:       d.DeviceName,
+			MachineID:        machineId,
+			SubnetCIDR:       ipNet.String(),
+			ConfigMethod:     string(d.ConfigMethod),
+			Value:            ip.String(),
+			DNSServers:       d.DNSServers,
+			DNSSearchDomains: d.DNSSearchDomains,
+			GatewayAddress:   d.GatewayAddress,
+		})
+	}
+	return nil
+}
+
+// addContainerNetworkEntities adds link-layer devices and IP addresses
+// to the model description for each LXC container that has been
+// migrated to LXD, based on the LXD container's devices and state.
+// Hosts whose LXD containers can't be listed are skipped, as the
+// containers may not have been migrated yet; Juju 2.x will discover
+// the devices when the machine agents start.
+func addContainerNetworkEntities(model description.Model, st *state.State) error {
+	lxcByHost, err := getLXCContainersFromState(st)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(lxcByHost) == 0 {
+		return nil
+	}
+	names, err := getContainerNames(lxcByHost, st.EnvironUUID())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for host, containers := range lxcByHost {
+		lxdContainers, err := ListLXDContainers(host)
+		if err != nil {
+			logger.Warningf(
+				"not adding network entities for containers on host %q: %v",
+				host.Id(), err,
+			)
+			continue
+		}
+		for _, container := range containers {
+			lxdContainer, ok := lxdContainers[names[container].newName]
+			if !ok {
+				lxdContainer, ok = lxdContainers[names[container].oldName]
+			}
+			if !ok {
+				continue
+			}
+			networkConfig, err := lxdContainerNetworkConfig(lxdContainer)
 			if err != nil {
+				return errors.Annotatef(err, "getting network config for machine %q", container.Id())
+			}
+			if err := addNetworkConfig(model, container.Id(), networkConfig); err != nil {
 				return errors.Trace(err)
 			}
-			model.AddIPAddress(description.IPAddressArgs{
-				ProviderID:       string(d.ProviderID),
-				DeviceName:       d.DeviceName,
-				MachineID:        machine.Id(),
-				SubnetCIDR:       ipNet.String(),
-				ConfigMethod:     string(d.ConfigMethod),
-				Value:            ip.String(),
-				DNSServers:       d.DNSServers,
-				DNSSearchDomains: d.DNSSearchDomains,
-				GatewayAddress:   d.GatewayAddress,
-			})
 		}
 	}
-
 	return nil
 }
+
+// lxdContainerNetworkConfig returns the network config of the LXD
+// container's nic devices, with the addresses they have if the
+// container is running. Juju 1.25 didn't record how the addresses were
+// configured, so they're reported as dynamic, except for those of the
+// interfaces that LXC configured statically, as recorded when the
+// container was migrated. Those are reported with their recorded
+// addresses if the container isn't running.
+func lxdContainerNetworkConfig(container *lxdContainer) ([]params.NetworkConfig, error) {
+	staticInterfaces, err := containerStaticInterfaces(container.Config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var deviceNames []string
+	for name, device := range container.ExpandedDevices {
+		if device["type"] == "nic" {
+			deviceNames = append(deviceNames, name)
+		}
+	}
+	sort.Strings(deviceNames)
+
+	var result []params.NetworkConfig
+	for i, deviceName := range deviceNames {
+		device := container.ExpandedDevices[deviceName]
+		config := params.NetworkConfig{
+			DeviceIndex:   i,
+			InterfaceName: device["name"],
+			InterfaceType: string(network.EthernetInterface),
+			MACAddress:    device["hwaddr"],
+			ConfigType:    string(network.ConfigDHCP),
+		}
+		if config.InterfaceName == "" {
+			config.InterfaceName = deviceName
+		}
+		if config.MACAddress == "" {
+			config.MACAddress = container.Config["volatile."+deviceName+".hwaddr"]
+		}
+		if mtu := device["mtu"]; mtu != "" {
+			var err error
+			if config.MTU, err = strconv.Atoi(mtu); err != nil {
+				return nil, errors.Annotatef(err, "parsing MTU of device %q", deviceName)
+			}
+		}
+		if vlan := device["vlan"]; vlan != "" {
+			var err error
+			if config.VLANTag, err = strconv.Atoi(vlan); err != nil {
+				return nil, errors.Annotatef(err, "parsing VLAN of device %q", deviceName)
+			}
+		}
+		staticInterface, isStatic := staticInterfaces[config.InterfaceName]
+		if isStatic {
+			config.ConfigType = string(network.ConfigStatic)
+		}
+
+		var netState *api.ContainerStateNetwork
+		if container.State != nil {
+			if s, ok := container.State.Network[config.InterfaceName]; ok {
+				netState = &s
+			}
+		}
+		if netState == nil {
+			if isStatic {
+				addrConfigs, err := staticAddressConfigs(config, staticInterface)
+				if err != nil {
+					return nil, errors.Annotatef(err, "device %q", deviceName)
+				}
+				result = append(result, addrConfigs...)
+			} else {
+				result = append(result, config)
+			}
+			continue
+		}
+		if netState.Hwaddr != "" {
+			config.MACAddress = netState.Hwaddr
+		}
+		if netState.Mtu > 0 {
+			config.MTU = netState.Mtu
+		}
+		config.Disabled = netState.State != "up"
+
+		var haveAddress bool
+		for _, addr := range netState.Addresses {
+			if addr.Scope != "global" {
+				continue
+			}
+			_, ipNet, err := net.ParseCIDR(addr.Address + "/" + addr.Netmask)
+			if err != nil {
+				return nil, errors.Annotatef(err, "parsing address of device %q", deviceName)
+			}
+			addrConfig := config
+			addrConfig.Address = addr.Address
+			addrConfig.CIDR = ipNet.String()
+			if isStatic {
+				addrConfig.GatewayAddress = staticInterface.IPv4Gateway
+				if addr.Family == "inet6" {
+					addrConfig.GatewayAddress = staticInterface.IPv6Gateway
+				}
+			}
+			result = append(result, addrConfig)
+			haveAddress = true
+		}
+		if !haveAddress {
+			result = append(result, config)
+		}
+	}
+	return result, nil
+}
+
+// staticAddressConfigs returns a copy of the network config for each
+// of the addresses recorded for the static interface.
+func staticAddressConfigs(config params.NetworkConfig, iface containerInterface) ([]params.NetworkConfig, error) {
+	var result []params.NetworkConfig
+	add := func(addresses []string, gateway string) error {
+		for _, address := range addresses {
+			ip, ipNet, err := net.ParseCIDR(address)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			addrConfig := config
+			addrConfig.Address = ip.String()
+			addrConfig.CIDR = ipNet.String()
+			addrConfig.GatewayAddress = gateway
+			result = append(result, addrConfig)
+		}
+		return nil
+	}
+	if err := add(iface.IPv4, iface.IPv4Gateway); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := add(iface.IPv6, iface.IPv6Gateway); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(result) == 0 {
+		result = append(result, config)
+	}
+	return result, nil
+}
+
+// reportModelSize reports the size of the serialized model, and of
+// each of its parts, so that it can be trimmed if it's too big to
+// import. The parts' sizes are taken from the serialized model rather
+// than serializing them again.
+func reportModelSize(ctx *cmd.Context, model description.Model, data []byte) {
+	history := 0
+	var countMachine func(description.Machine)
+	countMachine = func(m description.Machine) {
+		history += len(m.StatusHistory())
+		for _, container := range m.Containers() {
+			countMachine(container)
+		}
+	}
+	for _, m := range model.Machines() {
+		countMachine(m)
+	}
+	for _, a := range model.Applications() {
+		history += len(a.StatusHistory())
+		for _, u := range a.Units() {
+			history += len(u.WorkloadStatusHistory()) + len(u.AgentStatusHistory())
+		}
+	}
+	for _, v := range model.Volumes() {
+		history += len(v.StatusHistory())
+	}
+	for _, f := range model.Filesystems() {
+		history += len(f.StatusHistory())
+	}
+	ctx.Infof("model description is %dKiB, with %d status history entries", len(data)>>10, history)
+
+	sizes := topLevelSizes(data)
+	for _, part := range []string{
+		"machines",
+		"applications",
+		"relations",
+		"spaces",
+		"subnets",
+		"ip-addresses",
+		"link-layer-devices",
+		"ssh-host-keys",
+		"volumes",
+		"filesystems",
+		"storages",
+		"storage-pools",
+		"cloud-image-metadata",
+		"actions",
+	} {
+		ctx.Infof("  %-20s %dKiB", part, sizes[part]>>10)
+	}
+}
+
+// topLevelSizes returns the number of bytes taken by each top-level
+// key of a YAML mapping, as serialized by goyaml. Only the top-level
+// keys start at the beginning of a line: nested values are indented,
+// and the items of top-level sequences start with "- ".
+func topLevelSizes(data []byte) map[string]int {
+	sizes := make(map[string]int)
+	key := ""
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+		switch line[0] {
+		case ' ', '-', '\n', '#':
+		default:
+			if i := bytes.IndexByte(line, ':'); i > 0 {
+				key = string(line[:i])
+			}
+		}
+		sizes[key] += len(line)
+	}
+	return sizes
+}
@@ -0,0 +1,34 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type exportSuite struct{}
+
+var _ = gc.Suite(&exportSuite{})
+
+func (*exportSuite) TestTopLevelSizes(c *gc.C) {
+	data := []byte(`applications:
+- name: mysql
+  series: trusty
+machines:
+- id: "0"
+  containers: []
+  status:
+    message: |
+      started
+      ready: yes
+version: 1
+`)
+	c.Check(topLevelSizes(data), jc.DeepEquals, map[string]int{
+		"applications": 45,
+		// The indented lines of the block scalar belong to machines.
+		"machines": 93,
+		"version":  11,
+	})
+}
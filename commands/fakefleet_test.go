@@ -0,0 +1,543 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/version"
+	gc "gopkg.in/check.v1"
+)
+
+// fakeFleet is a remoteExecutor that simulates a 1.25 environment's
+// machines, each backed by a temporary directory laid out like the
+// parts of a machine's filesystem that the agent commands touch. It
+// recognises the scripts that the commands run, and carries out
+// their effects on the directory.
+type fakeFleet struct {
+	mu       sync.Mutex
+	machines map[string]*fakeMachine
+
+	// apiAddresses are the controller addresses that the machines
+	// are expected to check they can reach.
+	apiAddresses []string
+}
+
+func newFakeFleet() *fakeFleet {
+	return &fakeFleet{machines: make(map[string]*fakeMachine)}
+}
+
+const (
+	fakeAgentsDir  = "var/lib/juju/agents"
+	fakeToolsDir   = "var/lib/juju/tools"
+	fakeRollback   = "var/lib/juju/1.25-upgrade-rollback"
+	fakeUpgradeDir = "home/ubuntu/1.25-agent-upgrade"
+	fakeRsyslog    = "etc/rsyslog.d/25-juju.conf"
+	fakePlugin     = "juju-1.25-upgrade"
+)
+
+// fakeMachine is a simulated machine running the given agents.
+type fakeMachine struct {
+	FlatMachine
+	root    string
+	agents  []string
+	running map[string]bool
+
+	// unreachable makes SSH connections to the machine, and to
+	// any containers proxied through it, fail.
+	unreachable bool
+
+	// failUpgrade makes the agent upgrade script fail after it has
+	// installed the new tools, but before it rewrites the agent
+	// config files.
+	failUpgrade bool
+
+	// failCommand, if set, makes the init system commands that the
+	// agent upgrade script runs fail if they start with it.
+	failCommand string
+
+	// failConnectionCheck makes the agents fail to connect to the
+	// controller.
+	failConnectionCheck bool
+
+	// midHookUnit, if set, is a unit agent whose uniter was stopped
+	// part-way through a hook.
+	midHookUnit string
+
+	// controllerUnreachable makes connections from the machine to
+	// the controller fail.
+	controllerUnreachable bool
+}
+
+// addMachine adds a machine to the fleet with the given agents, all
+// running the machine's tools.
+func (f *fakeFleet) addMachine(c *gc.C, m FlatMachine, agents ...string) *fakeMachine {
+	fm := &fakeMachine{
+		FlatMachine: m,
+		root:        c.MkDir(),
+		agents:      agents,
+		running:     make(map[string]bool),
+	}
+	fm.mkdir(c, fakeToolsDir, m.Tools)
+	fm.writeFile(c, "1.25 jujud", fakeToolsDir, m.Tools, "jujud")
+	fm.mkdir(c, "home/ubuntu")
+	fm.writeFile(c, "1.25 log forwarding", fakeRsyslog)
+	for _, agent := range agents {
+		fm.writeFile(c, fakeAgentConf(agent, m.Tools), fakeAgentsDir, agent, "agent.conf")
+		if strings.HasPrefix(agent, "unit-") {
+			fm.writeFile(c, fakeUniterState, fakeAgentsDir, agent, "state", "uniter")
+		}
+		c.Assert(os.Symlink(m.Tools, fm.path(fakeToolsDir, agent)), jc.ErrorIsNil)
+		c.Assert(os.MkdirAll(filepath.Dir(fm.serviceDefinition(agent)), 0755), jc.ErrorIsNil)
+		c.Assert(ioutil.WriteFile(fm.serviceDefinition(agent), nil, 0644), jc.ErrorIsNil)
+		fm.running[agent] = true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.machines[m.Address] = fm
+	return fm
+}
+
+// fakeAgentConf returns the config of a 1.25 agent running the given
+// tools, with the attributes that the agent upgrade script changes.
+func fakeAgentConf(agent, tools string) string {
+	binary := version.MustParseBinary(tools)
+	return fmt.Sprintf(`tag: %s
+environment: environment-%s
+upgradedToVersion: %s
+cacert: 1.25 CA certificate
+stateaddresses:
+- 10.0.0.10:37017
+statepassword: sekrit
+apiaddresses:
+- 10.0.0.10:17070
+`, agent, fakeEnvironUUID, binary.Number)
+}
+
+const fakeEnvironUUID = "deadbeef-0bad-400d-8000-4b1d0d06f00d"
+
+func (m *fakeMachine) path(elem ...string) string {
+	return filepath.Join(append([]string{m.root}, elem...)...)
+}
+
+func (m *fakeMachine) mkdir(c *gc.C, elem ...string) {
+	c.Assert(os.MkdirAll(m.path(elem...), 0755), jc.ErrorIsNil)
+}
+
+func (m *fakeMachine) writeFile(c *gc.C, content string, elem ...string) {
+	m.mkdir(c, elem[:len(elem)-1]...)
+	c.Assert(ioutil.WriteFile(m.path(elem...), []byte(content), 0644), jc.ErrorIsNil)
+}
+
+// serviceDefinition returns the path of the agent's upstart job on
+// trusty, or of its systemd unit on later series.
+func (m *fakeMachine) serviceDefinition(agent string) string {
+	if m.Series == "trusty" {
+		return m.path("etc/init", "jujud-"+agent+".conf")
+	}
+	return filepath.Join(m.serviceDir(agent), "jujud-"+agent+".service")
+}
+
+// addJujuDB gives the machine a juju-db systemd unit, linked from
+// /var/lib/juju/init as juju links it, and returns the unit file.
+func (m *fakeMachine) addJujuDB(c *gc.C) string {
+	m.writeFile(c, "1.25 juju-db", "var/lib/juju/init/juju-db/juju-db.service")
+	m.mkdir(c, "etc/systemd/system")
+	unit, err := filepath.EvalSymlinks(m.path("var/lib/juju/init/juju-db/juju-db.service"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(os.Symlink(unit, m.path("etc/systemd/system/juju-db.service")), jc.ErrorIsNil)
+	return unit
+}
+
+// serviceDir returns the directory that juju keeps an agent's systemd
+// unit files in.
+func (m *fakeMachine) serviceDir(agent string) string {
+	return m.path("var/lib/juju/init", "jujud-"+agent)
+}
+
+// toolsLink returns the tools version that the agent's tools symlink
+// points at.
+func (m *fakeMachine) toolsLink(agent string) (string, error) {
+	target, err := os.Readlink(m.path(fakeToolsDir, agent))
+	return filepath.Base(target), err
+}
+
+// agentConf returns the content of the agent's config file.
+func (m *fakeMachine) agentConf(agent string) (string, error) {
+	data, err := ioutil.ReadFile(m.path(fakeAgentsDir, agent, "agent.conf"))
+	return string(data), err
+}
+
+// reach returns the machine with the given address, or an error
+// describing why SSH wouldn't be able to connect to it with the
+// given options. Containers can only be reached by proxying
+// through their host.
+func (f *fakeFleet) reach(addr string, options execOptions) (*fakeMachine, error) {
+	m, ok := f.machines[addr]
+	if !ok {
+		return nil, errors.Errorf("ssh: connect to host %s port 22: No route to host", addr)
+	}
+	if m.HostAddress != "" {
+		if options.proxyHost != m.HostAddress {
+			return nil, errors.Errorf("ssh: connect to host %s port 22: Network is unreachable", addr)
+		}
+		if host, ok := f.machines[m.HostAddress]; !ok || host.unreachable {
+			return nil, errors.New("ssh_exchange_identification: Connection closed by remote host")
+		}
+	}
+	if m.unreachable {
+		return nil, errors.Errorf("ssh: connect to host %s port 22: Connection timed out", addr)
+	}
+	return m, nil
+}
+
+// Run is part of the remoteExecutor interface.
+func (f *fakeFleet) Run(addr, script string, options execOptions) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, err := f.reach(addr, options)
+	if err != nil {
+		// ssh exits with 255 when it can't connect.
+		fmt.Fprintln(options.stderr, err)
+		return 255, nil
+	}
+	if reachability, err := controllerReachabilityScript(f.apiAddresses); err == nil && script == reachability {
+		return m.checkControllerReachable(f.apiAddresses, options.stdout)
+	}
+	switch script {
+	case "true":
+		return 0, nil
+	case collectHostKeysScript:
+		fmt.Fprintf(options.stdout, "ssh-rsa AAAAB3NzaC1yc2E%s root@machine-%s\n",
+			strings.Replace(m.ID, "/", "x", -1), m.ID)
+		return 0, nil
+	case agentServiceScript("start"):
+		return m.service("start", options.stdout, options.stderr)
+	case agentServiceScript("stop"):
+		return m.service("stop", options.stdout, options.stderr)
+	case agentServiceScript("status"):
+		return m.service("status", options.stdout, options.stderr)
+	case prepareUpgradeDirScript:
+		if err := os.RemoveAll(m.path(fakeUpgradeDir)); err != nil {
+			return -1, errors.Trace(err)
+		}
+		return 0, errors.Trace(os.Mkdir(m.path(fakeUpgradeDir), 0755))
+	case checkUniterStateScript(fakePlugin):
+		return m.checkUniterState(false, options.stdout, options.stderr)
+	case convertUniterStateScript(fakePlugin):
+		return m.checkUniterState(true, options.stdout, options.stderr)
+	case agentServicesScript(fakePlugin):
+		return m.updateServices(options.stdout, options.stderr)
+	case checkAgentServicesScript(fakePlugin):
+		return m.checkServices(options.stdout)
+	case runAgentUpgradeScript:
+		return m.runScript("main", options.stdout, options.stderr)
+	case rollbackAgentUpgradeScript:
+		return m.runScript("rollback", options.stdout, options.stderr)
+	case probeRollbackInfoScript:
+		if _, err := os.Stat(m.path(fakeRollback)); err != nil {
+			return 1, nil
+		}
+		return 0, nil
+	case connectionCheckScript:
+		return m.checkConnections(options.stdout)
+	}
+	return -1, errors.Errorf("fake fleet: unexpected script %q", script)
+}
+
+// Copy is part of the remoteExecutor interface.
+func (f *fakeFleet) Copy(addr string, args []string, dest string, options execOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, err := f.reach(addr, options)
+	if err != nil {
+		return errors.Annotate(err, "lost connection")
+	}
+	if dest != "~/1.25-agent-upgrade/" {
+		return errors.Errorf("fake fleet: unexpected destination %q", dest)
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		target := m.path(fakeUpgradeDir, filepath.Base(arg))
+		if err := ioutil.WriteFile(target, data, 0644); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// service simulates agentServiceScript, producing output like that
+// of upstart on trusty and systemd on later series.
+func (m *fakeMachine) service(command string, stdout, stderr io.Writer) (int, error) {
+	agents := append([]string(nil), m.agents...)
+	sort.Strings(agents)
+	for _, agent := range agents {
+		target, err := m.toolsLink(agent)
+		if err != nil {
+			return -1, errors.Trace(err)
+		}
+		if _, err := os.Stat(m.serviceDefinition(agent)); err != nil {
+			fmt.Fprintf(stderr, "jujud-%s: unrecognized service\n", agent)
+			return 1, nil
+		}
+		fmt.Fprintln(stdout, agent)
+		fmt.Fprintf(stdout, "lrwxrwxrwx 1 root root 42 Oct 19 10:00 /var/lib/juju/tools/%s -> /var/lib/juju/tools/%s\n", agent, target)
+		switch command {
+		case "start":
+			m.running[agent] = true
+		case "stop":
+			m.running[agent] = false
+		}
+		if m.Series == "trusty" {
+			if m.running[agent] {
+				fmt.Fprintf(stdout, "jujud-%s start/running, process 1234\n", agent)
+			} else {
+				fmt.Fprintf(stdout, "jujud-%s stop/waiting\n", agent)
+			}
+		} else if command == "status" {
+			fmt.Fprintf(stdout, "● jujud-%s.service - juju agent for %s\n", agent, agent)
+			if m.running[agent] {
+				fmt.Fprintln(stdout, "   Active: active (running) since Mon 2017-10-16 10:00:00 UTC")
+			} else {
+				fmt.Fprintln(stdout, "   Active: inactive (dead)")
+			}
+		}
+		fmt.Fprintln(stdout, "-- end-of-agent --")
+	}
+	return 0, nil
+}
+
+// fakeUniterState is the content of the 1.25 units' operation state.
+const fakeUniterState = "1.25 operation state"
+
+// uniterState returns the content of the unit's operation state.
+func (m *fakeMachine) uniterState(agent string) (string, error) {
+	data, err := ioutil.ReadFile(m.path(fakeAgentsDir, agent, "state", "uniter"))
+	return string(data), err
+}
+
+// checkUniterState simulates check-uniter-state-impl, which needs the
+// plugin to have been pushed to the machine. Unless it's only
+// checking, it converts each unit's operation state, keeping the
+// original where the agent upgrade script restores it from.
+func (m *fakeMachine) checkUniterState(convert bool, stdout, stderr io.Writer) (int, error) {
+	if _, err := os.Stat(m.path(fakeUpgradeDir, fakePlugin)); err != nil {
+		fmt.Fprintf(stderr, "bash: ~/1.25-agent-upgrade/%s: No such file or directory\n", fakePlugin)
+		return 127, nil
+	}
+	if m.midHookUnit != "" {
+		fmt.Fprintf(stdout, "%s: cannot upgrade: \"config-changed\" hook is running or has failed; resolve the unit before upgrading\n", m.midHookUnit)
+		fmt.Fprintf(stderr, "ERROR uniter state not upgradable for %s\n", strings.TrimPrefix(m.midHookUnit, "unit-"))
+		return 1, nil
+	}
+	for _, agent := range m.agents {
+		if !strings.HasPrefix(agent, "unit-") {
+			continue
+		}
+		if !convert {
+			fmt.Fprintf(stdout, "%s: uniter state can be upgraded\n", agent)
+			continue
+		}
+		state := m.path(fakeAgentsDir, agent, "state", "uniter")
+		backup := m.path("var/lib/juju", uniterStateBackupDir, agent, "state", "uniter")
+		if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+			return -1, errors.Trace(err)
+		}
+		if err := exec.Command("cp", "-a", state, backup).Run(); err != nil {
+			return -1, errors.Annotatef(err, "backing up %s", state)
+		}
+		if err := ioutil.WriteFile(state, []byte("2.x operation state"), 0644); err != nil {
+			return -1, errors.Trace(err)
+		}
+		fmt.Fprintf(stdout, "%s: converted operation state (installed: true)\n", agent)
+	}
+	return 0, nil
+}
+
+// fakeServiceDefinition is the content of the service definitions
+// written by the simulated agent-services-impl; those of 1.25 agents
+// are empty.
+const fakeServiceDefinition = "2.x definition"
+
+// updateServices simulates agent-services-impl, which replaces the
+// agents' service definitions, recording the 1.25 ones with the agent
+// upgrade's rollback information.
+func (m *fakeMachine) updateServices(stdout, stderr io.Writer) (int, error) {
+	if _, err := os.Stat(m.path(fakeUpgradeDir, fakePlugin)); err != nil {
+		fmt.Fprintf(stderr, "bash: ~/1.25-agent-upgrade/%s: No such file or directory\n", fakePlugin)
+		return 127, nil
+	}
+	dataDir := m.path("var/lib/juju")
+	changes, err := readLegacyChanges(dataDir)
+	if err != nil {
+		return -1, errors.Trace(err)
+	}
+	for _, agent := range m.agents {
+		change := legacyChange{
+			Action:  "replaced-service",
+			Init:    "upstart",
+			Service: "jujud-" + agent,
+			Path:    m.serviceDefinition(agent),
+			Backup:  filepath.Join(dataDir, legacyDir, strconv.Itoa(len(changes))),
+		}
+		if m.Series != "trusty" {
+			change.Init = "systemd"
+			change.Path = m.serviceDir(agent)
+		}
+		if err := exec.Command("cp", "-a", change.Path, change.Backup).Run(); err != nil {
+			return -1, errors.Annotatef(err, "backing up %s", change.Path)
+		}
+		changes = append(changes, change)
+		if err := writeLegacyChanges(dataDir, changes); err != nil {
+			return -1, errors.Trace(err)
+		}
+		if err := ioutil.WriteFile(m.serviceDefinition(agent), []byte(fakeServiceDefinition), 0644); err != nil {
+			return -1, errors.Trace(err)
+		}
+		fmt.Fprintf(stdout, "jujud-%s: installed 2.x definition\n", agent)
+	}
+	return 0, nil
+}
+
+// checkServices simulates checkAgentServicesScript, which reports
+// nothing if the plugin hasn't been pushed to the machine.
+func (m *fakeMachine) checkServices(stdout io.Writer) (int, error) {
+	if _, err := os.Stat(m.path(fakeUpgradeDir, fakePlugin)); err != nil {
+		return 0, nil
+	}
+	for _, agent := range m.agents {
+		data, err := ioutil.ReadFile(m.serviceDefinition(agent))
+		if err != nil {
+			return -1, errors.Trace(err)
+		}
+		state := definitionDiffers
+		if string(data) == fakeServiceDefinition {
+			state = definitionMatches
+		}
+		fmt.Fprintf(stdout, "jujud-%s: %s\n", agent, state)
+	}
+	fmt.Fprintf(stdout, "/usr/bin/juju-run: %s\n", definitionMatches)
+	return 0, nil
+}
+
+// checkControllerReachable simulates controllerReachabilityScript.
+func (m *fakeMachine) checkControllerReachable(addresses []string, stdout io.Writer) (int, error) {
+	state := "reachable"
+	if m.controllerUnreachable {
+		state = "unreachable"
+	}
+	for _, addr := range addresses {
+		fmt.Fprintf(stdout, "controller address %s %s\n", addr, state)
+	}
+	if m.controllerUnreachable {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// agentUpgradeHarness runs the agent upgrade script pushed to a
+// fake machine against the machine's directory. It's passed the
+// script, the machine's root, the function to call, "fail" if the
+// upgrade should fail after the new tools are installed, and the
+// prefix of the init system commands that should fail. Init system
+// commands are recorded in commands.log rather than run.
+const agentUpgradeHarness = `
+import shutil
+import subprocess
+import sys
+
+script, root, command, fail, failing = sys.argv[1:]
+with open(script) as f:
+    source = f.read()
+source = source.replace("\nROOT = '/'\n", "\nROOT = %r\n" % root, 1)
+
+def record(args, **kwargs):
+    with open(root + '/commands.log', 'a') as log:
+        log.write(' '.join(args) + '\n')
+    if failing and ' '.join(args).startswith(failing):
+        raise subprocess.CalledProcessError(1, args)
+    return 0
+
+subprocess.call = subprocess.check_call = record
+shutil.chown = lambda *args, **kwargs: None
+
+namespace = {'__name__': 'agent_upgrade', '__file__': script}
+exec(compile(source, script, 'exec'), namespace)
+if fail == 'fail':
+    def update_configs():
+        import yaml
+        yaml.safe_load('a: b: c')
+    namespace['update_configs'] = update_configs
+namespace[command]()
+`
+
+// runScript runs the given function of the agent upgrade script
+// that has been pushed to the machine.
+func (m *fakeMachine) runScript(command string, stdout, stderr io.Writer) (int, error) {
+	script := m.path(fakeUpgradeDir, "agent-upgrade.py")
+	if _, err := os.Stat(script); err != nil {
+		fmt.Fprintf(stderr, "python3: can't open file '%s': [Errno 2] No such file or directory\n", script)
+		return 2, nil
+	}
+	fail := ""
+	if m.failUpgrade && command == "main" {
+		fail = "fail"
+	}
+	cmd := exec.Command("python3", "-c", agentUpgradeHarness, script, m.root, command, fail, m.failCommand)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.Sys().(syscall.WaitStatus).ExitStatus(), nil
+	}
+	return 0, errors.Trace(err)
+}
+
+// commandsLog returns the init system commands that the agent upgrade
+// script has run on the machine.
+func (m *fakeMachine) commandsLog() (string, error) {
+	data, err := ioutil.ReadFile(m.path("commands.log"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// checkConnections simulates connectionCheckScript. Agents still
+// running 1.25 tools fail, as the check-connection command only
+// exists in 2.x.
+func (m *fakeMachine) checkConnections(stdout io.Writer) (int, error) {
+	failures := 0
+	for _, agent := range m.agents {
+		target, err := m.toolsLink(agent)
+		if err != nil {
+			return -1, errors.Trace(err)
+		}
+		if m.failConnectionCheck || strings.HasPrefix(target, "1.") {
+			fmt.Fprintf(stdout, "connection check failed for %s\n", agent)
+			failures = 1
+		} else {
+			fmt.Fprintf(stdout, "connection check succeeded for %s\n", agent)
+		}
+	}
+	return failures, nil
+}
@@ -0,0 +1,349 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils/set"
+	names2 "gopkg.in/juju/names.v2"
+
+	"github.com/juju/1.25-upgrade/juju1/state"
+	"github.com/juju/1.25-upgrade/juju2/api"
+	"github.com/juju/1.25-upgrade/juju2/apiserver/params"
+)
+
+var finalizeDoc = `
+
+The finalize command decommissions the 1.25 state servers once the new
+model has been activated and verify-target-model has succeeded.
+
+On each state server it stops and removes juju-db and its data, the old
+API server certificate and shared secret, the 1.25 tools and the
+information kept for rolling back the agent upgrade. The state server
+that the upgrade is run from is cleaned up last, and the upgrade's own
+state is removed from it, along with the client's record of it. After
+this the upgrade cannot be aborted.
+
+By default the state servers are left in the new model as plain workload
+machines. If --remove-unused-machines is specified, those that host no
+units or containers in the new model are removed from it.
+
+`
+
+func newFinalizeCommand() cmd.Command {
+	command := &finalizeCommand{}
+	command.remoteCommand = "finalize-impl"
+	command.needsController = true
+	return wrap(command)
+}
+
+type finalizeCommand struct {
+	baseClientCommand
+	removeUnusedMachines bool
+}
+
+func (c *finalizeCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "finalize",
+		Args:    "<environment name> <controller name>",
+		Purpose: "decommission the 1.25 state servers after the model is verified",
+		Doc:     finalizeDoc,
+	}
+}
+
+func (c *finalizeCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	f.BoolVar(&c.removeUnusedMachines, "remove-unused-machines", false, "remove state servers hosting no units or containers from the new model")
+}
+
+func (c *finalizeCommand) Init(args []string) error {
+	args, err := c.baseClientCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+func (c *finalizeCommand) Run(ctx *cmd.Context) error {
+	if c.removeUnusedMachines {
+		c.extraOptions = append(c.extraOptions, "--remove-unused-machines")
+	}
+	if err := c.baseClientCommand.Run(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	// The migration is over, so later commands needn't keep to its
+	// state server.
+	return errors.Annotate(removeExecutionHost(c.name), "removing migration state server record")
+}
+
+var finalizeImplDoc = `
+
+finalize-impl must be executed on an API server machine of a 1.25
+environment, after the model has been activated and verified.
+
+The command will remove the remains of the 1.25 state servers from them.
+
+`
+
+func newFinalizeImplCommand() cmd.Command {
+	return &finalizeImplCommand{
+		baseRemoteCommand: baseRemoteCommand{needsController: true},
+	}
+}
+
+type finalizeImplCommand struct {
+	baseRemoteCommand
+	removeUnusedMachines bool
+}
+
+func (c *finalizeImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseRemoteCommand.SetFlags(f)
+	f.BoolVar(&c.removeUnusedMachines, "remove-unused-machines", false, "remove state servers hosting no units or containers from the new model")
+}
+
+func (c *finalizeImplCommand) Init(args []string) error {
+	args, err := c.baseRemoteCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+func (c *finalizeImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "finalize-impl",
+		Purpose: "controller aspect of finalize",
+		Doc:     finalizeImplDoc,
+	}
+}
+
+func (c *finalizeImplCommand) Run(ctx *cmd.Context) error {
+	if err := checkVerified(); err != nil {
+		return errors.Trace(err)
+	}
+
+	// The state servers have to be read from the 1.25 database
+	// before juju-db is removed.
+	stateServers, err := getStateServers()
+	if err != nil {
+		return errors.Annotate(err, "getting state servers")
+	}
+
+	var unused []string
+	if c.removeUnusedMachines {
+		// Work out which machines can be removed before anything
+		// is changed, so that a failure leaves them all intact.
+		unused, err = c.unusedStateServers(stateServers)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Clean up the other state servers first, so that the machine
+	// we're running on keeps the upgrade state until the end.
+	local, err := getCurrentMachineTag(dataDir)
+	if err != nil {
+		return errors.Annotate(err, "finding machine tag")
+	}
+	var others, last []FlatMachine
+	for _, m := range stateServers {
+		if m.ID == local.Id() {
+			last = append(last, m)
+		} else {
+			others = append(others, m)
+		}
+	}
+	if len(others) > 0 {
+		results, err := parallelExec(flatMachineExecTargets(others...), finalizeStateServerScript)
+		if err != nil {
+			return errors.Annotate(err, "cleaning up state servers")
+		}
+		if err := reportResults(ctx, "state server cleanup", others, results); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(last) > 0 {
+		results, err := parallelExec(flatMachineExecTargets(last...), finalizeStateServerScript)
+		if err != nil {
+			return errors.Annotate(err, "cleaning up state server")
+		}
+		if err := reportResults(ctx, "state server cleanup", last, results); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if len(unused) > 0 {
+		if err := c.removeMachines(ctx, unused); err != nil {
+			return errors.Trace(err)
+		}
+	} else if c.removeUnusedMachines {
+		fmt.Fprintln(ctx.Stdout, "no unused state servers to remove")
+	}
+
+	// Everything the upgrade needed is gone now, so its own state
+	// goes too.
+	if err := os.RemoveAll(toolsDir); err != nil {
+		return errors.Annotate(err, "removing upgrade state")
+	}
+	fmt.Fprintln(ctx.Stdout, "finalized")
+	return nil
+}
+
+// checkVerified returns an error unless the model has been activated,
+// and verify-target-model has succeeded since then.
+func checkVerified() error {
+	activatedAt, err := loadPhaseTime(activatedAtFile)
+	if errors.IsNotFound(err) {
+		return errors.New("the model has not been activated")
+	} else if err != nil {
+		return errors.Annotate(err, "loading activation time")
+	}
+	verifiedAt, err := loadPhaseTime(verifiedAtFile)
+	if errors.IsNotFound(err) {
+		return errors.New("the model has not been verified, run verify-target-model first")
+	} else if err != nil {
+		return errors.Annotate(err, "loading verification time")
+	}
+	if verifiedAt.Before(activatedAt) {
+		return errors.Errorf(
+			"the model was last verified at %s, before it was activated at %s; run verify-target-model again",
+			verifiedAt.Format(time.RFC3339), activatedAt.Format(time.RFC3339),
+		)
+	}
+	return nil
+}
+
+// getStateServers returns the machines of the 1.25 environment that
+// manage it.
+func getStateServers() ([]FlatMachine, error) {
+	st, err := getState()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting state")
+	}
+	defer st.Close()
+	machines, err := st.AllMachines()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting 1.25 machines")
+	}
+	var result []FlatMachine
+	for _, m := range machines {
+		if !isStateServer(m.Jobs()) {
+			continue
+		}
+		fm, err := makeFlatMachine(st, m)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		result = append(result, fm)
+	}
+	return result, nil
+}
+
+func isStateServer(jobs []state.MachineJob) bool {
+	for _, job := range jobs {
+		if job == state.JobManageEnviron {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *finalizeImplCommand) modelConnection() (api.Connection, error) {
+	modelUUID, err := getModelUUID()
+	if err != nil {
+		return nil, errors.Annotate(err, "getting model UUID")
+	}
+	info := *c.controllerInfo
+	info.ModelTag = names2.NewModelTag(modelUUID)
+	conn, err := api.Open(&info, api.DefaultDialOpts())
+	return conn, errors.Annotate(err, "connecting to model")
+}
+
+func (c *finalizeImplCommand) unusedStateServers(stateServers []FlatMachine) ([]string, error) {
+	conn, err := c.modelConnection()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer conn.Close()
+	fullStatus, err := conn.Client().Status(nil)
+	if err != nil {
+		return nil, errors.Annotate(err, "getting model status")
+	}
+	ids := make([]string, len(stateServers))
+	for i, m := range stateServers {
+		ids[i] = m.ID
+	}
+	return unusedMachines(fullStatus, ids), nil
+}
+
+// unusedMachines returns those of the given top-level machines that
+// host no units or containers in the model with the given status.
+func unusedMachines(fullStatus *params.FullStatus, ids []string) []string {
+	used := set.NewStrings()
+	for _, app := range fullStatus.Applications {
+		for _, unit := range app.Units {
+			used.Add(unit.Machine)
+		}
+	}
+	var result []string
+	for _, id := range ids {
+		m, ok := fullStatus.Machines[id]
+		if !ok || used.Contains(id) || len(m.Containers) > 0 {
+			continue
+		}
+		result = append(result, id)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (c *finalizeImplCommand) removeMachines(ctx *cmd.Context, ids []string) error {
+	conn, err := c.modelConnection()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+	if err := conn.Client().DestroyMachines(ids...); err != nil {
+		return errors.Annotatef(err, "removing machines %s", strings.Join(ids, ", "))
+	}
+	fmt.Fprintf(ctx.Stdout, "removing unused machines from the model: %s\n", strings.Join(ids, ", "))
+	return nil
+}
+
+// finalizeStateServerScript removes juju-db and its data, the 1.25
+// state server secrets and tools, and the agent upgrade and uniter
+// state rollback information from a state server. The 2.x agents' tools are only
+// referenced through symlinks, so any 1.x tools directory can go.
+const finalizeStateServerScript = `
+set -xu
+for conf in /etc/init/juju-db*.conf; do
+    [ -e "$conf" ] || continue
+    service=$(basename "$conf" .conf)
+    stop "$service" || true
+    rm -f "$conf" /etc/init/"$service".override
+done
+for unit in /etc/systemd/system/juju-db*.service /lib/systemd/system/juju-db*.service; do
+    [ -e "$unit" ] || continue
+    service=$(basename "$unit")
+    systemctl stop "$service" || true
+    systemctl disable "$service" || true
+    rm -f "$unit"
+done
+rm -rf /var/lib/juju/init/juju-db*
+if [ -d /run/systemd/system ]; then
+    systemctl daemon-reload
+fi
+set -e
+rm -rf /var/lib/juju/db /var/lib/juju/server.pem /var/lib/juju/shared-secret
+find /var/lib/juju/tools -mindepth 1 -maxdepth 1 -type d -name '1.*' -exec rm -rf {} +
+rm -rf /var/lib/juju/1.25-upgrade-rollback /var/lib/juju/1.25-upgrade-uniter-state
+`
@@ -0,0 +1,54 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"time"
+
+	gitjujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/1.25-upgrade/juju2/apiserver/params"
+)
+
+type finalizeSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&finalizeSuite{})
+
+func (s *finalizeSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.PatchValue(&toolsDir, c.MkDir())
+}
+
+func (s *finalizeSuite) TestCheckVerified(c *gc.C) {
+	c.Check(checkVerified(), gc.ErrorMatches, "the model has not been activated")
+
+	activatedAt := time.Date(2017, 10, 16, 10, 0, 0, 0, time.UTC)
+	c.Assert(recordPhaseTime(activatedAtFile, activatedAt), jc.ErrorIsNil)
+	c.Check(checkVerified(), gc.ErrorMatches, "the model has not been verified, run verify-target-model first")
+
+	c.Assert(recordPhaseTime(verifiedAtFile, activatedAt.Add(-time.Minute)), jc.ErrorIsNil)
+	c.Check(checkVerified(), gc.ErrorMatches, "the model was last verified at 2017-10-16T09:59:00Z, before it was activated at 2017-10-16T10:00:00Z; run verify-target-model again")
+
+	c.Assert(recordPhaseTime(verifiedAtFile, activatedAt.Add(time.Minute)), jc.ErrorIsNil)
+	c.Check(checkVerified(), jc.ErrorIsNil)
+}
+
+func (s *finalizeSuite) TestUnusedMachines(c *gc.C) {
+	fullStatus := &params.FullStatus{
+		Machines: map[string]params.MachineStatus{
+			"0": {Id: "0"},
+			"1": {Id: "1", Containers: map[string]params.MachineStatus{"1/lxd/0": {Id: "1/lxd/0"}}},
+			"2": {Id: "2"},
+			"3": {Id: "3"},
+		},
+		Applications: map[string]params.ApplicationStatus{
+			"mysql": {Units: map[string]params.UnitStatus{"mysql/0": {Machine: "2"}}},
+		},
+	}
+	c.Check(unusedMachines(fullStatus, []string{"3", "2", "1", "0", "4"}), jc.DeepEquals, []string{"0", "3"})
+}
@@ -0,0 +1,421 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/juju/cmd"
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/utils/arch"
+	"github.com/juju/version"
+	gc "gopkg.in/check.v1"
+	goyaml "gopkg.in/yaml.v2"
+
+	"github.com/juju/1.25-upgrade/juju2/api"
+)
+
+// fleetSuite runs the agent commands against a fakeFleet of three
+// machines: a trusty controller, a xenial machine, and an LXC
+// container on the xenial machine that is only reachable through it.
+// The real agent upgrade script is run against the machines, so the
+// suite needs python3 with the yaml module.
+type fleetSuite struct {
+	gitjujutesting.IsolationSuite
+	fleet      *fakeFleet
+	machines   []FlatMachine
+	fake       map[string]*fakeMachine
+	scriptPath string
+}
+
+var _ = gc.Suite(&fleetSuite{})
+
+var fleetTargetVersion = version.MustParse("2.2.4")
+
+const fleetControllerTag = "controller-deadbeef-1bad-500d-9000-4b1d0d06f00d"
+
+func (s *fleetSuite) SetUpSuite(c *gc.C) {
+	s.IsolationSuite.SetUpSuite(c)
+	if err := exec.Command("python3", "-c", "import yaml").Run(); err != nil {
+		c.Skip("python3 with the yaml module is needed to run the agent upgrade script")
+	}
+}
+
+func (s *fleetSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.PatchValue(&toolsDir, c.MkDir())
+	s.fleet = newFakeFleet()
+	s.PatchValue(&remoteExec, remoteExecutor(s.fleet))
+
+	s.machines = []FlatMachine{{
+		Series:     "trusty",
+		ID:         "0",
+		InstanceID: "i-0",
+		Address:    "10.0.0.10",
+		Tools:      "1.25.13-trusty-amd64",
+	}, {
+		Series:     "xenial",
+		ID:         "1",
+		InstanceID: "i-1",
+		Address:    "10.0.0.11",
+		Tools:      "1.25.13-xenial-amd64",
+	}, {
+		Series:      "xenial",
+		ID:          "1/lxc/0",
+		InstanceID:  "juju-machine-1-lxc-0",
+		Address:     "10.0.3.20",
+		Tools:       "1.25.13-xenial-amd64",
+		HostAddress: "10.0.0.11",
+	}}
+	s.fake = map[string]*fakeMachine{
+		"0":       s.fleet.addMachine(c, s.machines[0], "machine-0"),
+		"1":       s.fleet.addMachine(c, s.machines[1], "machine-1", "unit-mysql-0"),
+		"1/lxc/0": s.fleet.addMachine(c, s.machines[2], "machine-1-lxc-0", "unit-wordpress-0"),
+	}
+	err := (&upgradeAgentsImplCommand{}).saveMachines(s.machines)
+	c.Assert(err, jc.ErrorIsNil)
+
+	for _, seriesArch := range []string{"trusty-amd64", "xenial-amd64"} {
+		writeFakeTools(c, toolsFilePath(fleetTargetVersion, seriesArch))
+	}
+	s.scriptPath, err = (&upgradeAgentsImplCommand{}).writeUpgradeScript(&scriptConfig{
+		ControllerInfo: &api.Info{CACert: "2.x CA certificate"},
+		ControllerTag:  fleetControllerTag,
+		APIAddresses:   []string{"10.0.0.2:17070"},
+		Version:        fleetTargetVersion,
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	plugin := path.Join(c.MkDir(), fakePlugin)
+	err = ioutil.WriteFile(plugin, []byte("plugin"), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	s.PatchValue(&pluginPath, func() (string, error) { return plugin, nil })
+}
+
+// writeFakeTools writes a tools tarball holding a jujud that does
+// nothing.
+func writeFakeTools(c *gc.C, toolsPath string) {
+	f, err := os.Create(toolsPath)
+	c.Assert(err, jc.ErrorIsNil)
+	defer f.Close()
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	content := []byte("#!/bin/sh\n")
+	err = tw.WriteHeader(&tar.Header{Name: "jujud", Mode: 0755, Size: int64(len(content))})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = tw.Write(content)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(tw.Close(), jc.ErrorIsNil)
+	c.Assert(gzw.Close(), jc.ErrorIsNil)
+}
+
+// checkTools checks that every agent on the machine is using the
+// given tools, and has config to match: the 1.25 agents' config is
+// untouched, and that of the upgraded ones is rewritten for 2.x.
+func (s *fleetSuite) checkTools(c *gc.C, id, tools string) {
+	m := s.fake[id]
+	binary := version.MustParseBinary(tools)
+	for _, agent := range m.agents {
+		target, err := m.toolsLink(agent)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(target, gc.Equals, tools, gc.Commentf("agent %s", agent))
+		conf, err := m.agentConf(agent)
+		c.Assert(err, jc.ErrorIsNil)
+		if binary.Major == 1 {
+			c.Check(conf, gc.Equals, fakeAgentConf(agent, tools))
+			continue
+		}
+		var parsed map[string]interface{}
+		c.Assert(goyaml.Unmarshal([]byte(conf), &parsed), jc.ErrorIsNil)
+		c.Check(parsed["upgradedToVersion"], gc.Equals, binary.Number.String())
+		c.Check(parsed["model"], gc.Equals, "model-"+fakeEnvironUUID)
+		c.Check(parsed["controller"], gc.Equals, fleetControllerTag)
+		c.Check(parsed["apiaddresses"], jc.DeepEquals, []interface{}{"10.0.0.2:17070"})
+		c.Check(parsed["stateaddresses"], gc.IsNil)
+		_, err = os.Stat(m.path(fakeToolsDir, tools, "jujud"))
+		c.Check(err, jc.ErrorIsNil)
+	}
+}
+
+func (s *fleetSuite) upgradedMachines(c *gc.C) []string {
+	upgraded, err := loadUpgradedMachines()
+	c.Assert(err, jc.ErrorIsNil)
+	return upgraded.SortedValues()
+}
+
+func (s *fleetSuite) upgrade(c *gc.C, flags rolloutFlags) (*cmd.Context, error) {
+	ctx := cmdtesting.Context(c)
+	command := &upgradeAgentsImplCommand{rolloutFlags: flags}
+	err := command.upgradeMachines(ctx, fleetTargetVersion, s.scriptPath, s.machines)
+	return ctx, err
+}
+
+func (s *fleetSuite) TestStopAgents(c *gc.C) {
+	ctx := cmdtesting.Context(c)
+	err := (&stopAgentsImplCommand{}).Run(ctx)
+	c.Assert(err, jc.ErrorIsNil)
+
+	for id, m := range s.fake {
+		for _, agent := range m.agents {
+			c.Check(m.running[agent], jc.IsFalse, gc.Commentf("machine %s agent %s", id, agent))
+		}
+	}
+	c.Check(cmdtesting.Stdout(ctx), gc.Matches, `(?s)AGENT +STATUS +VERSION
+machine-0 +stop/waiting +1.25.13-trusty-amd64
+machine-1 +inactive \(dead\) +1.25.13-xenial-amd64
+machine-1-lxc-0 +inactive \(dead\) +1.25.13-xenial-amd64
+unit-mysql-0 +inactive \(dead\) +1.25.13-xenial-amd64
+unit-wordpress-0 +inactive \(dead\) +1.25.13-xenial-amd64
+`)
+
+	keys, err := loadHostKeys()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(keys, gc.HasLen, 3)
+	c.Check(keys["1/lxc/0"].Address, gc.Equals, "10.0.3.20")
+}
+
+func (s *fleetSuite) TestAgentStatusHostUnreachable(c *gc.C) {
+	err := (&agentStatusImplCommand{}).Run(cmdtesting.Context(c))
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.fake["1"].unreachable = true
+	ctx := cmdtesting.Context(c)
+	err = (&agentStatusImplCommand{}).Run(ctx)
+	c.Assert(err, gc.ErrorMatches, `service status command failed for machines \["1" "1/lxc/0"\]`)
+	c.Check(cmdtesting.Stderr(ctx), jc.Contains, "(1:stderr) ssh: connect to host 10.0.0.11 port 22: Connection timed out\n")
+	c.Check(cmdtesting.Stderr(ctx), jc.Contains, "(1/lxc/0:stderr) ssh_exchange_identification: Connection closed by remote host\n")
+}
+
+func (s *fleetSuite) TestUpgradeAgents(c *gc.C) {
+	ctx, err := s.upgrade(c, rolloutFlags{})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "connection check successful on machine 1/lxc/0\n")
+
+	s.checkTools(c, "0", "2.2.4-trusty-amd64")
+	s.checkTools(c, "1", "2.2.4-xenial-amd64")
+	s.checkTools(c, "1/lxc/0", "2.2.4-xenial-amd64")
+	c.Check(s.upgradedMachines(c), jc.DeepEquals, []string{"0", "1", "1/lxc/0"})
+	// The 1.25 log forwarding is retired.
+	_, err = os.Stat(s.fake["1"].path(fakeRsyslog))
+	c.Check(os.IsNotExist(err), jc.IsTrue)
+
+	ctx = cmdtesting.Context(c)
+	err = (&agentStatusImplCommand{}).Run(ctx)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cmdtesting.Stdout(ctx), gc.Matches, `(?s).*
+unit-wordpress-0 +active \(running\) +2.2.4-xenial-amd64 +matches 2.x
+`)
+}
+
+func (s *fleetSuite) TestAgentStatusBeforeUpgrade(c *gc.C) {
+	ctx := cmdtesting.Context(c)
+	err := (&agentStatusImplCommand{}).Run(ctx)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cmdtesting.Stdout(ctx), gc.Matches, `AGENT +STATUS +VERSION +DEFINITION
+(?s).*
+machine-1 +active \(running\) +1.25.13-xenial-amd64 +unknown
+.*`)
+}
+
+func (s *fleetSuite) TestUpgradeAgentsStateServerLast(c *gc.C) {
+	s.machines[0].StateServer = true
+	ctx, err := s.upgrade(c, rolloutFlags{canary: 1})
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cmdtesting.Stdout(ctx), gc.Matches, `(?s)Upgrading canary batch: machines 1
+.*Upgrading batch 2 of 3: machines 1/lxc/0
+.*Upgrading batch 3 of 3: machines 0
+.*`)
+	s.checkTools(c, "0", "2.2.4-trusty-amd64")
+}
+
+func (s *fleetSuite) TestCheckControllerReachable(c *gc.C) {
+	addresses := []string{"10.0.0.2:17070", "10.0.0.3:17070"}
+	s.fleet.apiAddresses = addresses
+	ctx := cmdtesting.Context(c)
+	err := checkControllerReachable(ctx, s.machines, addresses)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "controller reachability check successful on machine 1/lxc/0\n")
+
+	s.fake["1/lxc/0"].controllerUnreachable = true
+	ctx = cmdtesting.Context(c)
+	err = checkControllerReachable(ctx, s.machines, addresses)
+	c.Assert(err, gc.ErrorMatches, `controller reachability check failed on machine 1/lxc/0`)
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "controller address 10.0.0.3:17070 unreachable\n")
+}
+
+func (s *fleetSuite) TestUpgradeAgentsRefusesUnitMidHook(c *gc.C) {
+	s.fake["1/lxc/0"].midHookUnit = "unit-wordpress-0"
+	ctx, err := s.upgrade(c, rolloutFlags{})
+	c.Assert(err, gc.ErrorMatches, `upgrading batch 1 of 1 \(0 machines not attempted\): uniter state check failed on machine 1/lxc/0`)
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "uniter state check successful on machine 1\n")
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, `unit-wordpress-0: cannot upgrade: "config-changed" hook is running or has failed`)
+
+	// Nothing on any machine in the batch is changed: no agent is
+	// switched to the new tools, and no uniter state is converted.
+	s.checkTools(c, "0", "1.25.13-trusty-amd64")
+	s.checkTools(c, "1", "1.25.13-xenial-amd64")
+	s.checkTools(c, "1/lxc/0", "1.25.13-xenial-amd64")
+	state, err := s.fake["1"].uniterState("unit-mysql-0")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(state, gc.Equals, fakeUniterState)
+	_, err = os.Stat(s.fake["1"].path("var/lib/juju", uniterStateBackupDir))
+	c.Check(os.IsNotExist(err), jc.IsTrue)
+	c.Check(s.upgradedMachines(c), gc.HasLen, 0)
+}
+
+func (s *fleetSuite) TestUpgradeAgentsPartialFailureRollsBackBatch(c *gc.C) {
+	s.fake["1"].failUpgrade = true
+	ctx, err := s.upgrade(c, rolloutFlags{canary: 1, rollbackOnFailure: true})
+	c.Assert(err, gc.ErrorMatches, `upgrading batch 2 of 2 \(0 machines not attempted\): upgrade failed on machine 1`)
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "rollback successful on machine 1\n")
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "rollback successful on machine 1/lxc/0\n")
+
+	// The canary stays upgraded; the failed batch, including the
+	// machine that did upgrade, is restored.
+	s.checkTools(c, "0", "2.2.4-trusty-amd64")
+	s.checkTools(c, "1", "1.25.13-xenial-amd64")
+	s.checkTools(c, "1/lxc/0", "1.25.13-xenial-amd64")
+	c.Check(s.upgradedMachines(c), jc.DeepEquals, []string{"0"})
+}
+
+func (s *fleetSuite) TestConnectionCheckFailureThenAbort(c *gc.C) {
+	s.fake["1/lxc/0"].failConnectionCheck = true
+	ctx, err := s.upgrade(c, rolloutFlags{})
+	c.Assert(err, gc.ErrorMatches, `upgrading batch 1 of 1 \(0 machines not attempted\): connection check failed on machine 1/lxc/0`)
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "connection check failed for unit-wordpress-0\n")
+	c.Check(s.upgradedMachines(c), jc.DeepEquals, []string{"0", "1", "1/lxc/0"})
+
+	err = (&abortImplCommand{}).rollbackAgents(cmdtesting.Context(c))
+	c.Assert(err, jc.ErrorIsNil)
+	s.checkTools(c, "0", "1.25.13-trusty-amd64")
+	s.checkTools(c, "1", "1.25.13-xenial-amd64")
+	s.checkTools(c, "1/lxc/0", "1.25.13-xenial-amd64")
+	c.Check(s.upgradedMachines(c), gc.HasLen, 0)
+	state, err := s.fake["1/lxc/0"].uniterState("unit-wordpress-0")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(state, gc.Equals, fakeUniterState)
+
+	// The 1.25 service definitions and log forwarding are restored.
+	commands, err := s.fake["1"].commandsLog()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(commands, jc.Contains, "systemctl enable "+s.fake["1"].serviceDefinition("machine-1")+"\n")
+	_, err = os.Stat(s.fake["1"].path(fakeRsyslog))
+	c.Check(err, jc.ErrorIsNil)
+	ctx = cmdtesting.Context(c)
+	err = (&agentStatusImplCommand{}).Run(ctx)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cmdtesting.Stdout(ctx), gc.Matches, `(?s).*
+machine-0 +active \(running\) +1.25.13-trusty-amd64 +differs from 2.x
+.*`)
+}
+
+func (s *fleetSuite) TestEnsureHostKeysSkipsUnreachable(c *gc.C) {
+	s.fake["1"].unreachable = true
+	keys, err := ensureHostKeys(s.machines)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(keys, gc.HasLen, 1)
+	c.Check(pinnedKnownHosts("10.0.0.10"), gc.Equals, knownHostsPath())
+	c.Check(pinnedKnownHosts("10.0.0.11"), gc.Equals, "")
+
+	s.fake["1"].unreachable = false
+	keys, err = ensureHostKeys(s.machines)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(keys, gc.HasLen, 3)
+	c.Check(pinnedKnownHosts("10.0.3.20"), gc.Equals, knownHostsPath())
+}
+
+func (s *fleetSuite) TestAbortWithoutUpgradedMachinesRecord(c *gc.C) {
+	s.machines = s.machines[1:]
+	_, err := s.upgrade(c, rolloutFlags{})
+	c.Assert(err, jc.ErrorIsNil)
+	s.machines = append([]FlatMachine{s.fake["0"].FlatMachine}, s.machines...)
+	// Upgrades started by earlier versions didn't record the
+	// upgraded machines.
+	c.Assert(os.Remove(path.Join(toolsDir, upgradedMachinesFile)), jc.ErrorIsNil)
+
+	ctx := cmdtesting.Context(c)
+	err = (&abortImplCommand{}).rollbackAgents(ctx)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "rollback successful on machine 1/lxc/0\n")
+	c.Check(cmdtesting.Stdout(ctx), gc.Not(jc.Contains), "machine 0\n")
+	s.checkTools(c, "1", "1.25.13-xenial-amd64")
+	s.checkTools(c, "1/lxc/0", "1.25.13-xenial-amd64")
+}
+
+func (s *fleetSuite) TestUpgradeAgentsDisablesLinkedJujuDB(c *gc.C) {
+	unit := s.fake["1"].addJujuDB(c)
+	_, err := s.upgrade(c, rolloutFlags{})
+	c.Assert(err, jc.ErrorIsNil)
+	commands, err := s.fake["1"].commandsLog()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(commands, gc.Equals, "systemctl disable juju-db.service\nsystemctl link "+unit+"\nservice rsyslog restart\n")
+
+	err = (&abortImplCommand{}).rollbackAgents(cmdtesting.Context(c))
+	c.Assert(err, jc.ErrorIsNil)
+	commands, err = s.fake["1"].commandsLog()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(commands, jc.Contains, "systemctl enable "+unit+"\n")
+}
+
+func (s *fleetSuite) TestRollbackContinuesPastFailures(c *gc.C) {
+	s.fake["1"].addJujuDB(c)
+	_, err := s.upgrade(c, rolloutFlags{})
+	c.Assert(err, jc.ErrorIsNil)
+
+	s.fake["1"].failCommand = "systemctl enable"
+	ctx := cmdtesting.Context(c)
+	err = (&abortImplCommand{}).rollbackAgents(ctx)
+	c.Assert(err, gc.ErrorMatches, `rollback failed on machine 1`)
+	c.Check(cmdtesting.Stdout(ctx), jc.Contains, "failed to restore: ")
+
+	// The changes made before and after the failing one are undone,
+	// and the rollback information is kept so that it can be rerun.
+	_, err = os.Stat(s.fake["1"].path(fakeRsyslog))
+	c.Check(err, jc.ErrorIsNil)
+	s.checkTools(c, "1", "1.25.13-xenial-amd64")
+	c.Check(s.upgradedMachines(c), jc.DeepEquals, []string{"1"})
+
+	s.fake["1"].failCommand = ""
+	err = (&abortImplCommand{}).rollbackAgents(cmdtesting.Context(c))
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = os.Stat(s.fake["1"].path(fakeRollback))
+	c.Check(os.IsNotExist(err), jc.IsTrue)
+}
+
+func (s *fleetSuite) TestUpgradeAgentsPushesPluginForArch(c *gc.C) {
+	otherArch := arch.S390X
+	if arch.HostArch() == otherArch {
+		otherArch = arch.ARM64
+	}
+	m := FlatMachine{
+		Series:     "xenial",
+		ID:         "2",
+		InstanceID: "i-2",
+		Address:    "10.0.0.12",
+		Tools:      "1.25.13-xenial-" + otherArch,
+	}
+	s.fake["2"] = s.fleet.addMachine(c, m, "machine-2", "unit-mysql-1")
+	s.machines = []FlatMachine{m}
+	writeFakeTools(c, toolsFilePath(fleetTargetVersion, "xenial-"+otherArch))
+
+	_, err := s.upgrade(c, rolloutFlags{})
+	c.Assert(err, gc.ErrorMatches, `.*machine 2: no plugin for architecture "`+otherArch+`": .*`)
+	s.checkTools(c, "2", "1.25.13-xenial-"+otherArch)
+
+	archPlugin := path.Join(archPluginsDir(), otherArch, fakePlugin)
+	c.Assert(os.MkdirAll(path.Dir(archPlugin), 0755), jc.ErrorIsNil)
+	c.Assert(ioutil.WriteFile(archPlugin, []byte(otherArch+" plugin"), 0755), jc.ErrorIsNil)
+	_, err = s.upgrade(c, rolloutFlags{})
+	c.Assert(err, jc.ErrorIsNil)
+	pushed, err := ioutil.ReadFile(s.fake["2"].path(fakeUpgradeDir, fakePlugin))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(string(pushed), gc.Equals, otherArch+" plugin")
+	s.checkTools(c, "2", "2.2.4-xenial-"+otherArch)
+}
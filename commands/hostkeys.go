@@ -0,0 +1,343 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/description"
+	"github.com/juju/errors"
+	"github.com/juju/utils"
+	"github.com/juju/utils/set"
+	"github.com/juju/utils/ssh"
+)
+
+const (
+	hostKeysFile   = "host-keys.json"
+	knownHostsFile = "known_hosts"
+)
+
+// collectHostKeysScript prints the public SSH host keys of a machine.
+const collectHostKeysScript = "cat /etc/ssh/ssh_host_*_key.pub"
+
+// machineHostKeys records the SSH host keys collected from a machine,
+// and the address they were collected through.
+type machineHostKeys struct {
+	MachineID string
+	Address   string
+	Keys      []string
+}
+
+func hostKeysPath() string {
+	return path.Join(toolsDir, hostKeysFile)
+}
+
+func knownHostsPath() string {
+	return path.Join(toolsDir, knownHostsFile)
+}
+
+// loadHostKeys returns the SSH host keys recorded so far, keyed by
+// machine ID.
+func loadHostKeys() (map[string]machineHostKeys, error) {
+	keys := make(map[string]machineHostKeys)
+	data, err := ioutil.ReadFile(hostKeysPath())
+	if os.IsNotExist(err) {
+		return keys, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var recorded []machineHostKeys
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return nil, errors.Annotatef(err, "parsing %s", hostKeysPath())
+	}
+	for _, mk := range recorded {
+		keys[mk.MachineID] = mk
+	}
+	return keys, nil
+}
+
+// saveHostKeys records the SSH host keys, and writes a known_hosts
+// file containing them for use by later SSH connections.
+func saveHostKeys(keys map[string]machineHostKeys) error {
+	if err := os.MkdirAll(toolsDir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	recorded := make([]machineHostKeys, len(ids))
+	var knownHosts bytes.Buffer
+	for i, id := range ids {
+		mk := keys[id]
+		recorded[i] = mk
+		for _, key := range mk.Keys {
+			// known_hosts entries don't carry the key comment.
+			fields := strings.Fields(key)
+			fmt.Fprintf(&knownHosts, "%s %s %s\n", mk.Address, fields[0], fields[1])
+		}
+	}
+	data, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := utils.AtomicWriteFile(hostKeysPath(), data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	if err := utils.AtomicWriteFile(knownHostsPath(), knownHosts.Bytes(), 0644); err != nil {
+		return errors.Trace(err)
+	}
+	pinned.set(keys)
+	return nil
+}
+
+// pinned caches the addresses that host keys have been recorded for,
+// so that host-keys.json is only read once rather than for every SSH
+// connection.
+var pinned pinnedAddresses
+
+type pinnedAddresses struct {
+	mu sync.Mutex
+	// path is the host-keys.json the addresses were read from;
+	// the cache is reloaded if toolsDir changes.
+	path      string
+	addresses set.Strings
+}
+
+func (p *pinnedAddresses) set(keys map[string]machineHostKeys) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.path = hostKeysPath()
+	p.addresses = set.NewStrings()
+	for _, mk := range keys {
+		p.addresses.Add(mk.Address)
+	}
+}
+
+func (p *pinnedAddresses) contains(addr string) bool {
+	p.mu.Lock()
+	loaded := p.path == hostKeysPath()
+	p.mu.Unlock()
+	if !loaded {
+		keys, err := loadHostKeys()
+		if err != nil {
+			logger.Warningf("cannot load SSH host keys: %v", err)
+			return false
+		}
+		p.set(keys)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addresses.Contains(addr)
+}
+
+// pinnedKnownHosts returns the path of the known_hosts file to check
+// the host key of the machine with address addr against, or "" if
+// no host keys have been recorded for that address.
+func pinnedKnownHosts(addr string) string {
+	if pinned.contains(addr) {
+		return knownHostsPath()
+	}
+	return ""
+}
+
+// ensureHostKeys collects the SSH host keys from any of the machines
+// that don't already have keys recorded for their current address,
+// and returns all of the recorded keys. Once recorded, the keys are
+// checked by every subsequent SSH connection to the machine.
+//
+// Juju 1.25 did not record host keys, so the first session to each
+// machine has to trust whatever host answers. Machines that can't be
+// reached are skipped, and their keys are collected the next time.
+func ensureHostKeys(machines []FlatMachine) (map[string]machineHostKeys, error) {
+	keys, err := loadHostKeys()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var toCollect []FlatMachine
+	for _, m := range machines {
+		if mk, ok := keys[m.ID]; ok && mk.Address == m.Address {
+			continue
+		}
+		toCollect = append(toCollect, m)
+	}
+	if len(toCollect) == 0 {
+		return keys, nil
+	}
+
+	logger.Debugf("collecting SSH host keys from %d machines", len(toCollect))
+	results, err := parallelExec(flatMachineExecTargets(toCollect...), collectHostKeysScript)
+	if err != nil {
+		return nil, errors.Annotate(err, "collecting SSH host keys")
+	}
+	for i, res := range results {
+		m := toCollect[i]
+		if res.Code != 0 {
+			logger.Warningf(
+				"cannot collect SSH host keys from machine %s: exited with %d: %s",
+				m.ID, res.Code, strings.TrimSpace(res.Stderr),
+			)
+			continue
+		}
+		collected := parseHostKeys(res.Stdout)
+		if len(collected) == 0 {
+			logger.Warningf("no SSH host keys found on machine %s", m.ID)
+			continue
+		}
+		if old, ok := keys[m.ID]; ok && !sameHostKeys(old.Keys, collected) {
+			// The machine's address changed, and so did the
+			// host answering on it.
+			return nil, errors.Errorf(
+				"SSH host keys for machine %s at %s differ from those recorded at %s",
+				m.ID, m.Address, old.Address,
+			)
+		}
+		keys[m.ID] = machineHostKeys{
+			MachineID: m.ID,
+			Address:   m.Address,
+			Keys:      collected,
+		}
+	}
+	if err := saveHostKeys(keys); err != nil {
+		return nil, errors.Annotate(err, "saving SSH host keys")
+	}
+	return keys, nil
+}
+
+// parseHostKeys returns the public keys in the output of
+// collectHostKeysScript, sorted.
+func parseHostKeys(output string) []string {
+	var keys []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if len(strings.Fields(line)) < 2 {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sameHostKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// Ignore the key comments, which contain the hostname.
+		fa, fb := strings.Fields(a[i]), strings.Fields(b[i])
+		if fa[0] != fb[0] || fa[1] != fb[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// addSSHHostKeys adds the recorded SSH host keys of the machines to
+// the model description. Exporting doesn't connect to the machines:
+// the keys are collected by the agent commands, such as stop-agents,
+// that run before the import.
+func addSSHHostKeys(model description.Model, machines []FlatMachine) error {
+	keys, err := loadHostKeys()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, m := range machines {
+		mk, ok := keys[m.ID]
+		if !ok {
+			logger.Debugf("no SSH host keys recorded for machine %s", m.ID)
+			continue
+		}
+		model.AddSSHHostKey(description.SSHHostKeyArgs{
+			MachineID: mk.MachineID,
+			Keys:      mk.Keys,
+		})
+	}
+	return nil
+}
+
+// clientKnownHostsPath returns the known_hosts file on the client that
+// the host keys of the API server machines and any jump host are
+// pinned in.
+func clientKnownHostsPath() string {
+	return filepath.Join(executionHostDir(), knownHostsFile)
+}
+
+// clientHostKeyOptions returns the ssh options for checking the host
+// key of host, given as host or [host]:port, against the client's
+// known_hosts file. Juju 1.25 doesn't record the API server machines'
+// host keys, so the first connection to each host trusts the key it's
+// given and records it; every later connection must present the same
+// key.
+func clientHostKeyOptions(host string) (knownHosts string, strict ssh.StrictHostChecksOption) {
+	knownHosts = clientKnownHostsPath()
+	if err := os.MkdirAll(filepath.Dir(knownHosts), 0755); err != nil {
+		logger.Warningf("cannot create %s: %v", filepath.Dir(knownHosts), err)
+	}
+	known, err := knownHost(knownHosts, host)
+	if err != nil {
+		logger.Warningf("cannot read %s: %v", knownHosts, err)
+	}
+	if known {
+		return knownHosts, ssh.StrictHostChecksYes
+	}
+	logger.Debugf("recording the SSH host key of %s in %s", host, knownHosts)
+	return knownHosts, ssh.StrictHostChecksNo
+}
+
+// knownHost reports whether the known_hosts file has an entry for
+// host, which may be hashed.
+func knownHost(knownHosts, host string) (bool, error) {
+	data, err := ioutil.ReadFile(knownHosts)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Trace(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for _, pattern := range strings.Split(fields[0], ",") {
+			if matchKnownHost(pattern, host) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matchKnownHost reports whether a known_hosts host pattern, either
+// plain or hashed as |1|salt|hash, names host.
+func matchKnownHost(pattern, host string) bool {
+	if !strings.HasPrefix(pattern, "|1|") {
+		return pattern == host
+	}
+	parts := strings.Split(pattern[len("|1|"):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)) == parts[1]
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	gitjujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type clientHostKeySuite struct {
+	gitjujutesting.IsolationSuite
+	dir string
+}
+
+var _ = gc.Suite(&clientHostKeySuite{})
+
+func (s *clientHostKeySuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.dir = c.MkDir()
+	s.PatchValue(&executionHostDir, func() string { return s.dir })
+}
+
+func (s *clientHostKeySuite) writeKnownHosts(c *gc.C, content string) {
+	err := ioutil.WriteFile(filepath.Join(s.dir, knownHostsFile), []byte(content), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *clientHostKeySuite) TestKnownHost(c *gc.C) {
+	s.writeKnownHosts(c, `
+# comment
+10.0.0.1,machine-0 ssh-rsa AAAA
+|1|MDEyMzQ1Njc4OWFiY2RlZmdoaWo=|fzfOb7X9CgyhUrtv7oNj8zATXD4= ecdsa-sha2-nistp256 AAAA
+[bastion]:2222 ssh-ed25519 AAAA
+`)
+	for host, expect := range map[string]bool{
+		"10.0.0.1":       true,
+		"machine-0":      true,
+		"10.0.0.2":       true,
+		"10.0.0.3":       false,
+		"[bastion]:2222": true,
+		"bastion":        false,
+	} {
+		known, err := knownHost(clientKnownHostsPath(), host)
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(known, gc.Equals, expect, gc.Commentf("host %s", host))
+	}
+}
+
+func (s *clientHostKeySuite) TestJumpHostProxyCommandPinsHostKey(c *gc.C) {
+	knownHosts := clientKnownHostsPath()
+	c.Check(jumpHostProxyCommand("admin@bastion:2222", "/home/me/.ssh/id_ed25519"), jc.DeepEquals, []string{
+		"ssh", "-q", "-W", "%h:%p",
+		"-i", "/home/me/.ssh/id_ed25519",
+		"-p", "2222",
+		"-o", "UserKnownHostsFile " + knownHosts,
+		"-o", "StrictHostKeyChecking no",
+		"admin@bastion",
+	})
+
+	// Once the key has been recorded, it must match.
+	s.writeKnownHosts(c, "[bastion]:2222 ssh-ed25519 AAAA\n")
+	c.Check(jumpHostProxyCommand("admin@bastion:2222", ""), jc.DeepEquals, []string{
+		"ssh", "-q", "-W", "%h:%p",
+		"-p", "2222",
+		"-o", "UserKnownHostsFile " + knownHosts,
+		"-o", "StrictHostKeyChecking yes",
+		"admin@bastion",
+	})
+}
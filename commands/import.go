@@ -31,6 +31,15 @@ target controller.
 All the agents in the source environment should be stopped before
 running the import command.
 
+On long-lived environments the status history can make the model too
+big to import. --skip-status-history, --max-status-history and
+--max-status-history-age limit how much of it is exported, and the size
+of each part of the model is reported before it's sent.
+
+The import upgrades the environment's tags in the provider, so it
+requires a backup made with backup-source, unless --skip-backup-check
+is given.
+
 `
 
 func newImportCommand() cmd.Command {
@@ -44,9 +53,12 @@ func newImportCommand() cmd.Command {
 
 type importCommand struct {
 	baseClientCommand
+	sourceBackupFlags
+	exportFlags
 
-	keepBroken  bool
-	targetCloud string
+	keepBroken    bool
+	targetCloud   string
+	agentBinaries string
 }
 
 func (c *importCommand) Info() *cmd.Info {
@@ -63,6 +75,9 @@ func (c *importCommand) Init(args []string) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if err := c.exportFlags.validate(); err != nil {
+		return errors.Trace(err)
+	}
 	return cmd.CheckEmpty(args)
 }
 
@@ -70,6 +85,9 @@ func (c *importCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.baseClientCommand.SetFlags(f)
 	f.BoolVar(&c.keepBroken, "keep-broken", false, "Keep a failed import")
 	f.StringVar(&c.targetCloud, "target-cloud", "", "The name of the cloud in the target controller")
+	f.StringVar(&c.agentBinaries, "agent-binaries", "", "local directory or simplestreams mirror of agent binaries to use instead of downloading them from the controller")
+	c.sourceBackupFlags.setFlags(f)
+	c.exportFlags.setFlags(f)
 }
 
 func (c *importCommand) Run(ctx *cmd.Context) error {
@@ -79,7 +97,19 @@ func (c *importCommand) Run(ctx *cmd.Context) error {
 	if c.targetCloud != "" {
 		c.extraOptions = append(c.extraOptions, "--target-cloud", c.targetCloud)
 	}
-	return c.baseClientCommand.Run(ctx)
+	c.extraOptions = append(c.extraOptions, c.sourceBackupFlags.options()...)
+	c.extraOptions = append(c.extraOptions, c.exportFlags.options()...)
+	if err := c.prepareRemote(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if c.agentBinaries != "" {
+		remoteDir, err := pushAgentBinaries(ctx, &c.baseClientCommand, c.agentBinaries)
+		if err != nil {
+			return errors.Annotate(err, "pushing agent binaries")
+		}
+		c.extraOptions = append(c.extraOptions, "--agent-binaries", remoteDir)
+	}
+	return c.runRemote(ctx)
 }
 
 var importImplDoc = `
@@ -100,9 +130,12 @@ func newImportImplCommand() cmd.Command {
 
 type importImplCommand struct {
 	baseRemoteCommand
+	sourceBackupFlags
+	exportFlags
 
-	keepBroken  bool
-	targetCloud string
+	keepBroken    bool
+	targetCloud   string
+	agentBinaries string
 }
 
 func (c *importImplCommand) Info() *cmd.Info {
@@ -126,6 +159,9 @@ func (c *importImplCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.baseRemoteCommand.SetFlags(f)
 	f.BoolVar(&c.keepBroken, "keep-broken", false, "Keep a failed import")
 	f.StringVar(&c.targetCloud, "target-cloud", "", "The name of the cloud in the target controller")
+	f.StringVar(&c.agentBinaries, "agent-binaries", "", "directory of agent binaries copied from the client")
+	c.sourceBackupFlags.setFlags(f)
+	c.exportFlags.setFlags(f)
 }
 
 func (c *importImplCommand) Run(ctx *cmd.Context) (err error) {
@@ -135,6 +171,10 @@ func (c *importImplCommand) Run(ctx *cmd.Context) (err error) {
 	}
 	defer st.Close()
 
+	if err := c.sourceBackupFlags.check(ctx, "import"); err != nil {
+		return errors.Trace(err)
+	}
+
 	conn, err := c.getControllerConnection()
 	if err != nil {
 		return errors.Annotate(err, "getting controller connection")
@@ -143,14 +183,17 @@ func (c *importImplCommand) Run(ctx *cmd.Context) (err error) {
 	targetAPI := migrationtarget.NewClient(conn)
 
 	logger.Debugf("exporting model from source environmment %s", st.EnvironTag().Id())
-	model, err := exportModel(st, c.targetCloud)
+	model, err := exportModel(st, c.targetCloud, c.exportFlags.config())
 	if err != nil {
 		return errors.Annotate(err, "exporting")
 	}
 
 	// We need to update the tools in the exported model to match the
 	// ones we'll put on the agents.
-	tw := newToolsWrangler(conn)
+	tw, err := newToolsWrangler(conn, c.controllerInfo, c.agentBinaries)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	allTools, err := updateToolsInModel(model, tw)
 	if err != nil {
 		return errors.Trace(err)
@@ -169,6 +212,7 @@ func (c *importImplCommand) Run(ctx *cmd.Context) (err error) {
 	if err != nil {
 		return errors.Annotate(err, "serializing model representation")
 	}
+	reportModelSize(ctx, model, bytes)
 	logger.Debugf("importing model to target controller %s", conn.ControllerTag().Id())
 	err = targetAPI.Import(bytes)
 	// We want to try to clean up the model in the target even if
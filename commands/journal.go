@@ -0,0 +1,130 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+)
+
+const (
+	migrationJournalFile = "migration-journal.json"
+
+	// backupSourcePhase is the journal phase recorded for each backup
+	// made by backup-source.
+	backupSourcePhase = "backup-source"
+)
+
+// journalEntry records a phase of the migration that was run against
+// the source environment. Entries for backup-source describe the
+// backup that was made; the entries for phases that change the source
+// environment refer to the latest backup at the time, if any.
+type journalEntry struct {
+	Phase    string    `json:"phase"`
+	Time     time.Time `json:"time"`
+	BackupID string    `json:"backup-id,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Archive  string    `json:"archive,omitempty"`
+}
+
+func migrationJournalPath() string {
+	return path.Join(toolsDir, migrationJournalFile)
+}
+
+// readJournal returns the entries recorded in the migration journal
+// so far, oldest first.
+func readJournal() ([]journalEntry, error) {
+	data, err := ioutil.ReadFile(migrationJournalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return parseJournal(data)
+}
+
+func parseJournal(data []byte) ([]journalEntry, error) {
+	var entries []journalEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Annotatef(err, "parsing %s", migrationJournalFile)
+	}
+	return entries, nil
+}
+
+// appendJournal adds the entry to the migration journal.
+func appendJournal(entry journalEntry) error {
+	entries, err := readJournal()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	entries = append(entries, entry)
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(toolsDir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(writeFile(migrationJournalPath(), 0644, bytes.NewReader(data)))
+}
+
+// latestBackup returns the journal entry for the most recent backup
+// of the source environment, or nil if there isn't one.
+func latestBackup(entries []journalEntry) *journalEntry {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Phase == backupSourcePhase {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// sourceBackupFlags holds the option for running a phase that changes
+// the source environment without a backup having been made first.
+type sourceBackupFlags struct {
+	skipCheck bool
+}
+
+func (f *sourceBackupFlags) setFlags(fs *gnuflag.FlagSet) {
+	fs.BoolVar(&f.skipCheck, "skip-backup-check", false, "continue even if the source environment hasn't been backed up with backup-source")
+}
+
+// options returns the flags for passing the option on to the remote
+// command.
+func (f *sourceBackupFlags) options() []string {
+	if f.skipCheck {
+		return []string{"--skip-backup-check"}
+	}
+	return nil
+}
+
+// check refuses to let the phase go ahead unless backup-source has
+// recorded a backup of the source environment in the journal, or the
+// check was skipped. The phase is recorded in the journal along with
+// the backup it can be recovered from.
+func (f *sourceBackupFlags) check(ctx *cmd.Context, phase string) error {
+	entries, err := readJournal()
+	if err != nil {
+		return errors.Annotate(err, "reading migration journal")
+	}
+	entry := journalEntry{Phase: phase, Time: time.Now().UTC()}
+	if backup := latestBackup(entries); backup != nil {
+		ctx.Infof("source environment backed up at %s (backup %s)", backup.Time.Format(time.RFC3339), backup.BackupID)
+		entry.BackupID = backup.BackupID
+	} else if f.skipCheck {
+		logger.Warningf("continuing without a backup of the source environment")
+	} else {
+		return errors.Errorf("the source environment hasn't been backed up; run backup-source before %s, or pass --skip-backup-check", phase)
+	}
+	return errors.Annotate(appendJournal(entry), "recording phase in migration journal")
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"time"
+
+	"github.com/juju/cmd/cmdtesting"
+	gitjujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type journalSuite struct {
+	gitjujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&journalSuite{})
+
+func (s *journalSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.PatchValue(&toolsDir, c.MkDir())
+}
+
+func (s *journalSuite) TestCheckRequiresBackup(c *gc.C) {
+	ctx := cmdtesting.Context(c)
+	var flags sourceBackupFlags
+	c.Assert(flags.check(ctx, "import"), gc.ErrorMatches, "the source environment hasn't been backed up; run backup-source before import, or pass --skip-backup-check")
+	entries, err := readJournal()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(entries, gc.HasLen, 0)
+
+	flags.skipCheck = true
+	c.Assert(flags.check(ctx, "import"), jc.ErrorIsNil)
+	entries, err = readJournal()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entries, gc.HasLen, 1)
+	c.Check(entries[0].Phase, gc.Equals, "import")
+	c.Check(entries[0].BackupID, gc.Equals, "")
+}
+
+func (s *journalSuite) TestCheckRecordsBackup(c *gc.C) {
+	backup := journalEntry{
+		Phase:    backupSourcePhase,
+		Time:     time.Date(2017, 10, 16, 10, 0, 0, 0, time.UTC),
+		BackupID: "20171016-100000.deadbeef",
+		Checksum: "checksum",
+		Size:     1024,
+		Archive:  "/tmp/juju-backup-20171016-100000.tar.gz",
+	}
+	c.Assert(appendJournal(backup), jc.ErrorIsNil)
+
+	var flags sourceBackupFlags
+	c.Assert(flags.check(cmdtesting.Context(c), "migrate-lxc"), jc.ErrorIsNil)
+	entries, err := readJournal()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(entries, gc.HasLen, 2)
+	c.Check(entries[0], jc.DeepEquals, backup)
+	c.Check(entries[1].Phase, gc.Equals, "migrate-lxc")
+	c.Check(entries[1].BackupID, gc.Equals, backup.BackupID)
+	c.Check(latestBackup(entries), jc.DeepEquals, &backup)
+}
@@ -9,32 +9,59 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/juju/errors"
+	"github.com/juju/utils"
+	"github.com/juju/utils/arch"
 	"github.com/lxc/lxd/shared/api"
 
 	"github.com/juju/1.25-upgrade/juju1/state"
 )
 
-//go:generate go run ../juju2/generate/filetoconst/filetoconst.go LXCMigrationScript lxc-to-lxd lxc2lxd_script.go 2017 commands
-
 // lxdPackages contains the packages required for running LXD containers,
-// and for the lxc-to-lxd migration.
+// and for migrating LXC containers to them.
 var lxdPackages = []string{
 	"lxd",
 	"lxd-client",
-	"python3-lxc", // required for lxc-to-lxd script
+	"rsync", // required for copying rootfs
 }
 
 type MigrateLXCOptions struct {
 	DryRun     bool
 	MoveRootfs bool
+
+	// ModelUUID is the UUID of the containers' model, recorded
+	// in the LXD containers' metadata.
+	ModelUUID string
+}
+
+// LXCMigrationError is returned by MigrateLXC when some of the
+// containers on a host could not be migrated.
+type LXCMigrationError struct {
+	Host   string
+	Failed []lxcMigrationResult
+}
+
+func (e *LXCMigrationError) Error() string {
+	failures := make([]string, len(e.Failed))
+	for i, result := range e.Failed {
+		failures[i] = fmt.Sprintf("%s: %s", result.Container, result.Error)
+	}
+	return fmt.Sprintf(
+		"migrating LXC containers on host %q failed (%s)",
+		e.Host, strings.Join(failures, "; "),
+	)
 }
 
-// MigrateLXC changes the LXC containers into LXD containers.
+// MigrateLXC changes the LXC containers into LXD containers, by running
+// lxc-to-lxd-impl on the host.
 func MigrateLXC(containers []*state.Machine, host *state.Machine, opts MigrateLXCOptions) error {
-	var args []string
+	args := []string{"lxc-to-lxd-impl", "--model-uuid", opts.ModelUUID}
+	if logger.IsDebugEnabled() {
+		args = append(args, "--debug")
+	}
 	if opts.DryRun {
 		args = append(args, "--dry-run")
 	}
@@ -50,6 +77,15 @@ func MigrateLXC(containers []*state.Machine, host *state.Machine, opts MigrateLX
 		args = append(args, string(instanceId))
 	}
 
+	hostAddr, err := getMachineAddress(host)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	plugin, err := ensureHostPlugin(hostAddr)
+	if err != nil {
+		return errors.Annotatef(err, "copying plugin to host %q", host.Id())
+	}
+
 	// Make sure the LXD packages are installed.
 	// This is required even for a dry-run.
 	aptCmd := "apt-get"
@@ -60,44 +96,86 @@ func MigrateLXC(containers []*state.Machine, host *state.Machine, opts MigrateLX
 	}
 	aptCmd += " install -q -y " + strings.Join(lxdPackages, " ")
 
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, `
+	script := fmt.Sprintf(`
 set -e
-mkdir -p /var/lib/juju/1.25-upgrade/scripts
-%s
-cat << 'EOF' > /var/lib/juju/1.25-upgrade/scripts/lxc-to-lxd
-%s
-EOF
-python3 /var/lib/juju/1.25-upgrade/scripts/lxc-to-lxd %s
-`, aptCmd, LXCMigrationScript, strings.Join(args, " "))
-
-	// write lxc-to-lxd output to stderr,
-	// prefixed by the host name.
+%s >&2
+./%s %s
+`, aptCmd, plugin, strings.Join(args, " "))
+
+	// Write lxc-to-lxd-impl's progress output to stderr,
+	// prefixed by the host name. The results are written
+	// to stdout.
 	output := &prefixWriter{
 		Writer: os.Stderr,
 		prefix: fmt.Sprintf("(machine %s) ", host.Id()),
 	}
-
-	hostAddr, err := getMachineAddress(host)
-	if err != nil {
-		return errors.Trace(err)
-	}
+	var stdout bytes.Buffer
 	rc, err := runViaSSH(
 		hostAddr,
-		buf.String(),
+		script,
 		withSystemIdentity(),
-		withStdout(output),
+		withStdout(&stdout),
 		withStderr(output),
 	)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	if rc != 0 {
-		return errors.Errorf("lxc-to-lxd exited %d", rc)
+		return errors.Errorf("lxc-to-lxd-impl exited %d", rc)
+	}
+
+	var results []lxcMigrationResult
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		return errors.Annotate(err, "parsing lxc-to-lxd-impl results")
+	}
+	migrationErr := &LXCMigrationError{Host: host.Id()}
+	for _, result := range results {
+		for _, warning := range result.Warnings {
+			logger.Warningf("container %q on host %q: %s", result.Container, host.Id(), warning)
+		}
+		if result.Error != "" {
+			migrationErr.Failed = append(migrationErr.Failed, result)
+		}
+	}
+	if len(migrationErr.Failed) > 0 {
+		return migrationErr
 	}
 	return nil
 }
 
+// ensureHostPlugin copies the plugin for the host's architecture to
+// the host with the given address, if it isn't there already, and
+// returns its name in the SSH user's home directory.
+func ensureHostPlugin(hostAddr string) (string, error) {
+	var buf bytes.Buffer
+	rc, err := runViaSSH(hostAddr, "uname -m", withSystemIdentity(), withStdout(&buf))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if rc != 0 {
+		return "", errors.Errorf("getting host architecture exited %d", rc)
+	}
+	plugin, err := pluginForArch(arch.NormaliseArch(strings.TrimSpace(buf.String())))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	local, err := localMD5Sum(plugin)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	remote, err := remoteMD5Sum(plugin, hostAddr, withSystemIdentity())
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if local != remote {
+		if err := updateRemotePlugin(plugin, hostAddr, withSystemIdentity()); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+	return filepath.Base(plugin), nil
+}
+
 // StopLXCContainer stops the specified LXC container machine.
 func StopLXCContainer(container, host *state.Machine) error {
 	hostAddr, err := getMachineAddress(host)
@@ -147,8 +225,8 @@ func StartLXCContainer(container, host *state.Machine) error {
 }
 
 // BackupLXCContainer backups up the specified container as an archive,
-// written to the given writer.
-func BackupLXCContainer(container, host *state.Machine, out io.Writer) error {
+// compressed with the given compressor and written to the given writer.
+func BackupLXCContainer(container, host *state.Machine, compressor lxcBackupCompressor, out io.Writer) error {
 	hostAddr, err := getMachineAddress(host)
 	if err != nil {
 		return errors.Trace(err)
@@ -157,9 +235,13 @@ func BackupLXCContainer(container, host *state.Machine, out io.Writer) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	script := "tar -C /var/lib/lxc -c " + string(instanceId)
+	if compressor.compress != "" {
+		script = "set -o pipefail; " + script + " | " + compressor.compress
+	}
 	rc, err := runViaSSH(
 		hostAddr,
-		"tar -C /var/lib/lxc -cJ "+string(instanceId),
+		script,
 		withSystemIdentity(),
 		withStdout(out),
 	)
@@ -173,15 +255,20 @@ func BackupLXCContainer(container, host *state.Machine, out io.Writer) error {
 }
 
 // RestoreLXCContainer restores the specified container's rootfs from an
-// archive, read from the given writer.
-func RestoreLXCContainer(container, host *state.Machine, in io.Reader) error {
+// archive compressed with the given compressor, read from the given
+// reader.
+func RestoreLXCContainer(container, host *state.Machine, compressor lxcBackupCompressor, in io.Reader) error {
 	hostAddr, err := getMachineAddress(host)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	script := "tar -C /var/lib/lxc -x"
+	if compressor.decompress != "" {
+		script = "set -o pipefail; " + compressor.decompress + " | " + script
+	}
 	rc, err := runViaSSH(
 		hostAddr,
-		"tar -C /var/lib/lxc -xJ ",
+		script,
 		withSystemIdentity(),
 		withStdin(in),
 	)
@@ -194,94 +281,157 @@ func RestoreLXCContainer(container, host *state.Machine, in io.Reader) error {
 	return nil
 }
 
-// StartLXCContainer starts the specified LXD container machine.
-func StartLXDContainers(containerNames []string, host *state.Machine) error {
+// LXDStorageLayout returns the storage layout of the specified LXC
+// containers on the given host, and of the LXD storage they would be
+// migrated to, by running lxc-storage-impl on the host.
+func LXDStorageLayout(containerNames []string, host *state.Machine) (*hostStorageLayout, error) {
 	hostAddr, err := getMachineAddress(host)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
+	}
+	plugin, err := ensureHostPlugin(hostAddr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "copying plugin to host %q", host.Id())
 	}
+	var stdout bytes.Buffer
 	rc, err := runViaSSH(
 		hostAddr,
-		"lxc start "+strings.Join(containerNames, " "),
+		fmt.Sprintf("./%s lxc-storage-impl %s", plugin, strings.Join(containerNames, " ")),
 		withSystemIdentity(),
+		withStdout(&stdout),
 	)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	if rc != 0 {
-		return errors.Errorf("lxc start exited %d", rc)
+		return nil, errors.Errorf("lxc-storage-impl exited %d", rc)
 	}
-	return nil
+	var layout hostStorageLayout
+	if err := json.Unmarshal(stdout.Bytes(), &layout); err != nil {
+		return nil, errors.Annotate(err, "parsing lxc-storage-impl output")
+	}
+	return &layout, nil
 }
 
-// RenameLXDContainer renames a LXD container on the given host.
-func RenameLXDContainer(newName, oldName string, host *state.Machine) error {
+// DisableLXCAutostart stops the specified LXC containers on the given
+// host from being started at boot, so that containers retained after
+// being copied to LXD don't come up alongside their LXD copies.
+func DisableLXCAutostart(containerNames []string, host *state.Machine) error {
 	hostAddr, err := getMachineAddress(host)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	script := fmt.Sprintf(`
+set -e
+for name in %s; do
+	sed -i 's/^lxc\.start\.auto *=.*/lxc.start.auto = 0/' /var/lib/lxc/$name/config
+	rm -f /etc/lxc/auto/$name
+done
+`, strings.Join(containerNames, " "))
 	rc, err := runViaSSH(
 		hostAddr,
-		fmt.Sprintf("lxc move %s %s", oldName, newName),
+		script,
 		withSystemIdentity(),
 	)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	if rc != 0 {
-		return errors.Errorf("renaming LXD container exited %d", rc)
+		return errors.Errorf("disabling LXC container autostart exited %d", rc)
 	}
 	return nil
 }
 
-// SetLXDContainerConfig sets the config for a LXD container on the given host.
-func SetLXDContainerConfig(containerName, key, value string, host *state.Machine) error {
+// DestroyLXCContainer destroys the LXC container with the given name on
+// the given host, if it exists.
+func DestroyLXCContainer(containerName string, host *state.Machine) error {
 	hostAddr, err := getMachineAddress(host)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	rc, err := runViaSSH(
 		hostAddr,
-		fmt.Sprintf("lxc config set %s %s %s", containerName, key, value),
+		fmt.Sprintf("if [ -d /var/lib/lxc/%[1]s ]; then lxc-destroy -n %[1]s; fi", containerName),
 		withSystemIdentity(),
 	)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	if rc != 0 {
-		return errors.Errorf("setting LXD container config exited %d", rc)
+		return errors.Errorf("lxc-destroy exited %d", rc)
 	}
 	return nil
 }
 
-// ListLXDContainers lists the LXD containers on the given host.
-func ListLXDContainers(host *state.Machine) (map[string]*lxdContainer, error) {
+// runLXDContainersImpl runs lxd-containers-impl on the host, which
+// manages its LXD containers with the LXD client.
+func runLXDContainersImpl(host *state.Machine, stdout io.Writer, args ...string) error {
 	hostAddr, err := getMachineAddress(host)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return errors.Trace(err)
+	}
+	plugin, err := ensureHostPlugin(hostAddr)
+	if err != nil {
+		return errors.Annotatef(err, "copying plugin to host %q", host.Id())
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = utils.ShQuote(arg)
+	}
+	var stderr bytes.Buffer
+	opts := []execOption{withSystemIdentity(), withStderr(&stderr)}
+	if stdout != nil {
+		opts = append(opts, withStdout(stdout))
 	}
-	var buf bytes.Buffer
 	rc, err := runViaSSH(
 		hostAddr,
-		// NOTE(axw) older versions of the lxc version
-		// do not support --format=yaml.
-		"lxc list --format=json",
-		withSystemIdentity(),
-		withStdout(&buf),
+		fmt.Sprintf("./%s lxd-containers-impl %s", plugin, strings.Join(quoted, " ")),
+		opts...,
 	)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return errors.Trace(err)
 	}
 	if rc != 0 {
-		return nil, errors.Errorf("listing LXD containers exited %d", rc)
+		return errors.Errorf("lxd-containers-impl %s exited %d: %s", args[0], rc, strings.TrimSpace(stderr.String()))
 	}
+	return nil
+}
+
+// StartLXDContainers starts the specified LXD containers on the given
+// host.
+func StartLXDContainers(containerNames []string, host *state.Machine) error {
+	args := append([]string{"start"}, containerNames...)
+	return errors.Trace(runLXDContainersImpl(host, nil, args...))
+}
+
+// StopLXDContainer stops the named LXD container on the given host,
+// if it is running.
+func StopLXDContainer(containerName string, host *state.Machine) error {
+	return errors.Trace(runLXDContainersImpl(host, nil, "stop", containerName))
+}
+
+// RenameLXDContainer renames a LXD container on the given host.
+func RenameLXDContainer(newName, oldName string, host *state.Machine) error {
+	return errors.Trace(runLXDContainersImpl(host, nil, "rename", oldName, newName))
+}
 
-	var lxcList []*lxdContainer
-	if err := json.Unmarshal(buf.Bytes(), &lxcList); err != nil {
+// SetLXDContainerConfig sets the config for a LXD container on the given host.
+func SetLXDContainerConfig(containerName, key, value string, host *state.Machine) error {
+	return errors.Trace(runLXDContainersImpl(host, nil, "set-config", containerName, key, value))
+}
+
+// ListLXDContainers lists the LXD containers on the given host.
+func ListLXDContainers(host *state.Machine) (map[string]*lxdContainer, error) {
+	var buf bytes.Buffer
+	if err := runLXDContainersImpl(host, &buf, "list"); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var lxdList []*lxdContainer
+	if err := json.Unmarshal(buf.Bytes(), &lxdList); err != nil {
 		return nil, errors.Trace(err)
 	}
 	containers := make(map[string]*lxdContainer)
-	for _, item := range lxcList {
+	for _, item := range lxdList {
 		containers[item.Name] = item
 	}
 	return containers, nil
@@ -292,3 +442,9 @@ type lxdContainer struct {
 	State     *api.ContainerState     `json:"state" yaml:"state"`
 	Snapshots []api.ContainerSnapshot `json:"snapshots" yaml:"snapshots"`
 }
+
+// migrationIncomplete reports whether the LXD container was left
+// part-way through the migration of an LXC container to it.
+func (c *lxdContainer) migrationIncomplete() bool {
+	return c.Config[lxdMigrationKey] != ""
+}
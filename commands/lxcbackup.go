@@ -0,0 +1,258 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils"
+)
+
+// lxcBackupManifestFile is the name of the manifest file written to
+// a backup directory by backup-lxc.
+const lxcBackupManifestFile = "manifest.json"
+
+// lxcBackupCompressor describes a compression program that backups
+// can be compressed with.
+type lxcBackupCompressor struct {
+	// extension is the file extension of a tarball compressed
+	// with this compressor.
+	extension string
+
+	// compress and decompress are the commands used on the
+	// host to compress and decompress the tarball; they're
+	// empty for uncompressed tarballs.
+	compress   string
+	decompress string
+}
+
+// lxcBackupCompressors holds the supported backup compressors, keyed
+// by the name used on the command line and recorded in the manifest.
+var lxcBackupCompressors = map[string]lxcBackupCompressor{
+	"xz":   {".tar.xz", "xz -c", "xz -dc"},
+	"gzip": {".tar.gz", "gzip -c", "gzip -dc"},
+	"zstd": {".tar.zst", "zstd -q -c", "zstd -q -dc"},
+	"none": {".tar", "", ""},
+}
+
+// lookupLXCBackupCompressor returns the named backup compressor.
+func lookupLXCBackupCompressor(name string) (lxcBackupCompressor, error) {
+	compressor, ok := lxcBackupCompressors[name]
+	if !ok {
+		names := make([]string, 0, len(lxcBackupCompressors))
+		for name := range lxcBackupCompressors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return lxcBackupCompressor{}, errors.NotValidf("compressor %q (expected one of %q)", name, names)
+	}
+	return compressor, nil
+}
+
+// lxcBackupManifest records the LXC container backups in a backup
+// directory.
+type lxcBackupManifest struct {
+	EnvironUUID string      `json:"environ-uuid"`
+	Backups     []lxcBackup `json:"backups"`
+}
+
+// lxcBackup records the backup of a single LXC container.
+type lxcBackup struct {
+	ContainerId string    `json:"container-id"`
+	InstanceId  string    `json:"instance-id"`
+	HostId      string    `json:"host-id"`
+	File        string    `json:"file"`
+	Compression string    `json:"compression"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	Created     time.Time `json:"created"`
+}
+
+type lxcBackupsByContainer []lxcBackup
+
+func (b lxcBackupsByContainer) Len() int           { return len(b) }
+func (b lxcBackupsByContainer) Less(i, j int) bool { return b[i].ContainerId < b[j].ContainerId }
+func (b lxcBackupsByContainer) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// readLXCBackupManifest reads the manifest in the backup directory. If
+// there is no manifest, an error satisfying errors.IsNotFound is
+// returned.
+func readLXCBackupManifest(backupDir string) (*lxcBackupManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(backupDir, lxcBackupManifestFile))
+	if os.IsNotExist(err) {
+		return nil, errors.NotFoundf("backup manifest in %s", backupDir)
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var manifest lxcBackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.Annotate(err, "parsing backup manifest")
+	}
+	return &manifest, nil
+}
+
+// writeLXCBackupManifest atomically replaces the manifest in the
+// backup directory.
+func writeLXCBackupManifest(backupDir string, manifest *lxcBackupManifest) error {
+	sort.Sort(lxcBackupsByContainer(manifest.Backups))
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(utils.AtomicWriteFile(
+		filepath.Join(backupDir, lxcBackupManifestFile), data, 0644,
+	))
+}
+
+// backup returns the manifest's record of the backup of the container
+// with the given ID, or nil if there is none.
+func (m *lxcBackupManifest) backup(containerId string) *lxcBackup {
+	for i := range m.Backups {
+		if m.Backups[i].ContainerId == containerId {
+			return &m.Backups[i]
+		}
+	}
+	return nil
+}
+
+// setBackup adds the backup to the manifest, replacing any existing
+// record of a backup of the same container.
+func (m *lxcBackupManifest) setBackup(backup lxcBackup) {
+	if existing := m.backup(backup.ContainerId); existing != nil {
+		*existing = backup
+		return
+	}
+	m.Backups = append(m.Backups, backup)
+}
+
+// lxcBackupWriter writes the backup manifest to a backup directory
+// as backups complete, so that an interrupted backup-lxc can skip
+// the backups it has already made.
+type lxcBackupWriter struct {
+	mu        sync.Mutex
+	backupDir string
+	manifest  *lxcBackupManifest
+}
+
+func (w *lxcBackupWriter) add(backup lxcBackup) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.manifest.setBackup(backup)
+	return errors.Trace(writeLXCBackupManifest(w.backupDir, w.manifest))
+}
+
+// verify checks that the backup file in the backup directory has the
+// size and SHA256 recorded in the manifest.
+func (b *lxcBackup) verify(backupDir string) error {
+	f, err := os.Open(filepath.Join(backupDir, b.File))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return errors.Annotatef(err, "reading %s", b.File)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != b.SHA256 || size != b.Size {
+		return errors.Errorf(
+			"%s does not match manifest: got SHA256 %s (size %d), expected %s (size %d)",
+			b.File, sum, size, b.SHA256, b.Size,
+		)
+	}
+	return nil
+}
+
+var verifyLXCBackupDoc = `
+The purpose of the verify-lxc-backup command is to check that the LXC
+container backups in a directory written by backup-lxc are intact.
+
+Each backup recorded in the directory's manifest is checked against
+its recorded size and SHA256. The command exits with an error if any
+backup is missing or doesn't match.
+
+If --match is specified, it is treated as a regular expression for
+matching container names. Only containers whose names match will
+be verified.
+`
+
+func newVerifyLXCBackupCommand() cmd.Command {
+	return &verifyLXCBackupCommand{}
+}
+
+type verifyLXCBackupCommand struct {
+	cmd.CommandBase
+	backupDir string
+	match     string
+}
+
+func (c *verifyLXCBackupCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "verify-lxc-backup",
+		Args:    "<backup dir>",
+		Purpose: "verify LXC container backups created by backup-lxc",
+		Doc:     verifyLXCBackupDoc,
+	}
+}
+
+func (c *verifyLXCBackupCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs to verify")
+}
+
+func (c *verifyLXCBackupCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no backup directory specified")
+	}
+	c.backupDir, args = args[0], args[1:]
+	return cmd.CheckEmpty(args)
+}
+
+func (c *verifyLXCBackupCommand) Run(ctx *cmd.Context) error {
+	match := func(string) bool { return true }
+	if c.match != "" {
+		matchRE, err := regexp.Compile(c.match)
+		if err != nil {
+			return errors.Annotate(err, "parsing --match")
+		}
+		match = matchRE.MatchString
+	}
+
+	manifest, err := readLXCBackupManifest(c.backupDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ctx.Infof("Backups of environment %s", manifest.EnvironUUID)
+	var failed int
+	for _, backup := range manifest.Backups {
+		if !match(backup.ContainerId) {
+			continue
+		}
+		if err := backup.verify(c.backupDir); err != nil {
+			ctx.Infof("Container %q: FAILED: %v", backup.ContainerId, err)
+			failed++
+			continue
+		}
+		ctx.Infof("Container %q: OK (%s, %d bytes, created %s)",
+			backup.ContainerId, backup.File, backup.Size,
+			backup.Created.Format(time.RFC3339),
+		)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d backup(s) failed verification", failed)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type lxcBackupSuite struct{}
+
+var _ = gc.Suite(&lxcBackupSuite{})
+
+func (*lxcBackupSuite) TestManifestRoundTrip(c *gc.C) {
+	dir := c.MkDir()
+	_, err := readLXCBackupManifest(dir)
+	c.Assert(err, jc.Satisfies, errors.IsNotFound)
+
+	created := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	manifest := &lxcBackupManifest{EnvironUUID: "env-uuid"}
+	writer := &lxcBackupWriter{backupDir: dir, manifest: manifest}
+	for _, id := range []string{"1/lxc/1", "0/lxc/0", "1/lxc/1"} {
+		err := writer.add(lxcBackup{
+			ContainerId: id,
+			InstanceId:  "juju-machine-" + id,
+			File:        "backup.tar.xz",
+			Compression: "xz",
+			Created:     created,
+		})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+
+	read, err := readLXCBackupManifest(dir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(read.EnvironUUID, gc.Equals, "env-uuid")
+	c.Assert(read.Backups, gc.HasLen, 2)
+	c.Assert(read.Backups[0].ContainerId, gc.Equals, "0/lxc/0")
+	c.Assert(read.Backups[1].Created.Equal(created), jc.IsTrue)
+	c.Assert(read.backup("2/lxc/0"), gc.IsNil)
+}
+
+func (*lxcBackupSuite) TestVerify(c *gc.C) {
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "foo.tar"), []byte("foo"), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+
+	backup := lxcBackup{
+		File:   "foo.tar",
+		Size:   3,
+		SHA256: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+	}
+	c.Assert(backup.verify(dir), jc.ErrorIsNil)
+
+	backup.Size = 4
+	c.Assert(backup.verify(dir), gc.ErrorMatches, "foo.tar does not match manifest: .*")
+	backup.File = "missing.tar"
+	c.Assert(backup.verify(dir), gc.ErrorMatches, ".*no such file or directory")
+}
+
+func (*lxcBackupSuite) TestLookupCompressor(c *gc.C) {
+	compressor, err := lookupLXCBackupCompressor("none")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(compressor.extension, gc.Equals, ".tar")
+	_, err = lookupLXCBackupCompressor("bzip2")
+	c.Assert(err, gc.ErrorMatches, `compressor "bzip2" \(expected one of \["gzip" "none" "xz" "zstd"\]\) not valid`)
+}
+
+func (*lxcBackupSuite) TestLXCSnapshotScript(c *gc.C) {
+	script := lxcSnapshotScript("juju-machine-1-lxc-0", "juju-machine-1-lxc-0.tar.gz", lxcBackupCompressors["gzip"])
+	c.Assert(script, jc.Contains, "du -skx /var/lib/lxc/juju-machine-1-lxc-0 ")
+	c.Assert(script, jc.Contains,
+		"tar -C /var/lib/lxc -c juju-machine-1-lxc-0 | gzip -c > $dir/juju-machine-1-lxc-0.tar.gz.tmp\n",
+	)
+	script = lxcSnapshotScript("foo", "foo.tar", lxcBackupCompressors["none"])
+	c.Assert(script, jc.Contains, "tar -C /var/lib/lxc -c foo > $dir/foo.tar.tmp\n")
+	c.Assert(script, jc.Contains, "stat -c %s $dir/foo.tar\n")
+}
@@ -0,0 +1,220 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// lxcConfigEntry is a single key/value line of an LXC config file.
+type lxcConfigEntry struct {
+	key   string
+	value string
+}
+
+// lxcConfig holds the entries of an LXC container's config, in the
+// order they appear, with includes and fstab entries expanded.
+type lxcConfig []lxcConfigEntry
+
+// parseLXCConfig parses the LXC config file at path. Included files
+// are parsed in place, except for LXC's own default configs, and the
+// lines of any fstab file named by lxc.mount become lxc.mount.entry
+// entries.
+func parseLXCConfig(path string) (lxcConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	var config lxcConfig
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := lxcConfigEntry{key: line, value: line}
+		if i := strings.Index(line, "="); i >= 0 {
+			entry.key = strings.TrimSpace(line[:i])
+			entry.value = strings.TrimSpace(line[i+1:])
+		}
+
+		switch entry.key {
+		case "lxc.include":
+			if strings.HasPrefix(entry.value, "/usr/share/lxc/config/") {
+				// Ignore LXC's own default configs.
+				continue
+			}
+			included, err := parseLXCInclude(entry.value)
+			if err == nil {
+				config = append(config, included...)
+				continue
+			}
+			logger.Warningf("invalid include in %s: %v", path, err)
+		case "lxc.mount":
+			entries, err := parseLXCFstab(entry.value)
+			if os.IsNotExist(err) {
+				logger.Warningf("container fstab %s doesn't exist, ignoring", entry.value)
+				continue
+			} else if err != nil {
+				return nil, errors.Annotatef(err, "reading fstab %s", entry.value)
+			}
+			config = append(config, entries...)
+			continue
+		}
+		config = append(config, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotatef(err, "reading %s", path)
+	}
+	return config, nil
+}
+
+// parseLXCInclude parses an included LXC config file, or each of the
+// .conf files in an included directory.
+func parseLXCInclude(path string) (lxcConfig, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !info.IsDir() {
+		return parseLXCConfig(path)
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var config lxcConfig
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".conf") {
+			continue
+		}
+		included, err := parseLXCConfig(filepath.Join(path, info.Name()))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		config = append(config, included...)
+	}
+	return config, nil
+}
+
+// parseLXCFstab returns an lxc.mount.entry entry for each mount in
+// the fstab file at path.
+func parseLXCFstab(path string) (lxcConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config lxcConfig
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		config = append(config, lxcConfigEntry{key: "lxc.mount.entry", value: line})
+	}
+	return config, nil
+}
+
+// get returns the values of all entries with the given key.
+func (config lxcConfig) get(key string) []string {
+	var values []string
+	for _, entry := range config {
+		if entry.key == key {
+			values = append(values, entry.value)
+		}
+	}
+	return values
+}
+
+// first returns the value of the first entry with the given key, or
+// "" if there is none.
+func (config lxcConfig) first(key string) string {
+	for _, entry := range config {
+		if entry.key == key {
+			return entry.value
+		}
+	}
+	return ""
+}
+
+// lxcNetwork holds the lxc.network.* settings of one of a
+// container's network interfaces.
+type lxcNetwork struct {
+	Type        string
+	Link        string
+	Name        string
+	HWAddr      string
+	MTU         string
+	VethPair    string
+	ScriptUp    string
+	ScriptDown  string
+	MacvlanMode string
+	Flags       string
+	VLANID      string
+	IPv4        []string
+	IPv4Gateway string
+	IPv6        []string
+	IPv6Gateway string
+}
+
+// networks returns the container's network interfaces. Each
+// lxc.network.type entry starts a new interface, and the other
+// lxc.network.* entries apply to the most recently started one.
+func (config lxcConfig) networks() ([]lxcNetwork, error) {
+	var networks []lxcNetwork
+	for _, entry := range config {
+		if !strings.HasPrefix(entry.key, "lxc.network.") {
+			continue
+		}
+		if entry.key == "lxc.network.type" {
+			networks = append(networks, lxcNetwork{Type: entry.value})
+			continue
+		}
+		if len(networks) == 0 {
+			return nil, errors.Errorf("%s set before lxc.network.type", entry.key)
+		}
+		network := &networks[len(networks)-1]
+		switch entry.key {
+		case "lxc.network.link":
+			network.Link = entry.value
+		case "lxc.network.name":
+			network.Name = entry.value
+		case "lxc.network.hwaddr":
+			network.HWAddr = entry.value
+		case "lxc.network.mtu":
+			network.MTU = entry.value
+		case "lxc.network.veth.pair":
+			network.VethPair = entry.value
+		case "lxc.network.script.up":
+			network.ScriptUp = entry.value
+		case "lxc.network.script.down":
+			network.ScriptDown = entry.value
+		case "lxc.network.macvlan.mode":
+			network.MacvlanMode = entry.value
+		case "lxc.network.flags":
+			network.Flags = entry.value
+		case "lxc.network.vlan.id":
+			network.VLANID = entry.value
+		case "lxc.network.ipv4":
+			network.IPv4 = append(network.IPv4, entry.value)
+		case "lxc.network.ipv4.gateway":
+			network.IPv4Gateway = entry.value
+		case "lxc.network.ipv6":
+			network.IPv6 = append(network.IPv6, entry.value)
+		case "lxc.network.ipv6.gateway":
+			network.IPv6Gateway = entry.value
+		default:
+			logger.Debugf("ignoring %s", entry.key)
+		}
+	}
+	return networks, nil
+}
@@ -0,0 +1,413 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils/set"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// supportedLXCConfigKeys holds the LXC config keys that are either
+// checked or converted when migrating a container to LXD. Containers
+// with any other keys, other than lxc.network.* and lxc.cgroup.*,
+// are not migrated.
+var supportedLXCConfigKeys = set.NewStrings(
+	"lxc.pts",
+	"lxc.tty",
+	"lxc.devttydir",
+	"lxc.aa_profile",
+	"lxc.loglevel",
+	"lxc.mount.auto",
+	"lxc.mount",
+	"lxc.pivotdir",
+	"lxc.hook.clone",
+	"lxc.include",
+	"lxc.start.auto",
+	"lxc.start.delay",
+	"lxc.start.order",
+	"lxc.environment",
+	"lxc.arch",
+	"lxc.id_map",
+	"lxc.rootfs.backend",
+	"lxc.rootfs",
+	"lxc.utsname",
+	"lxc.aa_allow_incomplete",
+	"lxc.autodev",
+	"lxc.haltsignal",
+	"lxc.rebootsignal",
+	"lxc.stopsignal",
+	"lxc.mount.entry",
+	"lxc.cap.drop",
+	"lxc.seccomp",
+)
+
+// defaultDroppedCapabilities are the capabilities that LXD containers
+// drop by default, and so may be dropped by a migrated LXC container.
+var defaultDroppedCapabilities = set.NewStrings(
+	"mac_admin",
+	"mac_override",
+	"sys_module",
+	"sys_time",
+)
+
+// lxcArchitectures maps LXC architecture names to those used by LXD.
+var lxcArchitectures = map[string]string{
+	"i686":      "i686",
+	"x86_64":    "x86_64",
+	"armhf":     "armv7l",
+	"arm64":     "aarch64",
+	"powerpc":   "ppc",
+	"powerpc64": "ppc64",
+	"ppc64el":   "ppc64le",
+	"s390x":     "s390x",
+}
+
+// lxdContainerSpec describes the LXD container to create for an LXC
+// container.
+type lxdContainerSpec struct {
+	api.ContainersPost
+
+	// Rootfs describes the LXC container's root filesystem.
+	Rootfs lxcRootfs
+
+	// Interfaces holds the interfaces that LXC configured with
+	// static addresses, which must be configured inside the LXD
+	// container instead.
+	Interfaces []containerInterface
+
+	// Warnings holds any differences in behaviour between the LXC
+	// container and the LXD container.
+	Warnings []string
+}
+
+// convertLXCContainer converts the config of the named LXC container
+// into the spec of an equivalent LXD container, or returns an error
+// describing why it can't be migrated. pathExists is used to check
+// for the existence of the root filesystem and mount sources.
+func convertLXCContainer(name string, config lxcConfig, pathExists func(string) bool) (*lxdContainerSpec, error) {
+	for _, entry := range config {
+		key := entry.key
+		if !strings.HasPrefix(key, "lxc.") || supportedLXCConfigKeys.Contains(key) {
+			continue
+		}
+		if strings.HasPrefix(key, "lxc.network.") || strings.HasPrefix(key, "lxc.cgroup.") {
+			continue
+		}
+		return nil, errors.Errorf("unsupported config key %q", key)
+	}
+
+	if config.first("lxd.migrated") != "" {
+		return nil, errors.New("container has already been migrated")
+	}
+	if config.first("lxc.id_map") != "" {
+		return nil, errors.New("unprivileged containers aren't supported")
+	}
+	if utsname := config.first("lxc.utsname"); utsname != "" && utsname != name {
+		return nil, errors.Errorf("container name doesn't match lxc.utsname %q", utsname)
+	}
+	if err := checkLXCConfigInt(config, "lxc.aa_allow_incomplete", 0); err != nil {
+		return nil, errors.Annotate(err, "incomplete AppArmor support isn't supported")
+	}
+	if err := checkLXCConfigInt(config, "lxc.autodev", 1); err != nil {
+		return nil, errors.Annotate(err, "containers without a minimal /dev aren't supported")
+	}
+	for _, key := range []string{"lxc.haltsignal", "lxc.rebootsignal", "lxc.stopsignal"} {
+		if config.first(key) != "" {
+			return nil, errors.Errorf("custom %s isn't supported", key)
+		}
+	}
+
+	value := config.first("lxc.rootfs")
+	if value == "" {
+		return nil, errors.New("missing lxc.rootfs")
+	}
+	rootfs, err := parseLXCRootfs(value, config.first("lxc.rootfs.backend"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, path := range rootfs.paths() {
+		if !pathExists(path) {
+			return nil, errors.Errorf("rootfs %q doesn't exist", path)
+		}
+	}
+
+	spec := &lxdContainerSpec{Rootfs: rootfs}
+	spec.Name = name
+	spec.Source = api.ContainerSource{Type: "none"}
+	spec.Profiles = []string{"default"}
+	spec.Config = map[string]string{
+		"security.privileged": "true",
+	}
+	spec.Devices = map[string]map[string]string{
+		// Override the default profile's eth0, so that only
+		// the converted network devices are present.
+		"eth0": {"type": "none"},
+	}
+
+	if err := convertLXCNetworks(config, spec); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := convertLXCMounts(config, rootfs, pathExists, spec); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, env := range config.get("lxc.environment") {
+		fields := strings.SplitN(env, "=", 2)
+		spec.Config["environment."+strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[len(fields)-1])
+	}
+
+	bootConfig := []struct {
+		lxcKey string
+		lxdKey string
+		value  func(string) string
+	}{
+		{"lxc.start.auto", "boot.autostart", func(string) string { return "true" }},
+		{"lxc.start.delay", "boot.autostart.delay", func(v string) string { return v }},
+		{"lxc.start.order", "boot.autostart.priority", func(v string) string { return v }},
+	}
+	for _, boot := range bootConfig {
+		value := config.first(boot.lxcKey)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Annotatef(err, "parsing %s", boot.lxcKey)
+		}
+		if n > 0 {
+			spec.Config[boot.lxdKey] = boot.value(value)
+		}
+	}
+
+	switch profile := config.first("lxc.aa_profile"); profile {
+	case "", "lxc-container-default":
+	case "lxc-container-default-with-nesting":
+		spec.Config["security.nesting"] = "true"
+	default:
+		spec.Config["raw.lxc"] = "lxc.aa_profile=" + profile
+	}
+
+	if seccomp := config.first("lxc.seccomp"); seccomp != "" && seccomp != "/usr/share/lxc/config/common.seccomp" {
+		return nil, errors.Errorf("custom seccomp profile %q isn't supported", seccomp)
+	}
+	for _, capability := range config.get("lxc.cap.drop") {
+		for _, capability := range strings.Fields(capability) {
+			if !defaultDroppedCapabilities.Contains(capability) {
+				return nil, errors.Errorf("dropping capability %q isn't supported", capability)
+			}
+		}
+	}
+
+	if arch := config.first("lxc.arch"); arch != "" {
+		if lxdArch, ok := lxcArchitectures[arch]; ok {
+			spec.Architecture = lxdArch
+		} else {
+			logger.Warningf("unknown architecture %q for %q, assuming native", arch, name)
+		}
+	}
+	return spec, nil
+}
+
+// checkLXCConfigInt checks that the config key, if set, has the
+// expected integer value.
+func checkLXCConfigInt(config lxcConfig, key string, expected int) error {
+	value := config.first(key)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.Annotatef(err, "parsing %s", key)
+	}
+	if n != expected {
+		return errors.Errorf("%s = %d", key, n)
+	}
+	return nil
+}
+
+// usesVLAN reports whether any of the container's nic devices are on
+// a VLAN.
+func (spec *lxdContainerSpec) usesVLAN() bool {
+	for _, device := range spec.Devices {
+		if device["type"] == "nic" && device["vlan"] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// convertLXCNetworks adds a nic device to spec for each of the LXC
+// container's network interfaces, and records the interfaces with
+// static addresses, which must be configured inside the container.
+// They're also recorded in the container's config, for the export.
+func convertLXCNetworks(config lxcConfig, spec *lxdContainerSpec) error {
+	networks, err := config.networks()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// LXC names the interfaces that aren't explicitly named ethN,
+	// in order. We name them explicitly in LXD, so that the names
+	// in the container's network configuration still apply.
+	var nextIndex int
+	for i, network := range networks {
+		if network.ScriptUp != "" || network.ScriptDown != "" {
+			return errors.New("network config scripts aren't supported")
+		}
+		device := map[string]string{"type": "nic"}
+		switch network.Type {
+		case "empty":
+			continue
+		case "none":
+			// LXD containers can't share the host's
+			// network namespace.
+			spec.Warnings = append(spec.Warnings,
+				"container shared the host's network namespace, and will have no network devices in LXD",
+			)
+			continue
+		case "veth":
+			device["nictype"] = "p2p"
+			if network.Link != "" {
+				device["nictype"] = "bridged"
+			}
+		case "phys":
+			device["nictype"] = "physical"
+		case "macvlan":
+			device["nictype"] = "macvlan"
+		case "vlan":
+			// LXD creates VLAN interfaces as macvlan
+			// devices on the VLAN's parent.
+			if network.Link == "" || network.VLANID == "" {
+				return errors.New("vlan network requires lxc.network.link and lxc.network.vlan.id")
+			}
+			device["nictype"] = "macvlan"
+			device["vlan"] = network.VLANID
+		default:
+			return errors.Errorf("%q network type isn't supported", network.Type)
+		}
+		name := network.Name
+		if name == "" {
+			name = fmt.Sprintf("eth%d", nextIndex)
+			nextIndex++
+		}
+		device["name"] = name
+		if network.HWAddr != "" {
+			device["hwaddr"] = network.HWAddr
+		}
+		if network.Link != "" {
+			device["parent"] = network.Link
+		}
+		if network.MTU != "" {
+			device["mtu"] = network.MTU
+		}
+		if network.VethPair != "" {
+			device["host_name"] = network.VethPair
+		}
+		spec.Devices[fmt.Sprintf("convert_net%d", i)] = device
+
+		iface, err := staticInterface(name, network)
+		if err != nil {
+			return errors.Annotatef(err, "interface %q", name)
+		}
+		if iface != nil {
+			spec.Interfaces = append(spec.Interfaces, *iface)
+		}
+	}
+	if len(spec.Interfaces) > 0 {
+		data, err := json.Marshal(spec.Interfaces)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		spec.Config[staticInterfacesKey] = string(data)
+	}
+	return nil
+}
+
+// staticInterface returns the static addressing of the interface
+// configured by LXC, or nil if it has none.
+func staticInterface(name string, network lxcNetwork) (*containerInterface, error) {
+	if len(network.IPv4) == 0 && len(network.IPv6) == 0 {
+		return nil, nil
+	}
+	iface := &containerInterface{Name: name}
+	for _, value := range network.IPv4 {
+		// LXC allows a broadcast address after the address.
+		address := strings.Fields(value)[0]
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return nil, errors.Annotatef(err, "parsing lxc.network.ipv4")
+		}
+		iface.IPv4 = append(iface.IPv4, address)
+	}
+	for _, address := range network.IPv6 {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return nil, errors.Annotatef(err, "parsing lxc.network.ipv6")
+		}
+		iface.IPv6 = append(iface.IPv6, address)
+	}
+	// A gateway of "auto" means the address of the bridge, which
+	// the container's own configuration must provide.
+	if gateway := network.IPv4Gateway; gateway != "" && gateway != "auto" {
+		if net.ParseIP(gateway) == nil {
+			return nil, errors.Errorf("invalid lxc.network.ipv4.gateway %q", gateway)
+		}
+		iface.IPv4Gateway = gateway
+	}
+	if gateway := network.IPv6Gateway; gateway != "" && gateway != "auto" {
+		if net.ParseIP(gateway) == nil {
+			return nil, errors.Errorf("invalid lxc.network.ipv6.gateway %q", gateway)
+		}
+		iface.IPv6Gateway = gateway
+	}
+	return iface, nil
+}
+
+// convertLXCMounts adds a disk device to spec for each of the LXC
+// container's mount entries, other than those LXD provides itself.
+func convertLXCMounts(config lxcConfig, rootfs lxcRootfs, pathExists func(string) bool, spec *lxdContainerSpec) error {
+	// Absolute mount targets are within the host's view of the
+	// container's rootfs. Clones are mounted alongside their delta.
+	mountPoint := rootfs.Path
+	if rootfs.isClone() {
+		mountPoint = filepath.Join(filepath.Dir(rootfs.Upper), "rootfs")
+	}
+	var i int
+	for _, entry := range config.get("lxc.mount.entry") {
+		mount := strings.Fields(entry)
+		if len(mount) < 4 {
+			return errors.Errorf("invalid mount entry %q", entry)
+		}
+		source, target, options := mount[0], mount[1], set.NewStrings(strings.Split(mount[3], ",")...)
+		if source == "proc" || source == "sysfs" {
+			// Present in LXD containers by default.
+			continue
+		}
+		device := map[string]string{
+			"type":   "disk",
+			"source": source,
+		}
+		if options.Contains("ro") {
+			device["readonly"] = "true"
+		}
+		if options.Contains("optional") {
+			device["optional"] = "true"
+		} else if !pathExists(source) {
+			return errors.Errorf("source %q of mount entry %q doesn't exist", source, entry)
+		}
+		if strings.HasPrefix(target, "/") {
+			device["path"] = strings.TrimPrefix(target, mountPoint)
+		} else {
+			device["path"] = "/" + target
+		}
+		spec.Devices[fmt.Sprintf("convert_mount%d", i)] = device
+		i++
+	}
+	return nil
+}
@@ -0,0 +1,505 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/lxc/lxd/shared/api"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/1.25-upgrade/juju2/apiserver/params"
+)
+
+type lxcConvertSuite struct{}
+
+var _ = gc.Suite(&lxcConvertSuite{})
+
+// jujuLXCConfig is the config of an LXC container created by Juju 1.25.
+const jujuLXCConfig = `
+# Template used to create this container: /usr/share/lxc/templates/lxc-ubuntu-cloud
+lxc.network.type = veth
+lxc.network.hwaddr = 00:16:3e:4d:0f:d5
+lxc.network.link = lxcbr0
+lxc.network.flags = up
+lxc.network.mtu = 1500
+
+# Common configuration
+lxc.include = /usr/share/lxc/config/ubuntu-cloud.common.conf
+
+# Container specific configuration
+lxc.rootfs = /var/lib/lxc/juju-machine-1-lxc-0/rootfs
+lxc.utsname = juju-machine-1-lxc-0
+lxc.arch = x86_64
+lxc.start.auto = 1
+lxc.mount.entry = /var/log/juju var/log/juju none defaults,bind 0 0
+lxc.mount.entry = proc proc proc nodev,noexec,nosuid 0 0
+lxc.aa_profile = lxc-container-default-with-nesting
+`
+
+func writeLXCConfig(c *gc.C, dir, config string) string {
+	path := filepath.Join(dir, "config")
+	err := ioutil.WriteFile(path, []byte(config), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	return path
+}
+
+func parseTestLXCConfig(c *gc.C, config string) lxcConfig {
+	parsed, err := parseLXCConfig(writeLXCConfig(c, c.MkDir(), config))
+	c.Assert(err, jc.ErrorIsNil)
+	return parsed
+}
+
+func existingPaths(paths ...string) func(string) bool {
+	return func(path string) bool {
+		for _, p := range paths {
+			if p == path {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (*lxcConvertSuite) TestParseLXCConfigIncludes(c *gc.C) {
+	dir := c.MkDir()
+	includeDir := filepath.Join(dir, "include.d")
+	err := os.Mkdir(includeDir, 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ioutil.WriteFile(filepath.Join(includeDir, "a.conf"), []byte("lxc.start.delay = 5\n"), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ioutil.WriteFile(filepath.Join(includeDir, "ignored"), []byte("lxc.start.order = 5\n"), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	fstab := filepath.Join(dir, "fstab")
+	err = ioutil.WriteFile(fstab, []byte("# comment\n/srv srv none bind 0 0\n"), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+
+	config, err := parseLXCConfig(writeLXCConfig(c, dir, strings.Join([]string{
+		"lxc.include = /usr/share/lxc/config/ubuntu.common.conf",
+		"lxc.include = " + includeDir,
+		"lxc.mount = " + fstab,
+		"  # indented comment",
+		"lxc.utsname=foo",
+	}, "\n")))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(config, jc.DeepEquals, lxcConfig{
+		{"lxc.start.delay", "5"},
+		{"lxc.mount.entry", "/srv srv none bind 0 0"},
+		{"lxc.utsname", "foo"},
+	})
+}
+
+func (*lxcConvertSuite) TestConvertJujuLXCContainer(c *gc.C) {
+	config := parseTestLXCConfig(c, jujuLXCConfig)
+	spec, err := convertLXCContainer(
+		"juju-machine-1-lxc-0", config,
+		existingPaths("/var/lib/lxc/juju-machine-1-lxc-0/rootfs", "/var/log/juju"),
+	)
+	c.Assert(err, jc.ErrorIsNil)
+
+	expected := &lxdContainerSpec{Rootfs: lxcRootfs{
+		Backend: "dir",
+		Path:    "/var/lib/lxc/juju-machine-1-lxc-0/rootfs",
+	}}
+	expected.Name = "juju-machine-1-lxc-0"
+	expected.Source = api.ContainerSource{Type: "none"}
+	expected.Profiles = []string{"default"}
+	expected.Architecture = "x86_64"
+	expected.Config = map[string]string{
+		"security.privileged": "true",
+		"security.nesting":    "true",
+		"boot.autostart":      "true",
+	}
+	expected.Devices = map[string]map[string]string{
+		"eth0": {"type": "none"},
+		"convert_net0": {
+			"type":    "nic",
+			"nictype": "bridged",
+			"name":    "eth0",
+			"parent":  "lxcbr0",
+			"hwaddr":  "00:16:3e:4d:0f:d5",
+			"mtu":     "1500",
+		},
+		"convert_mount0": {
+			"type":   "disk",
+			"source": "/var/log/juju",
+			"path":   "/var/log/juju",
+		},
+	}
+	c.Assert(spec, jc.DeepEquals, expected)
+}
+
+func (*lxcConvertSuite) TestConvertLXCContainerDevices(c *gc.C) {
+	rootfs := "/var/lib/lxc/foo/rootfs"
+	for i, test := range []struct {
+		about   string
+		config  string
+		devices map[string]map[string]string
+	}{{
+		about: "unbridged veth",
+		config: `
+lxc.network.type = veth
+lxc.network.veth.pair = vethfoo
+lxc.network.name = eth1`,
+		devices: map[string]map[string]string{
+			"convert_net0": {"type": "nic", "nictype": "p2p", "host_name": "vethfoo", "name": "eth1"},
+		},
+	}, {
+		about: "multiple networks",
+		config: `
+lxc.network.type = empty
+lxc.network.type = phys
+lxc.network.link = eth2
+lxc.network.type = macvlan
+lxc.network.link = eth3
+lxc.network.macvlan.mode = bridge`,
+		devices: map[string]map[string]string{
+			"convert_net1": {"type": "nic", "nictype": "physical", "parent": "eth2", "name": "eth0"},
+			"convert_net2": {"type": "nic", "nictype": "macvlan", "parent": "eth3", "name": "eth1"},
+		},
+	}, {
+		about: "vlan",
+		config: `
+lxc.network.type = vlan
+lxc.network.link = eth0
+lxc.network.vlan.id = 42`,
+		devices: map[string]map[string]string{
+			"convert_net0": {"type": "nic", "nictype": "macvlan", "parent": "eth0", "vlan": "42", "name": "eth0"},
+		},
+	}, {
+		about: "host network namespace",
+		config: `
+lxc.network.type = none`,
+		devices: map[string]map[string]string{},
+	}, {
+		about: "mounts",
+		config: `
+lxc.mount.entry = /srv/data /var/lib/lxc/foo/rootfs/srv/data none ro,bind 0 0
+lxc.mount.entry = /missing srv/missing none bind,optional 0 0
+lxc.mount.entry = sysfs sys sysfs defaults 0 0`,
+		devices: map[string]map[string]string{
+			"convert_mount0": {"type": "disk", "source": "/srv/data", "path": "/srv/data", "readonly": "true"},
+			"convert_mount1": {"type": "disk", "source": "/missing", "path": "/srv/missing", "optional": "true"},
+		},
+	}} {
+		c.Logf("test %d: %s", i, test.about)
+		config := parseTestLXCConfig(c, "lxc.rootfs = "+rootfs+"\n"+test.config)
+		spec, err := convertLXCContainer("foo", config, existingPaths(rootfs, "/srv/data"))
+		c.Assert(err, jc.ErrorIsNil)
+		test.devices["eth0"] = map[string]string{"type": "none"}
+		c.Check(spec.Devices, jc.DeepEquals, test.devices)
+	}
+}
+
+func (*lxcConvertSuite) TestConvertLXCContainerConfig(c *gc.C) {
+	rootfs := "/var/lib/lxc/foo/rootfs"
+	config := parseTestLXCConfig(c, `
+lxc.rootfs = /var/lib/lxc/foo/rootfs
+lxc.environment = FOO = bar
+lxc.start.auto = 0
+lxc.start.delay = 10
+lxc.start.order = 2
+lxc.aa_profile = unconfined
+lxc.cap.drop = sys_module mac_admin
+lxc.seccomp = /usr/share/lxc/config/common.seccomp
+`)
+	spec, err := convertLXCContainer("foo", config, existingPaths(rootfs))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(spec.Config, jc.DeepEquals, map[string]string{
+		"security.privileged":     "true",
+		"environment.FOO":         "bar",
+		"boot.autostart.delay":    "10",
+		"boot.autostart.priority": "2",
+		"raw.lxc":                 "lxc.aa_profile=unconfined",
+	})
+}
+
+func (*lxcConvertSuite) TestConvertLXCContainerErrors(c *gc.C) {
+	rootfs := "/var/lib/lxc/foo/rootfs"
+	for i, test := range []struct {
+		config string
+		err    string
+	}{{
+		config: "lxc.console = none",
+		err:    `unsupported config key "lxc.console"`,
+	}, {
+		config: "lxd.migrated = true",
+		err:    "container has already been migrated",
+	}, {
+		config: "lxc.id_map = u 0 100000 65536",
+		err:    "unprivileged containers aren't supported",
+	}, {
+		config: "lxc.utsname = bar",
+		err:    `container name doesn't match lxc.utsname "bar"`,
+	}, {
+		config: "lxc.autodev = 0",
+		err:    "containers without a minimal /dev aren't supported: lxc.autodev = 0",
+	}, {
+		config: "lxc.aa_allow_incomplete = yes",
+		err:    `incomplete AppArmor support isn't supported: parsing lxc.aa_allow_incomplete: .*`,
+	}, {
+		config: "lxc.stopsignal = SIGKILL",
+		err:    "custom lxc.stopsignal isn't supported",
+	}, {
+		config: "lxc.network.link = lxcbr0",
+		err:    "lxc.network.link set before lxc.network.type",
+	}, {
+		config: "lxc.network.type = vlan\nlxc.network.link = eth0",
+		err:    "vlan network requires lxc.network.link and lxc.network.vlan.id",
+	}, {
+		config: "lxc.network.type = vxlan",
+		err:    `"vxlan" network type isn't supported`,
+	}, {
+		config: "lxc.network.type = veth\nlxc.network.ipv4 = 10.0.0.2",
+		err:    `interface "eth0": parsing lxc.network.ipv4: invalid CIDR address: 10.0.0.2`,
+	}, {
+		config: "lxc.network.type = veth\nlxc.network.ipv4 = 10.0.0.2/24\nlxc.network.ipv4.gateway = foo",
+		err:    `interface "eth0": invalid lxc.network.ipv4.gateway "foo"`,
+	}, {
+		config: "lxc.network.type = veth\nlxc.network.script.up = /bin/up",
+		err:    "network config scripts aren't supported",
+	}, {
+		config: "lxc.mount.entry = /srv srv",
+		err:    `invalid mount entry "/srv srv"`,
+	}, {
+		config: "lxc.mount.entry = /srv srv none bind 0 0",
+		err:    `source "/srv" of mount entry "/srv srv none bind 0 0" doesn't exist`,
+	}, {
+		config: "lxc.seccomp = /etc/custom.seccomp",
+		err:    `custom seccomp profile "/etc/custom.seccomp" isn't supported`,
+	}, {
+		config: "lxc.cap.drop = sys_admin",
+		err:    `dropping capability "sys_admin" isn't supported`,
+	}} {
+		c.Logf("test %d: %s", i, test.config)
+		config := parseTestLXCConfig(c, "lxc.rootfs = "+rootfs+"\n"+test.config)
+		_, err := convertLXCContainer("foo", config, existingPaths(rootfs))
+		c.Check(err, gc.ErrorMatches, test.err)
+	}
+}
+
+func (*lxcConvertSuite) TestConvertLXCContainerRootfs(c *gc.C) {
+	_, err := convertLXCContainer("foo", parseTestLXCConfig(c, "lxc.utsname = foo"), existingPaths())
+	c.Assert(err, gc.ErrorMatches, "missing lxc.rootfs")
+	_, err = convertLXCContainer("foo", parseTestLXCConfig(c, "lxc.rootfs = /nowhere"), existingPaths())
+	c.Assert(err, gc.ErrorMatches, `rootfs "/nowhere" doesn't exist`)
+}
+
+func (*lxcConvertSuite) TestConvertClonedLXCContainer(c *gc.C) {
+	config := parseTestLXCConfig(c, `
+lxc.rootfs = overlayfs:/var/lib/lxc/juju-trusty-lxc-template/rootfs:/var/lib/lxc/foo/delta0
+lxc.mount.entry = /srv/data /var/lib/lxc/foo/rootfs/srv/data none bind 0 0
+`)
+	spec, err := convertLXCContainer("foo", config, existingPaths(
+		"/var/lib/lxc/juju-trusty-lxc-template/rootfs", "/var/lib/lxc/foo/delta0", "/srv/data",
+	))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(spec.Rootfs, jc.DeepEquals, lxcRootfs{
+		Backend: "overlayfs",
+		Lower:   "/var/lib/lxc/juju-trusty-lxc-template/rootfs",
+		Upper:   "/var/lib/lxc/foo/delta0",
+	})
+	c.Assert(spec.Devices["convert_mount0"]["path"], gc.Equals, "/srv/data")
+
+	_, err = convertLXCContainer("foo", config, existingPaths("/var/lib/lxc/foo/delta0"))
+	c.Assert(err, gc.ErrorMatches, `rootfs "/var/lib/lxc/juju-trusty-lxc-template/rootfs" doesn't exist`)
+}
+
+func (*lxcConvertSuite) TestConvertLXCContainerStaticAddresses(c *gc.C) {
+	rootfs := "/var/lib/lxc/foo/rootfs"
+	config := parseTestLXCConfig(c, `
+lxc.rootfs = /var/lib/lxc/foo/rootfs
+lxc.network.type = none
+lxc.network.type = veth
+lxc.network.link = br0
+lxc.network.ipv4 = 10.0.0.2/24 10.0.0.255
+lxc.network.ipv4 = 10.0.0.3/24
+lxc.network.ipv4.gateway = 10.0.0.1
+lxc.network.type = veth
+lxc.network.link = br1
+lxc.network.name = data0
+lxc.network.ipv6 = fd00::2/64
+lxc.network.ipv6.gateway = auto
+lxc.network.type = veth
+lxc.network.link = br2
+`)
+	spec, err := convertLXCContainer("foo", config, existingPaths(rootfs))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(spec.Interfaces, jc.DeepEquals, []containerInterface{{
+		Name:        "eth0",
+		IPv4:        []string{"10.0.0.2/24", "10.0.0.3/24"},
+		IPv4Gateway: "10.0.0.1",
+	}, {
+		Name: "data0",
+		IPv6: []string{"fd00::2/64"},
+	}})
+	c.Assert(spec.Config[staticInterfacesKey], gc.Equals,
+		`[{"name":"eth0","ipv4":["10.0.0.2/24","10.0.0.3/24"],"ipv4-gateway":"10.0.0.1"},{"name":"data0","ipv6":["fd00::2/64"]}]`,
+	)
+	c.Assert(spec.Warnings, gc.HasLen, 1)
+	c.Assert(spec.Devices["convert_net3"]["name"], gc.Equals, "eth1")
+	c.Assert(spec.usesVLAN(), jc.IsFalse)
+}
+
+func (*lxcConvertSuite) TestIfupdownStanzas(c *gc.C) {
+	stanzas := ifupdownStanzas([]containerInterface{{
+		Name:        "eth0",
+		IPv4:        []string{"10.0.0.2/24", "10.0.0.3/24"},
+		IPv4Gateway: "10.0.0.1",
+		IPv6:        []string{"fd00::2/64"},
+	}})
+	c.Assert(stanzas, gc.Equals, `# Static addresses configured by LXC before the
+# container was migrated to LXD.
+
+auto eth0
+iface eth0 inet static
+    address 10.0.0.2/24
+    gateway 10.0.0.1
+    post-up ip addr add 10.0.0.3/24 dev eth0
+    pre-down ip addr del 10.0.0.3/24 dev eth0
+iface eth0 inet6 static
+    address fd00::2/64
+`)
+}
+
+func (*lxcConvertSuite) TestWriteContainerInterfaces(c *gc.C) {
+	rootfs := c.MkDir()
+	err := os.MkdirAll(filepath.Join(rootfs, "etc/network/interfaces.d"), 0755)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ioutil.WriteFile(
+		filepath.Join(rootfs, "etc/network/interfaces"),
+		[]byte("auto lo\niface lo inet loopback\n"), 0644,
+	)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ioutil.WriteFile(
+		filepath.Join(rootfs, "etc/network/interfaces.d/eth0.cfg"),
+		[]byte("auto eth0\niface eth0 inet dhcp\n"), 0644,
+	)
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = writeContainerInterfaces(rootfs, []containerInterface{
+		{Name: "eth0", IPv4: []string{"10.0.0.2/24"}},
+		{Name: "eth1", IPv4: []string{"10.1.0.2/24"}},
+	})
+	c.Assert(err, jc.ErrorIsNil)
+
+	data, err := ioutil.ReadFile(filepath.Join(rootfs, containerInterfacesFile))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(configuredInterfaces(string(data)), jc.DeepEquals, []string{"eth1"})
+	data, err = ioutil.ReadFile(filepath.Join(rootfs, "etc/network/interfaces"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(string(data), gc.Equals,
+		"auto lo\niface lo inet loopback\n\nsource /etc/network/interfaces.d/*.cfg\n",
+	)
+}
+
+func (*lxcConvertSuite) TestLXDContainerNetworkConfig(c *gc.C) {
+	container := &lxdContainer{
+		Container: &api.Container{
+			ExpandedConfig: map[string]string{
+				"volatile.eth0.hwaddr": "00:16:3e:00:00:01",
+			},
+			ExpandedDevices: map[string]map[string]string{
+				"eth0":         {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+				"convert_net1": {"type": "nic", "nictype": "macvlan", "name": "eth1", "mtu": "9000"},
+				"root":         {"type": "disk", "path": "/"},
+			},
+		},
+		State: &api.ContainerState{
+			Network: map[string]api.ContainerStateNetwork{
+				"eth1": {
+					Hwaddr: "00:16:3e:00:00:02",
+					State:  "up",
+					Addresses: []api.ContainerStateNetworkAddress{
+						{Family: "inet", Address: "10.0.0.2", Netmask: "24", Scope: "global"},
+						{Family: "inet6", Address: "fe80::1", Netmask: "64", Scope: "link"},
+					},
+				},
+			},
+		},
+	}
+	container.Config = container.ExpandedConfig
+	config, err := lxdContainerNetworkConfig(container)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(config, jc.DeepEquals, []params.NetworkConfig{{
+		DeviceIndex:   0,
+		InterfaceName: "eth1",
+		InterfaceType: "ethernet",
+		MACAddress:    "00:16:3e:00:00:02",
+		MTU:           9000,
+		ConfigType:    "dhcp",
+		Address:       "10.0.0.2",
+		CIDR:          "10.0.0.0/24",
+	}, {
+		DeviceIndex:   1,
+		InterfaceName: "eth0",
+		InterfaceType: "ethernet",
+		MACAddress:    "00:16:3e:00:00:01",
+		ConfigType:    "dhcp",
+	}})
+}
+
+func (*lxcConvertSuite) TestLXDContainerNetworkConfigStaticVLAN(c *gc.C) {
+	container := &lxdContainer{
+		Container: &api.Container{
+			ExpandedConfig: map[string]string{
+				staticInterfacesKey: `[{"name":"eth0","ipv4":["10.0.0.2/24"],"ipv4-gateway":"10.0.0.1"},{"name":"eth1","ipv4":["192.168.1.2/24"]}]`,
+			},
+			ExpandedDevices: map[string]map[string]string{
+				"convert_net0": {"type": "nic", "nictype": "macvlan", "name": "eth0", "parent": "eth0", "vlan": "42", "hwaddr": "00:16:3e:00:00:01"},
+				"convert_net1": {"type": "nic", "nictype": "bridged", "name": "eth1", "parent": "br0", "hwaddr": "00:16:3e:00:00:02"},
+			},
+		},
+		State: &api.ContainerState{
+			Network: map[string]api.ContainerStateNetwork{
+				"eth0": {
+					Hwaddr: "00:16:3e:00:00:01",
+					State:  "up",
+					Addresses: []api.ContainerStateNetworkAddress{
+						{Family: "inet", Address: "10.0.0.2", Netmask: "24", Scope: "global"},
+					},
+				},
+			},
+		},
+	}
+	container.Config = container.ExpandedConfig
+	config, err := lxdContainerNetworkConfig(container)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(config, jc.DeepEquals, []params.NetworkConfig{{
+		DeviceIndex:    0,
+		InterfaceName:  "eth0",
+		InterfaceType:  "ethernet",
+		MACAddress:     "00:16:3e:00:00:01",
+		VLANTag:        42,
+		ConfigType:     "static",
+		Address:        "10.0.0.2",
+		CIDR:           "10.0.0.0/24",
+		GatewayAddress: "10.0.0.1",
+	}, {
+		// eth1 isn't in the container's state, so its
+		// recorded address is used.
+		DeviceIndex:   1,
+		InterfaceName: "eth1",
+		InterfaceType: "ethernet",
+		MACAddress:    "00:16:3e:00:00:02",
+		ConfigType:    "static",
+		Address:       "192.168.1.2",
+		CIDR:          "192.168.1.0/24",
+	}})
+}
+
+func (*lxcConvertSuite) TestJujuContainerMetadata(c *gc.C) {
+	metadata := jujuContainerMetadata("model-uuid", []byte("#cloud-config\n"))
+	c.Assert(metadata, jc.DeepEquals, map[string]string{
+		"user.network-config": "network:\n  config: \"disabled\"\n",
+		"user.juju-model":     "model-uuid",
+		"user.user-data":      "#cloud-config\n",
+		"boot.autostart":      "true",
+	})
+	c.Assert(jujuContainerMetadata("model-uuid", nil), gc.Not(jc.HasKey), "user.user-data")
+}
@@ -0,0 +1,322 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/1.25-upgrade/juju1/state"
+)
+
+// lxcSnapshotDir is the directory on each host in which host-local
+// snapshots of its LXC containers are kept.
+const lxcSnapshotDir = "/var/lib/lxc-backups"
+
+// Backup targets: backups are either copied to the client, or kept
+// on each container's host.
+const (
+	backupTargetClient = "client"
+	backupTargetHost   = "host"
+)
+
+func checkBackupTarget(target string) error {
+	switch target {
+	case backupTargetClient, backupTargetHost:
+		return nil
+	}
+	return errors.NotValidf("backup target %q (expected %q or %q)", target, backupTargetClient, backupTargetHost)
+}
+
+// lxcSnapshotRecordPath returns the path on the host of the record of
+// the named container's snapshot. The record is a backup manifest
+// holding just that snapshot.
+func lxcSnapshotRecordPath(instanceId string) string {
+	return path.Join(lxcSnapshotDir, instanceId+".json")
+}
+
+// lxcSnapshotScript returns a script that creates a snapshot of the
+// named LXC container in lxcSnapshotDir, compressed with the given
+// compressor, and writes the snapshot's size and SHA256 to stdout on
+// separate lines. The script fails without creating the snapshot if
+// there isn't enough free space for the uncompressed container.
+func lxcSnapshotScript(instanceId, file string, compressor lxcBackupCompressor) string {
+	compress := ""
+	if compressor.compress != "" {
+		compress = " | " + compressor.compress
+	}
+	return fmt.Sprintf(`
+set -eo pipefail
+dir=%[1]s
+mkdir -p -m 0700 $dir
+need=$(du -skx /var/lib/lxc/%[2]s | cut -f1)
+avail=$(df -Pk $dir | awk 'NR==2 {print $4}')
+if [ "$need" -gt "$avail" ]; then
+    echo "not enough disk space in $dir: need ${need}KiB, have ${avail}KiB" >&2
+    exit 1
+fi
+tar -C /var/lib/lxc -c %[2]s%[4]s > $dir/%[3]s.tmp
+mv $dir/%[3]s.tmp $dir/%[3]s
+stat -c %%s $dir/%[3]s
+sha256sum $dir/%[3]s | cut -d' ' -f1
+`, lxcSnapshotDir, instanceId, file, compress)
+}
+
+// lxcSnapshotVerifyScript returns a script that checks the snapshot
+// on the host matches its record.
+func lxcSnapshotVerifyScript(snapshot lxcBackup) string {
+	return fmt.Sprintf(`
+set -e
+cd %[1]s
+[ "$(stat -c %%s %[2]s)" = %[3]d ] || { echo "%[2]s: size mismatch" >&2; exit 1; }
+echo "%[4]s  %[2]s" | sha256sum -c --quiet -
+`, lxcSnapshotDir, snapshot.File, snapshot.Size, snapshot.SHA256)
+}
+
+// SnapshotLXCContainer creates a snapshot of the specified container
+// on its host, and records it alongside the snapshot. The container
+// should be stopped.
+func SnapshotLXCContainer(container, host *state.Machine, environUUID, compression string) (*lxcBackup, error) {
+	compressor, err := lookupLXCBackupCompressor(compression)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	hostAddr, err := getMachineAddress(host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	instanceId, err := container.InstanceId()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	file := string(instanceId) + compressor.extension
+
+	var stdout bytes.Buffer
+	rc, err := runViaSSH(
+		hostAddr,
+		lxcSnapshotScript(string(instanceId), file, compressor),
+		withSystemIdentity(),
+		withStdout(&stdout),
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rc != 0 {
+		return nil, errors.Errorf("snapshot of LXC container exited %d", rc)
+	}
+	fields := strings.Fields(stdout.String())
+	if len(fields) != 2 {
+		return nil, errors.Errorf("unexpected snapshot output %q", stdout.String())
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, errors.Annotate(err, "parsing snapshot size")
+	}
+
+	snapshot := lxcBackup{
+		ContainerId: container.Id(),
+		InstanceId:  string(instanceId),
+		HostId:      host.Id(),
+		File:        file,
+		Compression: compression,
+		Size:        size,
+		SHA256:      fields[1],
+		Created:     time.Now().UTC(),
+	}
+	record, err := json.MarshalIndent(&lxcBackupManifest{
+		EnvironUUID: environUUID,
+		Backups:     []lxcBackup{snapshot},
+	}, "", "  ")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	recordPath := lxcSnapshotRecordPath(string(instanceId))
+	rc, err = runViaSSH(
+		hostAddr,
+		fmt.Sprintf("cat > %[1]s.tmp && mv %[1]s.tmp %[1]s", recordPath),
+		withSystemIdentity(),
+		withStdin(bytes.NewReader(record)),
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rc != 0 {
+		return nil, errors.Errorf("writing snapshot record exited %d", rc)
+	}
+	return &snapshot, nil
+}
+
+// LXCSnapshot returns the record of the specified container's snapshot
+// on its host, having checked that the snapshot is of the container in
+// the given environment, and that it matches the record. If there is
+// no snapshot, an error satisfying errors.IsNotFound is returned.
+func LXCSnapshot(container, host *state.Machine, environUUID string) (*lxcBackup, error) {
+	hostAddr, err := getMachineAddress(host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	instanceId, err := container.InstanceId()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	recordPath := lxcSnapshotRecordPath(string(instanceId))
+
+	// Exit status 3 means there is no snapshot.
+	var stdout bytes.Buffer
+	rc, err := runViaSSH(
+		hostAddr,
+		fmt.Sprintf("[ -f %[1]s ] || exit 3; cat %[1]s", recordPath),
+		withSystemIdentity(),
+		withStdout(&stdout),
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rc == 3 {
+		return nil, errors.NotFoundf("snapshot of container %q", container.Id())
+	} else if rc != 0 {
+		return nil, errors.Errorf("reading snapshot record exited %d", rc)
+	}
+	var record lxcBackupManifest
+	if err := json.Unmarshal(stdout.Bytes(), &record); err != nil {
+		return nil, errors.Annotatef(err, "parsing %s", recordPath)
+	}
+	if record.EnvironUUID != environUUID {
+		return nil, errors.Errorf(
+			"snapshot of container %q is of environment %s, not %s",
+			container.Id(), record.EnvironUUID, environUUID,
+		)
+	}
+	snapshot := record.backup(container.Id())
+	if snapshot == nil || snapshot.InstanceId != string(instanceId) {
+		return nil, errors.Errorf("%s is not a snapshot of container %q", recordPath, container.Id())
+	}
+	if _, err := lookupLXCBackupCompressor(snapshot.Compression); err != nil {
+		return nil, errors.Annotatef(err, "snapshot of container %q", container.Id())
+	}
+
+	rc, err = runViaSSH(hostAddr, lxcSnapshotVerifyScript(*snapshot), withSystemIdentity())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rc != 0 {
+		return nil, errors.Errorf("snapshot of container %q does not match its record", container.Id())
+	}
+	return snapshot, nil
+}
+
+// RestoreLXCSnapshot restores the specified container from the given
+// snapshot on its host.
+func RestoreLXCSnapshot(host *state.Machine, snapshot *lxcBackup) error {
+	compressor, err := lookupLXCBackupCompressor(snapshot.Compression)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	hostAddr, err := getMachineAddress(host)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	script := fmt.Sprintf("tar -C /var/lib/lxc -xf %s", path.Join(lxcSnapshotDir, snapshot.File))
+	if compressor.decompress != "" {
+		script = fmt.Sprintf(
+			"set -o pipefail; %s < %s | tar -C /var/lib/lxc -x",
+			compressor.decompress, path.Join(lxcSnapshotDir, snapshot.File),
+		)
+	}
+	rc, err := runViaSSH(hostAddr, script, withSystemIdentity())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rc != 0 {
+		return errors.Errorf("restoring LXC snapshot exited %d", rc)
+	}
+	return nil
+}
+
+// RemoveLXCSnapshot removes the snapshot of the specified container,
+// and its record, from the container's host.
+func RemoveLXCSnapshot(container, host *state.Machine) error {
+	hostAddr, err := getMachineAddress(host)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	instanceId, err := container.InstanceId()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var files []string
+	for _, compressor := range lxcBackupCompressors {
+		files = append(files, path.Join(lxcSnapshotDir, string(instanceId)+compressor.extension))
+	}
+	files = append(files, lxcSnapshotRecordPath(string(instanceId)))
+	rc, err := runViaSSH(
+		hostAddr,
+		"rm -f "+strings.Join(files, " "),
+		withSystemIdentity(),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rc != 0 {
+		return errors.Errorf("removing LXC snapshot exited %d", rc)
+	}
+	return nil
+}
+
+// stopLXDCopy stops the LXD container that the specified LXC container
+// was migrated to, if there is one, and stops it from starting at
+// boot, so that the LXC container can be restored in its place. The
+// LXD container is left for the operator to remove.
+func stopLXDCopy(st *state.State, container, host *state.Machine) error {
+	byHost := map[*state.Machine][]*state.Machine{host: {container}}
+	names, err := getContainerNames(byHost, st.EnvironUUID())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	lxdContainers, err := ListLXDContainers(host)
+	if err != nil {
+		// LXD may not have been installed yet.
+		logger.Debugf("not checking for LXD containers on %q: %v", host.Id(), err)
+		return nil
+	}
+	for _, name := range []string{names[container].newName, names[container].oldName} {
+		if lxdContainers[name] == nil {
+			continue
+		}
+		logger.Infof("stopping LXD container %q, and disabling its autostart", name)
+		if err := StopLXDContainer(name, host); err != nil {
+			return errors.Trace(err)
+		}
+		if err := SetLXDContainerConfig(name, "boot.autostart", "false", host); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// restoreLXCContainerFromSnapshot restores the specified container
+// from its snapshot on its host, in place of any LXD container it was
+// migrated to, and starts it.
+func restoreLXCContainerFromSnapshot(st *state.State, container, host *state.Machine) error {
+	snapshot, err := LXCSnapshot(container, host, st.EnvironUUID())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := stopLXDCopy(st, container, host); err != nil {
+		return errors.Annotate(err, "stopping LXD container")
+	}
+	logger.Debugf("restoring LXC container %q from %s", container.Id(), snapshot.File)
+	if err := RestoreLXCSnapshot(host, snapshot); err != nil {
+		return errors.Annotate(err, "restoring LXC container")
+	}
+	logger.Debugf("restarting LXC container %q", container.Id())
+	return errors.Annotate(StartLXCContainer(container, host), "starting LXC container")
+}
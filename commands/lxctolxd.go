@@ -0,0 +1,427 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/lxc/lxd"
+	lxdshared "github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+)
+
+const (
+	// lxdMigrationKey is set in the config of an LXD container while
+	// an LXC container is being migrated to it, recording how far the
+	// migration got so that it can be resumed if it's interrupted.
+	lxdMigrationKey = "user.juju-lxc-migration"
+
+	// migrationCreated means the LXD container has been created, but
+	// the LXC container's rootfs may not have been transferred to it.
+	migrationCreated = "created"
+
+	// migrationTransferred means the LXC container's rootfs has been
+	// transferred to the LXD container.
+	migrationTransferred = "rootfs-transferred"
+)
+
+// lxcMigrationResult records the outcome of migrating an LXC
+// container to LXD on a host.
+type lxcMigrationResult struct {
+	Container string   `json:"container"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+var lxcToLXDImplDoc = `
+
+lxc-to-lxd-impl must be executed as root on a host of LXC containers.
+
+The command converts each of the named LXC containers, which must be
+stopped, into an LXD container, and moves or copies its root
+filesystem into LXD. The LXD containers are given the profile and
+metadata that Juju 2.x gives the containers it provisions. The result
+for each container is written to stdout as JSON.
+
+An LXD container left part-way through an earlier migration is removed
+and created again, unless its rootfs had already been transferred, in
+which case the migration is completed.
+
+`
+
+func newLXCToLXDImplCommand() cmd.Command {
+	return &lxcToLXDImplCommand{}
+}
+
+type lxcToLXDImplCommand struct {
+	cmd.CommandBase
+	dryRun     bool
+	moveRootfs bool
+	lxcPath    string
+	lxdPath    string
+	modelUUID  string
+	containers []string
+}
+
+func (c *lxcToLXDImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "lxc-to-lxd-impl",
+		Args:    "<container> ...",
+		Purpose: "host aspect of migrate-lxc",
+		Doc:     lxcToLXDImplDoc,
+	}
+}
+
+func (c *lxcToLXDImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.BoolVar(&c.dryRun, "dry-run", false, "check the containers can be migrated, without making any changes")
+	f.BoolVar(&c.moveRootfs, "move-rootfs", false, "move the container rootfs rather than copying it")
+	f.StringVar(&c.lxcPath, "lxc-path", "/var/lib/lxc", "LXC container path")
+	f.StringVar(&c.lxdPath, "lxd-path", "/var/lib/lxd", "LXD path")
+	f.StringVar(&c.modelUUID, "model-uuid", "", "UUID of the containers' model")
+}
+
+func (c *lxcToLXDImplCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no containers specified")
+	}
+	if c.modelUUID == "" {
+		return errors.New("--model-uuid is required")
+	}
+	c.containers = args
+	return nil
+}
+
+func (c *lxcToLXDImplCommand) Run(ctx *cmd.Context) error {
+	client, err := connectLXD(c.lxdPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	storage, err := detectLXDStorage(client)
+	if err != nil {
+		return errors.Annotate(err, "detecting LXD storage")
+	}
+	ctx.Infof("LXD storage: %s", storage)
+	containers, err := client.ListContainers()
+	if err != nil {
+		return errors.Annotate(err, "listing LXD containers")
+	}
+	existing := make(map[string]*api.Container)
+	for i, container := range containers {
+		existing[container.Name] = &containers[i]
+	}
+	status, err := client.ServerStatus()
+	if err != nil {
+		return errors.Annotate(err, "getting LXD server status")
+	}
+	if c.dryRun {
+		if _, err := client.ProfileConfig(jujuLXDProfile); err != nil {
+			return errors.Annotatef(err, "getting %q profile", jujuLXDProfile)
+		}
+	} else if err := ensureJujuLXDProfile(client, status); err != nil {
+		return errors.Trace(err)
+	}
+
+	results := make([]lxcMigrationResult, len(c.containers))
+	for i, name := range c.containers {
+		ctx.Infof("==> Processing container %q", name)
+		results[i].Container = name
+		warnings, err := c.migrate(ctx, client, status, storage, name, existing[name])
+		if err != nil {
+			results[i].Error = err.Error()
+		}
+		results[i].Warnings = warnings
+		if results[i].Error != "" {
+			ctx.Infof("Not migrating %q: %s", name, results[i].Error)
+		}
+	}
+	return json.NewEncoder(ctx.GetStdout()).Encode(results)
+}
+
+// migrate migrates the named LXC container to LXD, returning any
+// warnings about differences in the container's behaviour. existing
+// is the LXD container with the same name, if there is one.
+func (c *lxcToLXDImplCommand) migrate(
+	ctx *cmd.Context,
+	client *lxd.Client,
+	status *api.Server,
+	storage *lxdStorage,
+	name string,
+	existing *api.Container,
+) ([]string, error) {
+	var progress string
+	if existing != nil {
+		progress = existing.Config[lxdMigrationKey]
+		if progress == "" {
+			return nil, errors.New("LXD container already exists")
+		}
+	}
+	configPath := filepath.Join(c.lxcPath, name, "config")
+	config, err := parseLXCConfig(configPath)
+	if err != nil {
+		return nil, errors.Annotate(err, "parsing LXC config")
+	}
+	spec, err := convertLXCContainer(name, config, pathExists)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := setJujuContainerMetadata(spec, c.modelUUID); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if logger.IsDebugEnabled() {
+		data, _ := json.MarshalIndent(spec.ContainersPost, "", "  ")
+		logger.Debugf("LXD container config for %q: %s", name, data)
+	}
+	if spec.usesVLAN() && !lxdshared.StringInSlice("network_vlan", status.APIExtensions) {
+		return nil, errors.New("LXD doesn't support VLAN devices; upgrade LXD to migrate this container")
+	}
+	for _, warning := range spec.Warnings {
+		ctx.Infof("Warning: %s", warning)
+	}
+	if progress != "" {
+		ctx.Infof("LXD container %q was left part-way through migration (%s)", name, progress)
+	}
+	if c.dryRun {
+		return spec.Warnings, nil
+	}
+
+	running, err := lxcContainerRunning(c.lxcPath, name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if running {
+		return nil, errors.New("only stopped containers can be migrated")
+	}
+
+	switch progress {
+	case migrationTransferred:
+		ctx.Infof("Completing migration to LXD container %q", name)
+		if err := c.completeTransfer(ctx, storage, name, spec); err != nil {
+			return nil, errors.Trace(err)
+		}
+	case migrationCreated:
+		ctx.Infof("Removing partially migrated LXD container %q", name)
+		if err := removePartialContainer(client, name, spec.Rootfs); err != nil {
+			return nil, errors.Annotate(err, "removing partially migrated LXD container")
+		}
+		fallthrough
+	default:
+		ctx.Infof("Creating LXD container %q", name)
+		if spec.Config == nil {
+			spec.Config = make(map[string]string)
+		}
+		spec.Config[lxdMigrationKey] = migrationCreated
+		if err := createLXDContainer(client, spec.ContainersPost); err != nil {
+			return nil, errors.Annotate(err, "creating LXD container")
+		}
+		if err := c.transferRootfs(ctx, client, storage, name, spec); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	// The LXD container is complete once it no longer records the
+	// migration's progress, before the LXC container is marked, so
+	// that an LXC container is never marked as migrated to a
+	// partial LXD container.
+	if err := client.SetContainerConfig(name, lxdMigrationKey, ""); err != nil {
+		return nil, errors.Annotate(err, "completing LXD container")
+	}
+
+	// Mark the LXC container as migrated.
+	f, err := os.OpenFile(configPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, "lxd.migrated=true")
+	return spec.Warnings, errors.Trace(err)
+}
+
+// transferRootfs moves or copies the LXC container's root filesystem
+// into the newly created LXD container. Root filesystems are only
+// moved when they can be renamed into LXD's directory; otherwise
+// they're copied, and if moving was requested the original is then
+// removed. Cloned root filesystems are always copied, and left in
+// place, as they're shared with the container they were cloned from.
+//
+// Once the rootfs is in the LXD container, that's recorded in its
+// config, and the transfer is completed with completeTransfer.
+func (c *lxcToLXDImplCommand) transferRootfs(ctx *cmd.Context, client *lxd.Client, storage *lxdStorage, name string, spec *lxdContainerSpec) error {
+	rootfs := spec.Rootfs
+	source, unmountSource, err := rootfs.mount()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer unmountSource()
+
+	target, unmountTarget, err := storage.mountContainerRootfs(c.lxdPath, name)
+	if err != nil {
+		return errors.Annotate(err, "mounting LXD container rootfs")
+	}
+	defer unmountTarget()
+
+	if c.moveRootfs && storage.Driver == "dir" && !rootfs.isClone() {
+		ctx.Infof("Moving container rootfs")
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		if err := runCommand("mv", source, target); err != nil {
+			return errors.Annotate(err, "moving rootfs")
+		}
+		if err := os.Mkdir(source, 0755); err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		ctx.Infof("Copying container rootfs into LXD %s storage", storage.Driver)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return errors.Trace(err)
+		}
+		if err := runCommand(
+			"rsync", "-Aa", "--sparse", "--acls", "--numeric-ids", "--hard-links",
+			source+"/", target+"/",
+		); err != nil {
+			return errors.Annotate(err, "copying rootfs")
+		}
+	}
+	if err := client.SetContainerConfig(name, lxdMigrationKey, migrationTransferred); err != nil {
+		return errors.Annotate(err, "recording rootfs transfer")
+	}
+	return errors.Trace(c.finishTransfer(ctx, target, spec))
+}
+
+// completeTransfer completes the migration to an LXD container whose
+// rootfs has already been transferred.
+func (c *lxcToLXDImplCommand) completeTransfer(ctx *cmd.Context, storage *lxdStorage, name string, spec *lxdContainerSpec) error {
+	target, unmountTarget, err := storage.mountContainerRootfs(c.lxdPath, name)
+	if err != nil {
+		return errors.Annotate(err, "mounting LXD container rootfs")
+	}
+	defer unmountTarget()
+	return errors.Trace(c.finishTransfer(ctx, target, spec))
+}
+
+// finishTransfer removes the LXC container's rootfs if moving it was
+// requested and it was copied, and writes any static addresses that
+// LXC configured into the container's network configuration.
+func (c *lxcToLXDImplCommand) finishTransfer(ctx *cmd.Context, target string, spec *lxdContainerSpec) error {
+	if c.moveRootfs && !spec.Rootfs.isClone() {
+		ctx.Infof("Removing LXC container rootfs")
+		if err := os.RemoveAll(spec.Rootfs.Path); err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.Mkdir(spec.Rootfs.Path, 0755); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(c.configureInterfaces(ctx, target, spec))
+}
+
+// configureInterfaces writes the static addresses that LXC configured
+// into the network configuration in the container's rootfs.
+func (c *lxcToLXDImplCommand) configureInterfaces(ctx *cmd.Context, rootfs string, spec *lxdContainerSpec) error {
+	if len(spec.Interfaces) == 0 {
+		return nil
+	}
+	ctx.Infof("Configuring static addresses in container")
+	return errors.Annotate(
+		writeContainerInterfaces(rootfs, spec.Interfaces),
+		"configuring container network",
+	)
+}
+
+// createLXDContainer creates an LXD container with no image source,
+// for the LXC container's rootfs to be transferred into. The vendored
+// LXD client's Init method can only create containers from images,
+// so the request is made with the client's HTTP client, and the
+// operation is waited for with the LXD client.
+func createLXDContainer(client *lxd.Client, post api.ContainersPost) error {
+	body, err := json.Marshal(post)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req, err := http.NewRequest("POST", client.BaseURL+"/1.0/containers", bytes.NewReader(body))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	httpResp, err := client.Http.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer httpResp.Body.Close()
+
+	var resp api.Response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return errors.Annotate(err, "decoding LXD response")
+	}
+	if resp.Type == api.ErrorResponse {
+		return errors.New(resp.Error)
+	}
+	return errors.Trace(client.WaitForSuccess(resp.Operation))
+}
+
+// removePartialContainer deletes an LXD container that was created for
+// the LXC container with the given rootfs, but which the rootfs wasn't
+// completely transferred to. If the LXC container's rootfs is missing
+// or empty it may have been moved into the LXD container, so the LXD
+// container is left alone.
+func removePartialContainer(client *lxd.Client, name string, rootfs lxcRootfs) error {
+	if !rootfs.isClone() {
+		entries, err := ioutil.ReadDir(rootfs.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
+		if len(entries) == 0 {
+			return errors.Errorf(
+				"LXC container rootfs %s is missing or empty, and may have been moved to the LXD container; restore the LXC container with restore-lxc",
+				rootfs.Path,
+			)
+		}
+	}
+	container, err := client.ContainerInfo(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if container.IsActive() {
+		return errors.New("LXD container is running")
+	}
+	resp, err := client.Delete(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(client.WaitForSuccess(resp.Operation))
+}
+
+// lxcContainerRunning reports whether the named LXC container in
+// lxcPath is running.
+func lxcContainerRunning(lxcPath, name string) (bool, error) {
+	output, err := exec.Command("lxc-info", "-P", lxcPath, "-s", "-n", name).CombinedOutput()
+	if err != nil {
+		return false, errors.Annotatef(err, "getting LXC container state: %s", output)
+	}
+	return !strings.Contains(string(output), "STOPPED"), nil
+}
+
+func runCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return errors.Annotatef(err, "%s: %s", name, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"encoding/json"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/lxc/lxd"
+	lxdshared "github.com/lxc/lxd/shared"
+)
+
+var lxdContainersImplDoc = `
+
+lxd-containers-impl must be executed as root on a host of LXD
+containers.
+
+The command manages the host's LXD containers with the LXD client,
+for the migrate-lxc and restore-lxc commands:
+
+    list                           write the containers, with their state
+                                   and snapshots, to stdout as JSON
+    start <container> ...          start the containers
+    stop <container> ...           stop the containers that are running
+    rename <container> <new name>  rename a container
+    set-config <container> <key> <value>
+                                   set a container config key
+
+`
+
+func newLXDContainersImplCommand() cmd.Command {
+	return &lxdContainersImplCommand{}
+}
+
+type lxdContainersImplCommand struct {
+	cmd.CommandBase
+	lxdPath string
+	action  string
+	args    []string
+}
+
+func (c *lxdContainersImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "lxd-containers-impl",
+		Args:    "<action> [<arg> ...]",
+		Purpose: "host aspect of managing LXD containers",
+		Doc:     lxdContainersImplDoc,
+	}
+}
+
+func (c *lxdContainersImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.lxdPath, "lxd-path", "/var/lib/lxd", "LXD path")
+}
+
+func (c *lxdContainersImplCommand) Init(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no action specified")
+	}
+	c.action, c.args = args[0], args[1:]
+	var expected int
+	switch c.action {
+	case "list":
+		expected = 0
+	case "start", "stop":
+		if len(c.args) == 0 {
+			return errors.Errorf("%s: no containers specified", c.action)
+		}
+		return nil
+	case "rename":
+		expected = 2
+	case "set-config":
+		expected = 3
+	default:
+		return errors.Errorf("unknown action %q", c.action)
+	}
+	if len(c.args) != expected {
+		return errors.Errorf("%s: expected %d arguments, got %d", c.action, expected, len(c.args))
+	}
+	return nil
+}
+
+func (c *lxdContainersImplCommand) Run(ctx *cmd.Context) error {
+	client, err := connectLXD(c.lxdPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	switch c.action {
+	case "list":
+		containers, err := listLXDContainers(client)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(json.NewEncoder(ctx.GetStdout()).Encode(containers))
+	case "start":
+		for _, name := range c.args {
+			if err := lxdContainerAction(client, name, lxdshared.Start, false); err != nil {
+				return errors.Annotatef(err, "starting LXD container %q", name)
+			}
+		}
+	case "stop":
+		for _, name := range c.args {
+			container, err := client.ContainerInfo(name)
+			if err != nil {
+				return errors.Annotatef(err, "getting LXD container %q", name)
+			}
+			if !container.IsActive() {
+				continue
+			}
+			if err := lxdContainerAction(client, name, lxdshared.Stop, true); err != nil {
+				return errors.Annotatef(err, "stopping LXD container %q", name)
+			}
+		}
+	case "rename":
+		resp, err := client.Rename(c.args[0], c.args[1])
+		if err == nil {
+			err = client.WaitForSuccess(resp.Operation)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "renaming LXD container %q", c.args[0])
+		}
+	case "set-config":
+		if err := client.SetContainerConfig(c.args[0], c.args[1], c.args[2]); err != nil {
+			return errors.Annotatef(err, "setting %s of LXD container %q", c.args[1], c.args[0])
+		}
+	}
+	return nil
+}
+
+// listLXDContainers returns the host's LXD containers, with their
+// state and snapshots, in the same form as lxc list --format=json.
+func listLXDContainers(client *lxd.Client) ([]*lxdContainer, error) {
+	containers, err := client.ListContainers()
+	if err != nil {
+		return nil, errors.Annotate(err, "listing LXD containers")
+	}
+	result := make([]*lxdContainer, len(containers))
+	for i := range containers {
+		name := containers[i].Name
+		state, err := client.ContainerState(name)
+		if err != nil {
+			return nil, errors.Annotatef(err, "getting state of LXD container %q", name)
+		}
+		snapshots, err := client.ListSnapshots(name)
+		if err != nil {
+			return nil, errors.Annotatef(err, "listing snapshots of LXD container %q", name)
+		}
+		result[i] = &lxdContainer{
+			Container: &containers[i],
+			State:     state,
+			Snapshots: snapshots,
+		}
+	}
+	return result, nil
+}
+
+// lxdContainerAction starts or stops the named LXD container, and
+// waits for it to finish.
+func lxdContainerAction(client *lxd.Client, name string, action lxdshared.ContainerAction, force bool) error {
+	resp, err := client.Action(name, action, -1, force, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(client.WaitForSuccess(resp.Operation))
+}
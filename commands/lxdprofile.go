@@ -0,0 +1,75 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/errors"
+	"github.com/lxc/lxd"
+	lxdshared "github.com/lxc/lxd/shared"
+	"github.com/lxc/lxd/shared/api"
+
+	"github.com/juju/1.25-upgrade/juju1/container"
+	"github.com/juju/1.25-upgrade/juju2/cloudconfig/containerinit"
+	"github.com/juju/1.25-upgrade/juju2/tools/lxdclient"
+)
+
+// jujuLXDProfile is the profile that Juju 2.x applies to the LXD
+// containers it provisions on machines.
+const jujuLXDProfile = "default"
+
+// ensureJujuLXDProfile ensures that the profile Juju 2.x expects
+// exists and is configured the way Juju 2.x configures it when it
+// initialises LXD on a machine. For LXD versions with the network API,
+// that means the profile has an eth0 device on the default bridge;
+// older versions are left for Juju to configure.
+func ensureJujuLXDProfile(client *lxd.Client, status *api.Server) error {
+	if _, err := client.ProfileConfig(jujuLXDProfile); err != nil {
+		return errors.Annotatef(err, "getting %q profile", jujuLXDProfile)
+	}
+	if !lxdshared.StringInSlice("network", status.APIExtensions) {
+		return nil
+	}
+	return errors.Annotatef(
+		lxdclient.CreateDefaultBridgeInDefaultProfile(client),
+		"configuring %q profile", jujuLXDProfile,
+	)
+}
+
+// jujuContainerMetadata returns the config that Juju 2.x sets on the
+// LXD containers it provisions, for a container in the given model.
+// userData is the container's cloud-init user data, if known.
+func jujuContainerMetadata(modelUUID string, userData []byte) map[string]string {
+	metadata := map[string]string{
+		"user.network-config": containerinit.CloudInitNetworkConfigDisabled,
+		"user.juju-model":     modelUUID,
+		"boot.autostart":      "true",
+	}
+	if userData != nil {
+		metadata["user.user-data"] = string(userData)
+	}
+	return metadata
+}
+
+// setJujuContainerMetadata makes the container spec look like one that
+// Juju 2.x provisioned: it applies the Juju profile, and sets the
+// config Juju 2.x sets, including the cloud-init user data that Juju
+// 1.25 created the LXC container with.
+func setJujuContainerMetadata(spec *lxdContainerSpec, modelUUID string) error {
+	userData, err := ioutil.ReadFile(filepath.Join(container.ContainerDir, spec.Name, "cloud-init"))
+	if os.IsNotExist(err) {
+		logger.Warningf("no cloud-init user data found for %q", spec.Name)
+		userData = nil
+	} else if err != nil {
+		return errors.Annotate(err, "reading cloud-init user data")
+	}
+	spec.Profiles = []string{jujuLXDProfile}
+	for key, value := range jujuContainerMetadata(modelUUID, userData) {
+		spec.Config[key] = value
+	}
+	return nil
+}
@@ -0,0 +1,567 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/lxc/lxd"
+	lxdshared "github.com/lxc/lxd/shared"
+)
+
+const (
+	// defaultLVMThinPool and defaultLVMVolumeSize are the defaults
+	// LXD uses when they're not configured.
+	defaultLVMThinPool   = "LXDPool"
+	defaultLVMVolumeSize = "10GiB"
+)
+
+// lxcRootfs describes where an LXC container's root filesystem is
+// stored, as specified by lxc.rootfs.
+type lxcRootfs struct {
+	// Backend is the LXC storage backend: "dir" or "btrfs" for
+	// plain directories, or "overlayfs" or "aufs" for containers
+	// cloned from another with lxc-clone.
+	Backend string `json:"backend"`
+
+	// Path is the directory holding the root filesystem, for
+	// the "dir" and "btrfs" backends.
+	Path string `json:"path,omitempty"`
+
+	// Lower and Upper are the read-only directory of the cloned
+	// container and the read-write delta directory, for the
+	// "overlayfs" and "aufs" backends.
+	Lower string `json:"lower,omitempty"`
+	Upper string `json:"upper,omitempty"`
+}
+
+// isClone reports whether the root filesystem is a union of the root
+// filesystem of another container and a delta, and so can only be
+// copied, not moved.
+func (r lxcRootfs) isClone() bool {
+	return r.Backend == "overlayfs" || r.Backend == "aufs"
+}
+
+// parseLXCRootfs parses the value of lxc.rootfs, and of
+// lxc.rootfs.backend if set.
+func parseLXCRootfs(value, backend string) (lxcRootfs, error) {
+	fields := strings.Split(value, ":")
+	switch {
+	case len(fields) == 1:
+		if strings.HasPrefix(value, "/dev/") {
+			return lxcRootfs{}, errors.Errorf("block device rootfs %q isn't supported", value)
+		}
+		if backend == "" {
+			backend = "dir"
+		}
+		if backend != "dir" && backend != "btrfs" {
+			return lxcRootfs{}, errors.Errorf("%q rootfs backend isn't supported", backend)
+		}
+		return lxcRootfs{Backend: backend, Path: value}, nil
+	case fields[0] == "dir" && len(fields) == 2:
+		return lxcRootfs{Backend: "dir", Path: fields[1]}, nil
+	case (fields[0] == "overlayfs" || fields[0] == "overlay") && len(fields) == 3:
+		return lxcRootfs{Backend: "overlayfs", Lower: fields[1], Upper: fields[2]}, nil
+	case fields[0] == "aufs" && len(fields) == 3:
+		return lxcRootfs{Backend: "aufs", Lower: fields[1], Upper: fields[2]}, nil
+	}
+	return lxcRootfs{}, errors.Errorf("rootfs %q isn't supported", value)
+}
+
+// paths returns the directories that make up the root filesystem.
+func (r lxcRootfs) paths() []string {
+	if r.isClone() {
+		return []string{r.Lower, r.Upper}
+	}
+	return []string{r.Path}
+}
+
+// mount makes the root filesystem available, returning the directory
+// holding it and a function to call once done with it. Clones are
+// mounted in a temporary directory.
+func (r lxcRootfs) mount() (string, func(), error) {
+	if !r.isClone() {
+		return r.Path, func() {}, nil
+	}
+	dir, err := ioutil.TempDir("", "lxc-rootfs")
+	if err != nil {
+		return "", nil, errors.Trace(err)
+	}
+	var args []string
+	if r.Backend == "aufs" {
+		args = []string{"-t", "aufs", "-o", fmt.Sprintf("br=%s=rw:%s=ro", r.Upper, r.Lower), "none", dir}
+	} else if kernelHasFilesystem("overlayfs") {
+		// Trusty's kernel only has the original overlayfs.
+		args = []string{"-t", "overlayfs", "-o", fmt.Sprintf("ro,lowerdir=%s,upperdir=%s", r.Lower, r.Upper), "none", dir}
+	} else {
+		// Stacking the delta on the cloned rootfs read-only
+		// avoids the need for a work directory.
+		args = []string{"-t", "overlay", "-o", fmt.Sprintf("ro,lowerdir=%s:%s", r.Upper, r.Lower), "none", dir}
+	}
+	if err := runCommand("mount", args...); err != nil {
+		os.Remove(dir)
+		return "", nil, errors.Annotate(err, "mounting cloned rootfs")
+	}
+	return dir, func() {
+		if err := runCommand("umount", dir); err != nil {
+			logger.Warningf("unmounting %s: %v", dir, err)
+			return
+		}
+		os.Remove(dir)
+	}, nil
+}
+
+func kernelHasFilesystem(fstype string) bool {
+	data, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == fstype {
+			return true
+		}
+	}
+	return false
+}
+
+// lxdStorage describes where LXD stores its containers on a host.
+type lxdStorage struct {
+	// Driver is the LXD storage driver: "dir", "btrfs", "zfs"
+	// or "lvm".
+	Driver string `json:"driver"`
+
+	// Pool is the LXD storage pool that new containers are
+	// created in, or "" if LXD predates storage pools.
+	Pool string `json:"pool,omitempty"`
+
+	// ZFSPool is the ZFS pool or dataset holding the containers,
+	// for the "zfs" driver.
+	ZFSPool string `json:"zfs-pool,omitempty"`
+
+	// VolumeGroup and ThinPool are the LVM volume group and thin
+	// pool holding the containers, and VolumeSize the size of
+	// each container's logical volume, for the "lvm" driver.
+	VolumeGroup string `json:"volume-group,omitempty"`
+	ThinPool    string `json:"thin-pool,omitempty"`
+	VolumeSize  int64  `json:"volume-size,omitempty"`
+}
+
+func (s lxdStorage) String() string {
+	desc := s.Driver
+	if s.Pool != "" {
+		desc = fmt.Sprintf("%s (pool %q)", desc, s.Pool)
+	}
+	switch s.Driver {
+	case "zfs":
+		desc += fmt.Sprintf(", ZFS pool %q", s.ZFSPool)
+	case "lvm":
+		desc += fmt.Sprintf(", volume group %q, %dMiB volumes", s.VolumeGroup, s.VolumeSize>>20)
+	}
+	return desc
+}
+
+func connectLXD(lxdPath string) (*lxd.Client, error) {
+	client, err := lxd.NewClientFromInfo(lxd.ConnectInfo{
+		Name: "local",
+		RemoteConfig: lxd.RemoteConfig{
+			Addr: "unix://" + filepath.Join(lxdPath, "unix.socket"),
+		},
+	})
+	return client, errors.Annotate(err, "connecting to LXD")
+}
+
+// detectLXDStorage determines where LXD will store the containers it
+// creates. LXD with storage pools uses the pool of the default
+// profile's root disk; older versions of LXD have server-wide storage
+// configuration.
+func detectLXDStorage(client *lxd.Client) (*lxdStorage, error) {
+	status, err := client.ServerStatus()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !lxdshared.StringInSlice("storage", status.APIExtensions) {
+		storage := &lxdStorage{Driver: status.Environment.Storage}
+		serverConfig := func(key string) string {
+			value, _ := status.Config[key].(string)
+			return value
+		}
+		if pool := serverConfig("storage.zfs_pool_name"); pool != "" {
+			storage.Driver = "zfs"
+			storage.ZFSPool = pool
+		} else if vg := serverConfig("storage.lvm_vg_name"); vg != "" {
+			storage.Driver = "lvm"
+			storage.VolumeGroup = vg
+			storage.ThinPool = serverConfig("storage.lvm_thinpool_name")
+			if err := storage.setVolumeSize(serverConfig("storage.lvm_volume_size")); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		if storage.Driver == "" {
+			storage.Driver = "dir"
+		}
+		return storage, nil
+	}
+
+	profile, err := client.ProfileConfig("default")
+	if err != nil {
+		return nil, errors.Annotate(err, "getting default profile")
+	}
+	var poolName string
+	for _, device := range profile.Devices {
+		if device["type"] == "disk" && device["path"] == "/" {
+			poolName = device["pool"]
+		}
+	}
+	if poolName == "" {
+		return nil, errors.New("default profile has no root disk")
+	}
+	pools, err := client.ListStoragePools()
+	if err != nil {
+		return nil, errors.Annotate(err, "listing storage pools")
+	}
+	for _, pool := range pools {
+		if pool.Name != poolName {
+			continue
+		}
+		storage := &lxdStorage{Driver: pool.Driver, Pool: pool.Name}
+		switch pool.Driver {
+		case "zfs":
+			storage.ZFSPool = pool.Config["zfs.pool_name"]
+			if storage.ZFSPool == "" {
+				storage.ZFSPool = pool.Name
+			}
+		case "lvm":
+			storage.VolumeGroup = pool.Config["lvm.vg_name"]
+			if storage.VolumeGroup == "" {
+				storage.VolumeGroup = pool.Name
+			}
+			storage.ThinPool = pool.Config["lvm.thinpool_name"]
+			if err := storage.setVolumeSize(pool.Config["volume.size"]); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		return storage, nil
+	}
+	return nil, errors.Errorf("storage pool %q not found", poolName)
+}
+
+func (s *lxdStorage) setVolumeSize(size string) error {
+	if s.ThinPool == "" {
+		s.ThinPool = defaultLVMThinPool
+	}
+	if size == "" {
+		size = defaultLVMVolumeSize
+	}
+	volumeSize, err := lxdshared.ParseByteSizeString(size)
+	if err != nil {
+		return errors.Annotatef(err, "parsing LVM volume size %q", size)
+	}
+	s.VolumeSize = volumeSize
+	return nil
+}
+
+// available returns the number of bytes available for new
+// containers.
+func (s *lxdStorage) available(lxdPath string) (int64, error) {
+	switch s.Driver {
+	case "zfs":
+		output, err := exec.Command("zfs", "get", "-H", "-p", "-o", "value", "available", s.ZFSPool).Output()
+		if err != nil {
+			return 0, errors.Annotatef(err, "getting available space in %q", s.ZFSPool)
+		}
+		return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	case "lvm":
+		// Thin volumes are allocated from the thin pool,
+		// whose free space is a percentage of its size.
+		output, err := exec.Command(
+			"lvs", "--noheadings", "--nosuffix", "--units", "b",
+			"-o", "lv_size,data_percent", s.VolumeGroup+"/"+s.ThinPool,
+		).Output()
+		if err != nil {
+			return 0, errors.Annotatef(err, "getting available space in %s/%s", s.VolumeGroup, s.ThinPool)
+		}
+		fields := strings.Fields(string(output))
+		if len(fields) != 2 {
+			return 0, errors.Errorf("unexpected lvs output %q", output)
+		}
+		size, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		used, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		return int64(size * (100 - used) / 100), nil
+	}
+	dir := lxdPath
+	if s.Pool != "" {
+		dir = filepath.Join(lxdPath, "storage-pools", s.Pool)
+	}
+	if !pathExists(dir) {
+		// LXD isn't installed yet, and will create its
+		// directory in /var/lib.
+		dir = filepath.Dir(lxdPath)
+	}
+	return freeSpace(dir)
+}
+
+func freeSpace(dir string) (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
+
+// deviceOf returns the ID of the device holding path.
+func deviceOf(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return uint64(st.Dev), nil
+}
+
+// mountContainerRootfs makes the root filesystem of the newly created
+// LXD container available, returning the directory to copy the LXC
+// container's root filesystem to, and a function to call once done.
+func (s *lxdStorage) mountContainerRootfs(lxdPath, name string) (string, func(), error) {
+	noop := func() {}
+	switch s.Driver {
+	case "zfs":
+		dataset := s.ZFSPool + "/containers/" + name
+		if err := runCommand("zfs", "mount", dataset); err != nil {
+			// The dataset is usually mounted already.
+			logger.Debugf("mounting %s: %v", dataset, err)
+		}
+		output, err := exec.Command("zfs", "get", "-H", "-o", "value", "mountpoint", dataset).Output()
+		if err != nil {
+			return "", nil, errors.Annotatef(err, "getting mountpoint of %s", dataset)
+		}
+		return filepath.Join(strings.TrimSpace(string(output)), "rootfs"), noop, nil
+	case "lvm":
+		// LXD only mounts a container's logical volume while
+		// it's in use, so mount it ourselves.
+		lvName := strings.Replace(name, "-", "--", -1)
+		if s.Pool != "" {
+			lvName = "containers_" + lvName
+		}
+		device := filepath.Join("/dev", s.VolumeGroup, lvName)
+		dir, err := ioutil.TempDir("", "lxd-rootfs")
+		if err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		if err := runCommand("mount", device, dir); err != nil {
+			os.Remove(dir)
+			return "", nil, errors.Annotatef(err, "mounting %s", device)
+		}
+		rootfs := filepath.Join(dir, "rootfs")
+		if err := os.MkdirAll(rootfs, 0755); err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		return rootfs, func() {
+			if err := runCommand("umount", dir); err != nil {
+				logger.Warningf("unmounting %s: %v", dir, err)
+				return
+			}
+			os.Remove(dir)
+		}, nil
+	}
+	// The dir and btrfs drivers keep the container's
+	// filesystem under the LXD directory.
+	return filepath.Join(lxdPath, "containers", name, "rootfs"), noop, nil
+}
+
+// lxcContainerStorage describes the storage of an LXC container.
+type lxcContainerStorage struct {
+	Name   string    `json:"name"`
+	Rootfs lxcRootfs `json:"rootfs"`
+
+	// Size is the number of bytes used by the root filesystem.
+	// For clones this includes the cloned container's rootfs.
+	Size int64 `json:"size"`
+
+	// SameDevice records whether the root filesystem is on the
+	// same filesystem as the LXD containers, so can be moved
+	// without copying.
+	SameDevice bool `json:"same-device"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// hostStorageLayout describes the storage of LXC containers on a
+// host, and of the LXD containers they will be migrated to.
+type hostStorageLayout struct {
+	LXD        lxdStorage            `json:"lxd"`
+	Available  int64                 `json:"available"`
+	Containers []lxcContainerStorage `json:"containers"`
+}
+
+// requiredSpace returns the number of bytes needed to hold the
+// containers' root filesystems in LXD, or an error if they won't fit
+// in LXD's containers. Root filesystems are moved if moveRootfs is
+// true and they're in a plain directory on the same filesystem as
+// LXD's; otherwise they're copied.
+func (layout *hostStorageLayout) requiredSpace(moveRootfs bool) (int64, error) {
+	var required int64
+	for _, container := range layout.Containers {
+		if container.Error != "" {
+			return 0, errors.Errorf("container %q: %s", container.Name, container.Error)
+		}
+		if layout.LXD.Driver == "lvm" && container.Size > layout.LXD.VolumeSize {
+			return 0, errors.Errorf(
+				"container %q rootfs (%dMiB) won't fit in an LXD volume (%dMiB)",
+				container.Name, container.Size>>20, layout.LXD.VolumeSize>>20,
+			)
+		}
+		if moveRootfs && canMoveRootfs(layout.LXD, container) {
+			continue
+		}
+		required += container.Size
+	}
+	return required, nil
+}
+
+// canMoveRootfs reports whether the container's root filesystem can be
+// moved into LXD, rather than copied.
+func canMoveRootfs(storage lxdStorage, container lxcContainerStorage) bool {
+	return storage.Driver == "dir" && !container.Rootfs.isClone() && container.SameDevice
+}
+
+var lxcStorageImplDoc = `
+
+lxc-storage-impl must be executed as root on a host of LXC containers.
+
+The command writes to stdout, as JSON, the storage layout of the named
+LXC containers and the LXD storage they would be migrated to.
+
+`
+
+func newLXCStorageImplCommand() cmd.Command {
+	return &lxcStorageImplCommand{}
+}
+
+type lxcStorageImplCommand struct {
+	cmd.CommandBase
+	lxcPath    string
+	lxdPath    string
+	containers []string
+}
+
+func (c *lxcStorageImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "lxc-storage-impl",
+		Args:    "<container> ...",
+		Purpose: "host aspect of the migrate-lxc disk space checks",
+		Doc:     lxcStorageImplDoc,
+	}
+}
+
+func (c *lxcStorageImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.lxcPath, "lxc-path", "/var/lib/lxc", "LXC container path")
+	f.StringVar(&c.lxdPath, "lxd-path", "/var/lib/lxd", "LXD path")
+}
+
+func (c *lxcStorageImplCommand) Init(args []string) error {
+	c.containers = args
+	return nil
+}
+
+func (c *lxcStorageImplCommand) Run(ctx *cmd.Context) error {
+	layout := hostStorageLayout{LXD: lxdStorage{Driver: "dir"}}
+	if pathExists(filepath.Join(c.lxdPath, "unix.socket")) {
+		client, err := connectLXD(c.lxdPath)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		storage, err := detectLXDStorage(client)
+		if err != nil {
+			return errors.Annotate(err, "detecting LXD storage")
+		}
+		layout.LXD = *storage
+	}
+	// Otherwise LXD isn't installed yet, and will use the
+	// dir driver when it is.
+
+	available, err := layout.LXD.available(c.lxdPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	layout.Available = available
+
+	lxdDir := c.lxdPath
+	if !pathExists(lxdDir) {
+		lxdDir = filepath.Dir(lxdDir)
+	}
+	lxdDevice, err := deviceOf(lxdDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, name := range c.containers {
+		container := lxcContainerStorage{Name: name}
+		if err := c.measure(&container, lxdDevice); err != nil {
+			container.Error = err.Error()
+		}
+		layout.Containers = append(layout.Containers, container)
+	}
+	return json.NewEncoder(ctx.GetStdout()).Encode(layout)
+}
+
+func (c *lxcStorageImplCommand) measure(container *lxcContainerStorage, lxdDevice uint64) error {
+	config, err := parseLXCConfig(filepath.Join(c.lxcPath, container.Name, "config"))
+	if err != nil {
+		return errors.Annotate(err, "parsing LXC config")
+	}
+	container.Rootfs, err = parseLXCRootfs(config.first("lxc.rootfs"), config.first("lxc.rootfs.backend"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, path := range container.Rootfs.paths() {
+		output, err := exec.Command("du", "-sx", "-B1", path).Output()
+		if err != nil {
+			return errors.Annotatef(err, "measuring %s", path)
+		}
+		size, err := parseDiskUsage(string(output))
+		if err != nil {
+			return errors.Annotatef(err, "measuring %s", path)
+		}
+		container.Size += size
+	}
+	if !container.Rootfs.isClone() {
+		device, err := deviceOf(container.Rootfs.Path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		container.SameDevice = device == lxdDevice
+	}
+	return nil
+}
+
+// parseDiskUsage returns the number of bytes reported by du -sx -B1
+// for a single path.
+func parseDiskUsage(output string) (int64, error) {
+	// du separates the size from the path with a tab.
+	fields := strings.SplitN(strings.TrimSpace(output), "\t", 2)
+	if len(fields) != 2 {
+		return 0, errors.Errorf("unexpected disk usage output %q", strings.TrimSpace(output))
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, errors.Annotatef(err, "parsing size of %q", fields[1])
+	}
+	return size, nil
+}
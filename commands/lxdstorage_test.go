@@ -0,0 +1,124 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type lxdStorageSuite struct{}
+
+var _ = gc.Suite(&lxdStorageSuite{})
+
+func (*lxdStorageSuite) TestParseLXCRootfs(c *gc.C) {
+	for i, test := range []struct {
+		value    string
+		backend  string
+		expected lxcRootfs
+		err      string
+	}{{
+		value:    "/var/lib/lxc/foo/rootfs",
+		expected: lxcRootfs{Backend: "dir", Path: "/var/lib/lxc/foo/rootfs"},
+	}, {
+		value:    "dir:/var/lib/lxc/foo/rootfs",
+		expected: lxcRootfs{Backend: "dir", Path: "/var/lib/lxc/foo/rootfs"},
+	}, {
+		value:    "/var/lib/lxc/foo/rootfs",
+		backend:  "btrfs",
+		expected: lxcRootfs{Backend: "btrfs", Path: "/var/lib/lxc/foo/rootfs"},
+	}, {
+		value:    "overlayfs:/var/lib/lxc/template/rootfs:/var/lib/lxc/foo/delta0",
+		expected: lxcRootfs{Backend: "overlayfs", Lower: "/var/lib/lxc/template/rootfs", Upper: "/var/lib/lxc/foo/delta0"},
+	}, {
+		value:    "overlay:/var/lib/lxc/template/rootfs:/var/lib/lxc/foo/delta0",
+		expected: lxcRootfs{Backend: "overlayfs", Lower: "/var/lib/lxc/template/rootfs", Upper: "/var/lib/lxc/foo/delta0"},
+	}, {
+		value:    "aufs:/var/lib/lxc/template/rootfs:/var/lib/lxc/foo/delta0",
+		expected: lxcRootfs{Backend: "aufs", Lower: "/var/lib/lxc/template/rootfs", Upper: "/var/lib/lxc/foo/delta0"},
+	}, {
+		value: "/dev/lxc/foo",
+		err:   `block device rootfs "/dev/lxc/foo" isn't supported`,
+	}, {
+		value:   "/var/lib/lxc/foo/rootfs",
+		backend: "zfs",
+		err:     `"zfs" rootfs backend isn't supported`,
+	}, {
+		value: "loop:/var/lib/lxc/foo/rootdev",
+		err:   `rootfs "loop:/var/lib/lxc/foo/rootdev" isn't supported`,
+	}} {
+		c.Logf("test %d: %s", i, test.value)
+		rootfs, err := parseLXCRootfs(test.value, test.backend)
+		if test.err != "" {
+			c.Check(err, gc.ErrorMatches, test.err)
+			continue
+		}
+		c.Check(err, jc.ErrorIsNil)
+		c.Check(rootfs, jc.DeepEquals, test.expected)
+	}
+}
+
+func (*lxdStorageSuite) TestRequiredSpace(c *gc.C) {
+	dir := lxcRootfs{Backend: "dir", Path: "/var/lib/lxc/a/rootfs"}
+	clone := lxcRootfs{Backend: "overlayfs", Lower: "/var/lib/lxc/t/rootfs", Upper: "/var/lib/lxc/b/delta0"}
+	containers := []lxcContainerStorage{
+		{Name: "a", Rootfs: dir, Size: 100, SameDevice: true},
+		{Name: "b", Rootfs: clone, Size: 200},
+		{Name: "c", Rootfs: dir, Size: 400},
+	}
+	for i, test := range []struct {
+		about      string
+		storage    lxdStorage
+		moveRootfs bool
+		required   int64
+	}{{
+		about:    "copying everything",
+		storage:  lxdStorage{Driver: "dir"},
+		required: 700,
+	}, {
+		about:      "moving within the filesystem",
+		storage:    lxdStorage{Driver: "dir"},
+		moveRootfs: true,
+		required:   600,
+	}, {
+		about:      "moving into zfs",
+		storage:    lxdStorage{Driver: "zfs", ZFSPool: "lxd"},
+		moveRootfs: true,
+		required:   700,
+	}} {
+		c.Logf("test %d: %s", i, test.about)
+		layout := &hostStorageLayout{LXD: test.storage, Containers: containers}
+		required, err := layout.requiredSpace(test.moveRootfs)
+		c.Check(err, jc.ErrorIsNil)
+		c.Check(required, gc.Equals, test.required)
+	}
+}
+
+func (*lxdStorageSuite) TestRequiredSpaceErrors(c *gc.C) {
+	layout := &hostStorageLayout{
+		LXD: lxdStorage{Driver: "lvm", VolumeGroup: "lxd", VolumeSize: 10 << 20},
+		Containers: []lxcContainerStorage{
+			{Name: "a", Rootfs: lxcRootfs{Backend: "dir"}, Size: 20 << 20},
+		},
+	}
+	_, err := layout.requiredSpace(false)
+	c.Assert(err, gc.ErrorMatches, `container "a" rootfs \(20MiB\) won't fit in an LXD volume \(10MiB\)`)
+
+	layout.Containers[0].Error = "parsing LXC config: boom"
+	_, err = layout.requiredSpace(false)
+	c.Assert(err, gc.ErrorMatches, `container "a": parsing LXC config: boom`)
+}
+
+func (*lxdStorageSuite) TestParseDiskUsage(c *gc.C) {
+	size, err := parseDiskUsage("536870912\t/var/lib/lxc/juju-machine-1-lxc-0/rootfs\n")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(size, gc.Equals, int64(536870912))
+}
+
+func (*lxdStorageSuite) TestParseDiskUsageInvalid(c *gc.C) {
+	_, err := parseDiskUsage("lots\t/var/lib/lxc/juju-machine-1-lxc-0/rootfs\n")
+	c.Assert(err, gc.ErrorMatches, `parsing size of "/var/lib/lxc/juju-machine-1-lxc-0/rootfs": .*`)
+	_, err = parseDiskUsage("du: cannot access\n")
+	c.Assert(err, gc.ErrorMatches, `unexpected disk usage output "du: cannot access"`)
+}
@@ -5,18 +5,30 @@ package commands
 
 import (
 	"os"
+	"path"
+	"path/filepath"
 
 	"github.com/juju/cmd"
 	"github.com/juju/loggo"
 	"github.com/juju/version"
+	"github.com/kardianos/osext"
 )
 
 const (
-	toolsDir  = "/home/ubuntu/juju-1.25-upgrade-tools"
 	toolsFile = "downloaded-tools.txt"
+
+	// toolsDirName is the name of the directory in the SSH user's
+	// home directory on the API server machine that holds the
+	// upgrade state and downloaded tools.
+	toolsDirName = "juju-1.25-upgrade-tools"
 )
 
 var (
+	// toolsDir is where the upgrade state and downloaded tools are
+	// kept on the API server machine. It's a variable so that tests
+	// can relocate it.
+	toolsDir = defaultToolsDir()
+
 	logger          = loggo.GetLogger("upgrader")
 	upgraderVersion = version.MustParse("0.1.0")
 )
@@ -39,8 +51,12 @@ func NewUpgradeCommand(ctx *cmd.Context) cmd.Command {
 func registerCommands(super *cmd.SuperCommand) {
 	super.Register(newVerifySourceCommand())
 	super.Register(newVerifySourceImplCommand())
+	super.Register(newBackupSourceCommand())
+	super.Register(newBackupSourceImplCommand())
 	super.Register(newDumpSourceDBCommand())
 	super.Register(newDumpSourceDBImplCommand())
+	super.Register(newMongoPrimaryImplCommand())
+	super.Register(newEnvironmentInfoImplCommand())
 	super.Register(newAgentStatusCommand())
 	super.Register(newAgentStatusImplCommand())
 	super.Register(newStartAgentsCommand())
@@ -49,12 +65,22 @@ func registerCommands(super *cmd.SuperCommand) {
 	super.Register(newStopAgentsImplCommand())
 	super.Register(newUpgradeAgentsCommand())
 	super.Register(newUpgradeAgentsImplCommand())
+	super.Register(newCheckUniterStateImplCommand())
+	super.Register(newAgentServicesImplCommand())
 	super.Register(newBackupLXCCommand())
 	super.Register(newBackupLXCImplCommand())
 	super.Register(newRestoreLXCCommand())
 	super.Register(newRestoreLXCImplCommand())
+	super.Register(newVerifyLXCBackupCommand())
 	super.Register(newMigrateLXCCommand())
 	super.Register(newMigrateLXCImplCommand())
+	super.Register(newCleanupLXCCommand())
+	super.Register(newCleanupLXCImplCommand())
+	super.Register(newCleanupLXCSnapshotsCommand())
+	super.Register(newCleanupLXCSnapshotsImplCommand())
+	super.Register(newLXCToLXDImplCommand())
+	super.Register(newLXCStorageImplCommand())
+	super.Register(newLXDContainersImplCommand())
 	super.Register(newAbortCommand())
 	super.Register(newAbortImplCommand())
 	super.Register(newUpdateMAASAgentNameCommand())
@@ -63,4 +89,30 @@ func registerCommands(super *cmd.SuperCommand) {
 	super.Register(newImportImplCommand())
 	super.Register(newActivateCommand())
 	super.Register(newActivateImplCommand())
+	super.Register(newCompareCommand())
+	super.Register(newCompareImplCommand())
+	super.Register(newVerifyTargetModelCommand())
+	super.Register(newVerifyTargetModelImplCommand())
+	super.Register(newFinalizeCommand())
+	super.Register(newFinalizeImplCommand())
+}
+
+// defaultToolsDir returns the tools directory alongside the running
+// plugin. The client copies the plugin to the SSH user's home
+// directory on the API server machine, so that's where the tools
+// directory is for whichever user --ssh-user names.
+func defaultToolsDir() string {
+	plugin, err := osext.Executable()
+	if err != nil {
+		return path.Join("/home", defaultSSHUser, toolsDirName)
+	}
+	return filepath.Join(filepath.Dir(plugin), toolsDirName)
+}
+
+// remoteToolsPath returns the path of a file in the tools directory
+// on the API server machine for use by the client. It's relative to
+// the SSH user's home directory, where the client's remote commands
+// and copies start from.
+func remoteToolsPath(elem ...string) string {
+	return path.Join(append([]string{toolsDirName}, elem...)...)
 }
@@ -4,10 +4,13 @@
 package commands
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/cmd"
@@ -31,6 +34,18 @@ be backed up.
 
 If --dry-run is specified, then no backups will be created, nor
 will the containers be stopped.
+
+By default the LXC containers' root filesystems are moved into LXD,
+leaving nothing to fall back to other than a backup. If --copy-rootfs
+is specified, the root filesystems are copied instead, and the LXC
+containers are retained (with autostart disabled) until they are
+removed with the cleanup-lxc command.
+
+Before migrating, the command checks that each host has enough free
+space for the root filesystems that need to be copied.
+
+The migration changes the source environment, so it requires a backup
+made with backup-source, unless --skip-backup-check is given.
 `
 
 func newMigrateLXCCommand() cmd.Command {
@@ -41,8 +56,10 @@ func newMigrateLXCCommand() cmd.Command {
 
 type migrateLXCCommand struct {
 	baseClientCommand
-	dryRun bool
-	match  string
+	sourceBackupFlags
+	dryRun     bool
+	match      string
+	copyRootfs bool
 }
 
 func (c *migrateLXCCommand) Info() *cmd.Info {
@@ -58,6 +75,8 @@ func (c *migrateLXCCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.baseClientCommand.SetFlags(f)
 	f.BoolVar(&c.dryRun, "dry-run", false, "perform a dry run, without making any changes")
 	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs to migrate")
+	f.BoolVar(&c.copyRootfs, "copy-rootfs", false, "copy the LXC root filesystems, retaining the LXC containers")
+	c.sourceBackupFlags.setFlags(f)
 }
 
 func (c *migrateLXCCommand) Init(args []string) error {
@@ -75,6 +94,10 @@ func (c *migrateLXCCommand) Run(ctx *cmd.Context) error {
 	if c.dryRun {
 		c.extraOptions = append(c.extraOptions, "--dry-run")
 	}
+	if c.copyRootfs {
+		c.extraOptions = append(c.extraOptions, "--copy-rootfs")
+	}
+	c.extraOptions = append(c.extraOptions, c.sourceBackupFlags.options()...)
 	return c.baseClientCommand.Run(ctx)
 }
 
@@ -93,8 +116,10 @@ func newMigrateLXCImplCommand() cmd.Command {
 
 type migrateLXCImplCommand struct {
 	baseRemoteCommand
-	dryRun bool
-	match  string
+	sourceBackupFlags
+	dryRun     bool
+	match      string
+	copyRootfs bool
 }
 
 func (c *migrateLXCImplCommand) Info() *cmd.Info {
@@ -109,6 +134,8 @@ func (c *migrateLXCImplCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.baseRemoteCommand.SetFlags(f)
 	f.BoolVar(&c.dryRun, "dry-run", false, "perform a dry run, without making any changes")
 	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs to migrate")
+	f.BoolVar(&c.copyRootfs, "copy-rootfs", false, "copy the LXC root filesystems, retaining the LXC containers")
+	c.sourceBackupFlags.setFlags(f)
 }
 
 func (c *migrateLXCImplCommand) Run(ctx *cmd.Context) error {
@@ -172,14 +199,25 @@ func (c *migrateLXCImplCommand) Run(ctx *cmd.Context) error {
 		ctx, lxcByHost, lxdByHost, containerNames,
 	)
 
+	// Check that there's room for the root filesystems before
+	// stopping anything.
+	if err := checkLXDDiskSpace(ctx, lxcToMigrateByHost, c.copyRootfs); err != nil {
+		return errors.Trace(err)
+	}
+
 	if c.dryRun {
 		return nil
 	}
+	if len(lxcToMigrateByHost) > 0 {
+		if err := c.sourceBackupFlags.check(ctx, "migrate-lxc"); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
 	if err := stopLXCContainers(lxcToMigrateByHost); err != nil {
 		return errors.Annotate(err, "stopping LXC containers")
 	}
-	if err := migrateLXCContainers(lxcToMigrateByHost); err != nil {
+	if err := migrateLXCContainers(lxcToMigrateByHost, environUUID, c.copyRootfs); err != nil {
 		return errors.Annotate(err, "migrating LXC containers")
 	}
 
@@ -326,7 +364,15 @@ func getLXCContainersToMigrate(
 		nonMigrated := make([]*state.Machine, 0, len(containers))
 		for _, container := range containers {
 			names := containerNames[container]
-			if lxdContainers[names.oldName] != nil {
+			if existing := lxdContainers[names.oldName]; existing != nil {
+				if existing.migrationIncomplete() {
+					ctx.Infof(
+						"Resuming migration of LXC container %q to LXD (%q)",
+						container.Id(), names.newName,
+					)
+					nonMigrated = append(nonMigrated, container)
+					continue
+				}
 				// migrated but not yet renamed
 				ctx.Infof(
 					"LXC container %q already migrated to LXD (%q)",
@@ -374,11 +420,17 @@ func stopLXCContainers(lxcByHost map[*state.Machine][]*state.Machine) error {
 	return group.Wait()
 }
 
-// migrateLXCContainers migrates all of the LXC containers to LXD.
-func migrateLXCContainers(lxcByHost map[*state.Machine][]*state.Machine) error {
+// migrateLXCContainers migrates all of the LXC containers to LXD. If
+// copyRootfs is true, the root filesystems are copied rather than
+// moved, and the LXC containers are prevented from starting at boot.
+func migrateLXCContainers(
+	lxcByHost map[*state.Machine][]*state.Machine,
+	environUUID string,
+	copyRootfs bool,
+) error {
 	opts := MigrateLXCOptions{
-		// TODO(axw) option to copy rootfs?
-		MoveRootfs: true,
+		MoveRootfs: !copyRootfs,
+		ModelUUID:  environUUID,
 	}
 	var group errgroup.Group
 	for host, containers := range lxcByHost {
@@ -389,15 +441,135 @@ func migrateLXCContainers(lxcByHost map[*state.Machine][]*state.Machine) error {
 		logger.Debugf("migrating LXC containers: %s", strings.Join(containerNames, ", "))
 		host, containers := host, containers // copy for closure
 		group.Go(func() error {
+			if err := MigrateLXC(containers, host, opts); err != nil {
+				return errors.Annotatef(err,
+					"migrating LXC containers: %s", strings.Join(containerNames, ", "),
+				)
+			}
+			if !copyRootfs {
+				return nil
+			}
+			lxcNames, err := lxcContainerNames(containers)
+			if err != nil {
+				return errors.Trace(err)
+			}
 			return errors.Annotatef(
-				MigrateLXC(containers, host, opts),
-				"migrating LXC containers: %s", strings.Join(containerNames, ", "),
+				DisableLXCAutostart(lxcNames, host),
+				"disabling autostart of LXC containers: %s", strings.Join(containerNames, ", "),
 			)
 		})
 	}
 	return group.Wait()
 }
 
+// lxcContainerNames returns the LXC container names of the
+// container machines, which are recorded as their instance IDs.
+func lxcContainerNames(containers []*state.Machine) ([]string, error) {
+	names := make([]string, len(containers))
+	for i, container := range containers {
+		instanceId, err := container.InstanceId()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		names[i] = string(instanceId)
+	}
+	return names, nil
+}
+
+// rootfsHeadroom is the fraction of the total size of the root
+// filesystems to be copied that must be free on a host in addition,
+// so that the host isn't left without space once they're copied.
+const rootfsHeadroom = 0.1
+
+// checkLXDDiskSpace checks that each host has enough free space in
+// LXD's storage to hold the root filesystems of the LXC containers
+// being migrated. Moving a root filesystem only requires space if it
+// can't simply be renamed into LXD's directory; copying always does.
+func checkLXDDiskSpace(
+	ctx *cmd.Context,
+	lxcByHost map[*state.Machine][]*state.Machine,
+	copyRootfs bool,
+) error {
+	var group errgroup.Group
+	for host, containers := range lxcByHost {
+		host, containers := host, containers // copy for closure
+		group.Go(func() error {
+			lxcNames, err := lxcContainerNames(containers)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			layout, err := LXDStorageLayout(lxcNames, host)
+			if err != nil {
+				return errors.Annotatef(err, "getting storage layout of host %q", host.Id())
+			}
+			required, err := layout.requiredSpace(!copyRootfs)
+			if err != nil {
+				return errors.Annotatef(err, "host %q", host.Id())
+			}
+			if required == 0 {
+				return nil
+			}
+			required += int64(float64(required) * rootfsHeadroom)
+			ctx.Infof(
+				"Host %q requires %dMiB in LXD %s storage, %dMiB available",
+				host.Id(), required>>20, layout.LXD.Driver, layout.Available>>20,
+			)
+			if required > layout.Available {
+				return errors.Errorf(
+					"insufficient disk space on host %q: %dMiB required, %dMiB available",
+					host.Id(), required>>20, layout.Available>>20,
+				)
+			}
+			return nil
+		})
+	}
+	return errors.Annotate(group.Wait(), "checking disk space")
+}
+
+// reportStorageLayout prints the storage layout of the LXC containers
+// on each host, and of the LXD storage they would be migrated to.
+func reportStorageLayout(ctx *cmd.Context, lxcByHost map[*state.Machine][]*state.Machine) error {
+	var mu sync.Mutex
+	var group errgroup.Group
+	for host, containers := range lxcByHost {
+		host, containers := host, containers // copy for closure
+		group.Go(func() error {
+			lxcNames, err := lxcContainerNames(containers)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			layout, err := LXDStorageLayout(lxcNames, host)
+			if err != nil {
+				return errors.Annotatef(err, "getting storage layout of host %q", host.Id())
+			}
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "Host %q: LXD storage %s, %dMiB available\n", host.Id(), layout.LXD, layout.Available>>20)
+			for _, container := range layout.Containers {
+				fmt.Fprintf(&buf, "  %s: ", container.Name)
+				if container.Error != "" {
+					fmt.Fprintf(&buf, "error: %s\n", container.Error)
+					continue
+				}
+				fmt.Fprintf(&buf, "%s rootfs, %dMiB", container.Rootfs.Backend, container.Size>>20)
+				if container.Rootfs.isClone() {
+					fmt.Fprintf(&buf, ", cloned from %s", container.Rootfs.Lower)
+				}
+				if canMoveRootfs(layout.LXD, container) {
+					buf.WriteString(", can be moved")
+				} else {
+					buf.WriteString(", must be copied")
+				}
+				buf.WriteString("\n")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			ctx.Infof("%s", strings.TrimSuffix(buf.String(), "\n"))
+			return nil
+		})
+	}
+	return errors.Annotate(group.Wait(), "getting storage layout")
+}
+
 // renameLXDContainers renames all of the LXD containers to the new name,
 // if they aren't already named as such.
 func renameLXDContainers(
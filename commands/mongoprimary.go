@@ -0,0 +1,284 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/replicaset"
+	"github.com/juju/utils/set"
+
+	"github.com/juju/1.25-upgrade/juju2/juju/osenv"
+)
+
+// jujuMachineKey is the replica set member tag that juju 1.25's
+// peergrouper records each state server's machine ID in.
+const jujuMachineKey = "juju-machine-id"
+
+var mongoPrimaryImplDoc = `
+
+mongo-primary-impl must be executed on an API server machine of a 1.25
+environment.
+
+The command checks that every member of the environment's mongo replica
+set is healthy, and prints the machine ID and addresses of the primary
+as JSON. If this machine is no longer a state server, nothing is
+printed.
+
+`
+
+func newMongoPrimaryImplCommand() cmd.Command {
+	return &mongoPrimaryImplCommand{}
+}
+
+type mongoPrimaryImplCommand struct {
+	baseRemoteCommand
+}
+
+func (c *mongoPrimaryImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "mongo-primary-impl",
+		Purpose: "find the state server to run commands on",
+		Doc:     mongoPrimaryImplDoc,
+	}
+}
+
+// mongoPrimary describes the state server hosting the replica set
+// primary.
+type mongoPrimary struct {
+	MachineID string   `json:"machine-id"`
+	Addresses []string `json:"addresses"`
+}
+
+func (c *mongoPrimaryImplCommand) Run(ctx *cmd.Context) error {
+	// Once the migration is finalized the database is gone, and
+	// there's no primary to find.
+	if _, err := os.Stat(filepath.Join(dataDir, "db")); os.IsNotExist(err) {
+		return nil
+	}
+
+	st, err := getState()
+	if err != nil {
+		return errors.Annotate(err, "getting state")
+	}
+	defer st.Close()
+
+	session := st.MongoSession()
+	status, err := replicaset.CurrentStatus(session)
+	if err != nil {
+		return errors.Annotate(err, "getting replica set status")
+	}
+	members, err := replicaset.CurrentMembers(session)
+	if err != nil {
+		return errors.Annotate(err, "getting replica set members")
+	}
+	primaryID, err := checkReplicaSet(status, members)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	machine, err := st.Machine(primaryID)
+	if err != nil {
+		return errors.Annotatef(err, "getting primary machine %s", primaryID)
+	}
+	primary := mongoPrimary{MachineID: primaryID}
+	for _, addr := range machine.Addresses() {
+		primary.Addresses = append(primary.Addresses, addr.Value)
+	}
+	return errors.Trace(json.NewEncoder(ctx.Stdout).Encode(primary))
+}
+
+// checkReplicaSet returns the machine ID of the replica set primary,
+// or an error if any member isn't ready to serve as a primary or
+// secondary, in the same way that the peergrouper judges them.
+func checkReplicaSet(status *replicaset.Status, members []replicaset.Member) (string, error) {
+	machineIDs := make(map[int]string)
+	for _, member := range members {
+		machineIDs[member.Id] = member.Tags[jujuMachineKey]
+	}
+	describe := func(s replicaset.MemberStatus) string {
+		if id := machineIDs[s.Id]; id != "" {
+			return fmt.Sprintf("machine %s (%s)", id, s.Address)
+		}
+		return s.Address
+	}
+
+	var problems []string
+	var primary *replicaset.MemberStatus
+	for i, s := range status.Members {
+		switch {
+		case !s.Healthy:
+			problems = append(problems, describe(s)+" is unreachable")
+		case s.State == replicaset.PrimaryState:
+			primary = &status.Members[i]
+		case s.State != replicaset.SecondaryState:
+			problems = append(problems, fmt.Sprintf("%s is %s", describe(s), s.State))
+		}
+	}
+	if primary == nil {
+		problems = append(problems, "there is no primary")
+	}
+	if len(problems) > 0 {
+		return "", errors.Errorf("mongo replica set is unhealthy: %s", strings.Join(problems, ", "))
+	}
+	id := machineIDs[primary.Id]
+	if id == "" {
+		return "", errors.Errorf("replica set primary %s is not a juju state server", primary.Address)
+	}
+	return id, nil
+}
+
+// executionHostDir returns the client directory in which the state
+// server that each environment's migration runs on is recorded.
+var executionHostDir = func() string {
+	return osenv.JujuXDGDataHomePath("1.25-upgrade")
+}
+
+func executionHostPath(envName string) string {
+	return filepath.Join(executionHostDir(), envName+".host")
+}
+
+// readExecutionHost returns the state server address recorded for the
+// environment's migration, or "" if none has been recorded yet.
+func readExecutionHost(envName string) (string, error) {
+	data, err := ioutil.ReadFile(executionHostPath(envName))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Trace(err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writeExecutionHost records the state server address that the rest of
+// the environment's migration runs on.
+func writeExecutionHost(envName, address string) error {
+	if err := os.MkdirAll(executionHostDir(), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(executionHostPath(envName), []byte(address+"\n"), 0644))
+}
+
+// removeExecutionHost forgets the state server recorded for the
+// environment's migration.
+func removeExecutionHost(envName string) error {
+	err := os.Remove(executionHostPath(envName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+// selectExecutionHost returns the state server recorded for the
+// environment's migration, checking that it can still be reached. The
+// saved machines, upgrade records and migration journal are all kept
+// on that machine, so the commands mustn't move to another one.
+func (c *baseClientCommand) selectExecutionHost(ctx *cmd.Context) (string, error) {
+	host, err := readExecutionHost(c.name)
+	if err != nil {
+		return "", errors.Annotate(err, "reading migration state server")
+	}
+	if host == "" {
+		return "", nil
+	}
+	if _, err := selectSSHAddress([]string{host}, len(c.proxyCommand()) > 0, c.sshOptions()...); err != nil {
+		return "", errors.Errorf(
+			"cannot reach %s, the state server holding the migration's state; remove %s to run on another state server",
+			host, executionHostPath(c.name),
+		)
+	}
+	ctx.Verbosef("using migration state server %s", host)
+	return host, nil
+}
+
+// selectPrimary checks that the environment's replica set is healthy.
+// The first time it's run for the environment, it switches the API
+// server address that remote commands are run on to that of the state
+// server hosting the primary, if it can be reached, and records it
+// for the rest of the migration. Once recorded, the commands stay on
+// that state server even if the primary moves.
+//
+// Commands that undo the migration set allowDegraded, so that they
+// can still be run while the replica set is unhealthy.
+func (c *baseClientCommand) selectPrimary(ctx *cmd.Context, pinned bool) error {
+	var stdout, stderr bytes.Buffer
+	// The command's own options aren't passed on, as they aren't
+	// mongo-primary-impl's.
+	command := fmt.Sprintf("./%s mongo-primary-impl", filepath.Base(c.plugin))
+	rc, err := runViaSSH(c.address, command, c.sshOptions(withStdout(&stdout), withStderr(&stderr))...)
+	if err == nil && rc != 0 {
+		err = errors.New(strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		if c.allowDegraded {
+			logger.Warningf("continuing on %s without a healthy mongo replica set: %v", c.address, err)
+			return nil
+		}
+		return errors.Annotate(err, "finding mongo primary")
+	}
+	if strings.TrimSpace(stdout.String()) == "" {
+		return nil
+	}
+	var primary mongoPrimary
+	if err := json.Unmarshal(stdout.Bytes(), &primary); err != nil {
+		return errors.Annotate(err, "reading mongo primary")
+	}
+
+	addresses := set.NewStrings(primary.Addresses...)
+	if pinned {
+		if !addresses.Contains(c.address) {
+			ctx.Infof("mongo primary is now machine %s (%s); staying on %s, which holds the migration's state",
+				primary.MachineID, strings.Join(primary.Addresses, ", "), c.address)
+		}
+		return nil
+	}
+	if err := c.switchToPrimary(ctx, primary); err != nil {
+		return errors.Trace(err)
+	}
+	ctx.Infof("recording %s as the state server for the rest of the migration", c.address)
+	return errors.Annotate(writeExecutionHost(c.name, c.address), "recording migration state server")
+}
+
+// switchToPrimary switches the API server address that remote commands
+// are run on to that of the state server hosting the primary, if it's
+// one of the environment's API addresses and can be reached.
+func (c *baseClientCommand) switchToPrimary(ctx *cmd.Context, primary mongoPrimary) error {
+	addresses := set.NewStrings(primary.Addresses...)
+	if addresses.Contains(c.address) {
+		return nil
+	}
+	var candidates []string
+	for _, addr := range c.addresses {
+		if addresses.Contains(addr) {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		// The environment's API addresses may not include the
+		// primary's, in which case the commands still work from
+		// another state server.
+		ctx.Infof("mongo primary is machine %s (%s), which isn't one of the environment's API addresses; using %s",
+			primary.MachineID, strings.Join(primary.Addresses, ", "), c.address)
+		return nil
+	}
+	address, err := selectSSHAddress(candidates, len(c.proxyCommand()) > 0, c.sshOptions()...)
+	if err != nil {
+		ctx.Infof("cannot reach mongo primary machine %s (%v); using %s", primary.MachineID, err, c.address)
+		return nil
+	}
+	ctx.Infof("using mongo primary machine %s at %s", primary.MachineID, address)
+	c.address = address
+	return errors.Annotate(
+		checkUpdatePlugin(ctx, c.plugin, c.address, c.sshOptions()...),
+		"checking remote plugin on mongo primary",
+	)
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/cmd/cmdtesting"
+	"github.com/juju/errors"
+	"github.com/juju/replicaset"
+	gitjujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type replicaSetSuite struct{}
+
+var _ = gc.Suite(&replicaSetSuite{})
+
+var testReplicaSetMembers = []replicaset.Member{
+	{Id: 1, Address: "10.0.0.1:37017", Tags: map[string]string{jujuMachineKey: "0"}},
+	{Id: 2, Address: "10.0.0.2:37017", Tags: map[string]string{jujuMachineKey: "1"}},
+	{Id: 3, Address: "10.0.0.3:37017", Tags: map[string]string{jujuMachineKey: "2"}},
+}
+
+func (*replicaSetSuite) TestCheckReplicaSetHealthy(c *gc.C) {
+	status := &replicaset.Status{Members: []replicaset.MemberStatus{
+		{Id: 1, Address: "10.0.0.1:37017", Healthy: true, State: replicaset.SecondaryState},
+		{Id: 2, Address: "10.0.0.2:37017", Healthy: true, State: replicaset.PrimaryState},
+		{Id: 3, Address: "10.0.0.3:37017", Healthy: true, State: replicaset.SecondaryState},
+	}}
+	primary, err := checkReplicaSet(status, testReplicaSetMembers)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(primary, gc.Equals, "1")
+}
+
+func (*replicaSetSuite) TestCheckReplicaSetUnhealthy(c *gc.C) {
+	status := &replicaset.Status{Members: []replicaset.MemberStatus{
+		{Id: 1, Address: "10.0.0.1:37017", Healthy: true, State: replicaset.SecondaryState},
+		{Id: 2, Address: "10.0.0.2:37017", Healthy: false, State: replicaset.DownState},
+		{Id: 3, Address: "10.0.0.3:37017", Healthy: true, State: replicaset.RecoveringState},
+	}}
+	_, err := checkReplicaSet(status, testReplicaSetMembers)
+	c.Assert(err, gc.ErrorMatches, `mongo replica set is unhealthy: `+
+		`machine 1 \(10.0.0.2:37017\) is unreachable, `+
+		`machine 2 \(10.0.0.3:37017\) is RECOVERING, `+
+		`there is no primary`)
+}
+
+type executionHostSuite struct {
+	gitjujutesting.IsolationSuite
+	primary *fakePrimaryExecutor
+}
+
+var _ = gc.Suite(&executionHostSuite{})
+
+func (s *executionHostSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	dir := c.MkDir()
+	s.PatchValue(&executionHostDir, func() string { return dir })
+	s.primary = &fakePrimaryExecutor{}
+	s.PatchValue(&remoteExec, remoteExecutor(s.primary))
+}
+
+// fakePrimaryExecutor answers mongo-primary-impl for every address,
+// and reports the addresses that it's run on.
+type fakePrimaryExecutor struct {
+	rc     int
+	stdout string
+	stderr string
+	ran    []string
+}
+
+func (e *fakePrimaryExecutor) Run(addr, script string, options execOptions) (int, error) {
+	if !strings.HasSuffix(script, " mongo-primary-impl") {
+		return 0, nil
+	}
+	e.ran = append(e.ran, addr)
+	fmt.Fprint(options.stdout, e.stdout)
+	fmt.Fprint(options.stderr, e.stderr)
+	return e.rc, nil
+}
+
+func (e *fakePrimaryExecutor) Copy(addr string, args []string, dest string, options execOptions) error {
+	return errors.New("unexpected copy")
+}
+
+func (s *executionHostSuite) command() *baseClientCommand {
+	return &baseClientCommand{
+		name:      "test",
+		plugin:    "/usr/bin/juju-1.25-upgrade",
+		addresses: []string{"10.0.0.1", "10.0.0.2"},
+		// A proxy command stops selectSSHAddress dialling the
+		// addresses itself.
+		sshProxy: "nc %h %p",
+	}
+}
+
+func (s *executionHostSuite) TestReadWriteExecutionHost(c *gc.C) {
+	host, err := readExecutionHost("test")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(host, gc.Equals, "")
+
+	c.Assert(writeExecutionHost("test", "10.0.0.2"), jc.ErrorIsNil)
+	host, err = readExecutionHost("test")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(host, gc.Equals, "10.0.0.2")
+
+	c.Assert(removeExecutionHost("test"), jc.ErrorIsNil)
+	c.Assert(removeExecutionHost("test"), jc.ErrorIsNil)
+	host, err = readExecutionHost("test")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(host, gc.Equals, "")
+}
+
+func (s *executionHostSuite) TestSelectPrimaryRecordsHost(c *gc.C) {
+	s.primary.stdout = `{"machine-id": "0", "addresses": ["10.0.0.1"]}`
+	command := s.command()
+	command.address = "10.0.0.1"
+	c.Assert(command.selectPrimary(cmdtesting.Context(c), false), jc.ErrorIsNil)
+	c.Check(command.address, gc.Equals, "10.0.0.1")
+	host, err := readExecutionHost("test")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(host, gc.Equals, "10.0.0.1")
+}
+
+func (s *executionHostSuite) TestSelectPrimaryKeepsToPinnedHost(c *gc.C) {
+	c.Assert(writeExecutionHost("test", "10.0.0.2"), jc.ErrorIsNil)
+	// The primary has moved since the host was recorded.
+	s.primary.stdout = `{"machine-id": "0", "addresses": ["10.0.0.1"]}`
+	command := s.command()
+	ctx := cmdtesting.Context(c)
+	pinned, err := command.selectExecutionHost(ctx)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(pinned, gc.Equals, "10.0.0.2")
+	command.address = pinned
+	c.Assert(command.selectPrimary(ctx, true), jc.ErrorIsNil)
+	c.Check(command.address, gc.Equals, "10.0.0.2")
+	c.Check(s.primary.ran, jc.DeepEquals, []string{"10.0.0.2"})
+	c.Check(cmdtesting.Stderr(ctx), jc.Contains, "staying on 10.0.0.2, which holds the migration's state")
+}
+
+func (s *executionHostSuite) TestSelectPrimaryUnhealthy(c *gc.C) {
+	s.primary.rc = 1
+	s.primary.stderr = "ERROR mongo replica set is unhealthy: there is no primary\n"
+	command := s.command()
+	command.address = "10.0.0.1"
+	err := command.selectPrimary(cmdtesting.Context(c), false)
+	c.Assert(err, gc.ErrorMatches, "finding mongo primary: ERROR mongo replica set is unhealthy: there is no primary")
+	host, err := readExecutionHost("test")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(host, gc.Equals, "")
+}
+
+func (s *executionHostSuite) TestSelectPrimaryAllowDegraded(c *gc.C) {
+	c.Assert(writeExecutionHost("test", "10.0.0.2"), jc.ErrorIsNil)
+	s.primary.rc = 1
+	s.primary.stderr = "ERROR mongo replica set is unhealthy: there is no primary\n"
+	command := s.command()
+	command.allowDegraded = true
+	command.address = "10.0.0.2"
+	c.Assert(command.selectPrimary(cmdtesting.Context(c), true), jc.ErrorIsNil)
+	c.Check(command.address, gc.Equals, "10.0.0.2")
+}
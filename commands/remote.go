@@ -9,22 +9,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
+	"github.com/juju/utils/arch"
 )
 
-func remoteMD5Sum(plugin, address string) (string, error) {
+func remoteMD5Sum(plugin, address string, opts ...execOption) (string, error) {
 	pluginBase := filepath.Base(plugin)
 
 	var stdoutBuf bytes.Buffer
 	rc, err := runViaSSH(
 		address,
 		fmt.Sprintf("md5sum %s | cut -f 1 -d ' '\n", pluginBase),
-		withStdout(&stdoutBuf),
+		append(opts, withStdout(&stdoutBuf))...,
 	)
 	if err != nil {
 		return "", errors.Annotate(err, "getting md5sum")
@@ -45,18 +46,14 @@ func localMD5Sum(plugin string) (string, error) {
 	return fmt.Sprintf("%x", bytes), nil
 }
 
-func updateRemotePlugin(plugin, address string) error {
-	scp := exec.Command("scp", "-C", plugin, fmt.Sprintf("ubuntu@%s:~", address))
-	scp.Stdout = os.Stdout
-	scp.Stderr = os.Stderr
-	scp.Stdin = os.Stdin
-	if err := scp.Run(); err != nil {
+func updateRemotePlugin(plugin, address string, opts ...execOption) error {
+	if err := copyViaSSH(address, []string{"-C", plugin}, "~", opts...); err != nil {
 		return errors.Annotate(err, "copying command to environment")
 	}
 	return nil
 }
 
-func checkUpdatePlugin(ctx *cmd.Context, plugin, address string) error {
+func checkUpdatePlugin(ctx *cmd.Context, plugin, address string, opts ...execOption) error {
 	ctx.Infof("checking remote plugin")
 	local, err := localMD5Sum(plugin)
 	if err != nil {
@@ -64,7 +61,7 @@ func checkUpdatePlugin(ctx *cmd.Context, plugin, address string) error {
 	}
 	ctx.Verbosef("local: %q", local)
 
-	remote, err := remoteMD5Sum(plugin, address)
+	remote, err := remoteMD5Sum(plugin, address, opts...)
 	if err != nil {
 		return errors.Annotate(err, "generating remote md5sum")
 	}
@@ -72,7 +69,38 @@ func checkUpdatePlugin(ctx *cmd.Context, plugin, address string) error {
 
 	if local != remote {
 		ctx.Infof("updating remote plugin")
-		return updateRemotePlugin(plugin, address)
+		return updateRemotePlugin(plugin, address, opts...)
 	}
 	return nil
 }
+
+// archPluginsDir holds copies of the plugin built for architectures
+// other than the API server's, as plugins/<arch>/juju-1.25-upgrade,
+// for running on the machines with those architectures.
+func archPluginsDir() string {
+	return path.Join(toolsDir, "plugins")
+}
+
+// pluginForArch returns the path of the plugin to run on a machine
+// with the given architecture: this plugin if the machine has the API
+// server's architecture, or otherwise the copy built for it in the
+// architecture's plugins directory.
+func pluginForArch(machineArch string) (string, error) {
+	plugin, err := pluginPath()
+	if err != nil {
+		return "", errors.Annotate(err, "finding plugin location")
+	}
+	if machineArch == arch.HostArch() {
+		return plugin, nil
+	}
+	archPlugin := path.Join(archPluginsDir(), machineArch, filepath.Base(plugin))
+	if _, err := os.Stat(archPlugin); os.IsNotExist(err) {
+		return "", errors.Errorf(
+			"no plugin for architecture %q: build the plugin for %s and copy it to %s on the API server",
+			machineArch, machineArch, archPlugin,
+		)
+	} else if err != nil {
+		return "", errors.Trace(err)
+	}
+	return archPlugin, nil
+}
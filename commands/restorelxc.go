@@ -23,25 +23,38 @@ matching container names. Only containers whose names match will
 be restored.
 
 If --dry-run is specified, then no changes will take place.
+
+The backup directory must contain the manifest written by backup-lxc.
+Backups are only restored into the environment they were taken from,
+and each backup is checked against the size and SHA256 recorded in
+the manifest before it is restored.
+
+If --backup-target=host is specified, no backup dir is needed: the
+containers are restored from the snapshots taken on their hosts by
+backup-lxc --backup-target=host, after checking them against their
+records. Any LXD container that a restored container was migrated to
+is stopped, and its autostart disabled.
 `
 
 func newRestoreLXCCommand() cmd.Command {
 	command := &restoreLXCCommand{}
 	command.remoteCommand = "restore-lxc-impl"
+	command.allowDegraded = true
 	return wrap(command)
 }
 
 type restoreLXCCommand struct {
 	baseClientCommand
-	backupDir string
-	dryRun    bool
-	match     string
+	backupDir    string
+	backupTarget string
+	dryRun       bool
+	match        string
 }
 
 func (c *restoreLXCCommand) Info() *cmd.Info {
 	return &cmd.Info{
 		Name:    "restore-lxc",
-		Args:    "<environment name> <backup dir>",
+		Args:    "<environment name> [<backup dir>]",
 		Purpose: "restore LXC containers for the specified environment",
 		Doc:     restoreLXCDoc,
 	}
@@ -52,10 +65,15 @@ func (c *restoreLXCCommand) Init(args []string) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if len(args) == 0 {
-		return errors.New("no backup directory specified")
+	if err := checkBackupTarget(c.backupTarget); err != nil {
+		return errors.Annotate(err, "parsing --backup-target")
+	}
+	if c.backupTarget == backupTargetClient {
+		if len(args) == 0 {
+			return errors.New("no backup directory specified")
+		}
+		c.backupDir, args = args[0], args[1:]
 	}
-	c.backupDir, args = args[0], args[1:]
 	return cmd.CheckEmpty(args)
 }
 
@@ -63,11 +81,14 @@ func (c *restoreLXCCommand) SetFlags(f *gnuflag.FlagSet) {
 	c.baseClientCommand.SetFlags(f)
 	f.BoolVar(&c.dryRun, "dry-run", false, "perform a dry run, without making any changes")
 	f.StringVar(&c.match, "match", "", "regular expression for matching LXC container IDs to restore")
+	f.StringVar(&c.backupTarget, "backup-target", backupTargetClient, "where the backups are kept: client or host")
 }
 
 func (c *restoreLXCCommand) Run(ctx *cmd.Context) error {
-	if _, err := os.Stat(c.backupDir); err != nil {
-		return errors.Annotate(err, "checking restore dir")
+	if c.backupTarget == backupTargetClient {
+		if _, err := os.Stat(c.backupDir); err != nil {
+			return errors.Annotate(err, "checking restore dir")
+		}
 	}
 
 	match := func(string) bool { return true }
@@ -84,20 +105,35 @@ func (c *restoreLXCCommand) Run(ctx *cmd.Context) error {
 	}
 
 	// Get a listing of all of the LXC containers in the environment.
-	lxcContainers, err := getLXCContainerList(&c.baseClientCommand)
+	list, err := getLXCContainerList(&c.baseClientCommand)
 	if err != nil {
 		return errors.Annotate(err, "getting LXC container list")
 	}
+	if c.backupTarget == backupTargetHost {
+		return c.restoreSnapshots(ctx, list.Containers, match)
+	}
+
+	manifest, err := readLXCBackupManifest(c.backupDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if manifest.EnvironUUID != list.EnvironUUID {
+		return errors.Errorf(
+			"backups in %s are of environment %s, not %s",
+			c.backupDir, manifest.EnvironUUID, list.EnvironUUID,
+		)
+	}
 
-	doRestore := func(containerName, path string) error {
+	doRestore := func(containerName string, backup lxcBackup) error {
+		path := filepath.Join(c.backupDir, backup.File)
 		f, err := os.Open(path)
 		if err != nil {
 			return errors.Trace(err)
 		}
 		rc, err := runViaSSH(
 			c.address,
-			c.getRemoteCommand(c.remoteCommand, containerName),
-			withStdin(f),
+			c.getRemoteCommand(c.remoteCommand, "--compress="+backup.Compression, containerName),
+			c.sshOptions(withStdin(f))...,
 		)
 		f.Close()
 		if err != nil {
@@ -112,34 +148,77 @@ func (c *restoreLXCCommand) Run(ctx *cmd.Context) error {
 	// Restore each container matching --match,
 	// or all machines if --match isn't specified.
 	var group errgroup.Group
-	for _, container := range lxcContainers {
+	for _, container := range list.Containers {
 		containerName := container.Id
 		if !match(containerName) {
 			ctx.Infof("Skipping non-matching container %q", containerName)
 			continue
 		}
-		path := filepath.Join(c.backupDir, container.InstanceId+".tar.xz")
-		if _, err := os.Stat(path); err != nil {
-			if os.IsNotExist(err) {
-				ctx.Infof("Skipping container %q, missing backup file %q", containerName, path)
-				continue
-			}
+		backup := manifest.backup(containerName)
+		if backup == nil {
+			ctx.Infof("Skipping container %q, no backup in manifest", containerName)
+			continue
+		}
+		if backup.InstanceId != container.InstanceId {
+			return errors.Errorf(
+				"backup of container %q is of instance %q, not %q",
+				containerName, backup.InstanceId, container.InstanceId,
+			)
+		}
+		if _, err := lookupLXCBackupCompressor(backup.Compression); err != nil {
+			return errors.Annotatef(err, "backup of container %q", containerName)
+		}
+		if err := backup.verify(c.backupDir); err != nil {
+			return errors.Annotatef(err, "verifying backup of container %q", containerName)
 		}
-		ctx.Infof("Restoring container %q from %s", containerName, path)
+		ctx.Infof("Restoring container %q from %s", containerName, backup.File)
 		if c.dryRun {
 			continue
 		}
+		restore := *backup // copy for closure
 		group.Go(func() error {
 			return errors.Annotatef(
-				doRestore(containerName, path),
+				doRestore(containerName, restore),
 				"restoring %q from %s",
-				containerName, path,
+				containerName, restore.File,
 			)
 		})
 	}
 	return group.Wait()
 }
 
+// restoreSnapshots restores each of the matching containers from its
+// snapshot on its host.
+func (c *restoreLXCCommand) restoreSnapshots(ctx *cmd.Context, containers []lxcContainer, match func(string) bool) error {
+	var group errgroup.Group
+	for _, container := range containers {
+		containerName := container.Id
+		if !match(containerName) {
+			ctx.Infof("Skipping non-matching container %q", containerName)
+			continue
+		}
+		ctx.Infof("Restoring container %q from its snapshot on host %q", containerName, container.HostId)
+		if c.dryRun {
+			continue
+		}
+		group.Go(func() error {
+			rc, err := runViaSSH(
+				c.address,
+				c.getRemoteCommand(c.remoteCommand, "--backup-target=host", containerName),
+				c.sshOptions()...,
+			)
+			if err != nil {
+				return errors.Annotatef(err, "running %s via SSH", c.remoteCommand)
+			}
+			if rc != 0 {
+				return errors.Errorf("restoring container %q exited %d", containerName, rc)
+			}
+			return nil
+		})
+	}
+	return group.Wait()
+}
+
 var restoreLXCImplDoc = `
 
 restore-lxc-impl must be executed on an API server machine of a 1.25
@@ -148,8 +227,10 @@ environment.
 The command will get a list of all the LXC containers when run without
 arguments. When run with the name of a container, the command will
 SSH to the container's host, ensure the container is not running,
-stream the container's rootfs as a compressed tarball over stdin,
-unpack it, and then start the container.
+stream the container's rootfs as a tarball over stdin, compressed
+with the compressor given by --compress, unpack it, and then start
+the container. With --backup-target=host, the container is restored
+from its snapshot on its host instead.
 
 `
 
@@ -160,6 +241,8 @@ func newRestoreLXCImplCommand() cmd.Command {
 type restoreLXCImplCommand struct {
 	baseRemoteCommand
 	containerName string
+	compress      string
+	backupTarget  string
 }
 
 func (c *restoreLXCImplCommand) Info() *cmd.Info {
@@ -171,6 +254,11 @@ func (c *restoreLXCImplCommand) Info() *cmd.Info {
 	}
 }
 
+func (c *restoreLXCImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.compress, "compress", "xz", "backup compressor")
+	f.StringVar(&c.backupTarget, "backup-target", backupTargetClient, "where the backup is kept")
+}
+
 func (c *restoreLXCImplCommand) Init(args []string) error {
 	if len(args) > 0 {
 		c.containerName, args = args[0], args[1:]
@@ -200,8 +288,20 @@ func (c *restoreLXCImplCommand) Run(ctx *cmd.Context) error {
 		return errors.Annotate(err, "getting host machine")
 	}
 
+	if c.backupTarget == backupTargetHost {
+		return errors.Trace(restoreLXCContainerFromSnapshot(st, containerMachine, hostMachine))
+	}
+
+	compressor, err := lookupLXCBackupCompressor(c.compress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := stopLXDCopy(st, containerMachine, hostMachine); err != nil {
+		return errors.Annotate(err, "stopping LXD container")
+	}
+
 	logger.Debugf("restoring LXC container %q", c.containerName)
-	if err := RestoreLXCContainer(containerMachine, hostMachine, ctx.GetStdin()); err != nil {
+	if err := RestoreLXCContainer(containerMachine, hostMachine, compressor, ctx.GetStdin()); err != nil {
 		return errors.Annotate(err, "restoring LXC container")
 	}
 	logger.Debugf("restarting LXC container %q", c.containerName)
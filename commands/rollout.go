@@ -0,0 +1,298 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/utils"
+	"github.com/juju/utils/set"
+)
+
+const upgradedMachinesFile = "upgraded-machines.json"
+
+// rollbackAgentUpgradeScript restores the tools symlinks and agent
+// config files saved by the agent upgrade script.
+const rollbackAgentUpgradeScript = "python3 ~/1.25-agent-upgrade/agent-upgrade.py rollback"
+
+// probeRollbackInfoScript exits with 0 if the agent upgrade script has
+// saved rollback information on the machine, and 1 if it hasn't.
+const probeRollbackInfoScript = "test -d /var/lib/juju/" + agentRollbackDir
+
+// rolloutFlags holds the options controlling which machines
+// upgrade-agents upgrades, and how many at a time.
+type rolloutFlags struct {
+	machines          string
+	match             string
+	canary            int
+	batchSize         int
+	rollbackOnFailure bool
+}
+
+func (f *rolloutFlags) setFlags(fs *gnuflag.FlagSet) {
+	fs.StringVar(&f.machines, "machines", "", "comma-separated IDs of the machines to upgrade")
+	fs.StringVar(&f.match, "match", "", "regular expression for matching IDs of the machines to upgrade")
+	fs.IntVar(&f.canary, "canary", 0, "number of machines to upgrade and check before any others")
+	fs.IntVar(&f.batchSize, "batch-size", 0, "number of machines to upgrade at a time after the canary batch (0 means all of them)")
+	fs.BoolVar(&f.rollbackOnFailure, "rollback-on-failure", false, "roll back the agents in a batch that fails to upgrade")
+}
+
+// options returns the flags for passing the options on to the remote
+// command.
+func (f *rolloutFlags) options() []string {
+	var options []string
+	if f.machines != "" {
+		options = append(options, utils.ShQuote("--machines="+f.machines))
+	}
+	if f.match != "" {
+		options = append(options, utils.ShQuote("--match="+f.match))
+	}
+	if f.canary > 0 {
+		options = append(options, "--canary="+strconv.Itoa(f.canary))
+	}
+	if f.batchSize > 0 {
+		options = append(options, "--batch-size="+strconv.Itoa(f.batchSize))
+	}
+	if f.rollbackOnFailure {
+		options = append(options, "--rollback-on-failure")
+	}
+	return options
+}
+
+// selectMachines returns the machines selected by --machines and
+// --match, excluding those that have already been upgraded.
+func (f *rolloutFlags) selectMachines(ctx *cmd.Context, machines []FlatMachine, upgraded set.Strings) ([]FlatMachine, error) {
+	match := func(string) bool { return true }
+	if f.match != "" {
+		matchRE, err := regexp.Compile(f.match)
+		if err != nil {
+			return nil, errors.Annotate(err, "parsing --match")
+		}
+		match = matchRE.MatchString
+	}
+	ids := set.NewStrings()
+	if f.machines != "" {
+		ids = set.NewStrings(strings.Split(f.machines, ",")...)
+		unknown := ids.Difference(set.NewStrings(machineIds(machines)...))
+		if !unknown.IsEmpty() {
+			return nil, errors.Errorf("unknown machines %s", strings.Join(unknown.SortedValues(), ", "))
+		}
+	}
+
+	var selected []FlatMachine
+	for _, m := range machines {
+		if !ids.IsEmpty() && !ids.Contains(m.ID) {
+			continue
+		}
+		if !match(m.ID) {
+			ctx.Infof("Skipping non-matching machine %q", m.ID)
+			continue
+		}
+		if upgraded.Contains(m.ID) {
+			ctx.Infof("Skipping machine %q, already upgraded", m.ID)
+			continue
+		}
+		selected = append(selected, m)
+	}
+	return selected, nil
+}
+
+// stageMachines splits the machines into batches to be upgraded in
+// turn: a canary batch of the given size, followed by batches of
+// batchSize machines. A batchSize of zero puts all of the machines
+// after the canary batch into a single batch.
+//
+// State servers are upgraded last, each in a batch of its own along
+// with the containers it hosts, as upgrading one rewrites the agent
+// config that the upgrade reads the 1.25 environment with. The local
+// machine, which the upgrade is running on, is the very last.
+func stageMachines(machines []FlatMachine, canary, batchSize int, local string) [][]FlatMachine {
+	deferred := make(map[string]bool)
+	for _, m := range machines {
+		if m.ID == local || m.StateServer {
+			deferred[m.ID] = true
+		}
+	}
+	var others, stateServers, last []FlatMachine
+	hosted := make(map[string][]FlatMachine)
+	for _, m := range machines {
+		host := topLevelMachineId(m.ID)
+		switch {
+		case m.ID == local:
+			last = append(last, m)
+		case m.StateServer:
+			stateServers = append(stateServers, m)
+		case host != m.ID && deferred[host]:
+			hosted[host] = append(hosted[host], m)
+		default:
+			others = append(others, m)
+		}
+	}
+	batches := stageOrdinaryMachines(others, canary, batchSize)
+	for _, m := range append(stateServers, last...) {
+		batches = append(batches, append([]FlatMachine{m}, hosted[m.ID]...))
+	}
+	return batches
+}
+
+// topLevelMachineId returns the ID of the machine that ultimately
+// hosts the given machine, which is the machine itself unless it's a
+// container.
+func topLevelMachineId(id string) string {
+	return strings.SplitN(id, "/", 2)[0]
+}
+
+func stageOrdinaryMachines(machines []FlatMachine, canary, batchSize int) [][]FlatMachine {
+	var batches [][]FlatMachine
+	if canary > 0 && len(machines) > 0 {
+		if canary > len(machines) {
+			canary = len(machines)
+		}
+		batches = append(batches, machines[:canary])
+		machines = machines[canary:]
+	}
+	if batchSize <= 0 {
+		batchSize = len(machines)
+	}
+	for len(machines) > 0 {
+		if batchSize > len(machines) {
+			batchSize = len(machines)
+		}
+		batches = append(batches, machines[:batchSize])
+		machines = machines[batchSize:]
+	}
+	return batches
+}
+
+func machineIds(machines []FlatMachine) []string {
+	ids := make([]string, len(machines))
+	for i, m := range machines {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// loadUpgradedMachines returns the IDs of the machines that the agent
+// upgrade script has been run on, and not since rolled back.
+func loadUpgradedMachines() (set.Strings, error) {
+	data, err := ioutil.ReadFile(path.Join(toolsDir, upgradedMachinesFile))
+	if os.IsNotExist(err) {
+		return set.NewStrings(), nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return set.NewStrings(ids...), nil
+}
+
+func saveUpgradedMachines(ids set.Strings) error {
+	if err := os.MkdirAll(toolsDir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	data, err := json.Marshal(ids.SortedValues())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(writeFile(
+		path.Join(toolsDir, upgradedMachinesFile),
+		0644,
+		bytes.NewBuffer(data)))
+}
+
+func addUpgradedMachines(machines []FlatMachine) error {
+	ids, err := loadUpgradedMachines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return saveUpgradedMachines(ids.Union(set.NewStrings(machineIds(machines)...)))
+}
+
+func removeUpgradedMachines(machines []FlatMachine) error {
+	ids, err := loadUpgradedMachines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return saveUpgradedMachines(ids.Difference(set.NewStrings(machineIds(machines)...)))
+}
+
+// rollbackAgentUpgrades rolls back the agent upgrade on those of the
+// machines that have been upgraded.
+func rollbackAgentUpgrades(ctx *cmd.Context, machines []FlatMachine) error {
+	toRollback, err := machinesToRollback(machines)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(toRollback) == 0 {
+		ctx.Infof("no upgraded machines to roll back")
+		return nil
+	}
+
+	targets := flatMachineExecTargets(toRollback...)
+	results, err := parallelExec(targets, rollbackAgentUpgradeScript)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var rolledBack []FlatMachine
+	for i, res := range results {
+		if res.Code == 0 {
+			rolledBack = append(rolledBack, toRollback[i])
+		}
+	}
+	if err := removeUpgradedMachines(rolledBack); err != nil {
+		return errors.Annotate(err, "recording rolled back machines")
+	}
+	return errors.Trace(reportResults(ctx, "rollback", toRollback, results))
+}
+
+// machinesToRollback returns those of the machines that have been
+// upgraded. If the upgraded machines weren't recorded, because the
+// upgrade was started by an earlier version of upgrade-agents, each
+// machine is checked for the agent upgrade script's rollback
+// information instead. Machines that can't be checked are included,
+// so that the rollback reports them as failed rather than skipping
+// them.
+func machinesToRollback(machines []FlatMachine) ([]FlatMachine, error) {
+	_, err := os.Stat(path.Join(toolsDir, upgradedMachinesFile))
+	if err == nil {
+		upgraded, err := loadUpgradedMachines()
+		if err != nil {
+			return nil, errors.Annotate(err, "loading upgraded machines")
+		}
+		var result []FlatMachine
+		for _, m := range machines {
+			if upgraded.Contains(m.ID) {
+				result = append(result, m)
+			}
+		}
+		return result, nil
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Trace(err)
+	}
+
+	logger.Infof("upgraded machines not recorded; checking machines for rollback information")
+	results, err := parallelExec(flatMachineExecTargets(machines...), probeRollbackInfoScript)
+	if err != nil {
+		return nil, errors.Annotate(err, "checking for rollback information")
+	}
+	var result []FlatMachine
+	for i, res := range results {
+		if res.Code != 1 {
+			result = append(result, machines[i])
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	gc "gopkg.in/check.v1"
+)
+
+type stageMachinesSuite struct{}
+
+var _ = gc.Suite(&stageMachinesSuite{})
+
+func machinesWithIds(ids ...string) []FlatMachine {
+	machines := make([]FlatMachine, len(ids))
+	for i, id := range ids {
+		machines[i].ID = id
+	}
+	return machines
+}
+
+func batchIds(batches [][]FlatMachine) [][]string {
+	result := make([][]string, len(batches))
+	for i, batch := range batches {
+		result[i] = machineIds(batch)
+	}
+	return result
+}
+
+func (*stageMachinesSuite) TestStageMachines(c *gc.C) {
+	machines := machinesWithIds("0", "1", "2", "3", "4")
+	for i, test := range []struct {
+		canary    int
+		batchSize int
+		expected  [][]string
+	}{{
+		expected: [][]string{{"0", "1", "2", "3", "4"}},
+	}, {
+		canary:   1,
+		expected: [][]string{{"0"}, {"1", "2", "3", "4"}},
+	}, {
+		canary:    1,
+		batchSize: 2,
+		expected:  [][]string{{"0"}, {"1", "2"}, {"3", "4"}},
+	}, {
+		batchSize: 3,
+		expected:  [][]string{{"0", "1", "2"}, {"3", "4"}},
+	}, {
+		canary:   10,
+		expected: [][]string{{"0", "1", "2", "3", "4"}},
+	}} {
+		c.Logf("test %d: canary %d, batch size %d", i, test.canary, test.batchSize)
+		batches := stageMachines(machines, test.canary, test.batchSize, "")
+		c.Check(batchIds(batches), gc.DeepEquals, test.expected)
+	}
+}
+
+func (*stageMachinesSuite) TestStageMachinesEmpty(c *gc.C) {
+	c.Assert(stageMachines(nil, 1, 2, ""), gc.HasLen, 0)
+}
+
+func (*stageMachinesSuite) TestStageMachinesStateServersLast(c *gc.C) {
+	machines := machinesWithIds("0", "1", "2", "3", "4")
+	machines[0].StateServer = true
+	machines[3].StateServer = true
+	batches := stageMachines(machines, 1, 0, "0")
+	c.Check(batchIds(batches), gc.DeepEquals, [][]string{{"1"}, {"2", "4"}, {"3"}, {"0"}})
+}
+
+func (*stageMachinesSuite) TestStageMachinesStateServerContainers(c *gc.C) {
+	machines := machinesWithIds("0", "0/lxc/0", "1", "1/lxc/0", "1/lxc/0/kvm/0", "2", "2/lxc/0")
+	machines[0].StateServer = true
+	machines[2].StateServer = true
+	batches := stageMachines(machines, 0, 0, "0")
+	c.Check(batchIds(batches), gc.DeepEquals, [][]string{
+		{"2", "2/lxc/0"},
+		{"1", "1/lxc/0", "1/lxc/0/kvm/0"},
+		{"0", "0/lxc/0"},
+	})
+}
@@ -0,0 +1,597 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"time"
+
+	"github.com/juju/description"
+	"github.com/juju/errors"
+	"github.com/juju/names"
+	gitjujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/utils"
+	"github.com/juju/utils/clock"
+	"github.com/juju/version"
+	gc "gopkg.in/check.v1"
+	names2 "gopkg.in/juju/names.v2"
+
+	"github.com/juju/1.25-upgrade/juju1/constraints"
+	"github.com/juju/1.25-upgrade/juju1/instance"
+	"github.com/juju/1.25-upgrade/juju1/network"
+	"github.com/juju/1.25-upgrade/juju1/state"
+	statetesting "github.com/juju/1.25-upgrade/juju1/state/testing"
+	"github.com/juju/1.25-upgrade/juju1/storage/provider/registry"
+	coretesting "github.com/juju/1.25-upgrade/juju1/testing"
+	"github.com/juju/1.25-upgrade/juju1/testing/factory"
+	version1 "github.com/juju/1.25-upgrade/juju1/version"
+	"github.com/juju/1.25-upgrade/juju2/cloud"
+	constraints2 "github.com/juju/1.25-upgrade/juju2/constraints"
+	instance2 "github.com/juju/1.25-upgrade/juju2/instance"
+	"github.com/juju/1.25-upgrade/juju2/migration"
+	mongo2 "github.com/juju/1.25-upgrade/juju2/mongo"
+	"github.com/juju/1.25-upgrade/juju2/mongo/mongotest"
+	state2 "github.com/juju/1.25-upgrade/juju2/state"
+	provider2 "github.com/juju/1.25-upgrade/juju2/storage/provider"
+	testing2 "github.com/juju/1.25-upgrade/juju2/testing"
+	jujuversion2 "github.com/juju/1.25-upgrade/juju2/version"
+)
+
+// The exporter only knows how to split the environment config of
+// ec2, maas and openstack environments, so the source environments
+// are ec2 environments, imported into an equivalent cloud.
+const (
+	roundTripCloud  = "aws"
+	roundTripRegion = "us-east-1"
+)
+
+var sourceAgentVersion = version1.MustParseBinary("1.25.13-trusty-amd64")
+
+// knownGaps describes the known gaps in the 1.25 exporter (and the
+// 2.x importer), keyed by a pattern matching the error they cause. A
+// round trip that fails with one of them is skipped rather than
+// failed; once the gap is fixed the case runs in full. Any other
+// failure fails the case.
+var knownGaps = []struct {
+	pattern     *regexp.Regexp
+	description string
+}{{
+	regexp.MustCompile(`expected \[\]string\] for (spaces|tags), got \[\]interface \{\}`),
+	"list constraints read from mongo aren't converted to []string",
+}, {
+	regexp.MustCompile(`"" is not a valid (volume|storage) id`),
+	"filesystems without a backing volume export an empty volume tag",
+}, {
+	regexp.MustCompile(`container type "lxc" isn't supported by 2\.x`),
+	"LXC containers are exported as LXC rather than LXD, with lxc constraints, placement and machine IDs",
+}}
+
+// roundTripSuite builds 1.25 environments with the 1.25 state
+// factory, exports them as the import command does, imports the
+// result into a 2.x controller on the same mongod, and checks the
+// imported entities.
+//
+// The machines can't be reached over SSH, so the export adds no
+// container network config, and only the host keys recorded in the
+// tools directory. The suite is skipped if there's no mongod.
+type roundTripSuite struct {
+	gitjujutesting.MgoSuite
+	coretesting.BaseSuite
+
+	mongodStarted bool
+	source        *state.State
+	factory       *factory.Factory
+	nextAddress   int
+}
+
+var _ = gc.Suite(&roundTripSuite{})
+
+// mongodAvailable reports whether there's a mongod for the round trip
+// tests to run: the one named by $JUJU_MONGOD, Juju's own, or one on
+// the path.
+func mongodAvailable() bool {
+	if path := os.Getenv("JUJU_MONGOD"); path != "" {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	for _, path := range []string{"/usr/lib/juju/mongo3.2/bin/mongod", "/usr/lib/juju/bin/mongod"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	_, err := exec.LookPath("mongod")
+	return err == nil
+}
+
+func (s *roundTripSuite) SetUpSuite(c *gc.C) {
+	if !mongodAvailable() {
+		c.Skip("no mongod found; set JUJU_MONGOD to run the round trip tests")
+	}
+	err := gitjujutesting.MgoServer.Start(coretesting.Certs)
+	c.Assert(err, jc.ErrorIsNil)
+	s.mongodStarted = true
+	s.MgoSuite.SetUpSuite(c)
+	s.BaseSuite.SetUpSuite(c)
+	// Registering the environment type also registers the storage
+	// providers common to all environments, such as loop and rootfs.
+	registry.RegisterEnvironStorageProviders("ec2")
+}
+
+func (s *roundTripSuite) TearDownSuite(c *gc.C) {
+	if !s.mongodStarted {
+		return
+	}
+	s.BaseSuite.TearDownSuite(c)
+	s.MgoSuite.TearDownSuite(c)
+	gitjujutesting.MgoServer.Destroy()
+}
+
+func (s *roundTripSuite) SetUpTest(c *gc.C) {
+	s.MgoSuite.SetUpTest(c)
+	s.BaseSuite.SetUpTest(c)
+	// None of the machines are reachable.
+	s.PatchValue(&toolsDir, c.MkDir())
+	s.PatchValue(&remoteExec, remoteExecutor(newFakeFleet()))
+
+	cfg := coretesting.CustomEnvironConfig(c, coretesting.Attrs{
+		"uuid":       utils.MustNewUUID().String(),
+		"type":       "ec2",
+		"region":     roundTripRegion,
+		"access-key": "access-key",
+		"secret-key": "secret-key",
+	})
+	s.source = statetesting.Initialize(c, names.NewLocalUserTag("test-admin"), cfg, nil)
+	s.factory = factory.NewFactory(s.source)
+}
+
+func (s *roundTripSuite) TearDownTest(c *gc.C) {
+	s.closeSource(c)
+	s.BaseSuite.TearDownTest(c)
+	s.MgoSuite.TearDownTest(c)
+}
+
+func (s *roundTripSuite) closeSource(c *gc.C) {
+	if s.source == nil {
+		return
+	}
+	err := s.source.Close()
+	s.source = nil
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+// roundTrip exports the source environment, and imports it into a new
+// 2.x controller, returning the state of the imported model. The
+// source environment is gone once roundTrip returns.
+func (s *roundTripSuite) roundTrip(c *gc.C) *state2.State {
+	model, err := s.export()
+	checkKnownGaps(c, err)
+
+	// The import command replaces the agent binaries with 2.x ones
+	// before importing; do the same.
+	model.Config()["agent-version"] = jujuversion2.Current.String()
+	for _, machine := range model.Machines() {
+		setTargetTools(machine)
+	}
+	for _, app := range model.Applications() {
+		for _, unit := range app.Units() {
+			unit.SetTools(targetTools(unit.Tools()))
+		}
+	}
+	bytes, err := description.Serialize(model)
+	c.Assert(err, jc.ErrorIsNil)
+
+	// The 1.25 and 2.x states use the same databases, so the source
+	// has to go before the controller can be initialised.
+	s.closeSource(c)
+	err = gitjujutesting.MgoServer.Reset()
+	c.Assert(err, jc.ErrorIsNil)
+
+	controller := initializeController(c)
+	s.AddCleanup(func(*gc.C) { controller.Close() })
+	_, st, err := migration.ImportModel(controller, bytes)
+	checkKnownGaps(c, err)
+	s.AddCleanup(func(*gc.C) { st.Close() })
+	return st
+}
+
+// export exports the source environment as the import command does,
+// reporting any panic in the exporter as an error.
+func (s *roundTripSuite) export() (description.Model, error) {
+	return s.exportPartial(state.ExportConfig{})
+}
+
+func (s *roundTripSuite) exportPartial(cfg state.ExportConfig) (model description.Model, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("exporter panicked: %v", r)
+		}
+	}()
+	return exportModel(s.source, roundTripCloud, cfg)
+}
+
+func checkKnownGaps(c *gc.C, err error) {
+	if err == nil {
+		return
+	}
+	for _, gap := range knownGaps {
+		if gap.pattern.MatchString(err.Error()) {
+			c.Skip("known gap: " + gap.description)
+		}
+	}
+	c.Fatalf("round trip failed: %v", errors.ErrorStack(err))
+}
+
+func setTargetTools(machine description.Machine) {
+	machine.SetTools(targetTools(machine.Tools()))
+	for _, container := range machine.Containers() {
+		setTargetTools(container)
+	}
+}
+
+func targetTools(tools description.AgentTools) description.AgentToolsArgs {
+	return description.AgentToolsArgs{
+		Version: version.Binary{
+			Number: jujuversion2.Current,
+			Series: tools.Version().Series,
+			Arch:   tools.Version().Arch,
+		},
+		URL:    tools.URL(),
+		SHA256: tools.SHA256(),
+		Size:   tools.Size(),
+	}
+}
+
+// initializeController initialises a 2.x controller with a cloud that
+// the source environments can be imported into.
+func initializeController(c *gc.C) *state2.State {
+	st, err := state2.Initialize(state2.InitializeParams{
+		Clock:            clock.WallClock,
+		ControllerConfig: testing2.FakeControllerConfig(),
+		ControllerModelArgs: state2.ModelArgs{
+			CloudName:   roundTripCloud,
+			CloudRegion: roundTripRegion,
+			Config: testing2.CustomModelConfig(c, testing2.Attrs{
+				"name": "controller",
+				"uuid": utils.MustNewUUID().String(),
+			}),
+			Owner:                   names2.NewLocalUserTag("controller-admin"),
+			StorageProviderRegistry: provider2.CommonStorageProviders(),
+		},
+		Cloud: cloud.Cloud{
+			Name:      roundTripCloud,
+			Type:      "ec2",
+			AuthTypes: []cloud.AuthType{cloud.AccessKeyAuthType},
+			Regions:   []cloud.Region{{Name: roundTripRegion}},
+		},
+		MongoInfo: &mongo2.MongoInfo{
+			Info: mongo2.Info{
+				Addrs: []string{gitjujutesting.MgoServer.Addr()},
+				// The mongod is running with the 1.25 test certs.
+				CACert: coretesting.CACert,
+			},
+		},
+		MongoDialOpts: mongotest.DialOpts(),
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	return st
+}
+
+// address returns a new address for a machine. The export needs every
+// machine to have one.
+func (s *roundTripSuite) address() network.Address {
+	s.nextAddress++
+	return network.NewAddress(fmt.Sprintf("10.1.0.%d", s.nextAddress))
+}
+
+func (s *roundTripSuite) makeMachine(c *gc.C) *state.Machine {
+	machine := s.factory.MakeMachine(c, &factory.MachineParams{
+		Addresses: []network.Address{s.address()},
+	})
+	err := machine.SetAgentVersion(sourceAgentVersion)
+	c.Assert(err, jc.ErrorIsNil)
+	return machine
+}
+
+func (s *roundTripSuite) makeContainer(c *gc.C, host *state.Machine) *state.Machine {
+	container := s.factory.MakeMachineNested(c, host.Id(), nil)
+	instanceId := instance.Id("juju-" + names.NewMachineTag(container.Id()).String())
+	err := container.SetProvisioned(instanceId, "nonce", nil)
+	c.Assert(err, jc.ErrorIsNil)
+	err = container.SetProviderAddresses(s.address())
+	c.Assert(err, jc.ErrorIsNil)
+	err = container.SetAgentVersion(sourceAgentVersion)
+	c.Assert(err, jc.ErrorIsNil)
+	return container
+}
+
+func (s *roundTripSuite) makeService(c *gc.C, charmName, name string, storage map[string]state.StorageConstraints) *state.Service {
+	return s.factory.MakeService(c, &factory.ServiceParams{
+		Name:    name,
+		Charm:   s.factory.MakeCharm(c, &factory.CharmParams{Name: charmName}),
+		Storage: storage,
+	})
+}
+
+func (s *roundTripSuite) makeUnit(c *gc.C, service *state.Service, machine *state.Machine) *state.Unit {
+	unit := s.factory.MakeUnit(c, &factory.UnitParams{
+		Service:     service,
+		Machine:     machine,
+		SetCharmURL: true,
+	})
+	err := unit.SetAgentVersion(sourceAgentVersion)
+	c.Assert(err, jc.ErrorIsNil)
+	return unit
+}
+
+// relate relates the endpoints, and enters the units into the relation
+// scope, as their agents would. The exporter expects all the units of
+// a related service to be in scope.
+func (s *roundTripSuite) relate(c *gc.C, endpoints []string, units ...*state.Unit) *state.Relation {
+	eps, err := s.source.InferEndpoints(endpoints...)
+	c.Assert(err, jc.ErrorIsNil)
+	rel, err := s.source.AddRelation(eps...)
+	c.Assert(err, jc.ErrorIsNil)
+	for _, unit := range units {
+		ru, err := rel.Unit(unit)
+		c.Assert(err, jc.ErrorIsNil)
+		err = ru.EnterScope(map[string]interface{}{"unit": unit.Name()})
+		c.Assert(err, jc.ErrorIsNil)
+	}
+	return rel
+}
+
+func (s *roundTripSuite) TestServices(c *gc.C) {
+	wordpress := s.makeService(c, "wordpress", "wordpress", nil)
+	mysql := s.makeService(c, "mysql", "mysql", nil)
+	wp0 := s.makeUnit(c, wordpress, s.makeMachine(c))
+	wp1 := s.makeUnit(c, wordpress, s.makeMachine(c))
+	db0 := s.makeUnit(c, mysql, s.makeMachine(c))
+	s.relate(c, []string{"wordpress", "mysql"}, wp0, wp1, db0)
+
+	err := wordpress.SetConstraints(constraints.MustParse("mem=4G cpu-cores=2"))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.source.SetEnvironConstraints(constraints.MustParse("mem=2G"))
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.source.SetAnnotations(wordpress, map[string]string{"owner": "web-team"})
+	c.Assert(err, jc.ErrorIsNil)
+	env, err := s.source.Environment()
+	c.Assert(err, jc.ErrorIsNil)
+	err = s.source.SetAnnotations(env, map[string]string{"purpose": "testing"})
+	c.Assert(err, jc.ErrorIsNil)
+
+	err = s.source.LeadershipClaimer().ClaimLeadership("wordpress", wp1.Name(), time.Minute)
+	c.Assert(err, jc.ErrorIsNil)
+	token := s.source.LeadershipChecker().LeadershipCheck("wordpress", wp1.Name())
+	err = wordpress.UpdateLeaderSettings(token, map[string]string{"admin-password": "sekrit"})
+	c.Assert(err, jc.ErrorIsNil)
+
+	st := s.roundTrip(c)
+
+	apps, err := st.AllApplications()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(apps, gc.HasLen, 2)
+	app, err := st.Application("wordpress")
+	c.Assert(err, jc.ErrorIsNil)
+	units, err := app.AllUnits()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(units, gc.HasLen, 2)
+	for _, unit := range units {
+		machineId, err := unit.AssignedMachineId()
+		c.Assert(err, jc.ErrorIsNil)
+		c.Check(machineId, gc.Not(gc.Equals), "")
+	}
+
+	rels, err := st.AllRelations()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(rels, gc.HasLen, 1)
+	c.Check(rels[0].String(), gc.Equals, "wordpress:db mysql:server")
+
+	cons, err := app.Constraints()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cons.String(), gc.Equals, constraints2.MustParse("mem=4G cores=2").String())
+	modelCons, err := st.ModelConstraints()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(modelCons.String(), gc.Equals, constraints2.MustParse("mem=2G").String())
+
+	annotations, err := st.Annotations(app)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(annotations, jc.DeepEquals, map[string]string{"owner": "web-team"})
+	model, err := st.Model()
+	c.Assert(err, jc.ErrorIsNil)
+	annotations, err = st.Annotations(model)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(annotations, jc.DeepEquals, map[string]string{"purpose": "testing"})
+
+	leaders, err := st.ApplicationLeaders()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(leaders["wordpress"], gc.Equals, "wordpress/1")
+	settings, err := app.LeaderSettings()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(settings, jc.DeepEquals, map[string]string{"admin-password": "sekrit"})
+}
+
+func (s *roundTripSuite) TestSubordinates(c *gc.C) {
+	wordpress := s.makeService(c, "wordpress", "wordpress", nil)
+	s.makeService(c, "logging", "logging", nil)
+	wp0 := s.makeUnit(c, wordpress, s.makeMachine(c))
+	rel := s.relate(c, []string{"wordpress:juju-info", "logging:info"}, wp0)
+
+	// Entering the principal into scope created the subordinate.
+	logging0, err := s.source.Unit("logging/0")
+	c.Assert(err, jc.ErrorIsNil)
+	err = logging0.SetAgentVersion(sourceAgentVersion)
+	c.Assert(err, jc.ErrorIsNil)
+	ru, err := rel.Unit(logging0)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ru.EnterScope(nil)
+	c.Assert(err, jc.ErrorIsNil)
+
+	st := s.roundTrip(c)
+
+	app, err := st.Application("logging")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(app.IsPrincipal(), jc.IsFalse)
+	unit, err := st.Unit("logging/0")
+	c.Assert(err, jc.ErrorIsNil)
+	principal, ok := unit.PrincipalName()
+	c.Check(ok, jc.IsTrue)
+	c.Check(principal, gc.Equals, "wordpress/0")
+	unit, err = st.Unit("wordpress/0")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(unit.SubordinateNames(), jc.DeepEquals, []string{"logging/0"})
+}
+
+func (s *roundTripSuite) TestContainers(c *gc.C) {
+	host := s.makeMachine(c)
+	container := s.makeContainer(c, host)
+	mysql := s.makeService(c, "mysql", "mysql", nil)
+	s.makeUnit(c, mysql, container)
+
+	st := s.roundTrip(c)
+
+	machine, err := st.Machine(container.Id())
+	c.Assert(err, jc.ErrorIsNil)
+	parentId, ok := machine.ParentId()
+	c.Check(ok, jc.IsTrue)
+	c.Check(parentId, gc.Equals, host.Id())
+	unit, err := st.Unit("mysql/0")
+	c.Assert(err, jc.ErrorIsNil)
+	machineId, err := unit.AssignedMachineId()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(machineId, gc.Equals, container.Id())
+	if machine.ContainerType() != instance2.LXD {
+		checkKnownGaps(c, errors.Errorf("container type %q isn't supported by 2.x", machine.ContainerType()))
+	}
+}
+
+func (s *roundTripSuite) TestBlockStorage(c *gc.C) {
+	service := s.makeService(c, "storage-block", "storage-block", map[string]state.StorageConstraints{
+		"data": {Pool: "loop", Size: 1024, Count: 1},
+	})
+	s.makeUnit(c, service, s.makeMachine(c))
+
+	st := s.roundTrip(c)
+
+	instances, err := st.AllStorageInstances()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(instances, gc.HasLen, 1)
+	c.Check(instances[0].Kind(), gc.Equals, state2.StorageKindBlock)
+	c.Check(instances[0].StorageName(), gc.Equals, "data")
+	owner, ok := instances[0].Owner()
+	c.Check(ok, jc.IsTrue)
+	c.Check(owner, gc.Equals, names2.NewUnitTag("storage-block/0"))
+	attachments, err := st.UnitStorageAttachments(names2.NewUnitTag("storage-block/0"))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(attachments, gc.HasLen, 1)
+	volume, err := st.StorageInstanceVolume(instances[0].StorageTag())
+	c.Assert(err, jc.ErrorIsNil)
+	params, ok := volume.Params()
+	c.Check(ok, jc.IsTrue)
+	c.Check(params.Pool, gc.Equals, "loop")
+}
+
+func (s *roundTripSuite) TestFilesystemStorage(c *gc.C) {
+	service := s.makeService(c, "storage-filesystem", "storage-filesystem", map[string]state.StorageConstraints{
+		"data": {Pool: "rootfs", Size: 1024, Count: 1},
+	})
+	s.makeUnit(c, service, s.makeMachine(c))
+
+	st := s.roundTrip(c)
+
+	instances, err := st.AllStorageInstances()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(instances, gc.HasLen, 1)
+	c.Check(instances[0].Kind(), gc.Equals, state2.StorageKindFilesystem)
+	_, err = st.StorageInstanceFilesystem(instances[0].StorageTag())
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *roundTripSuite) addSpace(c *gc.C, name, cidr string) {
+	_, err := s.source.AddSubnet(state.SubnetInfo{
+		CIDR:             cidr,
+		ProviderId:       "subnet-" + name,
+		AvailabilityZone: roundTripRegion + "a",
+	})
+	c.Assert(err, jc.ErrorIsNil)
+	_, err = s.source.AddSpace(name, []string{cidr}, false)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *roundTripSuite) TestSpaces(c *gc.C) {
+	s.addSpace(c, "db", "10.0.0.0/24")
+	s.addSpace(c, "web", "10.0.1.0/24")
+
+	st := s.roundTrip(c)
+
+	spaces, err := st.AllSpaces()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(spaces, gc.HasLen, 2)
+	for _, space := range spaces {
+		subnets, err := space.Subnets()
+		c.Assert(err, jc.ErrorIsNil)
+		c.Assert(subnets, gc.HasLen, 1, gc.Commentf("space %q", space.Name()))
+		c.Check(subnets[0].AvailabilityZone(), gc.Equals, roundTripRegion+"a")
+		c.Check(string(subnets[0].ProviderId()), gc.Equals, "subnet-"+space.Name())
+	}
+}
+
+func (s *roundTripSuite) TestSpaceConstraints(c *gc.C) {
+	s.addSpace(c, "db", "10.0.0.0/24")
+	mysql := s.makeService(c, "mysql", "mysql", nil)
+	err := mysql.SetConstraints(constraints.MustParse("spaces=db tags=ssd"))
+	c.Assert(err, jc.ErrorIsNil)
+
+	st := s.roundTrip(c)
+
+	app, err := st.Application("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	cons, err := app.Constraints()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(cons.String(), gc.Equals, constraints2.MustParse("spaces=db tags=ssd").String())
+}
+
+func (s *roundTripSuite) TestStatusHistoryLimit(c *gc.C) {
+	machine := s.makeMachine(c)
+	for i := 0; i < 4; i++ {
+		status := state.StatusStarted
+		if i%2 == 1 {
+			status = state.StatusStopped
+		}
+		err := machine.SetStatus(status, "", nil)
+		c.Assert(err, jc.ErrorIsNil)
+	}
+
+	historyLen := func(cfg state.ExportConfig) int {
+		model, err := s.exportPartial(cfg)
+		checkKnownGaps(c, err)
+		machines := model.Machines()
+		c.Assert(machines, gc.HasLen, 1)
+		return len(machines[0].StatusHistory())
+	}
+	c.Check(historyLen(state.ExportConfig{}) > 2, jc.IsTrue)
+	c.Check(historyLen(state.ExportConfig{MaxStatusHistory: 2}), gc.Equals, 2)
+	c.Check(historyLen(state.ExportConfig{MaxStatusHistoryAge: time.Hour}) > 2, jc.IsTrue)
+	c.Check(historyLen(state.ExportConfig{SkipStatusHistory: true}), gc.Equals, 0)
+}
+
+func (s *roundTripSuite) TestTopLevelSizes(c *gc.C) {
+	s.makeMachine(c)
+	model, err := s.export()
+	checkKnownGaps(c, err)
+	data, err := description.Serialize(model)
+	c.Assert(err, jc.ErrorIsNil)
+
+	sizes := topLevelSizes(data)
+	total := 0
+	for key, size := range sizes {
+		c.Check(key, gc.Not(gc.Equals), "")
+		total += size
+	}
+	c.Check(total, gc.Equals, len(data))
+	c.Check(sizes["machines"] > sizes["applications"], jc.IsTrue)
+}
@@ -13,7 +13,10 @@ import (
 	"github.com/juju/juju/cmd/output"
 )
 
-func printServiceStatus(ctx *cmd.Context, machines []FlatMachine) error {
+// printServiceStatus prints the status of the agents on the machines.
+// If definitions is non-nil, it also prints whether each agent's
+// service definition matches 2.x, as reported by agentDefinitions.
+func printServiceStatus(ctx *cmd.Context, machines []FlatMachine, definitions map[string]string) error {
 	serviceStatusOutput, err := agentServiceCommand(ctx, machines, "status")
 	if err != nil {
 		return errors.Trace(err)
@@ -21,14 +24,83 @@ func printServiceStatus(ctx *cmd.Context, machines []FlatMachine) error {
 	values := parseStatus(machines, serviceStatusOutput)
 	writer := output.TabWriter(ctx.Stdout)
 	wrapper := output.Wrapper{writer}
-	wrapper.Println("AGENT", "STATUS", "VERSION")
+	if definitions == nil {
+		wrapper.Println("AGENT", "STATUS", "VERSION")
+	} else {
+		wrapper.Println("AGENT", "STATUS", "VERSION", "DEFINITION")
+	}
 	for _, v := range values {
-		wrapper.Println(v.agent, v.status, v.version)
+		if definitions == nil {
+			wrapper.Println(v.agent, v.status, v.version)
+			continue
+		}
+		definition, ok := definitions[v.agent]
+		if !ok {
+			definition = "unknown"
+		}
+		wrapper.Println(v.agent, v.status, v.version, definition)
 	}
 	writer.Flush()
 	return nil
 }
 
+// agentDefinitions returns whether the service definition of each
+// agent on the machines matches what 2.x would install, keyed by agent.
+// The machine agent's entry also covers the juju-run, juju-dumplogs
+// and juju-introspect links. Agents on machines that can't be checked,
+// including those that upgrade-agents hasn't reached, are omitted.
+func agentDefinitions(machines []FlatMachine) (map[string]string, error) {
+	plugin, err := pluginPath()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	targets := flatMachineExecTargets(machines...)
+	results, err := parallelExec(targets, checkAgentServicesScript(path.Base(plugin)))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	definitions := make(map[string]string)
+	for i, result := range results {
+		if result.Code != 0 {
+			logger.Warningf("checking service definitions on machine %s failed: %s", machines[i].ID, strings.TrimSpace(result.Stderr))
+			continue
+		}
+		var machineAgent, links string
+		for _, line := range strings.Split(strings.TrimSpace(result.Stdout), "\n") {
+			parts := strings.SplitN(line, ": ", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			name, state := parts[0], parts[1]
+			switch {
+			case strings.HasPrefix(name, "jujud-"):
+				agent := strings.TrimPrefix(name, "jujud-")
+				definitions[agent] = state
+				if strings.HasPrefix(agent, "machine-") {
+					machineAgent = agent
+				}
+			case state != definitionMatches && links == "":
+				links = name + " " + state
+			}
+		}
+		if links != "" && definitions[machineAgent] == definitionMatches {
+			definitions[machineAgent] = links
+		}
+	}
+	return definitions, nil
+}
+
+// checkAgentServicesScript runs agent-services-impl --check from the
+// copy of the plugin pushed to the machine by upgrade-agents, if
+// there is one.
+func checkAgentServicesScript(plugin string) string {
+	return fmt.Sprintf(`
+plugin=~/1.25-agent-upgrade/%s
+[ -e "$plugin" ] || exit 0
+"$plugin" agent-services-impl --check
+`, plugin)
+}
+
 type statusResult struct {
 	agent   string
 	status  string
@@ -101,20 +173,8 @@ func systemdStatus(output string) string {
 // to stderr will be logged, prefixed by the name of the machine on which the
 // command failed.
 func agentServiceCommand(ctx *cmd.Context, machines []FlatMachine, command string) ([]string, error) {
-	script := fmt.Sprintf(`
-set -xu
-cd /var/lib/juju/agents
-for agent in *
-do
-	echo $agent
-	ls -al /var/lib/juju/tools/$agent
-	sudo service jujud-$agent %s
-	echo "-- end-of-agent --"
-done
-	`, command)
-
 	targets := flatMachineExecTargets(machines...)
-	results, err := parallelExec(targets, script)
+	results, err := parallelExec(targets, agentServiceScript(command))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -150,3 +210,21 @@ done
 	}
 	return nil, errors.Errorf("service %s command failed for machine%s %q", command, plural, failed)
 }
+
+// agentServiceScript returns the script that runs the given "service"
+// subcommand for every Juju agent on a machine. For each agent it
+// prints the agent name, the tools symlink and the service output,
+// followed by an end-of-agent marker.
+func agentServiceScript(command string) string {
+	return fmt.Sprintf(`
+set -xu
+cd /var/lib/juju/agents
+for agent in *
+do
+	echo $agent
+	ls -al /var/lib/juju/tools/$agent
+	sudo service jujud-$agent %s
+	echo "-- end-of-agent --"
+done
+	`, command)
+}
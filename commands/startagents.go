@@ -78,5 +78,5 @@ func (c *startAgentsImplCommand) Run(ctx *cmd.Context) error {
 
 	// The information is then gathered and parsed and formatted here before
 	// the data is passed back to the caller.
-	return printServiceStatus(ctx, machines)
+	return printServiceStatus(ctx, machines, nil)
 }
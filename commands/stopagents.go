@@ -11,6 +11,10 @@ import (
 var stopAgentsDoc = ` 
 The purpose of the stop-agents command is to stop all the agents of a 1.25
 environment. The agents may be running the 1.25 binary, or a 2.x binary.
+
+Only the agents' jujud services are stopped. juju-db keeps running on the
+state servers, including those that host units, so that the environment can
+still be read for the rest of the migration.
 `
 
 func newStopAgentsCommand() cmd.Command {
@@ -78,5 +82,5 @@ func (c *stopAgentsImplCommand) Run(ctx *cmd.Context) error {
 
 	// The information is then gathered and parsed and formatted here before
 	// the data is passed back to the caller.
-	return printServiceStatus(ctx, machines)
+	return printServiceStatus(ctx, machines, nil)
 }
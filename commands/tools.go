@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 
 	"github.com/juju/errors"
 	"github.com/juju/utils"
@@ -23,18 +24,60 @@ import (
 
 const toolsURLTemplate = "https://%s/tools/%s-%s"
 
-func newToolsWrangler(conn api.Connection) *toolsWrangler {
-	return &toolsWrangler{
+// newToolsWrangler returns a toolsWrangler that gets agent binaries
+// from the controller connected to with the given info. If binariesDir
+// is non-empty, it holds agent binaries copied from the client by
+// pushAgentBinaries, and those are used in preference to downloading
+// from the controller.
+func newToolsWrangler(conn api.Connection, info *api.Info, binariesDir string) (*toolsWrangler, error) {
+	client, err := newControllerHTTPClient(info)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tw := &toolsWrangler{
 		conn:   conn,
-		client: utils.GetNonValidatingHTTPClient(),
+		client: client,
 		cache:  make(map[string]*coretools.Tools),
 	}
+	if binariesDir != "" {
+		// The client gives the directory relative to the SSH
+		// user's home directory, which holds the tools directory.
+		if !filepath.IsAbs(binariesDir) {
+			binariesDir = filepath.Join(filepath.Dir(toolsDir), binariesDir)
+		}
+		tw.binaries, err = loadAgentBinaries(binariesDir)
+		if err != nil {
+			return nil, errors.Annotate(err, "loading supplied agent binaries")
+		}
+	}
+	return tw, nil
 }
 
 type toolsWrangler struct {
-	conn   api.Connection
-	client *http.Client
-	cache  map[string]*coretools.Tools
+	conn     api.Connection
+	client   *http.Client
+	cache    map[string]*coretools.Tools
+	binaries map[string]agentBinary
+}
+
+// newControllerHTTPClient returns an HTTP client that validates the
+// controller's certificate against the controller's CA certificate.
+func newControllerHTTPClient(info *api.Info) (*http.Client, error) {
+	tlsConfig := utils.SecureTLSConfig()
+	if info.CACert != "" {
+		pool, err := api.CreateCertPool(info.CACert)
+		if err != nil {
+			return nil, errors.Annotate(err, "creating controller CA cert pool")
+		}
+		tlsConfig.RootCAs = pool
+		// The controller's certificate is issued for
+		// juju-apiserver rather than any of its addresses.
+		tlsConfig.ServerName = "juju-apiserver"
+	}
+	if info.SNIHostName != "" {
+		tlsConfig.ServerName = info.SNIHostName
+	}
+	return &http.Client{Transport: utils.NewHttpTLSTransport(tlsConfig)}, nil
 }
 
 func (tw *toolsWrangler) version() version.Number {
@@ -56,13 +99,44 @@ func (tw *toolsWrangler) url(seriesArch string) string {
 func (tw *toolsWrangler) getTools(seriesArch string) error {
 	toolsURL := tw.url(seriesArch)
 	toolsVersion := tw.binary(seriesArch)
+	binary, supplied := tw.binaries[toolsVersion.String()]
 
-	// Look to see if the file is already there, if it is, assume
-	// that it is good.
+	// A file left by an earlier run is only used if it's complete and
+	// unchanged: it must match the supplied binary, or the checksum
+	// recorded when it was downloaded.
 	downloadedTools := toolsFilePath(tw.version(), seriesArch)
 	if _, err := os.Stat(downloadedTools); err == nil {
-		logger.Infof("%s exists\n", downloadedTools)
-		return nil
+		var ok bool
+		if supplied {
+			ok, err = matchesSHA256(downloadedTools, binary.SHA256, binary.Size)
+		} else {
+			ok, err = matchesRecordedSHA256(downloadedTools)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "checking %s", downloadedTools)
+		}
+		if ok {
+			logger.Infof("%s exists and matches its SHA256\n", downloadedTools)
+			return nil
+		}
+		logger.Warningf("%s doesn't match its SHA256, replacing it", downloadedTools)
+		if err := removeToolsFile(downloadedTools); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Ensure the toolsDir exists.
+	if err := os.MkdirAll(toolsDir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+
+	if supplied {
+		return errors.Annotatef(
+			installAgentBinary(binary, downloadedTools),
+			"installing supplied agent binary %s", toolsVersion,
+		)
+	} else if tw.binaries != nil {
+		logger.Infof("agent binary %s not supplied, downloading from controller", toolsVersion)
 	}
 
 	logger.Infof("Downloading tools: %s\n", toolsURL)
@@ -75,17 +149,121 @@ func (tw *toolsWrangler) getTools(seriesArch string) error {
 		return errors.Errorf("bad HTTP response: %v", resp.Status)
 	}
 
-	// Ensure the toolsDir exists.
-	if err := os.MkdirAll(toolsDir, 0755); err != nil {
+	// The download goes to a temporary file, so that an interrupted
+	// download is never mistaken for the tools.
+	temp := downloadedTools + ".tmp"
+	hash := sha256.New()
+	if err := writeFile(temp, 0644, io.TeeReader(resp.Body, hash)); err != nil {
+		removeAll(temp)
+		return errors.Errorf("cannot save tools: %v", err)
+	}
+	info, err := os.Stat(temp)
+	if err != nil {
 		return errors.Trace(err)
 	}
-	err = writeFile(downloadedTools, 0644, resp.Body)
+	if resp.ContentLength >= 0 && info.Size() != resp.ContentLength {
+		removeAll(temp)
+		return errors.Errorf("downloading tools %s: got %d bytes, expected %d", toolsVersion, info.Size(), resp.ContentLength)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := writeToolsChecksum(downloadedTools, sum); err != nil {
+		removeAll(temp)
+		return errors.Annotate(err, "recording tools SHA256")
+	}
+	return errors.Trace(utils.ReplaceFile(temp, downloadedTools))
+}
+
+// toolsChecksumPath returns the path of the file recording the SHA256
+// of the downloaded tools, in the format written by sha256sum.
+func toolsChecksumPath(toolsFile string) string {
+	return toolsFile + ".sha256"
+}
+
+func writeToolsChecksum(toolsFile, sum string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, path.Base(toolsFile))
+	return errors.Trace(utils.AtomicWriteFile(toolsChecksumPath(toolsFile), []byte(line), 0644))
+}
+
+// matchesRecordedSHA256 reports whether the downloaded tools match
+// the SHA256 recorded when they were downloaded. Tools without a
+// recorded SHA256 don't match, as the download may not have finished.
+func matchesRecordedSHA256(toolsFile string) (bool, error) {
+	sums, err := readChecksums(toolsChecksumPath(toolsFile))
+	if os.IsNotExist(errors.Cause(err)) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Trace(err)
+	}
+	sum, ok := sums[path.Base(toolsFile)]
+	if !ok {
+		return false, nil
+	}
+	return matchesSHA256(toolsFile, sum, 0)
+}
+
+// matchesSHA256 reports whether the file has the given SHA256 and, if
+// size isn't 0, size.
+func matchesSHA256(file, sum string, size int64) (bool, error) {
+	f, err := os.Open(file)
 	if err != nil {
-		return errors.Errorf("cannot save tools: %v", err)
+		return false, errors.Trace(err)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if size != 0 && n != size {
+		return false, nil
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == sum, nil
+}
+
+// removeToolsFile removes the tools file and its recorded SHA256.
+func removeToolsFile(toolsFile string) error {
+	for _, name := range []string{toolsFile, toolsChecksumPath(toolsFile)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return errors.Trace(err)
+		}
 	}
 	return nil
 }
 
+// installAgentBinary copies the supplied agent binary to dest, after
+// checking that its size and SHA256 match those in the manifest.
+func installAgentBinary(binary agentBinary, dest string) error {
+	f, err := os.Open(binary.path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	temp := dest + ".tmp"
+	hash := sha256.New()
+	if err := writeFile(temp, 0644, io.TeeReader(f, hash)); err != nil {
+		return errors.Trace(err)
+	}
+	info, err := os.Stat(temp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != binary.SHA256 || (binary.Size != 0 && info.Size() != binary.Size) {
+		removeAll(temp)
+		return errors.Errorf(
+			"%s does not match metadata: got SHA256 %s (size %d), expected %s (size %d)",
+			binary.File, sum, info.Size(), binary.SHA256, binary.Size,
+		)
+	}
+	logger.Infof("verified SHA256 of supplied agent binary %s", binary.Version)
+	if err := writeToolsChecksum(dest, sum); err != nil {
+		removeAll(temp)
+		return errors.Annotate(err, "recording tools SHA256")
+	}
+	return errors.Trace(utils.ReplaceFile(temp, dest))
+}
+
 func (tw *toolsWrangler) metadata(seriesArch string) (*coretools.Tools, error) {
 	if cached, ok := tw.cache[seriesArch]; ok {
 		return cached, nil
@@ -0,0 +1,58 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type toolsSuite struct{}
+
+var _ = gc.Suite(&toolsSuite{})
+
+func (*toolsSuite) TestMatchesRecordedSHA256(c *gc.C) {
+	toolsFile := filepath.Join(c.MkDir(), "2.2.4-trusty-amd64.tgz")
+	content := []byte("agent binary")
+	c.Assert(ioutil.WriteFile(toolsFile, content, 0644), jc.ErrorIsNil)
+
+	// Without a recorded SHA256 the download may not have finished.
+	ok, err := matchesRecordedSHA256(toolsFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ok, jc.IsFalse)
+
+	sum := sha256.Sum256(content)
+	c.Assert(writeToolsChecksum(toolsFile, hex.EncodeToString(sum[:])), jc.ErrorIsNil)
+	ok, err = matchesRecordedSHA256(toolsFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ok, jc.IsTrue)
+
+	c.Assert(ioutil.WriteFile(toolsFile, content[:5], 0644), jc.ErrorIsNil)
+	ok, err = matchesRecordedSHA256(toolsFile)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ok, jc.IsFalse)
+
+	c.Assert(removeToolsFile(toolsFile), jc.ErrorIsNil)
+	c.Check(toolsFile, jc.DoesNotExist)
+	c.Check(toolsChecksumPath(toolsFile), jc.DoesNotExist)
+}
+
+func (*toolsSuite) TestMatchesSHA256Size(c *gc.C) {
+	toolsFile := filepath.Join(c.MkDir(), "2.2.4-trusty-amd64.tgz")
+	content := []byte("agent binary")
+	c.Assert(ioutil.WriteFile(toolsFile, content, 0644), jc.ErrorIsNil)
+	sum := sha256.Sum256(content)
+
+	ok, err := matchesSHA256(toolsFile, hex.EncodeToString(sum[:]), int64(len(content)))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ok, jc.IsTrue)
+	ok, err = matchesSHA256(toolsFile, hex.EncodeToString(sum[:]), int64(len(content)+1))
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(ok, jc.IsFalse)
+}
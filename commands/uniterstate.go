@@ -0,0 +1,486 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	"github.com/juju/names"
+	hooksv5 "gopkg.in/juju/charm.v5/hooks"
+	charmv6 "gopkg.in/juju/charm.v6-unstable"
+	hooksv6 "gopkg.in/juju/charm.v6-unstable/hooks"
+	names2 "gopkg.in/juju/names.v2"
+
+	uniter1 "github.com/juju/1.25-upgrade/juju1/worker/uniter"
+	charm1 "github.com/juju/1.25-upgrade/juju1/worker/uniter/charm"
+	metrics1 "github.com/juju/1.25-upgrade/juju1/worker/uniter/metrics"
+	operation1 "github.com/juju/1.25-upgrade/juju1/worker/uniter/operation"
+	relation1 "github.com/juju/1.25-upgrade/juju1/worker/uniter/relation"
+	storage1 "github.com/juju/1.25-upgrade/juju1/worker/uniter/storage"
+	spool2 "github.com/juju/1.25-upgrade/juju2/worker/metrics/spool"
+	uniter2 "github.com/juju/1.25-upgrade/juju2/worker/uniter"
+	hook2 "github.com/juju/1.25-upgrade/juju2/worker/uniter/hook"
+	operation2 "github.com/juju/1.25-upgrade/juju2/worker/uniter/operation"
+	relation2 "github.com/juju/1.25-upgrade/juju2/worker/uniter/relation"
+	storage2 "github.com/juju/1.25-upgrade/juju2/worker/uniter/storage"
+)
+
+// uniterStateBackupDir is where check-uniter-state-impl keeps the
+// original 1.25 files it converts, relative to the data directory.
+// The agent upgrade script restores them on rollback.
+const uniterStateBackupDir = "1.25-upgrade-uniter-state"
+
+var checkUniterStateImplDoc = `
+
+check-uniter-state-impl must be executed as root on a machine of a 1.25
+environment, with its agents stopped, before the agents are switched to
+the 2.x tools.
+
+For each unit agent on the machine, the command reads the uniter's
+on-disk state with both the 1.25 and 2.x readers, and converts what the
+2.x uniter would read differently: the operation state, which must
+record whether the install hook has run, and the metrics spool, whose
+batches must record their unit. The original files are kept in
+/var/lib/juju/1.25-upgrade-uniter-state for rollback.
+
+Nothing is converted if any unit is part-way through a hook, an action,
+or the deployment of a charm, or has state that either version can't
+read. With --check, nothing is converted at all: the command only
+reports whether each unit's state can be upgraded.
+
+`
+
+func newCheckUniterStateImplCommand() cmd.Command {
+	return &checkUniterStateImplCommand{}
+}
+
+type checkUniterStateImplCommand struct {
+	cmd.CommandBase
+	dataDir string
+	check   bool
+}
+
+func (c *checkUniterStateImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "check-uniter-state-impl",
+		Purpose: "machine aspect of upgrade-agents",
+		Doc:     checkUniterStateImplDoc,
+	}
+}
+
+func (c *checkUniterStateImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	f.StringVar(&c.dataDir, "data-dir", dataDir, "Juju data directory")
+	f.BoolVar(&c.check, "check", false, "only check whether the uniter state can be upgraded")
+}
+
+func (c *checkUniterStateImplCommand) Init(args []string) error {
+	return cmd.CheckEmpty(args)
+}
+
+func (c *checkUniterStateImplCommand) Run(ctx *cmd.Context) error {
+	units, err := unitAgents(c.dataDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Check every unit before converting any of them, so that a
+	// refused unit leaves the machine as it was.
+	var checks []*uniterStateCheck
+	var refused []string
+	for _, unit := range units {
+		check, err := checkUniterState(c.dataDir, unit)
+		if err != nil {
+			fmt.Fprintf(ctx.Stdout, "%s: cannot upgrade: %v\n", unit, err)
+			refused = append(refused, unit.Id())
+			continue
+		}
+		checks = append(checks, check)
+	}
+	if len(refused) > 0 {
+		return errors.Errorf("uniter state not upgradable for %s", strings.Join(refused, ", "))
+	}
+	if c.check {
+		for _, check := range checks {
+			fmt.Fprintf(ctx.Stdout, "%s: uniter state can be upgraded\n", check.unit)
+		}
+		return nil
+	}
+
+	backupDir := filepath.Join(c.dataDir, uniterStateBackupDir)
+	for _, check := range checks {
+		changes, err := check.convert(filepath.Join(backupDir, check.unit.String()))
+		if err != nil {
+			return errors.Annotatef(err, "converting uniter state of %s", check.unit.Id())
+		}
+		if len(changes) == 0 {
+			fmt.Fprintf(ctx.Stdout, "%s: uniter state unchanged\n", check.unit)
+		}
+		for _, change := range changes {
+			fmt.Fprintf(ctx.Stdout, "%s: %s\n", check.unit, change)
+		}
+	}
+	return nil
+}
+
+// unitAgents returns the tags of the unit agents on this machine.
+func unitAgents(dataDir string) ([]names.UnitTag, error) {
+	agentDirs, err := filepath.Glob(filepath.Join(dataDir, "agents", "unit-*"))
+	if err != nil {
+		return nil, errors.Annotate(err, "finding unit agents")
+	}
+	sort.Strings(agentDirs)
+	units := make([]names.UnitTag, len(agentDirs))
+	for i, agentDir := range agentDirs {
+		units[i], err = names.ParseUnitTag(filepath.Base(agentDir))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return units, nil
+}
+
+// uniterStateCheck holds the conversions that a unit's uniter state
+// needs for the 2.x uniter.
+type uniterStateCheck struct {
+	unit  names.UnitTag
+	paths uniter2.Paths
+
+	// operation is the converted operation state, or nil if the
+	// uniter hasn't recorded any.
+	operation *operation2.State
+
+	// metricsMetadata holds the metrics batch metadata files that
+	// don't record their unit.
+	metricsMetadata []string
+}
+
+// checkUniterState reads the unit's uniter state with both the 1.25
+// and 2.x readers, and returns the conversions it needs. It returns
+// an error if the state can't be converted.
+func checkUniterState(dataDir string, unit names.UnitTag) (*uniterStateCheck, error) {
+	paths1 := uniter1.NewPaths(dataDir, unit)
+	paths2 := uniter2.NewPaths(dataDir, names2.NewUnitTag(unit.Id()))
+	check := &uniterStateCheck{unit: unit, paths: paths2}
+
+	// The 1.25 uniter converts git-deployed charm directories when it
+	// starts, but the 2.x uniter can't read them at all.
+	gitDeployed, err := charm1.NewGitDir(filepath.Join(paths1.State.DeployerDir, "current")).Exists()
+	if err != nil {
+		return nil, errors.Annotate(err, "checking charm deployer")
+	}
+	if gitDeployed {
+		return nil, errors.New("charm was deployed by the git deployer; start the unit agent on 1.25 to convert it")
+	}
+
+	st1, err := operation1.NewStateFile(paths1.State.OperationsFile).Read()
+	if err == operation1.ErrNoStateFile {
+		// The uniter hasn't started; 2.x will start from scratch.
+	} else if err != nil {
+		return nil, errors.Annotate(err, "reading 1.25 operation state")
+	} else {
+		if err := checkOperationSettled(st1); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if _, err := operation2.NewStateFile(paths2.State.OperationsFile).Read(); err != nil {
+			return nil, errors.Annotate(err, "reading operation state as 2.x")
+		}
+		st2, err := convertOperationState(st1)
+		if err != nil {
+			return nil, errors.Annotate(err, "converting operation state")
+		}
+		if err := checkOperationStateRoundTrip(st2); err != nil {
+			return nil, errors.Annotate(err, "converted operation state")
+		}
+		check.operation = st2
+	}
+
+	relations1, err := relation1.ReadAllStateDirs(paths1.State.RelationsDir)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading 1.25 relation state")
+	}
+	relations2, err := relation2.ReadAllStateDirs(paths2.State.RelationsDir)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading relation state as 2.x")
+	}
+	if err := compareRelationStates(relations1, relations2); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	attached1, err := storage1.ReadAllAttached(paths1.State.StorageDir)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading 1.25 storage state")
+	}
+	attached2, err := storage2.ReadAllAttached(paths2.State.StorageDir)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading storage state as 2.x")
+	}
+	if err := compareStorageStates(attached1, attached2); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	check.metricsMetadata, err = checkMetricsSpool(paths1.State.MetricsSpoolDir, paths2.State.MetricsSpoolDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return check, nil
+}
+
+// checkOperationSettled returns an error if the uniter was stopped
+// part-way through an operation that the 2.x uniter can't pick up.
+// Queued operations haven't started, and completed ones only need
+// committing, which the 2.x uniter does.
+func checkOperationSettled(st *operation1.State) error {
+	if st.Step != operation1.Pending {
+		return nil
+	}
+	switch st.Kind {
+	case operation1.RunHook:
+		return errors.Errorf("%q hook is running or has failed; resolve the unit before upgrading", st.Hook.Kind)
+	case operation1.RunAction:
+		return errors.Errorf("action %s is running", *st.ActionId)
+	case operation1.Install:
+		return errors.Errorf("charm %s is being deployed", st.CharmURL)
+	case operation1.Upgrade:
+		return errors.Errorf("charm is being upgraded to %s", st.CharmURL)
+	}
+	return nil
+}
+
+// convertOperationState returns the 2.x operation state equivalent to
+// the 1.25 one.
+func convertOperationState(st1 *operation1.State) (*operation2.State, error) {
+	st2 := &operation2.State{
+		Leader:    st1.Leader,
+		Started:   st1.Started,
+		Stopped:   st1.Stopped,
+		Installed: operationInstalled(st1),
+		StatusSet: st1.StatusSet,
+		Kind:      operation2.Kind(st1.Kind),
+		Step:      operation2.Step(st1.Step),
+		ActionId:  st1.ActionId,
+	}
+	if st1.Hook != nil {
+		st2.Hook = &hook2.Info{
+			Kind:          hooksv6.Kind(st1.Hook.Kind),
+			RelationId:    st1.Hook.RelationId,
+			RemoteUnit:    st1.Hook.RemoteUnit,
+			ChangeVersion: st1.Hook.ChangeVersion,
+			StorageId:     st1.Hook.StorageId,
+		}
+	}
+	if st1.CharmURL != nil {
+		curl, err := charmv6.ParseURL(st1.CharmURL.String())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		st2.CharmURL = curl
+	}
+	return st2, nil
+}
+
+// operationInstalled returns whether the install hook has run. 1.25
+// doesn't record this, but 2.x would run the hook again without it.
+// Before the install hook the uniter only deploys the charm and runs
+// storage hooks; the 2.x uniter records the install hook itself when
+// committing it.
+func operationInstalled(st *operation1.State) bool {
+	if st.Started {
+		return true
+	}
+	switch st.Kind {
+	case operation1.Install:
+		return false
+	case operation1.RunHook:
+		return !preInstallHook(st.Hook.Kind)
+	case operation1.Continue:
+		// Continue records the last hook run, if any.
+		return st.Hook != nil && st.Hook.Kind != hooksv5.StorageAttached
+	}
+	return true
+}
+
+func preInstallHook(kind hooksv5.Kind) bool {
+	return kind == hooksv5.Install || kind == hooksv5.StorageAttached
+}
+
+// checkOperationStateRoundTrip checks that the 2.x uniter can write
+// and read back the operation state.
+func checkOperationStateRoundTrip(st *operation2.State) error {
+	dir, err := ioutil.TempDir("", "uniter-state")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := operation2.NewStateFile(filepath.Join(dir, "uniter"))
+	if err := stateFile.Write(st); err != nil {
+		return errors.Trace(err)
+	}
+	readBack, err := stateFile.Read()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !reflect.DeepEqual(readBack, st) {
+		return errors.Errorf("read back as %+v, expected %+v", readBack, st)
+	}
+	return nil
+}
+
+// compareRelationStates returns an error unless the 1.25 and 2.x
+// relation states match.
+func compareRelationStates(dirs1 map[int]*relation1.StateDir, dirs2 map[int]*relation2.StateDir) error {
+	if len(dirs1) != len(dirs2) {
+		return errors.Errorf("1.25 reads %d relations, 2.x reads %d", len(dirs1), len(dirs2))
+	}
+	for id, dir1 := range dirs1 {
+		dir2, ok := dirs2[id]
+		if !ok {
+			return errors.Errorf("relation %d not read by 2.x", id)
+		}
+		state1, state2 := dir1.State(), dir2.State()
+		if state1.ChangedPending != state2.ChangedPending || !reflect.DeepEqual(state1.Members, state2.Members) {
+			return errors.Errorf("relation %d read differently by 1.25 (%+v) and 2.x (%+v)", id, state1, state2)
+		}
+	}
+	return nil
+}
+
+// compareStorageStates returns an error unless the 1.25 and 2.x
+// storage attachment states match. The two versions name the state
+// files of storage with hyphenated names differently.
+func compareStorageStates(attached1 map[names.StorageTag]bool, attached2 map[names2.StorageTag]bool) error {
+	if len(attached1) != len(attached2) {
+		return errors.Errorf("1.25 reads %d storage attachments, 2.x reads %d", len(attached1), len(attached2))
+	}
+	for tag1, state1 := range attached1 {
+		state2, ok := attached2[names2.NewStorageTag(tag1.Id())]
+		if !ok {
+			return errors.Errorf("storage %s not read by 2.x", tag1.Id())
+		}
+		if state1 != state2 {
+			return errors.Errorf("storage %s read differently by 1.25 (attached: %v) and 2.x (attached: %v)", tag1.Id(), state1, state2)
+		}
+	}
+	return nil
+}
+
+// checkMetricsSpool reads the metrics batches spooled by the unit
+// with both the 1.25 and 2.x readers, and returns the metadata files
+// of those that don't record the unit, which the 2.x sender needs.
+func checkMetricsSpool(spoolDir1, spoolDir2 string) ([]string, error) {
+	if _, err := os.Stat(spoolDir1); os.IsNotExist(err) {
+		return nil, nil
+	}
+	reader1, err := metrics1.NewJSONMetricReader(spoolDir1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer reader1.Close()
+	batches1, err := reader1.Read()
+	if err != nil {
+		return nil, errors.Annotate(err, "reading 1.25 metrics spool")
+	}
+	reader2, err := spool2.NewJSONMetricReader(spoolDir2)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer reader2.Close()
+	batches2, err := reader2.Read()
+	if err != nil {
+		return nil, errors.Annotate(err, "reading metrics spool as 2.x")
+	}
+	if len(batches1) != len(batches2) {
+		return nil, errors.Errorf("1.25 reads %d metrics batches, 2.x reads %d", len(batches1), len(batches2))
+	}
+	var metadata []string
+	for _, batch := range batches2 {
+		if batch.UnitTag == "" {
+			metadata = append(metadata, filepath.Join(spoolDir2, batch.UUID+".meta"))
+		}
+	}
+	sort.Strings(metadata)
+	return metadata, nil
+}
+
+// convert makes the changes to the unit's uniter state found by
+// checkUniterState, keeping the original files in backupDir, and
+// returns a description of each change.
+func (c *uniterStateCheck) convert(backupDir string) ([]string, error) {
+	var changes []string
+	if c.operation != nil {
+		if err := c.backup(c.paths.State.OperationsFile, backupDir); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := operation2.NewStateFile(c.paths.State.OperationsFile).Write(c.operation); err != nil {
+			return nil, errors.Annotate(err, "writing operation state")
+		}
+		changes = append(changes, fmt.Sprintf("converted operation state (installed: %t)", c.operation.Installed))
+	}
+	for _, metadata := range c.metricsMetadata {
+		if err := c.backup(metadata, backupDir); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := addMetricsUnitTag(metadata, c.unit.String()); err != nil {
+			return nil, errors.Annotatef(err, "converting %s", metadata)
+		}
+	}
+	if n := len(c.metricsMetadata); n > 0 {
+		changes = append(changes, fmt.Sprintf("recorded unit in %d metrics batches", n))
+	}
+	return changes, nil
+}
+
+// backup copies the file into backupDir, at its path relative to the
+// unit's agent directory. A file that has already been backed up is
+// left alone, so that the backup is of the 1.25 original if the
+// conversion is repeated.
+func (c *uniterStateCheck) backup(file, backupDir string) error {
+	rel, err := filepath.Rel(c.paths.State.BaseDir, file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	dest := filepath.Join(backupDir, rel)
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotatef(ioutil.WriteFile(dest, data, info.Mode()), "backing up %s", file)
+}
+
+// addMetricsUnitTag records the unit in the metrics batch metadata
+// file, leaving its other fields as they are.
+func addMetricsUnitTag(metadataFile, unitTag string) error {
+	data, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return errors.Trace(err)
+	}
+	metadata["unit-tag"] = unitTag
+	data, err = json.Marshal(metadata)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(ioutil.WriteFile(metadataFile, data, 0644))
+}
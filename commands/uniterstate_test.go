@@ -0,0 +1,179 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/names"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	charmv5 "gopkg.in/juju/charm.v5"
+	hooksv5 "gopkg.in/juju/charm.v5/hooks"
+
+	uniter1 "github.com/juju/1.25-upgrade/juju1/worker/uniter"
+	hook1 "github.com/juju/1.25-upgrade/juju1/worker/uniter/hook"
+	operation1 "github.com/juju/1.25-upgrade/juju1/worker/uniter/operation"
+	relation1 "github.com/juju/1.25-upgrade/juju1/worker/uniter/relation"
+	spool2 "github.com/juju/1.25-upgrade/juju2/worker/metrics/spool"
+	operation2 "github.com/juju/1.25-upgrade/juju2/worker/uniter/operation"
+)
+
+type uniterStateSuite struct {
+	dataDir string
+	unit    names.UnitTag
+	paths   uniter1.Paths
+}
+
+var _ = gc.Suite(&uniterStateSuite{})
+
+func (s *uniterStateSuite) SetUpTest(c *gc.C) {
+	s.dataDir = c.MkDir()
+	s.unit = names.NewUnitTag("mysql/0")
+	s.paths = uniter1.NewPaths(s.dataDir, s.unit)
+	c.Assert(os.MkdirAll(filepath.Dir(s.paths.State.OperationsFile), 0755), jc.ErrorIsNil)
+}
+
+func (s *uniterStateSuite) writeOperationState(c *gc.C, st operation1.State) {
+	err := operation1.NewStateFile(s.paths.State.OperationsFile).Write(&st)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *uniterStateSuite) TestConvert(c *gc.C) {
+	s.writeOperationState(c, operation1.State{
+		Started:            true,
+		Kind:               operation1.Continue,
+		Step:               operation1.Pending,
+		CollectMetricsTime: 1508148000,
+	})
+	relations := s.paths.State.RelationsDir
+	c.Assert(os.MkdirAll(relations, 0755), jc.ErrorIsNil)
+	dir, err := relation1.ReadStateDir(relations, 1)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(dir.Ensure(), jc.ErrorIsNil)
+	err = dir.Write(hook1.Info{Kind: hooksv5.RelationJoined, RelationId: 1, RemoteUnit: "wordpress/0", ChangeVersion: 3})
+	c.Assert(err, jc.ErrorIsNil)
+
+	spool := s.paths.State.MetricsSpoolDir
+	c.Assert(os.MkdirAll(spool, 0755), jc.ErrorIsNil)
+	metadata := filepath.Join(spool, "batch-1.meta")
+	err = ioutil.WriteFile(metadata, []byte(`{"charmurl":"cs:trusty/mysql-1","uuid":"batch-1","created":"2017-10-16T10:00:00Z"}`), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+	err = ioutil.WriteFile(filepath.Join(spool, "batch-1"), []byte(`{"Key":"users","Value":"5","Time":"2017-10-16T10:00:00Z"}`), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+
+	check, err := checkUniterState(s.dataDir, s.unit)
+	c.Assert(err, jc.ErrorIsNil)
+	backupDir := filepath.Join(s.dataDir, uniterStateBackupDir, s.unit.String())
+	changes, err := check.convert(backupDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(changes, jc.DeepEquals, []string{
+		"converted operation state (installed: true)",
+		"recorded unit in 1 metrics batches",
+	})
+
+	st, err := operation2.NewStateFile(s.paths.State.OperationsFile).Read()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(st.Installed, jc.IsTrue)
+	c.Check(st.Started, jc.IsTrue)
+	reader, err := spool2.NewJSONMetricReader(spool)
+	c.Assert(err, jc.ErrorIsNil)
+	batches, err := reader.Read()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(batches, gc.HasLen, 1)
+	c.Check(batches[0].UnitTag, gc.Equals, "unit-mysql-0")
+
+	// The 1.25 originals are kept for rollback.
+	original, err := operation1.NewStateFile(filepath.Join(backupDir, "state", "uniter")).Read()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(original.CollectMetricsTime, gc.Equals, int64(1508148000))
+	c.Check(filepath.Join(backupDir, "state", "spool", "metrics", "batch-1.meta"), jc.IsNonEmptyFile)
+
+	// Converting again finds nothing to do with the metrics, and
+	// keeps the original backup.
+	check, err = checkUniterState(s.dataDir, s.unit)
+	c.Assert(err, jc.ErrorIsNil)
+	changes, err = check.convert(backupDir)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(changes, jc.DeepEquals, []string{"converted operation state (installed: true)"})
+	original, err = operation1.NewStateFile(filepath.Join(backupDir, "state", "uniter")).Read()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Check(original.CollectMetricsTime, gc.Equals, int64(1508148000))
+}
+
+func (s *uniterStateSuite) TestRefusesMidHook(c *gc.C) {
+	s.writeOperationState(c, operation1.State{
+		Started: true,
+		Kind:    operation1.RunHook,
+		Step:    operation1.Pending,
+		Hook:    &hook1.Info{Kind: hooksv5.ConfigChanged},
+	})
+	_, err := checkUniterState(s.dataDir, s.unit)
+	c.Assert(err, gc.ErrorMatches, `"config-changed" hook is running or has failed; resolve the unit before upgrading`)
+}
+
+func (s *uniterStateSuite) TestRefusesMidUpgradeCharm(c *gc.C) {
+	s.writeOperationState(c, operation1.State{
+		Started:  true,
+		Kind:     operation1.Upgrade,
+		Step:     operation1.Pending,
+		CharmURL: charmv5.MustParseURL("cs:trusty/mysql-2"),
+	})
+	_, err := checkUniterState(s.dataDir, s.unit)
+	c.Assert(err, gc.ErrorMatches, `charm is being upgraded to cs:trusty/mysql-2`)
+}
+
+func (s *uniterStateSuite) writeStorageState(c *gc.C, name string, attached bool) {
+	storageDir := s.paths.State.StorageDir
+	c.Assert(os.MkdirAll(storageDir, 0755), jc.ErrorIsNil)
+	content := fmt.Sprintf("attached: %v\n", attached)
+	err := ioutil.WriteFile(filepath.Join(storageDir, name), []byte(content), 0644)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *uniterStateSuite) TestStorageState(c *gc.C) {
+	s.writeOperationState(c, operation1.State{Started: true, Kind: operation1.Continue, Step: operation1.Pending})
+	s.writeStorageState(c, "data-0", true)
+	s.writeStorageState(c, "logs-1", false)
+	_, err := checkUniterState(s.dataDir, s.unit)
+	c.Assert(err, jc.ErrorIsNil)
+}
+
+func (s *uniterStateSuite) TestRefusesStorageStateReadDifferently(c *gc.C) {
+	s.writeOperationState(c, operation1.State{Started: true, Kind: operation1.Continue, Step: operation1.Pending})
+	s.writeStorageState(c, "data-0", true)
+	// 1.25 can't read back the state file of storage with a
+	// hyphenated name; 2.x can.
+	s.writeStorageState(c, "db-logs-0", true)
+	_, err := checkUniterState(s.dataDir, s.unit)
+	c.Assert(err, gc.ErrorMatches, `1.25 reads 1 storage attachments, 2.x reads 2`)
+}
+
+func (*uniterStateSuite) TestOperationInstalled(c *gc.C) {
+	for i, test := range []struct {
+		state     operation1.State
+		installed bool
+	}{{
+		state: operation1.State{Kind: operation1.Install, Step: operation1.Done},
+	}, {
+		state: operation1.State{Kind: operation1.RunHook, Step: operation1.Queued, Hook: &hook1.Info{Kind: hooksv5.StorageAttached}},
+	}, {
+		state: operation1.State{Kind: operation1.RunHook, Step: operation1.Done, Hook: &hook1.Info{Kind: hooksv5.Install}},
+	}, {
+		state:     operation1.State{Kind: operation1.Continue, Step: operation1.Pending, Hook: &hook1.Info{Kind: hooksv5.Install}},
+		installed: true,
+	}, {
+		state:     operation1.State{Kind: operation1.RunHook, Step: operation1.Queued, Hook: &hook1.Info{Kind: hooksv5.ConfigChanged}},
+		installed: true,
+	}, {
+		state:     operation1.State{Started: true, Kind: operation1.Continue, Step: operation1.Pending},
+		installed: true,
+	}} {
+		c.Logf("test %d: %+v", i, test.state)
+		c.Check(operationInstalled(&test.state), gc.Equals, test.installed)
+	}
+}
@@ -11,12 +11,16 @@ import (
 	"github.com/juju/1.25-upgrade/juju1/instance"
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
 )
 
 var updateMAASAgentNameDoc = ` 
 The purpose of the update-maas-agentname command is to update the agent_name
 config for a Juju 1.25 MAAS environment. The agents should be running the 1.25
 binary.
+
+The command changes the source environment, so it requires a backup
+made with backup-source, unless --skip-backup-check is given.
 `
 
 func newUpdateMAASAgentNameCommand() cmd.Command {
@@ -27,6 +31,7 @@ func newUpdateMAASAgentNameCommand() cmd.Command {
 
 type updateMAASAgentNameCommand struct {
 	baseClientCommand
+	sourceBackupFlags
 }
 
 func (c *updateMAASAgentNameCommand) Info() *cmd.Info {
@@ -38,6 +43,11 @@ func (c *updateMAASAgentNameCommand) Info() *cmd.Info {
 	}
 }
 
+func (c *updateMAASAgentNameCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	c.sourceBackupFlags.setFlags(f)
+}
+
 func (c *updateMAASAgentNameCommand) Init(args []string) error {
 	args, err := c.baseClientCommand.init(args)
 	if err != nil {
@@ -46,6 +56,11 @@ func (c *updateMAASAgentNameCommand) Init(args []string) error {
 	return cmd.CheckEmpty(args)
 }
 
+func (c *updateMAASAgentNameCommand) Run(ctx *cmd.Context) error {
+	c.extraOptions = append(c.extraOptions, c.sourceBackupFlags.options()...)
+	return c.baseClientCommand.Run(ctx)
+}
+
 var updateMAASAgentNameImplDoc = `
 
 update-maas-agentname-impl must be executed on an API server machine of a 1.25
@@ -64,6 +79,7 @@ func newUpdateMAASAgentNameImplCommand() cmd.Command {
 
 type updateMAASAgentNameImplCommand struct {
 	baseRemoteCommand
+	sourceBackupFlags
 }
 
 func (c *updateMAASAgentNameImplCommand) Info() *cmd.Info {
@@ -74,6 +90,11 @@ func (c *updateMAASAgentNameImplCommand) Info() *cmd.Info {
 	}
 }
 
+func (c *updateMAASAgentNameImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseRemoteCommand.SetFlags(f)
+	c.sourceBackupFlags.setFlags(f)
+}
+
 func (c *updateMAASAgentNameImplCommand) Run(ctx *cmd.Context) error {
 	st, err := getState()
 	if err != nil {
@@ -106,6 +127,9 @@ func (c *updateMAASAgentNameImplCommand) Run(ctx *cmd.Context) error {
 		ctx.Infof("MAAS agent name already updated, nothing to do.")
 		return nil
 	}
+	if err := c.sourceBackupFlags.check(ctx, "update-maas-agentname"); err != nil {
+		return errors.Trace(err)
+	}
 
 	// Print out the command for the user to run on the MAAS region controller.
 	sqlCommand := fmt.Sprintf(`
@@ -9,13 +9,15 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"text/template"
 
 	"github.com/juju/cmd"
 	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
 	"github.com/juju/utils/set"
-	"github.com/juju/utils/ssh"
 	"github.com/juju/version"
+	"github.com/kardianos/osext"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/juju/1.25-upgrade/juju2/api"
@@ -32,6 +34,36 @@ This command updates the tools symlinks for the agents, and updates their
 agent config files to specify the correct version, along with the CA Cert and
 addresses of the controller.
 
+The controller addresses given to the agents are chosen from those the
+controller reports for itself, preferring cloud-local addresses, rather than
+the addresses the client used. --agent-address-scope and --agent-address-space
+select the addresses in a network scope or space instead, and
+--agent-api-addresses specifies them explicitly. Before any agent is changed,
+every machine must be able to connect to at least one of the chosen addresses.
+
+The state servers, and the units and containers they host, are upgraded after
+all other machines, each in a batch of its own and never in the canary batch.
+The machine the upgrade runs on is upgraded last.
+
+It also removes the 1.25 rsyslog configuration that forwards logs to the
+state servers, along with its certificates, and stops juju-db being started
+on boot on the former state servers. juju-db is left running, and its data
+in place, until the migration is finalized. Rolling back the upgrade (with
+--rollback-on-failure or abort) restores all of these.
+
+Before switching any agent in a batch, the command checks the on-disk state
+of every unit's uniter in the batch, and converts it for the 2.x uniter. A
+batch isn't upgraded if any of its units is part-way through a hook, an
+action or a charm upgrade; resolve or wait for those units and run the
+command again.
+
+Once the agents are switched, each agent's init service definition is
+replaced with the one 2.x would install for the machine's series (an
+upstart job on trusty, a systemd unit elsewhere), and juju-run,
+juju-dumplogs and juju-introspect are linked to the machine agent's
+jujud. The 1.25 definitions are kept, and restored on rollback.
+agent-status reports whether the definitions on each machine match 2.x.
+
 `
 
 func newUpgradeAgentsCommand() cmd.Command {
@@ -45,6 +77,9 @@ func newUpgradeAgentsCommand() cmd.Command {
 
 type upgradeAgentsCommand struct {
 	baseClientCommand
+	agentBinaries string
+	rolloutFlags
+	agentAddressFlags
 }
 
 func (c *upgradeAgentsCommand) Info() *cmd.Info {
@@ -61,9 +96,35 @@ func (c *upgradeAgentsCommand) Init(args []string) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if err := c.agentAddressFlags.validate(); err != nil {
+		return errors.Trace(err)
+	}
 	return cmd.CheckEmpty(args)
 }
 
+func (c *upgradeAgentsCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	f.StringVar(&c.agentBinaries, "agent-binaries", "", "local directory or simplestreams mirror of agent binaries to use instead of downloading them from the controller")
+	c.rolloutFlags.setFlags(f)
+	c.agentAddressFlags.setFlags(f)
+}
+
+func (c *upgradeAgentsCommand) Run(ctx *cmd.Context) error {
+	c.extraOptions = append(c.extraOptions, c.rolloutFlags.options()...)
+	c.extraOptions = append(c.extraOptions, c.agentAddressFlags.options()...)
+	if err := c.prepareRemote(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if c.agentBinaries != "" {
+		remoteDir, err := pushAgentBinaries(ctx, &c.baseClientCommand, c.agentBinaries)
+		if err != nil {
+			return errors.Annotate(err, "pushing agent binaries")
+		}
+		c.extraOptions = append(c.extraOptions, "--agent-binaries", remoteDir)
+	}
+	return c.runRemote(ctx)
+}
+
 var upgradeAgentsImplDoc = `
 
 upgrade-agents-impl must be executed on an API server machine of a 1.25
@@ -82,6 +143,16 @@ func newUpgradeAgentsImplCommand() cmd.Command {
 
 type upgradeAgentsImplCommand struct {
 	baseRemoteCommand
+	agentBinaries string
+	rolloutFlags
+	agentAddressFlags
+}
+
+func (c *upgradeAgentsImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseRemoteCommand.SetFlags(f)
+	f.StringVar(&c.agentBinaries, "agent-binaries", "", "directory of agent binaries copied from the client")
+	c.rolloutFlags.setFlags(f)
+	c.agentAddressFlags.setFlags(f)
 }
 
 func (c *upgradeAgentsImplCommand) Init(args []string) error {
@@ -89,6 +160,9 @@ func (c *upgradeAgentsImplCommand) Init(args []string) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if err := c.agentAddressFlags.validate(); err != nil {
+		return errors.Trace(err)
+	}
 
 	return cmd.CheckEmpty(args)
 }
@@ -102,16 +176,12 @@ func (c *upgradeAgentsImplCommand) Info() *cmd.Info {
 }
 
 func (c *upgradeAgentsImplCommand) Run(ctx *cmd.Context) error {
-	st, err := getState()
-	if err != nil {
-		return errors.Annotate(err, "getting state")
-	}
-	defer st.Close()
-
-	// Here we always use the 1.25 environment to get all of the machine
-	// addresses. We then use those to ssh into every one of those machine
-	// and run the service status script against all the agents.
-	machines, err := getMachines(st)
+	// Use the saved machines if a previous, partial, upgrade has
+	// saved them - the agent config on this machine may have been
+	// rewritten since, so connecting to state might not work.
+	// Otherwise the 1.25 environment is used to get all of the
+	// machine addresses.
+	machines, err := loadMachines()
 	if err != nil {
 		return errors.Annotate(err, "unable to get addresses for machines")
 	}
@@ -122,6 +192,19 @@ func (c *upgradeAgentsImplCommand) Run(ctx *cmd.Context) error {
 		return errors.Annotate(err, "saving machine addresses")
 	}
 
+	upgraded, err := loadUpgradedMachines()
+	if err != nil {
+		return errors.Annotate(err, "loading upgraded machines")
+	}
+	machines, err = c.rolloutFlags.selectMachines(ctx, machines, upgraded)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(machines) == 0 {
+		ctx.Infof("no machines to upgrade")
+		return nil
+	}
+
 	conn, err := c.getControllerConnection()
 	if err != nil {
 		return errors.Annotate(err, "getting controller connection")
@@ -133,10 +216,24 @@ func (c *upgradeAgentsImplCommand) Run(ctx *cmd.Context) error {
 	fmt.Fprintf(ctx.Stdout, "Controller addresses: %#v\n", conn.APIHostPorts())
 	fmt.Fprintf(ctx.Stdout, "Controller UUID: %s\n", conn.ControllerTag().Id())
 
+	// The addresses the client connected with may not be reachable
+	// from the machines, so choose the ones to give the agents, and
+	// make sure that they can all reach them before any agent is
+	// changed.
+	apiAddresses, err := c.agentAddressFlags.selectAddresses(conn.APIHostPorts())
+	if err != nil {
+		return errors.Annotate(err, "selecting controller addresses for agents")
+	}
+	fmt.Fprintf(ctx.Stdout, "Agent controller addresses: %s\n", strings.Join(apiAddresses, ", "))
+	if err := checkControllerReachable(ctx, machines, apiAddresses); err != nil {
+		return errors.Trace(err)
+	}
+
 	// Emit the upgrade script for pushing to other machines.
 	scriptPath, err := c.writeUpgradeScript(&scriptConfig{
 		ControllerTag:  conn.ControllerTag().String(),
 		ControllerInfo: c.controllerInfo,
+		APIAddresses:   apiAddresses,
 		Version:        ver,
 	})
 	if err != nil {
@@ -150,19 +247,91 @@ func (c *upgradeAgentsImplCommand) Run(ctx *cmd.Context) error {
 	}
 
 	// Get the tools from the controller.
-	tw := newToolsWrangler(conn)
+	tw, err := newToolsWrangler(conn, c.controllerInfo, c.agentBinaries)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	for _, seriesArch := range toolsNeeded.SortedValues() {
 		if err := tw.getTools(seriesArch); err != nil {
 			return errors.Trace(err)
 		}
 	}
 
+	return errors.Trace(c.upgradeMachines(ctx, ver, scriptPath, machines))
+}
+
+// upgradeMachines upgrades the machines in the batches determined by
+// the rollout flags, stopping at the first batch that fails.
+func (c *upgradeAgentsImplCommand) upgradeMachines(ctx *cmd.Context, ver version.Number, scriptPath string, machines []FlatMachine) error {
+	plugin, err := pluginPath()
+	if err != nil {
+		return errors.Annotate(err, "finding plugin location")
+	}
+	// The local machine's ID is only used to upgrade it last, so
+	// carry on without it.
+	var local string
+	if tag, err := getCurrentMachineTag(dataDir); err == nil {
+		local = tag.Id()
+	} else {
+		logger.Debugf("finding local machine: %v", err)
+	}
+	batches := stageMachines(machines, c.canary, c.batchSize, local)
+	for i, batch := range batches {
+		name := fmt.Sprintf("batch %d of %d", i+1, len(batches))
+		if i == 0 && c.canary > 0 && !batch[0].StateServer && batch[0].ID != local {
+			name = "canary batch"
+		}
+		fmt.Fprintf(ctx.Stdout, "Upgrading %s: machines %s\n", name, strings.Join(machineIds(batch), ", "))
+		if err := c.upgradeBatch(ctx, ver, scriptPath, plugin, batch); err != nil {
+			if c.rollbackOnFailure {
+				if rollbackErr := rollbackAgentUpgrades(ctx, batch); rollbackErr != nil {
+					logger.Errorf("rolling back %s failed: %v", name, rollbackErr)
+				}
+			}
+			remaining := 0
+			for _, later := range batches[i+1:] {
+				remaining += len(later)
+			}
+			return errors.Annotatef(err, "upgrading %s (%d machines not attempted)", name, remaining)
+		}
+	}
+	return nil
+}
+
+// upgradeBatch checks and converts the uniter state on the machines,
+// upgrades their agents and their service definitions, and then checks
+// that each of the upgraded agents can connect to the controller.
+func (c *upgradeAgentsImplCommand) upgradeBatch(ctx *cmd.Context, ver version.Number, scriptPath, plugin string, machines []FlatMachine) error {
 	if err := c.pushTools(ctx, ver, scriptPath, machines); err != nil {
 		return errors.Trace(err)
 	}
 
+	// Refuse to upgrade the batch if any unit's uniter state can't be
+	// carried over, before anything is changed on any of the machines.
 	targets := flatMachineExecTargets(machines...)
-	results, err := parallelExec(targets, "apt-get install --yes python3 python3-yaml; python3 ~/1.25-agent-upgrade/agent-upgrade.py")
+	results, err := parallelExec(targets, checkUniterStateScript(path.Base(plugin)))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := reportResults(ctx, "uniter state check", machines, results); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Record the machines before anything on them is changed, even if
+	// the conversion or upgrade script then fails, so that abort knows
+	// which ones need rolling back.
+	if err := addUpgradedMachines(machines); err != nil {
+		return errors.Annotate(err, "recording upgraded machines")
+	}
+	results, err = parallelExec(targets, convertUniterStateScript(path.Base(plugin)))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := reportResults(ctx, "uniter state conversion", machines, results); err != nil {
+		return errors.Trace(err)
+	}
+
+	results, err = parallelExec(targets, runAgentUpgradeScript)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -170,6 +339,14 @@ func (c *upgradeAgentsImplCommand) Run(ctx *cmd.Context) error {
 		return errors.Trace(err)
 	}
 
+	results, err = parallelExec(targets, agentServicesScript(path.Base(plugin)))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := reportResults(ctx, "service definition update", machines, results); err != nil {
+		return errors.Trace(err)
+	}
+
 	results, err = parallelExec(targets, connectionCheckScript)
 	if err != nil {
 		return errors.Trace(err)
@@ -207,11 +384,20 @@ func (c *upgradeAgentsImplCommand) pushTools(ctx *cmd.Context, ver version.Numbe
 }
 
 func (c *upgradeAgentsImplCommand) pushToolsToMachine(ctx *cmd.Context, ver version.Number, scriptPath string, machine FlatMachine) error {
+	// The plugin checks the uniter state and replaces the service
+	// definitions on the machine, so it has to be built for the
+	// machine's architecture.
+	plugin, err := pluginForArch(version.MustParseBinary(machine.Tools).Arch)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	opts := []execOption{withSystemIdentity()}
+	if machine.HostAddress != "" {
+		// Containers are only reachable through their host.
+		opts = append(opts, withProxyCommandForHost(machine.HostAddress))
+	}
 	logger.Debugf("making target dir for machine %s", machine.ID)
-	rc, err := runViaSSH(
-		machine.Address,
-		"rm -rf 1.25-agent-upgrade; mkdir 1.25-agent-upgrade; chown ubuntu:ubuntu 1.25-agent-upgrade",
-		withSystemIdentity())
+	rc, err := runViaSSH(machine.Address, prepareUpgradeDirScript, opts...)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -219,15 +405,13 @@ func (c *upgradeAgentsImplCommand) pushToolsToMachine(ctx *cmd.Context, ver vers
 		return &cmd.RcPassthroughError{Code: rc}
 	}
 	toolsPath := toolsFilePath(ver, seriesArch(machine))
-	options := defaultSSHOptions()
-	options.SetIdentities(systemIdentity)
-	logger.Debugf("copying upgrade script and %s to machine %s", toolsPath, machine.ID)
-	args := []string{toolsPath, scriptPath, fmt.Sprintf("ubuntu@%s:~/1.25-agent-upgrade/", machine.Address)}
-	err = ssh.Copy(args, &options)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	return nil
+	logger.Debugf("copying upgrade script, plugin and %s to machine %s", toolsPath, machine.ID)
+	return errors.Trace(copyViaSSH(
+		machine.Address,
+		[]string{"-C", toolsPath, scriptPath, plugin},
+		"~/1.25-agent-upgrade/",
+		opts...,
+	))
 }
 
 func (c *upgradeAgentsImplCommand) writeUpgradeScript(config *scriptConfig) (string, error) {
@@ -263,9 +447,41 @@ func seriesArch(machine FlatMachine) string {
 type scriptConfig struct {
 	ControllerInfo *api.Info
 	ControllerTag  string
+	APIAddresses   []string
 	Version        version.Number
 }
 
+// prepareUpgradeDirScript creates an empty directory for the tools and
+// agent upgrade script in the ubuntu user's home directory.
+const prepareUpgradeDirScript = "rm -rf 1.25-agent-upgrade; mkdir 1.25-agent-upgrade; chown ubuntu:ubuntu 1.25-agent-upgrade"
+
+// pluginPath returns the location of this plugin, which is pushed to
+// the machines along with the tools. It's a variable so that tests can
+// substitute a smaller file.
+var pluginPath = osext.Executable
+
+// checkUniterStateScript runs check-uniter-state-impl from the copy of
+// the plugin pushed to the machine, only checking the uniter state.
+func checkUniterStateScript(plugin string) string {
+	return fmt.Sprintf("~/1.25-agent-upgrade/%s check-uniter-state-impl --check", plugin)
+}
+
+// convertUniterStateScript runs check-uniter-state-impl from the copy
+// of the plugin pushed to the machine, converting the uniter state.
+func convertUniterStateScript(plugin string) string {
+	return fmt.Sprintf("~/1.25-agent-upgrade/%s check-uniter-state-impl", plugin)
+}
+
+// agentServicesScript runs agent-services-impl from the copy of the
+// plugin pushed to the machine.
+func agentServicesScript(plugin string) string {
+	return fmt.Sprintf("~/1.25-agent-upgrade/%s agent-services-impl", plugin)
+}
+
+// runAgentUpgradeScript runs the agent upgrade script pushed to the
+// machine along with the new tools.
+const runAgentUpgradeScript = "apt-get install --yes python3 python3-yaml; python3 ~/1.25-agent-upgrade/agent-upgrade.py"
+
 const connectionCheckScript = `
 set -u
 failures=0
@@ -4,12 +4,15 @@
 package commands
 
 import (
+	"sort"
 	"strings"
 
+	"github.com/juju/1.25-upgrade/juju1/state"
 	_ "github.com/juju/1.25-upgrade/juju2/provider/maas"
 	"github.com/juju/cmd"
 	"github.com/juju/description"
 	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -27,6 +30,12 @@ func newVerifySourceCommand() cmd.Command {
 
 type verifySourceCommand struct {
 	baseClientCommand
+	exportFlags
+}
+
+func (c *verifySourceCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	c.exportFlags.setFlags(f)
 }
 
 func (c *verifySourceCommand) Info() *cmd.Info {
@@ -43,16 +52,24 @@ func (c *verifySourceCommand) Init(args []string) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if err := c.exportFlags.validate(); err != nil {
+		return errors.Trace(err)
+	}
 	return cmd.CheckEmpty(args)
 }
 
+func (c *verifySourceCommand) Run(ctx *cmd.Context) error {
+	c.extraOptions = append(c.extraOptions, c.exportFlags.options()...)
+	return c.baseClientCommand.Run(ctx)
+}
+
 var verifySourceImplDoc = `
 
 verify-source-impl must be executed on an API server machine of a 1.25
 environment.
 
 The command will check the export of the environment into the 2.0 model
-format.
+format, and report the size of each part of the model.
 
 `
 
@@ -62,6 +79,12 @@ func newVerifySourceImplCommand() cmd.Command {
 
 type verifySourceImplCommand struct {
 	baseRemoteCommand
+	exportFlags
+}
+
+func (c *verifySourceImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseRemoteCommand.SetFlags(f)
+	c.exportFlags.setFlags(f)
 }
 
 func (c *verifySourceImplCommand) Info() *cmd.Info {
@@ -80,7 +103,7 @@ func (c *verifySourceImplCommand) Run(ctx *cmd.Context) error {
 	defer st.Close()
 
 	// Check that the LXC containers can be migrated to LXD.
-	opts := MigrateLXCOptions{DryRun: true}
+	opts := MigrateLXCOptions{DryRun: true, ModelUUID: st.EnvironUUID()}
 	byHost, err := getLXCContainersFromState(st)
 	if err != nil {
 		return errors.Trace(err)
@@ -101,12 +124,65 @@ func (c *verifySourceImplCommand) Run(ctx *cmd.Context) error {
 	if err := group.Wait(); err != nil {
 		return errors.Annotate(err, "dry-running LXC migration")
 	}
+	if err := reportStorageLayout(ctx, byHost); err != nil {
+		return errors.Trace(err)
+	}
+	if err := reportStateServerWorkloads(ctx, st); err != nil {
+		return errors.Trace(err)
+	}
 
-	model, err := exportModel(st, "")
+	model, err := exportModel(st, "", c.exportFlags.config())
 	if err != nil {
 		return errors.Annotate(err, "exporting model")
 	}
-	return errors.Annotate(writeModel(ctx, model), "writing model")
+	bytes, err := description.Serialize(model)
+	if err != nil {
+		return errors.Annotate(err, "serializing model representation")
+	}
+	reportModelSize(ctx, model, bytes)
+	_, err = ctx.GetStdout().Write(bytes)
+	return errors.Annotate(err, "writing model")
+}
+
+// reportStateServerWorkloads reports the units and containers hosted
+// on the state servers. Their agents are upgraded along with the state
+// server's own, after those of every other machine.
+func reportStateServerWorkloads(ctx *cmd.Context, st *state.State) error {
+	machines, err := st.AllMachines()
+	if err != nil {
+		return errors.Annotate(err, "getting 1.25 machines")
+	}
+	for _, m := range machines {
+		if !isStateServer(m.Jobs()) {
+			continue
+		}
+		units, err := m.Units()
+		if err != nil {
+			return errors.Annotatef(err, "getting units of machine %s", m.Id())
+		}
+		containers, err := m.Containers()
+		if err != nil {
+			return errors.Annotatef(err, "getting containers of machine %s", m.Id())
+		}
+		if len(units) == 0 && len(containers) == 0 {
+			continue
+		}
+		unitNames := make([]string, len(units))
+		for i, u := range units {
+			unitNames[i] = u.Name()
+		}
+		sort.Strings(unitNames)
+		sort.Strings(containers)
+		var hosted []string
+		if len(unitNames) > 0 {
+			hosted = append(hosted, "units "+strings.Join(unitNames, ", "))
+		}
+		if len(containers) > 0 {
+			hosted = append(hosted, "containers "+strings.Join(containers, ", "))
+		}
+		ctx.Infof("State server %q hosts %s; its agents and those of its containers will be upgraded after all other machines", m.Id(), strings.Join(hosted, " and "))
+	}
+	return nil
 }
 
 func writeModel(ctx *cmd.Context, model description.Model) error {
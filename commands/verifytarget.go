@@ -0,0 +1,408 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/cmd"
+	"github.com/juju/errors"
+	"github.com/juju/gnuflag"
+	names2 "gopkg.in/juju/names.v2"
+
+	"github.com/juju/1.25-upgrade/juju2/api"
+	"github.com/juju/1.25-upgrade/juju2/apiserver/params"
+	"github.com/juju/1.25-upgrade/juju2/status"
+)
+
+const (
+	activatedAtFile = "activated-at"
+	verifiedAtFile  = "verified-at"
+
+	defaultVerifyTimeout = 15 * time.Minute
+)
+
+var verifyTargetModelDoc = `
+
+The verify-target-model command checks the health of the new model after
+it has been activated and the agents have been started. It waits for every
+machine agent to be started, and every unit agent to be idle, on the model's
+agent version, and for every application to have a leader.
+
+When all the agents have settled, or the timeout expires, it prints a
+summary listing any agents that haven't settled, units in error, hooks that
+have failed since the model was activated, and applications without a
+leader. The command fails unless the model is healthy.
+
+`
+
+func newVerifyTargetModelCommand() cmd.Command {
+	command := &verifyTargetModelCommand{}
+	command.remoteCommand = "verify-target-model-impl"
+	command.needsController = true
+	return wrap(command)
+}
+
+type verifyTargetModelCommand struct {
+	baseClientCommand
+	timeout time.Duration
+}
+
+func (c *verifyTargetModelCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "verify-target-model",
+		Args:    "<environment name> <controller name>",
+		Purpose: "wait for the activated model's agents to settle, and check its health",
+		Doc:     verifyTargetModelDoc,
+	}
+}
+
+func (c *verifyTargetModelCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseClientCommand.SetFlags(f)
+	f.DurationVar(&c.timeout, "timeout", defaultVerifyTimeout, "how long to wait for the agents to settle")
+}
+
+func (c *verifyTargetModelCommand) Init(args []string) error {
+	args, err := c.baseClientCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+func (c *verifyTargetModelCommand) Run(ctx *cmd.Context) error {
+	c.extraOptions = append(c.extraOptions, "--timeout="+c.timeout.String())
+	return c.baseClientCommand.Run(ctx)
+}
+
+var verifyTargetModelImplDoc = `
+
+verify-target-model-impl must be executed on an API server machine of a 1.25
+environment, after the model has been activated.
+
+The command will wait for the agents of the new model to settle, and report
+on the model's health.
+
+`
+
+func newVerifyTargetModelImplCommand() cmd.Command {
+	return &verifyTargetModelImplCommand{
+		baseRemoteCommand: baseRemoteCommand{needsController: true},
+	}
+}
+
+type verifyTargetModelImplCommand struct {
+	baseRemoteCommand
+	timeout time.Duration
+}
+
+func (c *verifyTargetModelImplCommand) SetFlags(f *gnuflag.FlagSet) {
+	c.baseRemoteCommand.SetFlags(f)
+	f.DurationVar(&c.timeout, "timeout", defaultVerifyTimeout, "how long to wait for the agents to settle")
+}
+
+func (c *verifyTargetModelImplCommand) Init(args []string) error {
+	args, err := c.baseRemoteCommand.init(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return cmd.CheckEmpty(args)
+}
+
+func (c *verifyTargetModelImplCommand) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "verify-target-model-impl",
+		Purpose: "controller aspect of verify-target-model",
+		Doc:     verifyTargetModelImplDoc,
+	}
+}
+
+func (c *verifyTargetModelImplCommand) Run(ctx *cmd.Context) error {
+	modelUUID, err := getModelUUID()
+	if err != nil {
+		return errors.Annotate(err, "getting model UUID")
+	}
+	info := *c.controllerInfo
+	info.ModelTag = names2.NewModelTag(modelUUID)
+	conn, err := api.Open(&info, api.DefaultDialOpts())
+	if err != nil {
+		return errors.Annotate(err, "connecting to model")
+	}
+	defer conn.Close()
+	client := conn.Client()
+
+	activatedAt, err := loadActivationTime()
+	if err != nil {
+		return errors.Annotate(err, "loading activation time")
+	}
+
+	health, err := waitModelSettled(ctx, client, c.timeout)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Hooks may have failed and been retried successfully while
+	// we were waiting, so check the units' status history for
+	// failures since the cut-over as well as their current status.
+	for _, unit := range health.unitNames {
+		failures, err := hookFailures(client, unit, activatedAt)
+		if err != nil {
+			return errors.Annotatef(err, "getting status history for unit %s", unit)
+		}
+		health.hookFailures = append(health.hookFailures, failures...)
+	}
+
+	health.writeSummary(ctx.Stdout, modelUUID)
+	if problems := health.problems(); problems > 0 {
+		plural := "s"
+		if problems == 1 {
+			plural = ""
+		}
+		return errors.Errorf("model %s is not healthy: %d problem%s found", modelUUID, problems, plural)
+	}
+	// Record the successful verification, which finalize requires.
+	return errors.Annotate(recordPhaseTime(verifiedAtFile, time.Now()), "recording verification")
+}
+
+// verifyPollInterval is how long to wait between checks of the model's
+// status.
+var verifyPollInterval = 10 * time.Second
+
+// waitModelSettled polls the model's status until all of the agents
+// have settled, or the timeout expires, and returns the last health
+// assessment.
+func waitModelSettled(ctx *cmd.Context, client *api.Client, timeout time.Duration) (*modelHealth, error) {
+	waitCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		fullStatus, err := client.Status(nil)
+		if err != nil {
+			return nil, errors.Annotate(err, "getting model status")
+		}
+		health := assessModelHealth(fullStatus)
+		if health.settled() {
+			return health, nil
+		}
+		ctx.Infof("waiting for %d agents to settle, %d units in error", len(health.unsettled), len(health.unitErrors))
+		select {
+		case <-time.After(verifyPollInterval):
+		case <-waitCtx.Done():
+			ctx.Infof("timed out after %s", timeout)
+			return health, nil
+		}
+	}
+}
+
+// modelHealth is an assessment of the health of a model from its
+// status.
+type modelHealth struct {
+	version      string
+	machines     int
+	unitNames    []string
+	applications int
+
+	// unsettled describes the agents that aren't yet started or idle
+	// on the model's agent version.
+	unsettled []string
+
+	// unitErrors describes the units currently in error.
+	unitErrors []string
+
+	// noLeader holds the names of applications with units, but no
+	// leader.
+	noLeader []string
+
+	// hookFailures describes the hooks that have failed since the
+	// model was activated, whether or not they've since succeeded.
+	hookFailures []string
+}
+
+// assessModelHealth returns the health of the model with the given
+// status.
+func assessModelHealth(fullStatus *params.FullStatus) *modelHealth {
+	health := &modelHealth{version: fullStatus.Model.Version}
+
+	var addMachine func(m params.MachineStatus)
+	addMachine = func(m params.MachineStatus) {
+		health.machines++
+		agent := m.AgentStatus
+		if agent.Status != string(status.Started) || agent.Version != health.version {
+			health.unsettled = append(health.unsettled, fmt.Sprintf(
+				"machine %s: %s on %s", m.Id, agentStatusString(agent), versionString(agent.Version),
+			))
+		}
+		for _, container := range m.Containers {
+			addMachine(container)
+		}
+	}
+	for _, m := range fullStatus.Machines {
+		addMachine(m)
+	}
+
+	var addUnit func(name string, unit params.UnitStatus) bool
+	addUnit = func(name string, unit params.UnitStatus) bool {
+		health.unitNames = append(health.unitNames, name)
+		agent := unit.AgentStatus
+		if agent.Status != string(status.Idle) || agent.Version != health.version {
+			health.unsettled = append(health.unsettled, fmt.Sprintf(
+				"unit %s: %s on %s", name, agentStatusString(agent), versionString(agent.Version),
+			))
+		}
+		if workload := unit.WorkloadStatus; workload.Status == string(status.Error) {
+			health.unitErrors = append(health.unitErrors, fmt.Sprintf("unit %s: %s", name, workload.Info))
+		}
+		return unit.Leader
+	}
+	// Subordinate applications have no units of their own in the
+	// status; their units are listed under their principals.
+	leaders := make(map[string]bool)
+	hasUnits := make(map[string]bool)
+	for appName, app := range fullStatus.Applications {
+		health.applications++
+		for unitName, unit := range app.Units {
+			hasUnits[appName] = true
+			if addUnit(unitName, unit) {
+				leaders[appName] = true
+			}
+			for subName, sub := range unit.Subordinates {
+				subApp := strings.Split(subName, "/")[0]
+				hasUnits[subApp] = true
+				if addUnit(subName, sub) {
+					leaders[subApp] = true
+				}
+			}
+		}
+	}
+	for appName := range hasUnits {
+		if !leaders[appName] {
+			health.noLeader = append(health.noLeader, appName)
+		}
+	}
+
+	sort.Strings(health.unitNames)
+	sort.Strings(health.unsettled)
+	sort.Strings(health.unitErrors)
+	sort.Strings(health.noLeader)
+	return health
+}
+
+func agentStatusString(agent params.DetailedStatus) string {
+	if agent.Info != "" {
+		return fmt.Sprintf("%s (%s)", agent.Status, agent.Info)
+	}
+	return agent.Status
+}
+
+func versionString(version string) string {
+	if version == "" {
+		return "unknown version"
+	}
+	return version
+}
+
+// settled returns whether every agent has settled. Units in error
+// and missing leaders may resolve themselves, so they don't count as
+// settled either.
+func (h *modelHealth) settled() bool {
+	return len(h.unsettled) == 0 && len(h.unitErrors) == 0 && len(h.noLeader) == 0
+}
+
+// problems returns the number of problems that stop the model being
+// signed off. Hook failures that have since been resolved are only
+// reported.
+func (h *modelHealth) problems() int {
+	return len(h.unsettled) + len(h.unitErrors) + len(h.noLeader)
+}
+
+func (h *modelHealth) writeSummary(w io.Writer, modelUUID string) {
+	fmt.Fprintf(w, "Model %s, agent version %s\n", modelUUID, h.version)
+	fmt.Fprintf(w, "  machines:     %d\n", h.machines)
+	fmt.Fprintf(w, "  units:        %d\n", len(h.unitNames))
+	fmt.Fprintf(w, "  applications: %d\n", h.applications)
+	writeList := func(heading string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "%s:\n", heading)
+		for _, item := range items {
+			fmt.Fprintf(w, "  %s\n", item)
+		}
+	}
+	writeList("Agents not settled", h.unsettled)
+	writeList("Units in error", h.unitErrors)
+	writeList("Applications without a leader", h.noLeader)
+	writeList("Hook failures since activation", h.hookFailures)
+	if h.problems() == 0 {
+		fmt.Fprintln(w, "All agents settled on", h.version)
+	}
+}
+
+// hookFailures returns descriptions of the times the unit's workload
+// has gone into error since the given time.
+func hookFailures(client *api.Client, unit string, since time.Time) ([]string, error) {
+	history, err := client.StatusHistory(status.KindWorkload, names2.NewUnitTag(unit), status.StatusHistoryFilter{
+		FromDate: &since,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var failures []string
+	for _, entry := range history {
+		if entry.Status != status.Error {
+			continue
+		}
+		when := ""
+		if entry.Since != nil {
+			when = " at " + entry.Since.UTC().Format(time.RFC3339)
+		}
+		failures = append(failures, fmt.Sprintf("unit %s: %s%s", unit, entry.Info, when))
+	}
+	return failures, nil
+}
+
+// recordPhaseTime records the time that a phase of the migration
+// completed in the named file, for later phases to check.
+func recordPhaseTime(name string, t time.Time) error {
+	if err := os.MkdirAll(toolsDir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(writeFile(
+		path.Join(toolsDir, name),
+		0644,
+		bytes.NewBufferString(t.UTC().Format(time.RFC3339)),
+	))
+}
+
+// loadPhaseTime returns the time recorded in the named file by
+// recordPhaseTime. It returns a NotFound error if no time has been
+// recorded.
+func loadPhaseTime(name string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path.Join(toolsDir, name))
+	if os.IsNotExist(err) {
+		return time.Time{}, errors.NotFoundf("%s", name)
+	} else if err != nil {
+		return time.Time{}, errors.Trace(err)
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	return t, errors.Trace(err)
+}
+
+// loadActivationTime returns the time the model was activated. If the
+// time wasn't recorded, the last hour is checked.
+func loadActivationTime() (time.Time, error) {
+	t, err := loadPhaseTime(activatedAtFile)
+	if errors.IsNotFound(err) {
+		logger.Warningf("model activation time not recorded, checking the last hour")
+		return time.Now().Add(-time.Hour), nil
+	}
+	return t, errors.Trace(err)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package commands
+
+import (
+	"bytes"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/1.25-upgrade/juju2/apiserver/params"
+)
+
+type verifyTargetSuite struct{}
+
+var _ = gc.Suite(&verifyTargetSuite{})
+
+func agentStatus(status, version string) params.DetailedStatus {
+	return params.DetailedStatus{Status: status, Version: version}
+}
+
+func healthyStatus() *params.FullStatus {
+	return &params.FullStatus{
+		Model: params.ModelStatusInfo{Version: "2.2.4"},
+		Machines: map[string]params.MachineStatus{
+			"0": {
+				Id:          "0",
+				AgentStatus: agentStatus("started", "2.2.4"),
+				Containers: map[string]params.MachineStatus{
+					"0/lxc/0": {Id: "0/lxc/0", AgentStatus: agentStatus("started", "2.2.4")},
+				},
+			},
+		},
+		Applications: map[string]params.ApplicationStatus{
+			"mysql": {
+				Units: map[string]params.UnitStatus{
+					"mysql/0": {
+						AgentStatus:    agentStatus("idle", "2.2.4"),
+						WorkloadStatus: params.DetailedStatus{Status: "active"},
+						Leader:         true,
+						Subordinates: map[string]params.UnitStatus{
+							"nrpe/0": {
+								AgentStatus:    agentStatus("idle", "2.2.4"),
+								WorkloadStatus: params.DetailedStatus{Status: "active"},
+								Leader:         true,
+							},
+						},
+					},
+				},
+			},
+			"nrpe": {SubordinateTo: []string{"mysql"}},
+		},
+	}
+}
+
+func (*verifyTargetSuite) TestAssessHealthy(c *gc.C) {
+	health := assessModelHealth(healthyStatus())
+	c.Check(health.settled(), jc.IsTrue)
+	c.Check(health.problems(), gc.Equals, 0)
+	c.Check(health.machines, gc.Equals, 2)
+	c.Check(health.unitNames, jc.DeepEquals, []string{"mysql/0", "nrpe/0"})
+	c.Check(health.applications, gc.Equals, 2)
+}
+
+func (*verifyTargetSuite) TestAssessProblems(c *gc.C) {
+	fullStatus := healthyStatus()
+	container := fullStatus.Machines["0"].Containers["0/lxc/0"]
+	container.AgentStatus = agentStatus("started", "1.25.13")
+	fullStatus.Machines["0"].Containers["0/lxc/0"] = container
+
+	mysql := fullStatus.Applications["mysql"].Units["mysql/0"]
+	mysql.AgentStatus = params.DetailedStatus{Status: "executing", Info: "running config-changed hook", Version: "2.2.4"}
+	mysql.Leader = false
+	nrpe := mysql.Subordinates["nrpe/0"]
+	nrpe.WorkloadStatus = params.DetailedStatus{Status: "error", Info: `hook failed: "upgrade-charm"`}
+	mysql.Subordinates["nrpe/0"] = nrpe
+	fullStatus.Applications["mysql"].Units["mysql/0"] = mysql
+
+	health := assessModelHealth(fullStatus)
+	c.Check(health.settled(), jc.IsFalse)
+	c.Check(health.unsettled, jc.DeepEquals, []string{
+		"machine 0/lxc/0: started on 1.25.13",
+		"unit mysql/0: executing (running config-changed hook) on 2.2.4",
+	})
+	c.Check(health.unitErrors, jc.DeepEquals, []string{`unit nrpe/0: hook failed: "upgrade-charm"`})
+	c.Check(health.noLeader, jc.DeepEquals, []string{"mysql"})
+	health.hookFailures = []string{`unit nrpe/0: hook failed: "upgrade-charm" at 2017-10-16T10:00:00Z`}
+	c.Check(health.problems(), gc.Equals, 4)
+
+	var buf bytes.Buffer
+	health.writeSummary(&buf, "model-uuid")
+	c.Check(buf.String(), gc.Equals, `Model model-uuid, agent version 2.2.4
+  machines:     2
+  units:        2
+  applications: 2
+Agents not settled:
+  machine 0/lxc/0: started on 1.25.13
+  unit mysql/0: executing (running config-changed hook) on 2.2.4
+Units in error:
+  unit nrpe/0: hook failed: "upgrade-charm"
+Applications without a leader:
+  mysql
+Hook failures since activation:
+  unit nrpe/0: hook failed: "upgrade-charm" at 2017-10-16T10:00:00Z
+`)
+}
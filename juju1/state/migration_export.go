@@ -5,7 +5,6 @@ package state
 
 import (
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/juju/description"
@@ -15,6 +14,7 @@ import (
 	"github.com/juju/utils/set"
 	"github.com/juju/version"
 	names2 "gopkg.in/juju/names.v2"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/juju/1.25-upgrade/juju1/payload"
@@ -50,37 +50,47 @@ var storageProviderTypeMap = map[string]storage.ProviderType{
 	"dummy":     "dummy",
 }
 
+// ExportConfig limits how much of the environment's status history
+// is exported. The zero value exports all of it.
+type ExportConfig struct {
+	SkipStatusHistory bool
+
+	// MaxStatusHistory, if positive, is the number of the most
+	// recent status history entries exported for each entity.
+	MaxStatusHistory int
+
+	// MaxStatusHistoryAge, if positive, excludes status history
+	// entries older than this.
+	MaxStatusHistoryAge time.Duration
+}
+
+// ExportPartial exports the current model for the State, limiting the
+// status history as defined by the ExportConfig.
+func (st *State) ExportPartial(overrideCloud string, cfg ExportConfig) (description.Model, error) {
+	return st.exportImpl(overrideCloud, cfg)
+}
+
 // Export the current model for the State.
 func (st *State) Export(overrideCloud string) (description.Model, error) {
+	return st.exportImpl(overrideCloud, ExportConfig{})
+}
+
+func (st *State) exportImpl(overrideCloud string, cfg ExportConfig) (description.Model, error) {
 	dbModel, err := st.Environment()
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	export := exporter{
-		st:      st,
-		dbModel: dbModel,
-		logger:  loggo.GetLogger("juju.state.export-model"),
-	}
-	if err := export.readAllStatuses(); err != nil {
-		return nil, errors.Annotate(err, "reading statuses")
-	}
-	if err := export.readAllStatusHistory(); err != nil {
-		return nil, errors.Trace(err)
-	}
-	if err := export.readAllSettings(); err != nil {
-		return nil, errors.Trace(err)
-	}
-	if err := export.readAllStorageConstraints(); err != nil {
-		return nil, errors.Trace(err)
+		st:                  st,
+		cfg:                 cfg,
+		dbModel:             dbModel,
+		logger:              loggo.GetLogger("juju.state.export-model"),
+		exportedAnnotations: set.NewStrings(),
 	}
-	if err := export.readAllAnnotations(); err != nil {
-		return nil, errors.Trace(err)
-	}
-	if err := export.readAllConstraints(); err != nil {
-		return nil, errors.Trace(err)
+	if cfg.MaxStatusHistoryAge > 0 {
+		export.statusHistoryCutoff = time.Now().Add(-cfg.MaxStatusHistoryAge).UnixNano()
 	}
-
 	blocks, err := export.readBlocks()
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -113,7 +123,11 @@ func (st *State) Export(overrideCloud string) (description.Model, error) {
 	export.model.SetCloudCredential(creds)
 
 	modelKey := dbModel.globalKey()
-	export.model.SetAnnotations(export.getAnnotations(modelKey))
+	annotations, err := export.getAnnotations(modelKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	export.model.SetAnnotations(annotations)
 	if err := export.sequences(); err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -162,26 +176,29 @@ func (st *State) Export(overrideCloud string) (description.Model, error) {
 		return nil, errors.Trace(err)
 	}
 
-	export.logExtras()
+	if err := export.logExtras(); err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	return export.model, nil
 }
 
 type exporter struct {
 	st      *State
+	cfg     ExportConfig
 	dbModel *Environment
 	model   description.Model
 	logger  loggo.Logger
 
-	annotations             map[string]annotatorDoc
-	constraints             map[string]bson.M
-	modelSettings           map[string]bson.M
-	modelStorageConstraints map[string]storageConstraintsDoc
-	status                  map[string]bson.M
-	statusHistory           map[string][]historicalStatusDoc
-	// Map of application name to units. Populated as part
-	// of the applications export.
-	units map[string][]*Unit
+	// The entities' statuses, settings, constraints and annotations
+	// are read as each entity is exported, rather than loading whole
+	// collections. The global keys of the exported annotations are
+	// kept so that any left over can be reported.
+	exportedAnnotations set.Strings
+
+	// statusHistoryCutoff, if positive, is the time in nanoseconds
+	// of the oldest status history entry exported.
+	statusHistoryCutoff int64
 }
 
 // Need to break up the 1.25 environment settings into:
@@ -195,9 +212,11 @@ func (e *exporter) splitEnvironConfig() (map[string]interface{}, description.Clo
 		creds  description.CloudCredentialArgs
 		region string
 	)
-	environConfig, found := e.modelSettings[environGlobalKey]
-	if !found {
+	environConfig, err := e.readSettings(environGlobalKey)
+	if errors.IsNotFound(err) {
 		return nil, creds, region, errors.New("missing model config")
+	} else if err != nil {
+		return nil, creds, region, errors.Trace(err)
 	}
 
 	// grab a copy...
@@ -286,12 +305,10 @@ func (e *exporter) sequences() error {
 	sequences, closer := e.st.getCollection(sequenceC)
 	defer closer()
 
-	var docs []sequenceDoc
-	if err := sequences.Find(nil).All(&docs); err != nil {
-		return errors.Trace(err)
-	}
-
-	for _, doc := range docs {
+	var doc sequenceDoc
+	iter := sequences.Find(nil).Iter()
+	defer iter.Close()
+	for iter.Next(&doc) {
 		name := doc.Name
 		// Rename any service sequences to be application sequences.
 		if svcTag, err := names1.ParseServiceTag(doc.Name); err == nil {
@@ -300,25 +317,26 @@ func (e *exporter) sequences() error {
 		}
 		e.model.SetSequence(name, doc.Counter)
 	}
-	return nil
+	return errors.Annotate(iter.Err(), "failed to read sequences")
 }
 
 func (e *exporter) readBlocks() (map[string]string, error) {
 	blocks, closer := e.st.getCollection(blocksC)
 	defer closer()
 
-	var docs []blockDoc
-	if err := blocks.Find(nil).All(&docs); err != nil {
-		return nil, errors.Trace(err)
-	}
-
 	result := make(map[string]string)
-	for _, doc := range docs {
+	var doc blockDoc
+	iter := blocks.Find(nil).Iter()
+	defer iter.Close()
+	for iter.Next(&doc) {
 		// We don't care about the id, uuid, or tag.
 		// The uuid and tag both refer to the model uuid, and the
 		// id is opaque - even though it is sequence generated.
 		result[doc.Type.MigrationValue()] = doc.Message
 	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.Annotate(err, "failed to read blocks")
+	}
 	return result, nil
 }
 
@@ -338,12 +356,13 @@ func (e *exporter) modelUsers() error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	lastConnections, err := e.readLastConnectionTimes()
-	if err != nil {
-		return errors.Trace(err)
-	}
 	for _, user := range users {
-		lastConn := lastConnections[strings.ToLower(user.UserName())]
+		lastConn, err := user.LastConnection()
+		if IsNeverConnectedError(err) {
+			lastConn = time.Time{}
+		} else if err != nil {
+			return errors.Trace(err)
+		}
 		arg := description.UserArgs{
 			Name:           e.userTag(user.UserTag()),
 			DisplayName:    user.DisplayName(),
@@ -364,24 +383,6 @@ func (e *exporter) machines() error {
 	}
 	e.logger.Debugf("found %d machines", len(machines))
 
-	instances, err := e.loadMachineInstanceData()
-	if err != nil {
-		return errors.Trace(err)
-	}
-	blockDevices, err := e.loadMachineBlockDevices()
-	if err != nil {
-		return errors.Trace(err)
-	}
-
-	// Read all the open ports documents.
-	openedPorts, closer := e.st.getCollection(openedPortsC)
-	defer closer()
-	var portsData []portsDoc
-	if err := openedPorts.Find(nil).All(&portsData); err != nil {
-		return errors.Annotate(err, "opened ports")
-	}
-	e.logger.Debugf("found %d openedPorts docs", len(portsData))
-
 	// We are iterating through a flat list of machines, but the migration
 	// model stores the nesting. The AllMachines method assures us that the
 	// machines are returned in an order so the parent will always before
@@ -400,7 +401,7 @@ func (e *exporter) machines() error {
 			}
 		}
 
-		exMachine, err := e.newMachine(exParent, machine, instances, portsData, blockDevices)
+		exMachine, err := e.newMachine(exParent, machine)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -410,39 +411,7 @@ func (e *exporter) machines() error {
 	return nil
 }
 
-func (e *exporter) loadMachineInstanceData() (map[string]instanceData, error) {
-	instanceDataCollection, closer := e.st.getCollection(instanceDataC)
-	defer closer()
-
-	var instData []instanceData
-	instances := make(map[string]instanceData)
-	if err := instanceDataCollection.Find(nil).All(&instData); err != nil {
-		return nil, errors.Annotate(err, "instance data")
-	}
-	e.logger.Debugf("found %d instanceData", len(instData))
-	for _, data := range instData {
-		instances[data.MachineId] = data
-	}
-	return instances, nil
-}
-
-func (e *exporter) loadMachineBlockDevices() (map[string][]BlockDeviceInfo, error) {
-	coll, closer := e.st.getCollection(blockDevicesC)
-	defer closer()
-
-	var deviceData []blockDevicesDoc
-	result := make(map[string][]BlockDeviceInfo)
-	if err := coll.Find(nil).All(&deviceData); err != nil {
-		return nil, errors.Annotate(err, "block devices")
-	}
-	e.logger.Debugf("found %d block device records", len(deviceData))
-	for _, data := range deviceData {
-		result[data.Machine] = data.BlockDevices
-	}
-	return result, nil
-}
-
-func (e *exporter) newMachine(exParent description.Machine, machine *Machine, instances map[string]instanceData, portsData []portsDoc, blockDevices map[string][]BlockDeviceInfo) (description.Machine, error) {
+func (e *exporter) newMachine(exParent description.Machine, machine *Machine) (description.Machine, error) {
 	args := description.MachineArgs{
 		Id:           names2.NewMachineTag(machine.MachineTag().Id()),
 		Nonce:        machine.doc.Nonce,
@@ -480,9 +449,11 @@ func (e *exporter) newMachine(exParent description.Machine, machine *Machine, in
 
 	// We fully expect the machine to have tools set, and that there is
 	// some instance data.
-	instData, found := instances[machine.doc.Id]
-	if !found {
+	instData, err := getInstanceData(e.st, machine.doc.Id)
+	if errors.IsNotFound(err) {
 		return nil, errors.NotValidf("missing instance data for machine %s", machine.Id())
+	} else if err != nil {
+		return nil, errors.Trace(err)
 	}
 	exMachine.SetInstance(e.newCloudInstanceArgs(instData))
 
@@ -501,7 +472,11 @@ func (e *exporter) newMachine(exParent description.Machine, machine *Machine, in
 
 	// We don't rely on devices being there. If they aren't, we get an empty slice,
 	// which is fine to iterate over with range.
-	for _, device := range blockDevices[machine.doc.Id] {
+	blockDevices, err := e.st.blockDevices(machine.doc.Id)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, errors.Trace(err)
+	}
+	for _, device := range blockDevices {
 		exMachine.AddBlockDevice(description.BlockDeviceArgs{
 			Name:           device.DeviceName,
 			Links:          device.DeviceLinks,
@@ -523,7 +498,11 @@ func (e *exporter) newMachine(exParent description.Machine, machine *Machine, in
 		return nil, errors.Annotatef(err, "status for machine %s", machine.Id())
 	}
 	exMachine.SetStatus(statusArgs)
-	exMachine.SetStatusHistory(e.statusHistoryArgs(globalKey))
+	history, err := e.statusHistoryArgs(globalKey)
+	if err != nil {
+		return nil, errors.Annotatef(err, "status history for machine %s", machine.Id())
+	}
+	exMachine.SetStatusHistory(history)
 
 	tools, err := machine.AgentTools()
 	if err != nil {
@@ -538,11 +517,15 @@ func (e *exporter) newMachine(exParent description.Machine, machine *Machine, in
 		Size:    tools.Size,
 	})
 
-	for _, args := range e.openedPortsArgsForMachine(machine.Id(), portsData) {
+	for _, args := range e.openedPortsArgsForMachine(machine) {
 		exMachine.AddOpenedPorts(args)
 	}
 
-	exMachine.SetAnnotations(e.getAnnotations(globalKey))
+	annotations, err := e.getAnnotations(globalKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	exMachine.SetAnnotations(annotations)
 
 	constraintsArgs, err := e.constraintsArgs(globalKey)
 	if err != nil {
@@ -553,12 +536,17 @@ func (e *exporter) newMachine(exParent description.Machine, machine *Machine, in
 	return exMachine, nil
 }
 
-func (e *exporter) openedPortsArgsForMachine(machineId string, portsData []portsDoc) []description.OpenedPortsArgs {
+func (e *exporter) openedPortsArgsForMachine(machine *Machine) []description.OpenedPortsArgs {
 	var result []description.OpenedPortsArgs
 	// FIXME (thumper)
-	// for _, doc := range portsData {
+	// allPorts, err := machine.AllPorts()
+	// if err != nil {
+	// 	return nil, errors.Trace(err)
+	// }
+	// for _, ports := range allPorts {
+	// 	doc := ports.doc
 	// 	// Don't bother including a subnet if there are no ports open on it.
-	// 	if doc.MachineID == machineId && len(doc.Ports) > 0 {
+	// 	if len(doc.Ports) > 0 {
 	// 		args := description.OpenedPortsArgs{SubnetID: doc.SubnetID}
 	// 		for _, p := range doc.Ports {
 	// 			args.OpenedPorts = append(args.OpenedPorts, description.PortRangeArgs{
@@ -626,16 +614,6 @@ func (e *exporter) applications() error {
 	}
 	e.logger.Debugf("found %d services", len(services))
 
-	e.units, err = e.readAllUnits()
-	if err != nil {
-		return errors.Trace(err)
-	}
-
-	meterStatus, err := e.readAllMeterStatus()
-	if err != nil {
-		return errors.Trace(err)
-	}
-
 	leaders, err := e.readServiceLeaders()
 	if err != nil {
 		return errors.Trace(err)
@@ -646,16 +624,17 @@ func (e *exporter) applications() error {
 		return errors.Trace(err)
 	}
 
-	_ = meterStatus
 	_ = payloads
 	for _, service := range services {
 		name := service.Name()
-		applicationUnits := e.units[name]
+		applicationUnits, err := e.readUnits(name)
+		if err != nil {
+			return errors.Trace(err)
+		}
 		leader := leaders[name]
 		if err := e.addApplication(addApplicationContext{
 			application: service,
 			units:       applicationUnits,
-			meterStatus: meterStatus,
 			leader:      leader,
 			payloads:    payloads,
 		}); err != nil {
@@ -691,23 +670,20 @@ func (e *exporter) readServiceLeaders() (map[string]string, error) {
 	return leaders, nil
 }
 
-func (e *exporter) readAllStorageConstraints() error {
+// readStorageConstraints returns the storage constraints document
+// for the global key, or nil if there isn't one.
+func (e *exporter) readStorageConstraints(globalKey string) (*storageConstraintsDoc, error) {
 	coll, closer := e.st.getCollection(storageConstraintsC)
 	defer closer()
 
-	storageConstraints := make(map[string]storageConstraintsDoc)
 	var doc storageConstraintsDoc
-	iter := coll.Find(nil).Iter()
-	defer iter.Close()
-	for iter.Next(&doc) {
-		storageConstraints[e.st.localID(doc.DocID)] = doc
-	}
-	if err := iter.Err(); err != nil {
-		return errors.Annotate(err, "failed to read storage constraints")
+	err := coll.FindId(globalKey).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "failed to read storage constraints for %s", globalKey)
 	}
-	e.logger.Debugf("read %d storage constraint documents", len(storageConstraints))
-	e.modelStorageConstraints = storageConstraints
-	return nil
+	return &doc, nil
 }
 
 func (e *exporter) storageConstraints(doc storageConstraintsDoc) map[string]description.StorageConstraintArgs {
@@ -738,7 +714,6 @@ func (e *exporter) readAllPayloads() (map[string][]payload.FullPayloadInfo, erro
 type addApplicationContext struct {
 	application *Service
 	units       []*Unit
-	meterStatus map[string]*meterStatusDoc
 	leader      string
 	payloads    map[string][]payload.FullPayloadInfo
 }
@@ -751,13 +726,17 @@ func (e *exporter) addApplication(ctx addApplicationContext) error {
 
 	leadershipKey := leadershipSettingsDocId(appName)
 
-	applicationSettings, found := e.modelSettings[settingsKey]
-	if !found {
+	applicationSettings, err := e.readSettings(settingsKey)
+	if errors.IsNotFound(err) {
 		return errors.Errorf("missing settings for application %q", appName)
+	} else if err != nil {
+		return errors.Trace(err)
 	}
-	leadershipSettings, found := e.modelSettings[leadershipKey]
-	if !found {
+	leadershipSettings, err := e.readSettings(leadershipKey)
+	if errors.IsNotFound(err) {
 		return errors.Errorf("missing leadership settings for application %q", appName)
+	} else if err != nil {
+		return errors.Trace(err)
 	}
 
 	args := description.ApplicationArgs{
@@ -778,8 +757,12 @@ func (e *exporter) addApplication(ctx addApplicationContext) error {
 		LeadershipSettings: leadershipSettings,
 		MetricsCredentials: application.doc.MetricCredentials,
 	}
-	if constraints, found := e.modelStorageConstraints[globalKey]; found {
-		args.StorageConstraints = e.storageConstraints(constraints)
+	storageConstraints, err := e.readStorageConstraints(globalKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if storageConstraints != nil {
+		args.StorageConstraints = e.storageConstraints(*storageConstraints)
 	}
 
 	e.logger.Debugf("Adding application %q", args.Tag.Id())
@@ -790,8 +773,16 @@ func (e *exporter) addApplication(ctx addApplicationContext) error {
 		return errors.Annotatef(err, "status for application %s", appName)
 	}
 	exApplication.SetStatus(statusArgs)
-	exApplication.SetStatusHistory(e.statusHistoryArgs(globalKey))
-	exApplication.SetAnnotations(e.getAnnotations(globalKey))
+	history, err := e.statusHistoryArgs(globalKey)
+	if err != nil {
+		return errors.Annotatef(err, "status history for application %s", appName)
+	}
+	exApplication.SetStatusHistory(history)
+	annotations, err := e.getAnnotations(globalKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	exApplication.SetAnnotations(annotations)
 
 	constraintsArgs, err := e.constraintsArgs(globalKey)
 	if err != nil {
@@ -801,9 +792,11 @@ func (e *exporter) addApplication(ctx addApplicationContext) error {
 
 	for _, unit := range ctx.units {
 		agentKey := unit.globalAgentKey()
-		unitMeterStatus, found := ctx.meterStatus[agentKey]
-		if !found {
+		unitMeterStatus, err := e.readMeterStatus(agentKey)
+		if errors.IsNotFound(err) {
 			return errors.Errorf("missing meter status for unit %s", unit.Name())
+		} else if err != nil {
+			return errors.Trace(err)
 		}
 
 		args := description.UnitArgs{
@@ -838,14 +831,22 @@ func (e *exporter) addApplication(ctx addApplicationContext) error {
 			return errors.Annotatef(err, "workload status for unit %s", unit.Name())
 		}
 		exUnit.SetWorkloadStatus(statusArgs)
-		exUnit.SetWorkloadStatusHistory(e.statusHistoryArgs(globalKey))
+		history, err := e.statusHistoryArgs(globalKey)
+		if err != nil {
+			return errors.Annotatef(err, "workload status history for unit %s", unit.Name())
+		}
+		exUnit.SetWorkloadStatusHistory(history)
 
 		statusArgs, err = e.statusArgs(agentKey)
 		if err != nil {
 			return errors.Annotatef(err, "agent status for unit %s", unit.Name())
 		}
 		exUnit.SetAgentStatus(statusArgs)
-		exUnit.SetAgentStatusHistory(e.statusHistoryArgs(agentKey))
+		history, err = e.statusHistoryArgs(agentKey)
+		if err != nil {
+			return errors.Annotatef(err, "agent status history for unit %s", unit.Name())
+		}
+		exUnit.SetAgentStatusHistory(history)
 
 		tools, err := unit.AgentTools()
 		if err != nil {
@@ -858,7 +859,11 @@ func (e *exporter) addApplication(ctx addApplicationContext) error {
 			SHA256:  tools.SHA256,
 			Size:    tools.Size,
 		})
-		exUnit.SetAnnotations(e.getAnnotations(globalKey))
+		annotations, err := e.getAnnotations(globalKey)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		exUnit.SetAnnotations(annotations)
 
 		constraintsArgs, err := e.constraintsArgs(agentKey)
 		if err != nil {
@@ -914,11 +919,6 @@ func (e *exporter) relations() error {
 	}
 	e.logger.Debugf("read %d relations", len(rels))
 
-	relationScopes, err := e.readAllRelationScopes()
-	if err != nil {
-		return errors.Trace(err)
-	}
-
 	for _, relation := range rels {
 		exRelation := e.model.AddRelation(description.RelationArgs{
 			Id:  relation.Id(),
@@ -936,19 +936,26 @@ func (e *exporter) relations() error {
 			})
 			// We expect a relationScope and settings for each of the
 			// units of the specified application.
-			units := e.units[ep.ServiceName]
+			units, err := e.readUnits(ep.ServiceName)
+			if err != nil {
+				return errors.Trace(err)
+			}
 			for _, unit := range units {
 				ru, err := relation.Unit(unit)
 				if err != nil {
 					return errors.Trace(err)
 				}
 				key := ru.currentKey()
-				if !relationScopes.Contains(key) {
+				if inScope, err := e.relationScopeExists(key); err != nil {
+					return errors.Trace(err)
+				} else if !inScope {
 					return errors.Errorf("missing relation scope for %s and %s", relation, unit.Name())
 				}
-				settings, found := e.modelSettings[key]
-				if !found {
+				settings, err := e.readSettings(key)
+				if errors.IsNotFound(err) {
 					return errors.Errorf("missing relation settings for %s and %s", relation, unit.Name())
+				} else if err != nil {
+					return errors.Trace(err)
 				}
 				exEndPoint.SetUnitSettings(unit.Name(), settings)
 			}
@@ -1071,208 +1078,100 @@ func (e *exporter) actions() error {
 	return nil
 }
 
-func (e *exporter) readAllRelationScopes() (set.Strings, error) {
+func (e *exporter) relationScopeExists(key string) (bool, error) {
 	relationScopes, closer := e.st.getCollection(relationScopesC)
 	defer closer()
 
-	docs := []relationScopeDoc{}
-	err := relationScopes.Find(nil).All(&docs)
+	count, err := relationScopes.FindId(key).Count()
 	if err != nil {
-		return nil, errors.Annotate(err, "cannot get all relation scopes")
-	}
-	e.logger.Debugf("found %d relationScope docs", len(docs))
-
-	result := set.NewStrings()
-	for _, doc := range docs {
-		result.Add(doc.Key)
+		return false, errors.Annotatef(err, "cannot get relation scope %q", key)
 	}
-	return result, nil
+	return count > 0, nil
 }
 
-func (e *exporter) readAllUnits() (map[string][]*Unit, error) {
+// readUnits returns the service's units, ordered by name.
+func (e *exporter) readUnits(serviceName string) ([]*Unit, error) {
 	unitsCollection, closer := e.st.getCollection(unitsC)
 	defer closer()
 
-	docs := []unitDoc{}
-	err := unitsCollection.Find(nil).Sort("name").All(&docs)
-	if err != nil {
-		return nil, errors.Annotate(err, "cannot get all units")
+	var units []*Unit
+	iter := unitsCollection.Find(bson.D{{"service", serviceName}}).Sort("name").Iter()
+	defer iter.Close()
+	for {
+		// Each unit keeps its own document.
+		var doc unitDoc
+		if !iter.Next(&doc) {
+			break
+		}
+		units = append(units, newUnit(e.st, &doc))
 	}
-	e.logger.Debugf("found %d unit docs", len(docs))
-	result := make(map[string][]*Unit)
-	for _, doc := range docs {
-		units := result[doc.Service]
-		result[doc.Service] = append(units, newUnit(e.st, &doc))
+	if err := iter.Err(); err != nil {
+		return nil, errors.Annotatef(err, "cannot get units of service %q", serviceName)
 	}
-	return result, nil
+	e.logger.Debugf("found %d units of service %q", len(units), serviceName)
+	return units, nil
 }
 
-func (e *exporter) readAllMeterStatus() (map[string]*meterStatusDoc, error) {
+func (e *exporter) readMeterStatus(agentKey string) (*meterStatusDoc, error) {
 	meterStatuses, closer := e.st.getCollection(meterStatusC)
 	defer closer()
 
-	docs := []meterStatusDoc{}
-	err := meterStatuses.Find(nil).All(&docs)
-	if err != nil {
-		return nil, errors.Annotate(err, "cannot get all meter status docs")
-	}
-	e.logger.Debugf("found %d meter status docs", len(docs))
-	result := make(map[string]*meterStatusDoc)
-	for _, doc := range docs {
-		result[e.st.localID(doc.DocID)] = &doc
+	var doc meterStatusDoc
+	err := meterStatuses.FindId(agentKey).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, errors.NotFoundf("meter status for %s", agentKey)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "cannot get meter status for %s", agentKey)
 	}
-	return result, nil
+	return &doc, nil
 }
 
-func (e *exporter) readLastConnectionTimes() (map[string]time.Time, error) {
-	lastConnections, closer := e.st.getCollection(envUserLastConnectionC)
-	defer closer()
-
-	var docs []envUserLastConnectionDoc
-	if err := lastConnections.Find(nil).All(&docs); err != nil {
-		return nil, errors.Trace(err)
-	}
-
-	result := make(map[string]time.Time)
-	for _, doc := range docs {
-		result[doc.UserName] = doc.LastConnection.UTC()
-	}
-	return result, nil
-}
-
-func (e *exporter) readAllAnnotations() error {
+// getAnnotations doesn't really care if there are any there or not
+// for the key, but if they were there, the key is recorded so we can
+// check at the end of the export for anything we have forgotten.
+func (e *exporter) getAnnotations(key string) (map[string]string, error) {
 	annotations, closer := e.st.getCollection(annotationsC)
 	defer closer()
 
-	var docs []annotatorDoc
-	if err := annotations.Find(nil).All(&docs); err != nil {
-		return errors.Trace(err)
-	}
-	e.logger.Debugf("read %d annotations docs", len(docs))
-
-	e.annotations = make(map[string]annotatorDoc)
-	for _, doc := range docs {
-		e.annotations[doc.GlobalKey] = doc
-	}
-	return nil
-}
-
-func (e *exporter) readAllConstraints() error {
-	constraintsCollection, closer := e.st.getCollection(constraintsC)
-	defer closer()
-
-	// Since the constraintsDoc doesn't include any global key or _id
-	// fields, we can't just deserialize the entire collection into a slice
-	// of docs, so we get them all out with bson maps.
-	var docs []bson.M
-	err := constraintsCollection.Find(nil).All(&docs)
-	if err != nil {
-		return errors.Annotate(err, "failed to read constraints collection")
+	var doc annotatorDoc
+	err := annotations.FindId(key).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "failed to read annotations for %s", key)
 	}
-
-	e.logger.Debugf("read %d constraints docs", len(docs))
-	e.constraints = make(map[string]bson.M)
-	for _, doc := range docs {
-		docId, ok := doc["_id"].(string)
-		if !ok {
-			return errors.Errorf("expected string, got %v (%T)", doc["_id"], doc["_id"])
-		}
-		id := e.st.localID(docId)
-		e.constraints[id] = doc
-		e.logger.Debugf("doc[%q] = %#v", id, doc)
-	}
-	return nil
+	e.exportedAnnotations.Add(key)
+	return doc.Annotations, nil
 }
 
-// getAnnotations doesn't really care if there are any there or not
-// for the key, but if they were there, they are removed so we can
-// check at the end of the export for anything we have forgotten.
-func (e *exporter) getAnnotations(key string) map[string]string {
-	result, found := e.annotations[key]
-	if found {
-		delete(e.annotations, key)
-	}
-	return result.Annotations
-}
-
-func (e *exporter) readAllSettings() error {
+// readSettings returns the settings document with the key, without
+// the fields that aren't settings.
+func (e *exporter) readSettings(key string) (bson.M, error) {
 	settings, closer := e.st.getCollection(settingsC)
 	defer closer()
 
-	var docs []bson.M
-	if err := settings.Find(nil).All(&docs); err != nil {
-		return errors.Trace(err)
-	}
-
-	e.modelSettings = make(map[string]bson.M)
-	for _, doc := range docs {
-		docId, ok := doc["_id"].(string)
-		if !ok {
-			return errors.Errorf("expected string, got %v (%T)", doc["_id"], doc["_id"])
-		}
-		id := e.st.localID(docId)
-		cleanSettingsMap(map[string]interface{}(doc))
-		e.modelSettings[id] = doc
+	var doc bson.M
+	err := settings.FindId(key).One(&doc)
+	if err == mgo.ErrNotFound {
+		return nil, errors.NotFoundf("settings %q", key)
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "failed to read settings %q", key)
 	}
-	return nil
+	cleanSettingsMap(map[string]interface{}(doc))
+	return doc, nil
 }
 
-func (e *exporter) readAllStatuses() error {
+func (e *exporter) statusArgs(globalKey string) (description.StatusArgs, error) {
+	result := description.StatusArgs{}
 	statuses, closer := e.st.getCollection(statusesC)
 	defer closer()
 
-	var docs []bson.M
-	err := statuses.Find(nil).All(&docs)
-	if err != nil {
-		return errors.Annotate(err, "failed to read status collection")
-	}
-
-	e.logger.Debugf("read %d status documents", len(docs))
-	e.status = make(map[string]bson.M)
-	for _, doc := range docs {
-		docId, ok := doc["_id"].(string)
-		if !ok {
-			return errors.Errorf("expected string, got %v (%T)", doc["_id"], doc["_id"])
-		}
-		id := e.st.localID(docId)
-		e.status[id] = doc
-	}
-
-	return nil
-}
-
-func (e *exporter) readAllStatusHistory() error {
-	statuses, closer := e.st.getCollection(statusesHistoryC)
-	defer closer()
-
-	count := 0
-	e.statusHistory = make(map[string][]historicalStatusDoc)
-	var doc historicalStatusDoc
-	// In tests, sorting by time can leave the results
-	// underconstrained - include document id for deterministic
-	// ordering in those cases.
-	iter := statuses.Find(nil).Sort("-updated", "-_id").Iter()
-	defer iter.Close()
-	for iter.Next(&doc) {
-		history := e.statusHistory[doc.GlobalKey]
-		e.statusHistory[doc.GlobalKey] = append(history, doc)
-		count++
-	}
-
-	if err := iter.Err(); err != nil {
-		return errors.Annotate(err, "failed to read status history collection")
-	}
-
-	e.logger.Debugf("read %d status history documents", count)
-
-	return nil
-}
-
-func (e *exporter) statusArgs(globalKey string) (description.StatusArgs, error) {
-	result := description.StatusArgs{}
-	statusDoc, found := e.status[globalKey]
-	if !found {
+	var statusDoc bson.M
+	err := statuses.FindId(globalKey).One(&statusDoc)
+	if err == mgo.ErrNotFound {
 		return result, errors.NotFoundf("status data for %s", globalKey)
+	} else if err != nil {
+		return result, errors.Annotatef(err, "failed to read status for %s", globalKey)
 	}
 
 	status, ok := statusDoc["status"].(string)
@@ -1302,28 +1201,64 @@ func (e *exporter) statusArgs(globalKey string) (description.StatusArgs, error)
 	return result, nil
 }
 
-func (e *exporter) statusHistoryArgs(globalKey string) []description.StatusArgs {
-	history := e.statusHistory[globalKey]
-	result := make([]description.StatusArgs, len(history))
-	e.logger.Debugf("found %d status history docs for %s", len(history), globalKey)
-	for i, doc := range history {
-		result[i] = description.StatusArgs{
+// statusHistoryArgs returns the entity's status history, newest
+// first, limited as defined by the ExportConfig.
+func (e *exporter) statusHistoryArgs(globalKey string) ([]description.StatusArgs, error) {
+	result := []description.StatusArgs{}
+	if e.cfg.SkipStatusHistory {
+		return result, nil
+	}
+	statuses, closer := e.st.getCollection(statusesHistoryC)
+	defer closer()
+
+	query := bson.D{{"globalkey", globalKey}}
+	if e.statusHistoryCutoff > 0 {
+		query = append(query, bson.DocElem{"updated", bson.D{{"$gte", e.statusHistoryCutoff}}})
+	}
+	// In tests, sorting by time can leave the results
+	// underconstrained - include document id for deterministic
+	// ordering in those cases.
+	q := statuses.Find(query).Sort("-updated", "-_id")
+	if e.cfg.MaxStatusHistory > 0 {
+		q = q.Limit(e.cfg.MaxStatusHistory)
+	}
+	iter := q.Iter()
+	defer iter.Close()
+	for {
+		// The status data is a map, so each document needs its own.
+		var doc historicalStatusDoc
+		if !iter.Next(&doc) {
+			break
+		}
+		result = append(result, description.StatusArgs{
 			Value:   string(doc.Status),
 			Message: doc.StatusInfo,
 			Data:    doc.StatusData,
 			Updated: time.Unix(0, doc.Updated),
-		}
+		})
 	}
-
-	return result
+	if err := iter.Err(); err != nil {
+		return nil, errors.Annotatef(err, "failed to read status history for %s", globalKey)
+	}
+	e.logger.Debugf("found %d status history docs for %s", len(result), globalKey)
+	return result, nil
 }
 
 func (e *exporter) constraintsArgs(globalKey string) (description.ConstraintsArgs, error) {
-	doc, found := e.constraints[globalKey]
-	if !found {
+	constraintsCollection, closer := e.st.getCollection(constraintsC)
+	defer closer()
+
+	// Since the constraintsDoc doesn't include any global key or _id
+	// fields, we can't just deserialize it into a constraintsDoc, so we
+	// get it out as a bson map.
+	var doc bson.M
+	err := constraintsCollection.FindId(globalKey).One(&doc)
+	if err == mgo.ErrNotFound {
 		// No constraints for this key.
 		e.logger.Debugf("no constraints found for key %q", globalKey)
 		return description.ConstraintsArgs{}, nil
+	} else if err != nil {
+		return description.ConstraintsArgs{}, errors.Annotatef(err, "failed to read constraints for %s", globalKey)
 	}
 	// We capture any type error using a closure to avoid having to return
 	// multiple values from the optional functions. This does mean that we will
@@ -1378,15 +1313,24 @@ func (e *exporter) constraintsArgs(globalKey string) (description.ConstraintsArg
 	return result, nil
 }
 
-func (e *exporter) logExtras() {
-	// As annotations are saved into the model, they are removed from the
-	// exporter's map. If there are any left at the end, we are missing
-	// things. Not an error just now, just a warning that we have missed
-	// something. Could potentially be an error at a later date when
-	// migrations are complete (but probably not).
-	for key, doc := range e.annotations {
-		e.logger.Warningf("unexported annotation for %s, %s", doc.Tag, key)
+func (e *exporter) logExtras() error {
+	// As annotations are saved into the model, their keys are recorded.
+	// If there are any others, we are missing things. Not an error just
+	// now, just a warning that we have missed something. Could
+	// potentially be an error at a later date when migrations are
+	// complete (but probably not).
+	annotations, closer := e.st.getCollection(annotationsC)
+	defer closer()
+
+	var doc annotatorDoc
+	iter := annotations.Find(nil).Select(bson.D{{"globalkey", 1}, {"tag", 1}}).Iter()
+	defer iter.Close()
+	for iter.Next(&doc) {
+		if !e.exportedAnnotations.Contains(doc.GlobalKey) {
+			e.logger.Warningf("unexported annotation for %s, %s", doc.Tag, doc.GlobalKey)
+		}
 	}
+	return errors.Annotate(iter.Err(), "failed to read annotations")
 }
 
 func (e *exporter) storage() error {
@@ -1466,7 +1410,11 @@ func (e *exporter) addVolume(vol *volume, volAttachments []volumeAttachmentDoc)
 
 	exVolume := e.model.AddVolume(args)
 	exVolume.SetStatus(statusArgs)
-	exVolume.SetStatusHistory(e.statusHistoryArgs(globalKey))
+	history, err := e.statusHistoryArgs(globalKey)
+	if err != nil {
+		return errors.Annotatef(err, "status history for volume %s", vol.doc.Name)
+	}
+	exVolume.SetStatusHistory(history)
 	if count := len(volAttachments); count != vol.doc.AttachmentCount {
 		return errors.Errorf("volume attachment count mismatch, have %d, expected %d",
 			count, vol.doc.AttachmentCount)
@@ -1705,13 +1653,7 @@ type storagePoolSettingsManager struct {
 }
 
 func (m storagePoolSettingsManager) ListSettings(keyPrefix string) (map[string]map[string]interface{}, error) {
-	result := make(map[string]map[string]interface{})
-	for key, doc := range m.e.modelSettings {
-		if strings.HasPrefix(key, keyPrefix) {
-			result[key] = doc
-		}
-	}
-	return result, nil
+	return listSettings(m.e.st, keyPrefix)
 }
 
 func isCommonStorageType(t storage.ProviderType) bool {
@@ -120,6 +120,21 @@ func readAllStateFiles(dirPath string) (files map[names.StorageTag]*stateFile, e
 	return files, nil
 }
 
+// ReadAllAttached returns, for each storage attachment whose state is
+// persisted inside the supplied dirPath, whether the uniter has run its
+// storage-attached hook. If dirPath does not exist, no error is returned.
+func ReadAllAttached(dirPath string) (map[names.StorageTag]bool, error) {
+	files, err := readAllStateFiles(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	attached := make(map[names.StorageTag]bool)
+	for tag, f := range files {
+		attached[tag] = f.attached
+	}
+	return attached, nil
+}
+
 // CommitHook atomically writes to disk the storage state change in hi.
 // It must be called after the respective hook was executed successfully.
 // CommitHook doesn't validate hi but guarantees that successive writes